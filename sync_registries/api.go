@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
+
+// registryStatus is the outcome of the latest sync of a registry entry, as
+// served on /status.
+type registryStatus struct {
+	Source          string     `json:"source"`
+	Destinations    []string   `json:"destinations"`
+	Reason          string     `json:"reason"`
+	Tags            []string   `json:"tags,omitempty"` // Empty for a full sync
+	Running         bool       `json:"running"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds,omitempty"`
+	Error           string     `json:"error,omitempty"`
+
+	// Measured by the latest full sync, kept by syncs of given tags
+	MirrorLag *regsync.MirrorLag `json:"mirror_lag,omitempty"`
+}
+
+func destinationNames(registry config.RegistryConfig) []string {
+	destinations := []string{}
+	for _, dest := range registry.AllDestinations() {
+		destinations = append(destinations, dest.String())
+	}
+	return destinations
+}
+
+// registryKey identifies a registry entry by its source and destinations.
+func registryKey(registry config.RegistryConfig) string {
+	return fmt.Sprintf("%s/%s -> %s", registry.SourceRegistry, registry.SourceRepository, strings.Join(destinationNames(registry), ", "))
+}
+
+// startJob records that job started and returns a function recording its
+// result and the mirror lag of the entry, if measured.
+func (d *daemon) startJob(job syncJob) func(err error, lag *regsync.MirrorLag) {
+	status := &registryStatus{
+		Source:       job.Registry.SourceRegistry + "/" + job.Registry.SourceRepository,
+		Destinations: destinationNames(job.Registry),
+		Reason:       job.Reason,
+		Tags:         job.Tags,
+		Running:      true,
+		StartedAt:    time.Now(),
+	}
+
+	d.mu.Lock()
+	d.jobCounts[job.Reason]++
+	if previous, ok := d.statuses[registryKey(job.Registry)]; ok {
+		status.MirrorLag = previous.MirrorLag
+	}
+	d.statuses[registryKey(job.Registry)] = status
+	d.mu.Unlock()
+
+	return func(err error, lag *regsync.MirrorLag) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		finished := time.Now()
+		status.Running = false
+		status.FinishedAt = &finished
+		status.DurationSeconds = finished.Sub(status.StartedAt).Seconds()
+		if err != nil {
+			status.Error = err.Error()
+		}
+		if lag != nil {
+			status.MirrorLag = lag
+		}
+	}
+}
+
+// handleHealthz reports that the process is up.
+func (d *daemon) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether jobs are being accepted, which stops once the
+// daemon is shutting down.
+func (d *daemon) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !d.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleStatus serves the latest sync of every registry entry as JSON.
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	keys := make([]string, 0, len(d.statuses))
+	for key := range d.statuses {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	registries := make([]registryStatus, 0, len(keys))
+	for _, key := range keys {
+		registries = append(registries, *d.statuses[key])
+	}
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"leader":     d.leader.Load(),
+		"queued":     len(d.jobs),
+		"registries": registries,
+	})
+}
+
+// handleMetrics serves the latest sync of every registry entry in the
+// Prometheus text format, for a ServiceMonitor to scrape.
+func (d *daemon) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	keys := make([]string, 0, len(d.statuses))
+	for key := range d.statuses {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	finished := []registryStatus{}
+	for _, key := range keys {
+		if status := d.statuses[key]; status.FinishedAt != nil {
+			finished = append(finished, *status)
+		}
+	}
+	reasons := make([]string, 0, len(d.jobCounts))
+	for reason := range d.jobCounts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	jobCounts := make([]int, len(reasons))
+	for i, reason := range reasons {
+		jobCounts[i] = d.jobCounts[reason]
+	}
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	leader := 0
+	if d.leader.Load() {
+		leader = 1
+	}
+	gauge("registries_sync_leader", "Whether the replica processes jobs.")
+	fmt.Fprintf(w, "registries_sync_leader %d\n", leader)
+	gauge("registries_sync_queued_jobs", "Sync jobs waiting for the worker.")
+	fmt.Fprintf(w, "registries_sync_queued_jobs %d\n", len(d.jobs))
+	fmt.Fprintf(w, "# HELP registries_sync_jobs_total Sync jobs started, by what queued them.\n# TYPE registries_sync_jobs_total counter\n")
+	for i, reason := range reasons {
+		fmt.Fprintf(w, "registries_sync_jobs_total{reason=\"%s\"} %d\n", metricsLabelEscaper.Replace(reason), jobCounts[i])
+	}
+
+	gauge("registries_sync_registry_last_sync_success", "Whether the latest sync of the registry entry succeeded.")
+	for _, status := range finished {
+		success := 1
+		if status.Error != "" {
+			success = 0
+		}
+		fmt.Fprintf(w, "registries_sync_registry_last_sync_success%s %d\n", registryLabels(status), success)
+	}
+	gauge("registries_sync_registry_last_sync_timestamp_seconds", "When the latest sync of the registry entry finished, as a Unix timestamp.")
+	for _, status := range finished {
+		fmt.Fprintf(w, "registries_sync_registry_last_sync_timestamp_seconds%s %d\n", registryLabels(status), status.FinishedAt.Unix())
+	}
+	gauge("registries_sync_registry_last_sync_duration_seconds", "Duration of the latest sync of the registry entry.")
+	for _, status := range finished {
+		fmt.Fprintf(w, "registries_sync_registry_last_sync_duration_seconds%s %g\n", registryLabels(status), status.DurationSeconds)
+	}
+	gauge("registries_sync_registry_mirror_lag_seconds", "How far the newest mirrored tag of the registry entry is behind the newest source tag.")
+	for _, status := range finished {
+		if status.MirrorLag != nil {
+			fmt.Fprintf(w, "registries_sync_registry_mirror_lag_seconds%s %g\n", registryLabels(status), status.MirrorLag.Seconds)
+		}
+	}
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// registryLabels returns the labels identifying the registry entry of
+// status, several entries may have the same source.
+func registryLabels(status registryStatus) string {
+	return fmt.Sprintf(`{source="%s",destinations="%s"}`, metricsLabelEscaper.Replace(status.Source), metricsLabelEscaper.Replace(strings.Join(status.Destinations, ",")))
+}
+
+// handleSync enqueues an on-demand sync of the registry entries whose source
+// is the registry query parameter, e.g. docker.io/library/nginx. Repeating
+// the tag parameter syncs just those tags instead of the filtered tag list.
+// Without the registry parameter every entry is synced, as a manual full sync.
+func (d *daemon) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !d.authorizedWebhook(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !d.leader.Load() {
+		http.Error(w, "standby replica, not the leader", http.StatusServiceUnavailable)
+		return
+	}
+	source := r.URL.Query().Get("registry")
+	if source == "" {
+		// A manual full sync, like SIGHUP
+		registries, ok := d.queueManualSync()
+		if !ok {
+			http.Error(w, "a manual full sync is already queued", http.StatusConflict)
+			return
+		}
+		log.Printf("Sync API queued a manual full sync of %d registry entries", registries)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]int{"queued": registries})
+		return
+	}
+	host, repository, ok := strings.Cut(source, "/")
+	if !ok {
+		http.Error(w, "registry must be <source_registry>/<source_repository>", http.StatusBadRequest)
+		return
+	}
+
+	jobs := []syncJob{}
+	for _, registry := range d.currentConfig().Registries {
+		if config.ImagePath(registry.SourceRegistry, registry.SourceRepository) == config.ImagePath(host, repository) {
+			jobs = append(jobs, syncJob{Registry: registry, Tags: r.URL.Query()["tag"], Reason: "api"})
+		}
+	}
+	if len(jobs) == 0 {
+		http.Error(w, fmt.Sprintf("no registry entry for %s", source), http.StatusNotFound)
+		return
+	}
+
+	queued, ok := d.enqueueJobs(jobs)
+	if !ok {
+		http.Error(w, "sync queue is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Sync API queued %d of %d sync jobs for %s", queued, len(jobs), source)
+	writeQueued(w, queued, len(jobs))
+}
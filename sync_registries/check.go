@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
+
+// runCheck implements -check. It prints, for every registry entry and
+// destination, the tags the filters select that the destination lacks, and
+// returns false when any are missing or a destination couldn't be checked.
+// Tags a sync skips on purpose are listed but aren't drift. Nothing is copied.
+func runCheck(ctx context.Context, cfg *config.Config, secrets *config.Secrets) bool {
+	ok := true
+	for _, registry := range cfg.Registries {
+		for _, dest := range registry.AllDestinations() {
+			name := fmt.Sprintf("%s/%s -> %s", registry.SourceRegistry, registry.SourceRepository, dest)
+
+			secret := auth.SecretForRole(dest.DestRegistry, config.RolePull, secrets.Secrets)
+			credentials, err := auth.ResolveCredentials(ctx, dest.DestRegistry, secret)
+			if err != nil {
+				fmt.Printf("ERROR %s: %v\n", name, err)
+				ok = false
+				continue
+			}
+			destCtx, err := auth.SecretSystemContext(secret, credentials)
+			if err != nil {
+				fmt.Printf("ERROR %s: %v\n", name, err)
+				ok = false
+				continue
+			}
+			diff, err := regsync.Diff(ctx, cfg, registry, dest, destCtx)
+			if err != nil {
+				fmt.Printf("ERROR %s: %v\n", name, err)
+				ok = false
+				continue
+			}
+
+			if len(diff.Missing) > 0 {
+				fmt.Printf("DRIFT %s: %d missing: %s\n", name, len(diff.Missing), strings.Join(diff.Missing, ", "))
+				ok = false
+			} else {
+				fmt.Printf("OK    %s\n", name)
+			}
+			if len(diff.Skipped) > 0 {
+				fmt.Printf("SKIP  %s: %d skipped by the sync: %s\n", name, len(diff.Skipped), strings.Join(diff.Skipped, ", "))
+			}
+		}
+	}
+	return ok
+}
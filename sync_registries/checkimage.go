@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
+
+// runCheckImage implements the "check-image" subcommand. It exits with status
+// 0 when the image exists at the destination and, with -match-source, has
+// the digest of its source, and with status 1 otherwise, so deploy pipelines
+// can wait for an image to be mirrored.
+func runCheckImage(args []string) {
+	flags := flag.NewFlagSet("check-image", flag.ExitOnError)
+	configFile := flags.String("config", "registries.yaml", "Path to the registries configuration file, read with -match-source")
+	secretsFile := flags.String("secrets", "secrets.yaml", "Path to the secrets file")
+	matchSource := flags.Bool("match-source", false, "Also require the digest of the source image the registry entry mirroring the image copies it from")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: check-image [flags] <registry>/<repository>:<tag> or <registry>/<repository>@<digest>")
+	}
+	image := flags.Arg(0)
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		log.Fatalf("Invalid image reference %s: %v", image, err)
+	}
+
+	secrets, err := loadSecrets(*secretsFile)
+	if err != nil {
+		log.Fatalf("Failed to load secrets: %v", err)
+	}
+	var registry *config.RegistryConfig
+	if *matchSource {
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		registry = mirroringEntry(cfg, reference.Domain(named), reference.Path(named))
+		if registry == nil {
+			log.Fatalf("No registry entry in %s mirrors to %s", *configFile, reference.TrimNamed(named))
+		}
+	}
+
+	ctx := context.Background()
+	host := reference.Domain(named)
+	secret := auth.SecretForRole(host, config.RolePull, secrets.Secrets)
+	credentials, err := auth.ResolveCredentials(ctx, host, secret)
+	if err != nil {
+		log.Fatalf("Failed to resolve credentials for %s: %v", host, err)
+	}
+	destCtx, err := auth.SecretSystemContext(secret, credentials)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	check, err := regsync.CheckImage(ctx, image, destCtx, registry)
+	if err != nil {
+		log.Fatalf("Failed to check %s: %v", image, err)
+	}
+	switch {
+	case !check.Exists():
+		fmt.Printf("MISSING %s\n", image)
+		os.Exit(1)
+	case !check.MatchesSource():
+		fmt.Printf("STALE   %s: %s, source %s is %s\n", image, check.Digest, check.Source, strings.Join(check.SourceDigests, " or "))
+		os.Exit(1)
+	}
+	fmt.Printf("OK      %s: %s\n", image, check.Digest)
+}
+
+// mirroringEntry returns a copy of the registry entry with host/repository as
+// a registry destination, targeting only that destination, or nil when there
+// is none.
+func mirroringEntry(cfg *config.Config, host, repository string) *config.RegistryConfig {
+	for _, registry := range cfg.Registries {
+		for _, dest := range registry.AllDestinations() {
+			if dest.Local() {
+				continue
+			}
+			if config.ImagePath(dest.DestRegistry, dest.DestRepository) == config.ImagePath(host, repository) {
+				entry := registry.WithDestination(dest)
+				return &entry
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"registries-sync/internal/kube"
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+)
+
+// Keys of the ConfigMap and Secret read with -config-source.
+const (
+	configMapKey = "registries.yaml"
+	secretKey    = "secrets.yaml"
+)
+
+// configSource is where registries.yaml and secrets.yaml are read from: the
+// -config and -secrets files, or with -config-source k8s://namespace/name the
+// ConfigMap and the Secret of that name, read through the Kubernetes API.
+// With -config-dir the configuration is merged from the files of a directory,
+// with -skopeo-dest it is a `skopeo sync --src yaml` file.
+type configSource struct {
+	configFile  string
+	configDir   string // Replaces configFile when set
+	secretsFile string
+	skopeo      *config.SkopeoDestination // nil for registries.yaml
+
+	client    *kube.Client // nil when reading files
+	namespace string
+	name      string
+}
+
+func newConfigSource(source, configFile, configDir, secretsFile, skopeoDest string, skopeoScoped bool) (*configSource, error) {
+	var skopeo *config.SkopeoDestination
+	if skopeoDest != "" {
+		skopeo = &config.SkopeoDestination{Dest: skopeoDest, Scoped: skopeoScoped}
+	}
+	if configDir != "" && (source != "" || skopeo != nil) {
+		return nil, errors.New("-config-dir can't be combined with -config-source or -skopeo-dest")
+	}
+	if source == "" {
+		return &configSource{configFile: configFile, configDir: configDir, secretsFile: secretsFile, skopeo: skopeo}, nil
+	}
+	rest, ok := strings.CutPrefix(source, "k8s://")
+	if !ok {
+		return nil, fmt.Errorf("unsupported config source %q, expected k8s://namespace/name", source)
+	}
+	namespace, name, ok := strings.Cut(rest, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid config source %q, expected k8s://namespace/name", source)
+	}
+	client, err := kube.InCluster()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config source %s: %w", source, err)
+	}
+	return &configSource{client: client, namespace: namespace, name: name, skopeo: skopeo}, nil
+}
+
+func (s *configSource) String() string {
+	if s.client == nil && s.configDir != "" {
+		return s.configDir + " and " + s.secretsFile
+	}
+	if s.client == nil {
+		return s.configFile + " and " + s.secretsFile
+	}
+	return fmt.Sprintf("ConfigMap and Secret %s/%s", s.namespace, s.name)
+}
+
+// read returns the raw content of registries.yaml and secrets.yaml. The files
+// of a config directory are concatenated with their names, so adding or
+// removing one changes the content.
+func (s *configSource) read(ctx context.Context) ([]byte, []byte, error) {
+	if s.client == nil {
+		var configData []byte
+		var err error
+		if s.configDir != "" {
+			configData, err = readConfigDir(s.configDir)
+		} else {
+			configData, err = os.ReadFile(s.configFile)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		secretsData, err := os.ReadFile(s.secretsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return configData, secretsData, nil
+	}
+
+	configMap, err := s.client.ConfigMap(ctx, s.namespace, s.name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read ConfigMap %s/%s: %w", s.namespace, s.name, err)
+	}
+	configData, ok := configMap[configMapKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("no %s key in ConfigMap %s/%s", configMapKey, s.namespace, s.name)
+	}
+	secret, err := s.client.Secret(ctx, s.namespace, s.name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read Secret %s/%s: %w", s.namespace, s.name, err)
+	}
+	secretsData, ok := secret[secretKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("no %s key in Secret %s/%s", secretKey, s.namespace, s.name)
+	}
+	return []byte(configData), secretsData, nil
+}
+
+// fingerprint hashes the configuration and secrets, to notice when they
+// change. Mounted ConfigMaps and Secrets are updated by swapping a symlink
+// rather than writing the file, which changes the content read through the
+// path all the same.
+func (s *configSource) fingerprint(ctx context.Context) (string, error) {
+	configData, secretsData, err := s.read(ctx)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(configData)
+	hash.Write(secretsData)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// load reads and parses the configuration and secrets, and resolves
+// references to secret managers, so the rest of the run only sees plain
+// credentials.
+func (s *configSource) load(ctx context.Context) (*config.Config, *config.Secrets, error) {
+	var err error
+	if s.client == nil {
+		var cfg *config.Config
+		if s.skopeo != nil {
+			cfg, err = config.LoadSkopeo(s.configFile, *s.skopeo)
+		} else if s.configDir != "" {
+			cfg, err = config.LoadDir(s.configDir)
+		} else {
+			cfg, err = config.Load(s.configFile)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		secrets, err := loadSecrets(s.secretsFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load secrets: %w", err)
+		}
+		return cfg, secrets, nil
+	}
+
+	log.Printf("Loading configuration from %s", s)
+	configData, secretsData, err := s.read(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cfg *config.Config
+	if s.skopeo != nil {
+		cfg, err = config.ParseSkopeo(configData, *s.skopeo)
+	} else {
+		cfg, err = config.Parse(configData)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s of ConfigMap %s/%s: %w", configMapKey, s.namespace, s.name, err)
+	}
+	secrets, err := config.ParseSecrets(secretsData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s of Secret %s/%s: %w", secretKey, s.namespace, s.name, err)
+	}
+	if err := auth.ResolveSecretReferences(ctx, secrets); err != nil {
+		return nil, nil, fmt.Errorf("failed to load secrets: %w", err)
+	}
+	return cfg, secrets, nil
+}
+
+// readConfigDir returns the names and raw content of the files of a config
+// directory.
+func readConfigDir(dir string) ([]byte, error) {
+	files, err := config.ConfigFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, file...)
+		data = append(data, 0)
+		data = append(data, content...)
+	}
+	return data, nil
+}
+
+// loadConfig loads the configuration of subcommands without -config-source:
+// the files of configDir when set, configFile otherwise.
+func loadConfig(configFile, configDir string) (*config.Config, error) {
+	if configDir != "" {
+		return config.LoadDir(configDir)
+	}
+	return config.Load(configFile)
+}
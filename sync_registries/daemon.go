@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"registries-sync/internal/kube"
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
+
+// syncJob is a unit of work for the daemon worker. An empty Tags list means a
+// full sync of the registry entry using its filters.
+type syncJob struct {
+	Registry config.RegistryConfig
+	Tags     []string
+	Reason   string
+}
+
+type daemon struct {
+	config           *config.Config
+	syncer           *regsync.Syncer
+	webhookToken     string
+	insecureWebhooks bool // Serve the webhooks and /sync without webhookToken
+	jobs             chan syncJob
+	ready            atomic.Bool  // Accepting jobs, served on /readyz
+	leader           atomic.Bool  // Processing jobs, false while standing by for the lease
+	jobStarted       atomic.Int64 // Unix nanoseconds the job in progress started at, 0 while idle
+	manualQueued     atomic.Int64 // Jobs of the pending manual full sync not started yet
+
+	mu         sync.Mutex
+	statuses   map[string]*registryStatus // Latest sync per registryKey, served on /status
+	jobCounts  map[string]int             // Jobs started by reason, served on /metrics
+	nextSyncer *regsync.Syncer            // Reloaded configuration the worker switches to
+
+	shutdown context.Context // Done once the daemon shuts down
+
+	// Context the event consumers run in and stops them, guarded by mu
+	eventsCtx  context.Context
+	stopEvents context.CancelFunc
+}
+
+// runDaemon implements the "daemon" subcommand. It serves registry push
+// webhooks and optionally runs a full sync on a fixed interval. Jobs are
+// processed one at a time so webhook and scheduled syncs never overlap.
+func runDaemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configFile := flags.String("config", "registries.yaml", "Path to the registries configuration file")
+	configDir := flags.String("config-dir", "", "Directory whose *.yaml files are merged into the configuration, instead of -config")
+	secretsFile := flags.String("secrets", "secrets.yaml", "Path to the secrets file")
+	configSource := flags.String("config-source", "", "Read the configuration from the ConfigMap and the secrets from the Secret k8s://namespace/name instead of -config and -secrets")
+	skopeoDest := flags.String("skopeo-dest", "", "Read -config as a skopeo sync --src yaml file and mirror its images to this registry[/path], like skopeo sync --dest")
+	skopeoScoped := flags.Bool("skopeo-scoped", false, "Keep the source registry and repository path under -skopeo-dest, like skopeo sync --scoped")
+	listen := flags.String("listen", ":8080", "Address to serve webhooks on")
+	interval := flags.Duration("interval", 0, "Interval between full syncs, 0 disables scheduled syncs")
+	historyFile := flags.String("history-db", "", "SQLite database recording every sync and image copy, empty disables the history")
+	auditLog := flags.String("audit-log", "", "Hash-chained file recording every pushed image and the credential it was pushed with, empty disables the audit log")
+	digestExport := flags.String("digest-export", "", "File mapping every tag pushed to a registry destination to its digest, for dependency update bots, empty disables the export")
+	digestExportFormat := flags.String("digest-export-format", "json", "Format of -digest-export: json or properties")
+	webhookToken := flags.String("webhook-token", os.Getenv("SYNC_WEBHOOK_TOKEN"), "Shared token required on webhook requests and /sync, which are disabled without one")
+	insecureWebhooks := flags.Bool("insecure-webhooks", false, "Serve the webhook endpoints and /sync without -webhook-token, to anyone reaching -listen")
+	leaseName := flags.String("leader-election-lease", "", "Kubernetes Lease in the pod's namespace that elects the replica processing jobs, empty disables leader election")
+	leaseDuration := flags.Duration("leader-election-duration", 15*time.Second, "How long the lease stays valid without renewal")
+	reloadInterval := flags.Duration("reload-interval", 30*time.Second, "Interval between checks of the configuration and secrets for changes, 0 disables reloading")
+	debugListen := flags.String("debug-listen", "", "Address to serve /debug/pprof and /debug/dump on, e.g. localhost:6060, empty disables them")
+	dumpDir := flags.String("dump-dir", os.TempDir(), "Directory goroutine and heap dumps are written to on SIGUSR1 or POST /debug/dump")
+	watchdogJobTimeout := flags.Duration("watchdog-job-timeout", 2*time.Hour, "Stop pinging the systemd watchdog once a job runs for longer, so systemd restarts a stuck daemon, 0 disables the check")
+	logging := addLogFlags(flags)
+	flags.Parse(args)
+
+	closeLog, err := logging.apply()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+
+	source, err := newConfigSource(*configSource, *configFile, *configDir, *secretsFile, *skopeoDest, *skopeoScoped)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	loaded, err := source.fingerprint(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to read configuration from %s: %v", source, err)
+	}
+	cfg, secrets, err := source.load(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load configuration from %s: %v", source, err)
+	}
+	// Reloaded configurations keep the files
+	files := regsync.Options{HistoryFile: *historyFile, AuditLog: *auditLog, DigestExport: *digestExport, DigestExportFormat: *digestExportFormat}
+	opts := files
+	opts.Config, opts.Secrets = cfg, secrets
+	syncer, err := regsync.New(opts)
+	if err != nil {
+		log.Fatalf("Failed to initialize sync: %v", err)
+	}
+
+	d := &daemon{
+		config:           cfg,
+		syncer:           syncer,
+		webhookToken:     *webhookToken,
+		insecureWebhooks: *insecureWebhooks,
+		jobs:             make(chan syncJob, 100),
+		statuses:         map[string]*registryStatus{},
+		jobCounts:        map[string]int{},
+	}
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.syncer.Close()
+		if d.nextSyncer != nil {
+			d.nextSyncer.Close()
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	d.shutdown = ctx
+
+	shutdownTracing, err := regsync.InitTracing(ctx)
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	start := func() {
+		go d.worker(ctx)
+		d.startEventConsumers(ctx)
+		if *interval > 0 {
+			go d.schedule(ctx, *interval)
+		}
+	}
+	go dumpOnSignal(ctx, *dumpDir)
+	go d.resyncOnSignal(ctx)
+	if *debugListen != "" {
+		go serveDebug(ctx, *debugListen, *dumpDir)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		log.Printf("Pinging the systemd watchdog every %s", interval)
+		go d.watchdog(ctx, interval, *watchdogJobTimeout)
+	}
+	if *reloadInterval > 0 {
+		go d.watchConfig(ctx, source, loaded, *reloadInterval, files)
+	}
+	leading := make(chan struct{})
+	if *leaseName != "" {
+		client, err := kube.InCluster()
+		if err != nil {
+			log.Fatalf("Failed to set up leader election: %v", err)
+		}
+		lease := client.NewLease(*leaseName, hostname(), *leaseDuration)
+		go func() {
+			defer close(leading)
+			d.lead(ctx, lease, start)
+		}()
+	} else {
+		d.leader.Store(true)
+		start()
+		close(leading)
+	}
+
+	mux := http.NewServeMux()
+	switch {
+	case *webhookToken != "":
+	case *insecureWebhooks:
+		log.Printf("Warning: serving the webhook endpoints and /sync without -webhook-token, to anyone reaching %s", *listen)
+	default:
+		log.Printf("Webhook endpoints and /sync are disabled without -webhook-token, pass -insecure-webhooks to serve them unauthenticated")
+	}
+	if *webhookToken != "" || *insecureWebhooks {
+		mux.HandleFunc("/webhooks/harbor", d.handleWebhook(parseHarborWebhook))
+		mux.HandleFunc("/webhooks/quay", d.handleWebhook(parseQuayWebhook))
+		mux.HandleFunc("/webhooks/dockerhub", d.handleWebhook(parseDockerHubWebhook))
+		mux.HandleFunc("/sync", d.handleSync)
+	}
+	mux.HandleFunc("/healthz", d.handleHealthz)
+	mux.HandleFunc("/readyz", d.handleReadyz)
+	mux.HandleFunc("/status", d.handleStatus)
+	mux.HandleFunc("/metrics", d.handleMetrics)
+
+	server := &http.Server{Addr: *listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		d.ready.Store(false)
+		log.Println("Shutting down daemon...")
+		notifySystemd("STOPPING=1")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.ready.Store(true)
+	log.Printf("Daemon listening on %s", *listen)
+	notifySystemd("READY=1\nSTATUS=Listening on " + *listen)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	// Release the lease before exiting
+	<-leading
+}
+
+func (d *daemon) worker(ctx context.Context) {
+	for job := range d.jobs {
+		log.Printf("Processing %s job for %s/%s", job.Reason, job.Registry.SourceRegistry, job.Registry.SourceRepository)
+		notifySystemd(fmt.Sprintf("STATUS=Syncing %s/%s", job.Registry.SourceRegistry, job.Registry.SourceRepository))
+		d.jobStarted.Store(time.Now().UnixNano())
+		finish := d.startJob(job)
+		syncer := d.currentSyncer()
+		jobCtx := ctx
+		if job.Reason == manualReason {
+			jobCtx = regsync.WithRunKind(ctx, manualReason)
+			d.manualQueued.Add(-1)
+		}
+		err := syncer.SyncRegistry(jobCtx, job.Registry, job.Tags)
+		if lag, ok := syncer.MirrorLag(job.Registry); ok {
+			finish(err, &lag)
+		} else {
+			finish(err, nil)
+		}
+		d.jobStarted.Store(0)
+		notifySystemd("STATUS=Idle")
+		if err != nil {
+			log.Printf("Failed to sync %s: %v", job.Registry.SourceRepository, err)
+		} else {
+			log.Printf("Completed sync for %s/%s", job.Registry.SourceRegistry, job.Registry.SourceRepository)
+		}
+	}
+}
+
+// schedule enqueues a full sync immediately and then once per interval.
+func (d *daemon) schedule(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		d.enqueueFullSync(ctx, d.currentConfig().Registries, "scheduled")
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueueFullSync queues a job for every registry, waiting for room in the
+// queue until ctx is done.
+func (d *daemon) enqueueFullSync(ctx context.Context, registries []config.RegistryConfig, reason string) {
+	for _, registry := range registries {
+		select {
+		case <-ctx.Done():
+			return
+		case d.jobs <- syncJob{Registry: registry, Reason: reason}:
+		}
+	}
+}
+
+// queueManualSync queues a manual full sync of every registry entry in the
+// background and returns their number, unless one is pending already, i.e.
+// some of its jobs haven't started, which it reports with false. Requests
+// are coalesced that way, rather than piling up passes.
+func (d *daemon) queueManualSync() (int, bool) {
+	registries := d.currentConfig().Registries
+	if !d.manualQueued.CompareAndSwap(0, int64(len(registries))) {
+		return 0, false
+	}
+	go d.enqueueFullSync(d.shutdown, registries, manualReason)
+	return len(registries), true
+}
+
+// manualReason is the reason of full syncs an operator triggered outside the
+// schedule, with SIGHUP or POST /sync.
+const manualReason = "manual"
+
+// resyncOnSignal queues a manual full sync on every SIGHUP. Standby replicas
+// ignore it, the leader syncs.
+func (d *daemon) resyncOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+		if !d.leader.Load() {
+			log.Printf("Ignoring SIGHUP, standby replica")
+			continue
+		}
+		if _, ok := d.queueManualSync(); !ok {
+			log.Printf("Ignoring SIGHUP, a manual full sync is already queued")
+			continue
+		}
+		log.Printf("Received SIGHUP, queueing a manual full sync")
+	}
+}
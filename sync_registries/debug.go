@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+)
+
+// serveDebug serves the pprof endpoints on addr until ctx is done. They are
+// kept off the webhook listener, which is usually exposed more widely.
+func serveDebug(ctx context.Context, addr, dumpDir string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/dump", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		files, err := writeDumps(dumpDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, file := range files {
+			fmt.Fprintln(w, file)
+		}
+	})
+
+	// No write timeout, CPU profiles and traces take as long as requested
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Serving debug endpoints on %s", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Debug endpoints failed: %v", err)
+	}
+}
+
+// dumpOnSignal writes goroutine and heap dumps to dir on every SIGUSR1, for
+// when the debug endpoints aren't reachable. Windows has no such signal.
+func dumpOnSignal(ctx context.Context, dir string) {
+	if len(dumpSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, dumpSignals...)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+		files, err := writeDumps(dir)
+		if err != nil {
+			log.Printf("Failed to write debug dumps: %v", err)
+			continue
+		}
+		log.Printf("Wrote debug dumps %v", files)
+	}
+}
+
+// writeDumps writes the stacks of all goroutines as text and a heap profile
+// to dir, named after the current time, and returns their paths.
+func writeDumps(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	goroutines := filepath.Join(dir, "goroutines-"+stamp+".txt")
+	heap := filepath.Join(dir, "heap-"+stamp+".pprof")
+
+	if err := writeProfile(goroutines, "goroutine", 2); err != nil {
+		return nil, err
+	}
+	// Up to date statistics, as of the last GC otherwise
+	runtime.GC()
+	if err := writeProfile(heap, "heap", 0); err != nil {
+		return nil, err
+	}
+	return []string{goroutines, heap}, nil
+}
+
+func writeProfile(path, name string, debug int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := runtimepprof.Lookup(name).WriteTo(file, debug); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s profile: %w", name, err)
+	}
+	return file.Close()
+}
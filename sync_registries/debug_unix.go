@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals trigger debug dumps.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
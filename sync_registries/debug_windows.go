@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// dumpSignals trigger debug dumps, none on Windows, use POST /debug/dump.
+var dumpSignals []os.Signal
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
+
+// runDiff implements the "diff" subcommand. It compares the source and
+// destination tag sets of every registry entry without copying anything.
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	configFile := flags.String("config", "registries.yaml", "Path to the registries configuration file")
+	configDir := flags.String("config-dir", "", "Directory whose *.yaml files are merged into the configuration, instead of -config")
+	secretsFile := flags.String("secrets", "secrets.yaml", "Path to the secrets file")
+	flags.Parse(args)
+
+	cfg, err := loadConfig(*configFile, *configDir)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	secrets, err := loadSecrets(*secretsFile)
+	if err != nil {
+		log.Fatalf("Failed to load secrets: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, registry := range cfg.Registries {
+		for _, dest := range registry.AllDestinations() {
+			fmt.Printf("%s/%s -> %s\n", registry.SourceRegistry, registry.SourceRepository, dest)
+
+			secret := auth.SecretForRole(dest.DestRegistry, config.RolePull, secrets.Secrets)
+			credentials, err := auth.ResolveCredentials(ctx, dest.DestRegistry, secret)
+			if err != nil {
+				fmt.Printf("  error: %v\n", err)
+				continue
+			}
+
+			destCtx, err := auth.SecretSystemContext(secret, credentials)
+			if err != nil {
+				fmt.Printf("  error: %v\n", err)
+				continue
+			}
+			diff, err := regsync.Diff(ctx, cfg, registry, dest, destCtx)
+			if err != nil {
+				fmt.Printf("  error: %v\n", err)
+				continue
+			}
+
+			printDiffLine("missing at destination", diff.Missing)
+			printDiffLine("skipped by the sync", diff.Skipped)
+			printDiffLine("excluded by filters", diff.Excluded)
+			printDiffLine("beyond tag_limit", diff.BeyondLimit)
+			printDiffLine("digest mismatch", diff.DigestMismatch)
+		}
+	}
+}
+
+func printDiffLine(label string, tags []string) {
+	if len(tags) == 0 {
+		tags = []string{"-"}
+	}
+	fmt.Printf("  %s: %s\n", label, strings.Join(tags, ", "))
+}
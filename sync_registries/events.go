@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"golang.org/x/oauth2/google"
+
+	"registries-sync/pkg/config"
+)
+
+const eventRetryDelay = 30 * time.Second
+
+// startEventConsumers starts a goroutine for every event source of the
+// current configuration, running until ctx is done or they are restarted.
+func (d *daemon) startEventConsumers(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.eventsCtx = ctx
+	d.runEventConsumers()
+}
+
+// restartEventConsumers stops the event consumers and starts those of the
+// current configuration, after a reload changed the events section. Standby
+// replicas have none running and start them once they lead.
+func (d *daemon) restartEventConsumers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopEvents == nil {
+		return
+	}
+	d.stopEvents()
+	d.runEventConsumers()
+}
+
+// runEventConsumers starts the consumers of d.config, with d.mu held.
+func (d *daemon) runEventConsumers() {
+	ctx, stop := context.WithCancel(d.eventsCtx)
+	d.stopEvents = stop
+	if d.config.Events.GCRPubSub != nil {
+		go d.consumeGCRPubSub(ctx, *d.config.Events.GCRPubSub)
+	}
+	if d.config.Events.ECRSQS != nil {
+		go d.consumeECRSQS(ctx, *d.config.Events.ECRSQS)
+	}
+}
+
+func (d *daemon) enqueueEvent(ctx context.Context, event pushEvent, reason string) {
+	for _, job := range d.jobsForEvent(event) {
+		job.Reason = reason
+		select {
+		case <-ctx.Done():
+			return
+		case d.jobs <- job:
+		}
+	}
+}
+
+// waitToRetry waits eventRetryDelay, and reports false when ctx is done
+// first.
+func waitToRetry(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(eventRetryDelay):
+		return true
+	}
+}
+
+func (d *daemon) consumeGCRPubSub(ctx context.Context, cfg config.GCRPubSubConfig) {
+	const scope = "https://www.googleapis.com/auth/pubsub"
+
+	var client *http.Client
+	if cfg.ServiceAccountKey != "" {
+		data, err := ioutil.ReadFile(cfg.ServiceAccountKey)
+		if err != nil {
+			log.Printf("Failed to read Pub/Sub service account key: %v", err)
+			return
+		}
+		conf, err := google.JWTConfigFromJSON(data, scope)
+		if err != nil {
+			log.Printf("Failed to create JWT config for Pub/Sub: %v", err)
+			return
+		}
+		client = conf.Client(ctx)
+	} else {
+		var err error
+		client, err = google.DefaultClient(ctx, scope)
+		if err != nil {
+			log.Printf("Failed to create default Google client for Pub/Sub: %v", err)
+			return
+		}
+	}
+
+	log.Printf("Consuming GCR notifications from %s", cfg.Subscription)
+	endpoint := "https://pubsub.googleapis.com/v1/" + cfg.Subscription
+	for ctx.Err() == nil {
+		if err := d.pullGCRPubSub(ctx, client, endpoint); err != nil {
+			log.Printf("Failed to pull from %s: %v", cfg.Subscription, err)
+			if !waitToRetry(ctx) {
+				return
+			}
+		}
+	}
+}
+
+func (d *daemon) pullGCRPubSub(ctx context.Context, client *http.Client, endpoint string) error {
+	var pulled struct {
+		ReceivedMessages []struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				Data string `json:"data"`
+			} `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	if err := postJSON(ctx, client, endpoint+":pull", map[string]int{"maxMessages": 10}, &pulled); err != nil {
+		return err
+	}
+	if len(pulled.ReceivedMessages) == 0 {
+		return nil
+	}
+
+	ackIDs := []string{}
+	for _, received := range pulled.ReceivedMessages {
+		ackIDs = append(ackIDs, received.AckID)
+		data, err := base64.StdEncoding.DecodeString(received.Message.Data)
+		if err != nil {
+			log.Printf("Ignoring undecodable Pub/Sub message: %v", err)
+			continue
+		}
+		event, ok, err := parseGCRNotification(data)
+		if err != nil {
+			log.Printf("Ignoring invalid GCR notification: %v", err)
+			continue
+		}
+		if ok {
+			d.enqueueEvent(ctx, event, "pubsub")
+		}
+	}
+
+	return postJSON(ctx, client, endpoint+":acknowledge", map[string][]string{"ackIds": ackIDs}, nil)
+}
+
+// parseGCRNotification parses a GCR / Artifact Registry notification. Only
+// INSERT actions carrying a tag produce an event.
+func parseGCRNotification(data []byte) (pushEvent, bool, error) {
+	var notification struct {
+		Action string `json:"action"`
+		Tag    string `json:"tag"`
+	}
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return pushEvent{}, false, err
+	}
+	if notification.Action != "INSERT" || notification.Tag == "" {
+		return pushEvent{}, false, nil
+	}
+
+	// The tag is a full reference such as gcr.io/project/image:1.0
+	slash := strings.Index(notification.Tag, "/")
+	colon := strings.LastIndex(notification.Tag, ":")
+	if slash < 0 || colon < slash {
+		return pushEvent{}, false, fmt.Errorf("unexpected tag reference %q", notification.Tag)
+	}
+	return pushEvent{
+		Registry:   notification.Tag[:slash],
+		Repository: notification.Tag[slash+1 : colon],
+		Tag:        notification.Tag[colon+1:],
+	}, true, nil
+}
+
+func (d *daemon) consumeECRSQS(ctx context.Context, cfg config.ECRSQSConfig) {
+	opts := []func(*awsconfig.LoadOptions) error{}
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		log.Printf("Failed to load AWS configuration for SQS: %v", err)
+		return
+	}
+	client := sqs.NewFromConfig(awsCfg)
+
+	log.Printf("Consuming ECR push events from %s", cfg.QueueURL)
+	for ctx.Err() == nil {
+		out, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(cfg.QueueURL),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			log.Printf("Failed to receive from %s: %v", cfg.QueueURL, err)
+			if !waitToRetry(ctx) {
+				return
+			}
+			continue
+		}
+
+		for _, message := range out.Messages {
+			event, ok, err := parseECREvent([]byte(aws.ToString(message.Body)))
+			if err != nil {
+				log.Printf("Ignoring invalid ECR event: %v", err)
+			} else if ok {
+				d.enqueueEvent(ctx, event, "sqs")
+			}
+
+			if _, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(cfg.QueueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			}); err != nil {
+				log.Printf("Failed to delete SQS message: %v", err)
+			}
+		}
+	}
+}
+
+// parseECREvent parses an EventBridge "ECR Image Action" event. Only
+// successful pushes of a tag produce an event.
+func parseECREvent(data []byte) (pushEvent, bool, error) {
+	var event struct {
+		Source  string `json:"source"`
+		Account string `json:"account"`
+		Region  string `json:"region"`
+		Detail  struct {
+			Result         string `json:"result"`
+			ActionType     string `json:"action-type"`
+			RepositoryName string `json:"repository-name"`
+			ImageTag       string `json:"image-tag"`
+		} `json:"detail"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return pushEvent{}, false, err
+	}
+	if event.Source != "aws.ecr" || event.Detail.ActionType != "PUSH" || event.Detail.Result != "SUCCESS" || event.Detail.ImageTag == "" {
+		return pushEvent{}, false, nil
+	}
+
+	return pushEvent{
+		Registry:   fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", event.Account, event.Region),
+		Repository: event.Detail.RepositoryName,
+		Tag:        event.Detail.ImageTag,
+	}, true, nil
+}
+
+// postJSON posts payload with client and decodes the response into out.
+func postJSON(ctx context.Context, client *http.Client, endpoint string, payload, out interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(string(data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, endpoint)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"registries-sync/pkg/config"
+)
+
+// Where the generated workloads mount registries.yaml and secrets.yaml.
+const (
+	k8sConfigDir  = "/etc/registries-sync/config"
+	k8sSecretsDir = "/etc/registries-sync/secrets"
+)
+
+// k8sManifest is a Kubernetes object. Fields holds everything after the
+// metadata, e.g. spec or data.
+type k8sManifest struct {
+	APIVersion string         `yaml:"apiVersion"`
+	Kind       string         `yaml:"kind"`
+	Metadata   map[string]any `yaml:"metadata"`
+	Fields     map[string]any `yaml:",inline"`
+}
+
+// k8sOptions are the settings of the generated manifests.
+type k8sOptions struct {
+	name, namespace string
+	image           string
+	mode            string // "cronjob" or "daemon"
+	schedule        string
+	interval        time.Duration
+	replicas        int
+	serviceMonitor  bool
+}
+
+// runGenerate implements the "generate" subcommand. "generate k8s" writes the
+// manifests for running the sync in a cluster with the current configuration.
+func runGenerate(args []string) {
+	if len(args) == 0 || args[0] != "k8s" {
+		log.Fatal("Usage: generate k8s [flags]")
+	}
+	flags := flag.NewFlagSet("generate k8s", flag.ExitOnError)
+	configFile := flags.String("config", "registries.yaml", "Path to the registries configuration file put into the ConfigMap")
+	secretsFile := flags.String("secrets", "secrets.yaml", "Path to the secrets file put into the Secret")
+	name := flags.String("name", "registries-sync", "Name of the generated objects")
+	namespace := flags.String("namespace", "", "Namespace of the generated objects, empty leaves it to kubectl")
+	image := flags.String("image", "registries-sync", "Container image running the sync, without the tag")
+	tag := flags.String("tag", "latest", "Tag of -image")
+	mode := flags.String("mode", "cronjob", "cronjob for a CronJob running a sync on -schedule, or daemon for a Deployment running the daemon")
+	schedule := flags.String("schedule", "0 */6 * * *", "Cron schedule of the CronJob")
+	interval := flags.Duration("interval", 6*time.Hour, "Interval between full syncs of the daemon, 0 disables scheduled syncs")
+	replicas := flags.Int("replicas", 1, "Replicas of the daemon, which elect a leader through a Lease")
+	serviceMonitor := flags.Bool("service-monitor", false, "Add a Prometheus Operator ServiceMonitor scraping the daemon's /metrics")
+	output := flags.String("output", "-", "File to write to, \"-\" for stdout")
+	flags.Parse(args[1:])
+
+	switch *mode {
+	case "cronjob":
+		if *serviceMonitor {
+			log.Fatal("-service-monitor needs -mode daemon, a CronJob pushes its metrics to the Pushgateway")
+		}
+	case "daemon":
+	default:
+		log.Fatalf("Unknown mode %q, expected cronjob or daemon", *mode)
+	}
+	if *replicas < 1 {
+		log.Fatal("-replicas must be at least 1")
+	}
+
+	// Refuse to deploy a configuration that doesn't load
+	if _, err := config.Load(*configFile); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if _, err := config.LoadSecrets(*secretsFile); err != nil {
+		log.Fatalf("Failed to load secrets: %v", err)
+	}
+	configData, err := os.ReadFile(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to read configuration: %v", err)
+	}
+	secretsData, err := os.ReadFile(*secretsFile)
+	if err != nil {
+		log.Fatalf("Failed to read secrets: %v", err)
+	}
+
+	opts := k8sOptions{
+		name:           *name,
+		namespace:      *namespace,
+		image:          *image + ":" + *tag,
+		mode:           *mode,
+		schedule:       *schedule,
+		interval:       *interval,
+		replicas:       *replicas,
+		serviceMonitor: *serviceMonitor,
+	}
+	var data bytes.Buffer
+	encoder := yaml.NewEncoder(&data)
+	encoder.SetIndent(2)
+	for _, manifest := range k8sManifests(opts, configData, secretsData) {
+		if err := encoder.Encode(manifest); err != nil {
+			log.Fatalf("Failed to encode %s: %v", manifest.Kind, err)
+		}
+	}
+	encoder.Close()
+
+	if *output == "-" {
+		os.Stdout.Write(data.Bytes())
+		return
+	}
+	// The Secret holds the credentials
+	if err := os.WriteFile(*output, data.Bytes(), 0o600); err != nil {
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+	log.Printf("Wrote %s manifests to %s", *mode, *output)
+}
+
+// k8sManifests returns the objects running the sync: a ServiceAccount with
+// access to the Lease of the run, the ConfigMap and Secret holding the
+// configuration, and a CronJob, or a Deployment and its Service.
+func k8sManifests(opts k8sOptions, configData, secretsData []byte) []k8sManifest {
+	labels := map[string]string{"app.kubernetes.io/name": "registries-sync", "app.kubernetes.io/instance": opts.name}
+	metadata := func() map[string]any {
+		m := map[string]any{"name": opts.name, "labels": labels}
+		if opts.namespace != "" {
+			m["namespace"] = opts.namespace
+		}
+		return m
+	}
+
+	manifests := []k8sManifest{
+		{APIVersion: "v1", Kind: "ServiceAccount", Metadata: metadata()},
+		{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role", Metadata: metadata(), Fields: map[string]any{
+			"rules": []map[string]any{
+				{"apiGroups": []string{"coordination.k8s.io"}, "resources": []string{"leases"}, "verbs": []string{"get", "create", "update"}},
+			},
+		}},
+		{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding", Metadata: metadata(), Fields: map[string]any{
+			"roleRef":  map[string]string{"apiGroup": "rbac.authorization.k8s.io", "kind": "Role", "name": opts.name},
+			"subjects": []map[string]string{{"kind": "ServiceAccount", "name": opts.name}},
+		}},
+		{APIVersion: "v1", Kind: "ConfigMap", Metadata: metadata(), Fields: map[string]any{
+			"data": map[string]string{configMapKey: string(configData)},
+		}},
+		{APIVersion: "v1", Kind: "Secret", Metadata: metadata(), Fields: map[string]any{
+			"type": "Opaque",
+			"data": map[string]string{secretKey: base64.StdEncoding.EncodeToString(secretsData)},
+		}},
+	}
+
+	args := []string{"-config", k8sConfigDir + "/" + configMapKey, "-secrets", k8sSecretsDir + "/" + secretKey}
+	container := map[string]any{
+		"name":  "registries-sync",
+		"image": opts.image,
+		"volumeMounts": []map[string]any{
+			{"name": "config", "mountPath": k8sConfigDir, "readOnly": true},
+			{"name": "secrets", "mountPath": k8sSecretsDir, "readOnly": true},
+		},
+	}
+	podSpec := map[string]any{
+		"serviceAccountName": opts.name,
+		"containers":         []map[string]any{container},
+		"volumes": []map[string]any{
+			{"name": "config", "configMap": map[string]string{"name": opts.name}},
+			{"name": "secrets", "secret": map[string]string{"secretName": opts.name}},
+		},
+	}
+
+	if opts.mode == "cronjob" {
+		// Pods don't share a lock file or the state of an interrupted run
+		container["args"] = append(args, "-no-progress", "-lock-file", "", "-lock-lease", opts.name, "-state-file", "")
+		podSpec["restartPolicy"] = "Never"
+		return append(manifests, k8sManifest{APIVersion: "batch/v1", Kind: "CronJob", Metadata: metadata(), Fields: map[string]any{
+			"spec": map[string]any{
+				"schedule":          opts.schedule,
+				"concurrencyPolicy": "Forbid",
+				"jobTemplate": map[string]any{
+					"spec": map[string]any{
+						"backoffLimit": 0,
+						"template": map[string]any{
+							"metadata": map[string]any{"labels": labels},
+							"spec":     podSpec,
+						},
+					},
+				},
+			},
+		}})
+	}
+
+	container["args"] = append([]string{"daemon"}, append(args, "-interval", opts.interval.String(), "-leader-election-lease", opts.name)...)
+	container["ports"] = []map[string]any{{"name": "http", "containerPort": 8080}}
+	container["livenessProbe"] = map[string]any{"httpGet": map[string]any{"path": "/healthz", "port": "http"}}
+	container["readinessProbe"] = map[string]any{"httpGet": map[string]any{"path": "/readyz", "port": "http"}}
+	manifests = append(manifests,
+		k8sManifest{APIVersion: "apps/v1", Kind: "Deployment", Metadata: metadata(), Fields: map[string]any{
+			"spec": map[string]any{
+				"replicas": opts.replicas,
+				"selector": map[string]any{"matchLabels": labels},
+				"template": map[string]any{
+					"metadata": map[string]any{"labels": labels},
+					"spec":     podSpec,
+				},
+			},
+		}},
+		k8sManifest{APIVersion: "v1", Kind: "Service", Metadata: metadata(), Fields: map[string]any{
+			"spec": map[string]any{
+				"selector": labels,
+				"ports":    []map[string]any{{"name": "http", "port": 8080, "targetPort": "http"}},
+			},
+		}},
+	)
+	if opts.serviceMonitor {
+		manifests = append(manifests, k8sManifest{APIVersion: "monitoring.coreos.com/v1", Kind: "ServiceMonitor", Metadata: metadata(), Fields: map[string]any{
+			"spec": map[string]any{
+				"selector":  map[string]any{"matchLabels": labels},
+				"endpoints": []map[string]any{{"port": "http", "path": "/metrics", "interval": "60s"}},
+			},
+		}})
+	}
+	return manifests
+}
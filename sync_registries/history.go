@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	units "github.com/docker/go-units"
+
+	regsync "registries-sync/pkg/sync"
+)
+
+// runHistory implements the "history" subcommand. It lists the most recent
+// runs recorded with -history-db and the image copies each of them made, or
+// with -image every recorded copy of a matching image.
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	historyFile := flags.String("history-db", "sync-history.db", "SQLite database written by -history-db")
+	runs := flags.Int("runs", 10, "Number of recent runs to list")
+	image := flags.String("image", "", "List every copy whose source or destination contains this, e.g. nginx:1.27")
+	limit := flags.Int("limit", 100, "Maximum number of copies to list per run, or in total with -image")
+	flags.Parse(args)
+
+	if _, err := os.Stat(*historyFile); err != nil {
+		log.Fatalf("Failed to open history: %v", err)
+	}
+	history, err := regsync.OpenHistory(*historyFile)
+	if err != nil {
+		log.Fatalf("Failed to open history: %v", err)
+	}
+	defer history.Close()
+
+	if *image != "" {
+		copies, err := history.Copies(0, *image, *limit)
+		if err != nil {
+			log.Fatalf("Failed to read history: %v", err)
+		}
+		for _, c := range copies {
+			printHistoryCopy(c)
+		}
+		return
+	}
+
+	recent, err := history.Runs(*runs)
+	if err != nil {
+		log.Fatalf("Failed to read history: %v", err)
+	}
+	for _, run := range recent {
+		duration := "running"
+		if run.FinishedAt != nil {
+			duration = run.FinishedAt.Sub(run.StartedAt).Round(time.Second).String()
+		}
+		fmt.Printf("Run %d: %s at %s, %s, %s\n", run.ID, run.Kind, run.StartedAt.Local().Format(time.RFC3339), duration, run.Result)
+
+		copies, err := history.Copies(run.ID, "", *limit)
+		if err != nil {
+			log.Fatalf("Failed to read history: %v", err)
+		}
+		for _, c := range copies {
+			printHistoryCopy(c)
+		}
+	}
+}
+
+func printHistoryCopy(c regsync.HistoryCopy) {
+	line := fmt.Sprintf("  %s %s -> %s", c.FinishedAt.Local().Format(time.RFC3339), c.Source, c.Destination)
+	if c.Digest != "" {
+		line += " " + c.Digest
+	}
+	line += fmt.Sprintf(", %s, %s", units.BytesSize(float64(c.Bytes)), c.Result)
+	if c.Error != "" {
+		line += ": " + c.Error
+	}
+	fmt.Println(line)
+}
+
+// runVerifyAudit implements the "verify-audit" subcommand. It checks the hash
+// chain of an -audit-log file and exits with status 1 when it is broken.
+func runVerifyAudit(args []string) {
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	auditLog := flags.String("audit-log", "sync-audit.log", "Audit log written by -audit-log")
+	flags.Parse(args)
+
+	count, lastHash, err := regsync.VerifyAuditLog(*auditLog)
+	if err != nil {
+		log.Printf("Audit log %s is not intact: %v", *auditLog, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d records intact, last hash %s\n", count, lastHash)
+}
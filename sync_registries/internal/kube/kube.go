@@ -0,0 +1,119 @@
+// Package kube is a minimal client for the Kubernetes API, used from inside
+// a pod with its service account to coordinate replicas through Leases.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ErrNotInCluster is returned by InCluster outside of a Kubernetes pod.
+var ErrNotInCluster = errors.New("not running in a Kubernetes pod")
+
+// Client calls the Kubernetes API server with the pod's service account.
+type Client struct {
+	host      string
+	namespace string
+	tokenFile string
+	http      *http.Client
+}
+
+// InCluster returns a client for the API server of the cluster the pod runs
+// in, acting in the pod's namespace.
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the pod namespace: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in the cluster CA")
+	}
+	return &Client{
+		host:      "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+		tokenFile: serviceAccountDir + "/token",
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// Namespace is the namespace of the pod.
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// do sends payload (if any) as JSON and decodes a successful response into
+// result. It returns the status code, also for errors reported by the API.
+func (c *Client) do(ctx context.Context, method, path string, payload, result interface{}) (int, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, body)
+	if err != nil {
+		return 0, err
+	}
+	// The token is rotated by the kubelet, read it for every request
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &status) == nil && status.Message != "" {
+			return resp.StatusCode, fmt.Errorf("%s %s: %s", method, path, status.Message)
+		}
+		return resp.StatusCode, fmt.Errorf("%s %s: unexpected status %s", method, path, resp.Status)
+	}
+	if result != nil {
+		if err := json.Unmarshal(data, result); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to decode response of %s %s: %w", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,220 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// microTime is the timestamp format of Lease fields.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// ErrLeaseLost is returned when the lease is held by someone else.
+var ErrLeaseLost = errors.New("lease is held by another holder")
+
+// Lease is a coordination.k8s.io/v1 Lease held under an identity. It is not
+// safe for concurrent use.
+type Lease struct {
+	client   *Client
+	name     string
+	identity string
+	duration time.Duration
+
+	object *leaseObject // As last read or written
+}
+
+type leaseObject struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+}
+
+// NewLease returns the lease name in the pod's namespace, held for duration
+// after every renewal.
+func (c *Client) NewLease(name, identity string, duration time.Duration) *Lease {
+	return &Lease{client: c, name: name, identity: identity, duration: duration}
+}
+
+// Name is the name of the lease.
+func (l *Lease) Name() string {
+	return l.name
+}
+
+func (l *Lease) path() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", l.client.namespace, l.name)
+}
+
+// TryAcquire takes the lease if it is free, expired or already held by this
+// identity. Otherwise it returns false and the current holder.
+func (l *Lease) TryAcquire(ctx context.Context) (bool, string, error) {
+	var current leaseObject
+	status, err := l.client.do(ctx, http.MethodGet, l.path(), nil, &current)
+	if status == http.StatusNotFound {
+		return l.create(ctx)
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	holder := stringValue(current.Spec.HolderIdentity)
+	if holder != "" && holder != l.identity && !expired(current.Spec) {
+		return false, holder, nil
+	}
+	now := time.Now().Format(microTime)
+	if holder != l.identity {
+		transitions := intValue(current.Spec.LeaseTransitions)
+		if holder != "" {
+			transitions++
+		}
+		current.Spec.LeaseTransitions = &transitions
+		current.Spec.AcquireTime = &now
+	}
+	seconds := int(l.duration.Seconds())
+	current.Spec.HolderIdentity = &l.identity
+	current.Spec.LeaseDurationSeconds = &seconds
+	current.Spec.RenewTime = &now
+	return l.update(ctx, &current, holder)
+}
+
+func (l *Lease) create(ctx context.Context) (bool, string, error) {
+	now := time.Now().Format(microTime)
+	seconds := int(l.duration.Seconds())
+	transitions := 0
+	lease := &leaseObject{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   leaseMetadata{Name: l.name, Namespace: l.client.namespace},
+		Spec: leaseSpec{
+			HolderIdentity:       &l.identity,
+			LeaseDurationSeconds: &seconds,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+			LeaseTransitions:     &transitions,
+		},
+	}
+	var created leaseObject
+	status, err := l.client.do(ctx, http.MethodPost, fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.client.namespace), lease, &created)
+	if status == http.StatusConflict {
+		// Created by someone else in the meantime
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	l.object = &created
+	return true, l.identity, nil
+}
+
+// update writes lease, which fails with a conflict when it was changed since
+// it was read.
+func (l *Lease) update(ctx context.Context, lease *leaseObject, holder string) (bool, string, error) {
+	var updated leaseObject
+	status, err := l.client.do(ctx, http.MethodPut, l.path(), lease, &updated)
+	if status == http.StatusConflict {
+		return false, holder, nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	l.object = &updated
+	return true, l.identity, nil
+}
+
+// Renew extends the lease. It returns ErrLeaseLost when another holder took
+// it over in the meantime.
+func (l *Lease) Renew(ctx context.Context) error {
+	acquired, holder, err := l.TryAcquire(ctx)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("%w: %s", ErrLeaseLost, holder)
+	}
+	return nil
+}
+
+// KeepRenewed renews the lease every third of its duration until ctx is
+// done. lost is called, and renewing stops, when the lease was taken over or
+// could not be renewed before it expired.
+func (l *Lease) KeepRenewed(ctx context.Context, lost func(error)) {
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := l.Renew(ctx)
+		if err == nil {
+			renewed = time.Now()
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, ErrLeaseLost) || time.Since(renewed) >= l.duration {
+			lost(err)
+			return
+		}
+	}
+}
+
+// Release gives the lease up so the next holder doesn't have to wait for it
+// to expire.
+func (l *Lease) Release(ctx context.Context) error {
+	if l.object == nil || stringValue(l.object.Spec.HolderIdentity) != l.identity {
+		return nil
+	}
+	lease := *l.object
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.AcquireTime = nil
+	lease.Spec.RenewTime = nil
+	_, err := l.client.do(ctx, http.MethodPut, l.path(), &lease, nil)
+	l.object = nil
+	return err
+}
+
+func expired(spec leaseSpec) bool {
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	// Accepts the fractional seconds of microTime as well
+	renewed, err := time.Parse(time.RFC3339, *spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return time.Since(renewed) > time.Duration(*spec.LeaseDurationSeconds)*time.Second
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func intValue(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
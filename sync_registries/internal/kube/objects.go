@@ -0,0 +1,29 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// ConfigMap returns the data of a ConfigMap.
+func (c *Client) ConfigMap(ctx context.Context, namespace, name string) (map[string]string, error) {
+	var object struct {
+		Data map[string]string `json:"data"`
+	}
+	if _, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", namespace, name), nil, &object); err != nil {
+		return nil, err
+	}
+	return object.Data, nil
+}
+
+// Secret returns the decoded data of a Secret.
+func (c *Client) Secret(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	var object struct {
+		Data map[string][]byte `json:"data"` // Base64 in JSON, decoded by encoding/json
+	}
+	if _, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, name), nil, &object); err != nil {
+		return nil, err
+	}
+	return object.Data, nil
+}
@@ -0,0 +1,117 @@
+// Package logfile writes logs to a file that is rotated by size and age.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated files, e.g. sync-20240501T120000.000Z.log.
+const backupTimeFormat = "20060102T150405.000Z"
+
+// Writer is an io.Writer appending to a file. It is safe for concurrent use.
+type Writer struct {
+	path       string
+	maxSize    int64         // Rotate before the file grows past this, 0 disables
+	maxAge     time.Duration // Rotate once the file is this old, 0 disables
+	maxBackups int           // Rotated files kept, 0 keeps all
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Open appends to the file at path, creating it and its directory if needed.
+func Open(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*Writer, error) {
+	w := &Writer{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	// Files have no portable creation time, the age of an existing file
+	// counts from now
+	w.file, w.size, w.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p, rotating the file first when p would make it too large or
+// it is too old.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > 0 && ((w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize) || (w.maxAge > 0 && time.Since(w.opened) > w.maxAge)) {
+		if err := w.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %v\n", w.path, err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(w.path)
+	backup := strings.TrimSuffix(w.path, ext) + "-" + time.Now().UTC().Format(backupTimeFormat) + ext
+	renameErr := os.Rename(w.path, backup)
+	if err := w.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	return w.removeOldBackups()
+}
+
+// removeOldBackups deletes all but the newest maxBackups rotated files.
+func (w *Writer) removeOldBackups() error {
+	if w.maxBackups <= 0 {
+		return nil
+	}
+	ext := filepath.Ext(w.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(w.path, ext) + "-[0-9]*" + ext)
+	if err != nil {
+		return err
+	}
+	// The timestamps sort chronologically
+	sort.Strings(backups)
+	for len(backups) > w.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Close closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
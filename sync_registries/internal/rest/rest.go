@@ -0,0 +1,64 @@
+// Package rest holds the small JSON-over-HTTP helpers used to talk to
+// registry, Vault and policy APIs.
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// BearerAuth sets a bearer token, unless token is empty.
+func BearerAuth(token string) func(*http.Request) {
+	return func(req *http.Request) {
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+}
+
+// BasicAuth sets basic auth credentials, unless username is empty.
+func BasicAuth(username, password string) func(*http.Request) {
+	return func(req *http.Request) {
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+	}
+}
+
+// DoJSON sends payload (if any) as JSON and returns the status code and body.
+func DoJSON(ctx context.Context, method, endpoint string, payload interface{}, auth func(*http.Request)) (int, []byte, error) {
+	var reader io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if auth != nil {
+		auth(req)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
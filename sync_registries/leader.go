@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"registries-sync/internal/kube"
+)
+
+// leaderRetryPeriod is how often a standby replica tries to take the lease.
+const leaderRetryPeriod = 2 * time.Second
+
+// lead waits until lease is acquired, then marks the daemon as the leader and
+// calls start. The lease is renewed until ctx is done and released
+// afterwards, so a standby replica takes over right away. Losing the lease
+// ends the process, the replica then restarts as a standby.
+func (d *daemon) lead(ctx context.Context, lease *kube.Lease, start func()) {
+	if !awaitLease(ctx, lease) {
+		return
+	}
+	d.leader.Store(true)
+	start()
+
+	lease.KeepRenewed(ctx, func(err error) {
+		log.Fatalf("Lost lease %s, exiting to restart as a standby: %v", lease.Name(), err)
+	})
+
+	releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := lease.Release(releaseCtx); err != nil {
+		log.Printf("Failed to release lease %s: %v", lease.Name(), err)
+		return
+	}
+	log.Printf("Released lease %s", lease.Name())
+}
+
+// awaitLease tries to acquire lease until it succeeds or ctx is done.
+func awaitLease(ctx context.Context, lease *kube.Lease) bool {
+	lastHolder := ""
+	for {
+		acquired, holder, err := lease.TryAcquire(ctx)
+		switch {
+		case err != nil:
+			log.Printf("Failed to acquire lease %s: %v", lease.Name(), err)
+		case acquired:
+			log.Printf("Acquired lease %s, this replica is the leader", lease.Name())
+			return true
+		case holder != lastHolder:
+			log.Printf("Standing by, lease %s is held by %s", lease.Name(), holder)
+			lastHolder = holder
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(leaderRetryPeriod):
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"registries-sync/internal/kube"
+)
+
+// errLocked is returned by tryLockFile when another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// runLeaseDuration is how long a run lease stays valid without renewal, so a
+// crashed run blocks the next one for at most this long.
+const runLeaseDuration = time.Minute
+
+// acquireRunLock keeps runs from overlapping, with an exclusive lock on
+// lockFile, or with the Kubernetes Lease leaseName when set, since pods don't
+// share a file system. When another run holds the lock it returns a
+// description of that run. lost is called when the lease is taken over
+// during the run. The returned release function may be called repeatedly.
+func acquireRunLock(ctx context.Context, lockFile, leaseName string, lost func()) (string, func(), error) {
+	if leaseName != "" {
+		return acquireRunLease(ctx, leaseName, lost)
+	}
+	if lockFile == "" {
+		return "", func() {}, nil
+	}
+
+	file, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := tryLockFile(file); err != nil {
+		defer file.Close()
+		if errors.Is(err, errLocked) {
+			owner, _ := os.ReadFile(lockFile)
+			return fmt.Sprintf("%s, locked by %s", lockFile, strings.TrimSpace(string(owner))), nil, nil
+		}
+		return "", nil, fmt.Errorf("failed to lock %s: %w", lockFile, err)
+	}
+
+	// Only informative, the lock itself is released when the process exits
+	file.Truncate(0)
+	fmt.Fprintf(file, "pid %d on %s since %s\n", os.Getpid(), hostname(), time.Now().Format(time.RFC3339))
+
+	var once sync.Once
+	return "", func() {
+		once.Do(func() {
+			file.Truncate(0)
+			file.Close()
+		})
+	}, nil
+}
+
+func acquireRunLease(ctx context.Context, leaseName string, lost func()) (string, func(), error) {
+	client, err := kube.InCluster()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to use lease %s: %w", leaseName, err)
+	}
+	identity := fmt.Sprintf("%s-%d", hostname(), os.Getpid())
+	lease := client.NewLease(leaseName, identity, runLeaseDuration)
+	acquired, holder, err := lease.TryAcquire(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to acquire lease %s: %w", leaseName, err)
+	}
+	if !acquired {
+		return fmt.Sprintf("lease %s/%s, held by %s", client.Namespace(), leaseName, holder), nil, nil
+	}
+
+	renewCtx, stopRenewing := context.WithCancel(context.Background())
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		lease.KeepRenewed(renewCtx, func(err error) {
+			log.Printf("Lost lease %s/%s, stopping the run: %v", client.Namespace(), leaseName, err)
+			lost()
+		})
+	}()
+
+	var once sync.Once
+	return "", func() {
+		once.Do(func() {
+			stopRenewing()
+			<-renewed
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := lease.Release(ctx); err != nil {
+				log.Printf("Failed to release lease %s/%s: %v", client.Namespace(), leaseName, err)
+			}
+		})
+	}, nil
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+
+	"registries-sync/internal/logfile"
+)
+
+// logFlags are the flags shared by the sync run and the daemon that send the
+// log to a rotated file.
+type logFlags struct {
+	file       *string
+	maxSize    *string
+	maxAge     *time.Duration
+	maxBackups *int
+	stdout     *bool
+}
+
+func addLogFlags(flags *flag.FlagSet) *logFlags {
+	return &logFlags{
+		file:       flags.String("log-file", "", "Write the log to this file instead of stderr, rotating it by -log-max-size and -log-max-age"),
+		maxSize:    flags.String("log-max-size", "100MiB", "Rotate the log file before it grows past this size, 0 disables size rotation"),
+		maxAge:     flags.Duration("log-max-age", 0, "Rotate the log file once it is this old, e.g. 24h, 0 disables age rotation"),
+		maxBackups: flags.Int("log-max-backups", 7, "Rotated log files kept, 0 keeps all"),
+		stdout:     flags.Bool("log-stdout", false, "With -log-file, also write the log to stdout"),
+	}
+}
+
+// apply redirects the log to the file, if one was given. The returned
+// function closes it.
+func (f *logFlags) apply() (func(), error) {
+	if *f.file == "" {
+		return func() {}, nil
+	}
+	maxSize, err := units.RAMInBytes(*f.maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -log-max-size: %w", err)
+	}
+	writer, err := logfile.Open(*f.file, maxSize, *f.maxAge, *f.maxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	var out io.Writer = writer
+	if *f.stdout {
+		out = io.MultiWriter(writer, os.Stdout)
+	}
+	log.SetOutput(out)
+	return func() {
+		log.SetOutput(os.Stderr)
+		writer.Close()
+	}, nil
+}
+
+// utcTimestampWriter prefixes every log line with the time in UTC, in RFC 3339.
+type utcTimestampWriter struct {
+	out io.Writer
+}
+
+func (w utcTimestampWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, time.Now().UTC().Format(time.RFC3339)+" "); err != nil {
+		return 0, err
+	}
+	return w.out.Write(p)
+}
+
+// useUTCLogTimestamps replaces the local timestamps of the log with UTC
+// RFC 3339 ones, which sort and compare across hosts.
+func useUTCLogTimestamps() {
+	log.SetFlags(0)
+	log.SetOutput(utcTimestampWriter{out: log.Writer()})
+}
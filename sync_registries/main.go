@@ -2,270 +2,249 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
+	"errors"
+	"flag"
 	"log"
-	"regexp"
-	"sort"
-	"time"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"github.com/briandowns/spinner"
-	"github.com/containers/image/v5/copy"
-	"github.com/containers/image/v5/docker"
-	"github.com/containers/image/v5/signature"
-	"github.com/containers/image/v5/types"
-	"golang.org/x/oauth2/google"
-	"gopkg.in/yaml.v3"
-)
-
-type RegistryConfig struct {
-	SourceRegistry   string   `yaml:"source_registry"`
-	SourceRepository string   `yaml:"source_repository"`
-	DestRegistry     string   `yaml:"dest_registry"`
-	DestRepository   string   `yaml:"dest_repository"`
-	TagLimit         int      `yaml:"tag_limit"`
-	ExcludePatterns  []string `yaml:"exclude_patterns"`
-}
+	"go.opentelemetry.io/otel"
 
-type SecretConfig struct {
-	DestRegistry      string `yaml:"dest_registry"`
-	Type              string `yaml:"type"` // Registry type, e.g., "gcr", "acr"
-	Username          string `yaml:"username,omitempty"`
-	Password          string `yaml:"password,omitempty"`
-	ServiceAccountKey string `yaml:"service_account_key,omitempty"`
-}
-
-type Config struct {
-	Registries []RegistryConfig `yaml:"registries"`
-}
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
 
-type Secrets struct {
-	Secrets []SecretConfig `yaml:"secrets"`
-}
+var tracer = otel.Tracer("registries-sync")
 
 func main() {
-	log.Println("Starting the sync process...")
-
-	// Load the YAML configuration file
-	config, err := loadConfig("registries.yaml")
-	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		case "validate":
+			runValidate(os.Args[2:])
+			return
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		case "verify-audit":
+			runVerifyAudit(os.Args[2:])
+			return
+		case "gen-pull-secret":
+			runGenPullSecret(os.Args[2:])
+			return
+		case "push":
+			runPush(os.Args[2:])
+			return
+		case "generate":
+			runGenerate(os.Args[2:])
+			return
+		case "check-image":
+			runCheckImage(os.Args[2:])
+			return
+		case "quarantine":
+			runQuarantine(os.Args[2:])
+			return
+		}
 	}
-	log.Println("Loaded configuration successfully.")
 
-	// Load the secrets file
-	secrets, err := loadSecrets("secrets.yaml")
+	configFile := flag.String("config", "registries.yaml", "Path to the registries configuration file")
+	configDir := flag.String("config-dir", "", "Directory whose *.yaml files are merged into the configuration, instead of -config")
+	secretsFile := flag.String("secrets", "secrets.yaml", "Path to the secrets file")
+	reportFile := flag.String("report", "", "Write a summary of the run to this file, \"-\" for stdout")
+	reportFormat := flag.String("report-format", "json", "Format of the run summary: json, yaml or html")
+	stateFile := flag.String("state-file", "sync-state.json", "File recording progress so an interrupted run can be resumed, empty disables resuming")
+	check := flag.Bool("check", false, "Only report destinations missing tags the filters select and exit with status 1 if any, nothing is copied")
+	historyFile := flag.String("history-db", "", "SQLite database recording every run and image copy, empty disables the history")
+	auditLog := flag.String("audit-log", "", "Hash-chained file recording every pushed image and the credential it was pushed with, empty disables the audit log")
+	digestExport := flag.String("digest-export", "", "File mapping every tag pushed to a registry destination to its digest, for dependency update bots, empty disables the export")
+	digestExportFormat := flag.String("digest-export-format", "json", "Format of -digest-export: json or properties")
+	noProgress := flag.Bool("no-progress", false, "Don't report copy progress, only log status lines")
+	previousReport := flag.String("previous-report", "", "File the report of every completed run is saved to, so the report, the email and -report of the next run list what changed since, empty disables the comparison")
+	deterministic := flag.Bool("deterministic", false, "Sync registry entries one at a time sorted by source, without progress, timestamp the log in UTC RFC 3339 and zero the timing in the report, so runs against the same state produce identical reports")
+	configSource := flag.String("config-source", "", "Read the configuration from the ConfigMap and the secrets from the Secret k8s://namespace/name instead of -config and -secrets")
+	skopeoDest := flag.String("skopeo-dest", "", "Read -config as a skopeo sync --src yaml file and mirror its images to this registry[/path], like skopeo sync --dest")
+	skopeoScoped := flag.Bool("skopeo-scoped", false, "Keep the source registry and repository path under -skopeo-dest, like skopeo sync --scoped")
+	maxDuration := flag.Duration("max-duration", 0, "Stop the run after this long, resumable like an interrupted run, 0 means no limit")
+	lockFile := flag.String("lock-file", "sync.lock", "File locked while a run is in progress so overlapping runs exit, empty disables locking")
+	lockLease := flag.String("lock-lease", "", "Kubernetes Lease in the pod's namespace held while a run is in progress, instead of -lock-file")
+	logging := addLogFlags(flag.CommandLine)
+	onlyRegistry := flag.String("only-registry", "", "Only sync the registry entries with this source registry, e.g. docker.io")
+	onlyRepo := flag.String("only-repo", "", "Only sync the registry entries with this source repository, e.g. library/nginx or docker.io/library/nginx")
+	onlyTag := flag.String("only-tag", "", "Only sync these comma-separated source tags or pinned digests of the entries -only-repo or -only-registry select, whatever their filters")
+	stageDir := flag.String("stage-dir", "", "Pull the selected images into a directory per tag below this directory instead of pushing them, for a later push -stage-dir run, e.g. on a removable drive")
+	mirrorConfigDir := flag.String("mirror-config-dir", "", "After the sync, write OpenShift ImageContentSourcePolicy and ImageDigestMirrorSet manifests and containerd hosts.toml files pointing at the mirror to this directory")
+	flag.Parse()
+
+	closeLog, err := logging.apply()
 	if err != nil {
-		log.Fatalf("Failed to load secrets: %v", err)
+		log.Fatal(err)
 	}
-	log.Println("Loaded secrets successfully.")
-
-	// Loop through each registry configuration
-	for _, registry := range config.Registries {
-		log.Printf("Starting sync for registry: %s/%s to %s/%s", registry.SourceRegistry, registry.SourceRepository, registry.DestRegistry, registry.DestRepository)
-
-		// Retrieve the credentials for the destination registry
-		secret := getSecretConfig(registry.DestRegistry, secrets.Secrets)
-
-		if isGCR(secret) && secret.ServiceAccountKey != "" {
-			// Authenticate using the service account key
-			token, err := getGCRToken(secret.ServiceAccountKey)
-			if err != nil {
-				log.Fatalf("Failed to get GCR token: %v", err)
-			}
-			secret.Username = "oauth2accesstoken"
-			secret.Password = token
-		}
-
-		if err := syncRegistry(registry, secret.Username, secret.Password); err != nil {
-			log.Printf("Failed to sync %s: %v", registry.SourceRepository, err)
-		} else {
-			log.Printf("Completed sync for %s/%s", registry.SourceRegistry, registry.SourceRepository)
-		}
+	defer closeLog()
+	if *deterministic {
+		useUTCLogTimestamps()
 	}
 
-	log.Println("Sync process completed.")
-}
+	log.Println("Starting the sync process...")
 
-func loadConfig(filename string) (*Config, error) {
-	log.Printf("Loading configuration from file: %s", filename)
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, err
+	// SIGINT and SIGTERM cancel the context, which aborts the copy in progress
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxDuration)
+		defer cancel()
 	}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, err
+	shutdownTracing, err := regsync.InitTracing(ctx)
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	return &config, nil
-}
+	ctx, runSpan := tracer.Start(ctx, "sync-run")
+	defer runSpan.End()
 
-func loadSecrets(filename string) (*Secrets, error) {
-	log.Printf("Loading secrets from file: %s", filename)
-	data, err := ioutil.ReadFile(filename)
+	// Load the configuration and secrets
+	loadCtx, loadSpan := tracer.Start(ctx, "load-config")
+	source, err := newConfigSource(*configSource, *configFile, *configDir, *secretsFile, *skopeoDest, *skopeoScoped)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
-
-	var secrets Secrets
-	if err := yaml.Unmarshal(data, &secrets); err != nil {
-		return nil, err
+	cfg, secrets, err := source.load(loadCtx)
+	if err != nil {
+		log.Fatalf("Failed to load configuration from %s: %v", source, err)
 	}
+	log.Println("Loaded configuration and secrets successfully.")
+	loadSpan.End()
 
-	return &secrets, nil
-}
-
-func getSecretConfig(destRegistry string, secrets []SecretConfig) SecretConfig {
-	for _, secret := range secrets {
-		if secret.DestRegistry == destRegistry {
-			return secret
+	only := onlyFilter{registry: *onlyRegistry, repository: *onlyRepo}
+	if *onlyTag != "" {
+		only.tags = strings.Split(*onlyTag, ",")
+	}
+	if !only.empty() {
+		cfg, err = only.apply(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Only syncing %d registry entries matching %s", len(cfg.Registries), only)
+		if *stateFile != "" {
+			// Keep the progress of an interrupted full run for the next one
+			log.Printf("Not resuming or saving progress in %s for a partial run", *stateFile)
+			*stateFile = ""
 		}
 	}
-	return SecretConfig{}
-}
 
-func getGCRToken(serviceAccountKeyPath string) (string, error) {
-	data, err := ioutil.ReadFile(serviceAccountKeyPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read service account key file: %w", err)
+	if *check {
+		if !runCheck(ctx, cfg, secrets) {
+			runSpan.End()
+			shutdownTracing(context.Background())
+			os.Exit(1)
+		}
+		return
 	}
 
-	conf, err := google.JWTConfigFromJSON(data, "https://www.googleapis.com/auth/devstorage.read_write")
-	if err != nil {
-		return "", fmt.Errorf("failed to create JWT config from JSON: %w", err)
+	if *reportFile != "" && *reportFormat != "json" && *reportFormat != "yaml" && *reportFormat != "html" {
+		log.Fatalf("Unknown report format %q, expected json, yaml or html", *reportFormat)
 	}
 
-	// Get the token from the JWT config
-	token, err := conf.TokenSource(context.Background()).Token()
+	ctx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	holder, releaseLock, err := acquireRunLock(ctx, *lockFile, *lockLease, cancelRun)
 	if err != nil {
-		return "", fmt.Errorf("failed to retrieve OAuth token: %w", err)
-	}
-
-	return token.AccessToken, nil
-}
-
-func isGCR(secret SecretConfig) bool {
-	return secret.Type == "gcr"
-}
-
-func syncRegistry(registry RegistryConfig, username, password string) error {
-	ctx := context.Background()
-
-	// Create a source image reference to fetch tags
-	log.Printf("Fetching tags from source repository: %s/%s", registry.SourceRegistry, registry.SourceRepository)
-	sourceCtx := &types.SystemContext{}
-	sourceImage := fmt.Sprintf("%s/%s", registry.SourceRegistry, registry.SourceRepository)
-	sourceRef, err := docker.ParseReference("//" + sourceImage)
+		log.Fatalf("Failed to lock the run: %v", err)
+	}
+	if holder != "" {
+		log.Printf("Another run is in progress (%s), exiting.", holder)
+		return
+	}
+	defer releaseLock()
+
+	syncer, err := regsync.New(regsync.Options{
+		Config:             cfg,
+		Secrets:            secrets,
+		StateFile:          *stateFile,
+		Report:             *reportFile != "",
+		HistoryFile:        *historyFile,
+		AuditLog:           *auditLog,
+		DigestExport:       *digestExport,
+		DigestExportFormat: *digestExportFormat,
+		Progress:           !*noProgress,
+		Deterministic:      *deterministic,
+		PreviousReport:     *previousReport,
+		StageDir:           *stageDir,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to parse source image reference for %s: %w", sourceImage, err)
+		log.Fatalf("Failed to initialize sync: %v", err)
 	}
-
-	// Fetch tags from the source repository
-	tags, err := docker.GetRepositoryTags(ctx, sourceCtx, sourceRef)
-	if err != nil {
-		return fmt.Errorf("failed to get tags: %w", err)
+	defer syncer.Close()
+	if syncer.Resuming() {
+		log.Printf("Resuming interrupted run from %s", *stateFile)
 	}
-	log.Printf("Fetched %d tags from source repository.", len(tags))
 
-	// Exclude tags based on patterns
-	filteredTags := filterTags(tags, registry.ExcludePatterns)
-	log.Printf("Filtered tags: %v", filteredTags)
+	err = syncer.SyncAll(ctx)
 
-	// Sort the tags (assuming semantic versioning)
-	log.Println("Sorting tags to determine the latest ones.")
-	sort.Slice(filteredTags, func(i, j int) bool {
-		return filteredTags[i] > filteredTags[j]
-	})
-
-	// Take the latest tags based on the tag limit
-	if len(filteredTags) > registry.TagLimit {
-		filteredTags = filteredTags[:registry.TagLimit]
-	}
-	log.Printf("Selected %d latest tags for syncing: %v", len(filteredTags), filteredTags)
-
-	// Set up the destination context
-	var destCtx *types.SystemContext
-	if username != "" {
-		// Use credentials if provided
-		destCtx = &types.SystemContext{
-			DockerAuthConfig: &types.DockerAuthConfig{
-				Username: username,
-				Password: password,
-			},
+	if report := syncer.Report(); report != nil && *reportFile != "" {
+		if err := report.Write(*reportFile, *reportFormat); err != nil {
+			log.Printf("Failed to write report: %v", err)
 		}
-	} else {
-		// No credentials
-		destCtx = &types.SystemContext{}
 	}
 
-	for _, tag := range filteredTags {
-		fullSourceImage := fmt.Sprintf("%s/%s:%s", registry.SourceRegistry, registry.SourceRepository, tag)
-		fullDestImage := fmt.Sprintf("%s/%s:%s", registry.DestRegistry, registry.DestRepository, tag)
-
-		log.Printf("Syncing image %s to %s", fullSourceImage, fullDestImage)
-
-		// Parse the source reference again with the tag
-		srcRef, err := docker.ParseReference("//" + fullSourceImage)
-		if err != nil {
-			log.Printf("Failed to parse source image reference for %s: %v", fullSourceImage, err)
-			continue
-		}
-
-		destRef, err := docker.ParseReference("//" + fullDestImage)
-		if err != nil {
-			log.Printf("Failed to parse destination image reference for %s: %v", fullDestImage, err)
-			continue
-		}
-
-		// Initialize spinner
-		s := spinner.New(spinner.CharSets[14], 100*time.Millisecond) // Choose spinner style and speed
-		s.Start()
-
-		// Copy the image from source to destination
-		policyContext, err := signature.NewPolicyContext(&signature.Policy{
-			Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
-		})
-		if err != nil {
-			s.Stop()
-			return fmt.Errorf("failed to create policy context: %w", err)
+	if err != nil {
+		exitCode := 130
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Sync stopped after reaching -max-duration of %v.", *maxDuration)
+			exitCode = 1
+		} else if errors.Is(err, regsync.ErrMaxFailures) {
+			log.Printf("Sync stopped after reaching max_failures of %d.", cfg.MaxFailures)
+			exitCode = 1
 		}
-		defer policyContext.Destroy()
-
-		start := time.Now()
-		_, err = copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{
-			SourceCtx:      sourceCtx,
-			DestinationCtx: destCtx,
-		})
-		s.Stop()
-		duration := time.Since(start)
+		log.Printf("Sync interrupted. Run again to resume from the first unfinished tag.")
+		syncer.Close()
+		releaseLock()
+		runSpan.End()
+		shutdownTracing(context.Background())
+		os.Exit(exitCode)
+	}
 
-		if err != nil {
-			log.Printf("Failed to sync image %s to %s: %v", fullSourceImage, fullDestImage, err)
+	if skipped := syncer.Skipped(); len(skipped) > 0 {
+		log.Printf("Images skipped: %s", strings.Join(skipped, ", "))
+	}
+	if opened := syncer.OpenedCircuits(); len(opened) > 0 {
+		log.Printf("Destinations skipped by the circuit breaker: %s", strings.Join(opened, "; "))
+	}
+	if persistent := syncer.PersistentFailures(); len(persistent) > 0 {
+		log.Printf("Persistently failing tags: %s", strings.Join(persistent, "; "))
+	}
+	if quota := syncer.DockerHubQuota(); quota != nil {
+		log.Printf("Docker Hub pull quota: %d of %d remaining", quota.Remaining, quota.Limit)
+	}
+	if *mirrorConfigDir != "" {
+		if err := writeMirrorConfigs(*mirrorConfigDir, cfg); err != nil {
+			log.Printf("Failed to write mirror configuration: %v", err)
 		} else {
-			log.Printf("Successfully synced image %s to %s in %v", fullSourceImage, fullDestImage, duration)
+			log.Printf("Wrote mirror configuration to %s", *mirrorConfigDir)
 		}
 	}
-
-	return nil
+	log.Println("Sync process completed.")
 }
 
-func filterTags(tags []string, excludePatterns []string) []string {
-	filteredTags := []string{}
-	for _, tag := range tags {
-		exclude := false
-		for _, pattern := range excludePatterns {
-			match, _ := regexp.MatchString(pattern, tag)
-			if match {
-				exclude = true
-				break
-			}
-		}
-		if !exclude {
-			filteredTags = append(filteredTags, tag)
-		}
+// loadSecrets reads the secrets file and resolves references to secret
+// managers, so the rest of the run only sees plain credentials.
+func loadSecrets(filename string) (*config.Secrets, error) {
+	secrets, err := config.LoadSecrets(filename)
+	if err != nil {
+		return nil, err
 	}
-	return filteredTags
+	if err := auth.ResolveSecretReferences(context.Background(), secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
 }
-
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"registries-sync/pkg/config"
+)
+
+// mirrorConfigName is the metadata.name of the generated OpenShift manifests.
+const mirrorConfigName = "registries-sync"
+
+// repositoryMirror maps a source repository to the repositories mirroring it,
+// as in an ImageContentSourcePolicy or ImageDigestMirrorSet.
+type repositoryMirror struct {
+	Source  string   `yaml:"source"`
+	Mirrors []string `yaml:"mirrors"`
+}
+
+type mirrorManifest struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   map[string]string `yaml:"metadata"`
+	Spec       map[string]any    `yaml:"spec"`
+}
+
+// hostMirror is a containerd mirror of a whole source registry: the
+// destination registry, and the path the source repositories are mirrored
+// under.
+type hostMirror struct {
+	registry   string
+	prefix     string
+	resolveTag bool // Tags are mirrored unchanged, so the mirror can resolve them
+}
+
+// writeMirrorConfigs writes, to dir, an ImageContentSourcePolicy and an
+// ImageDigestMirrorSet for OpenShift, and containerd hosts.toml files under
+// dir/certs.d, that point clusters at the destinations of cfg instead of the
+// source registries.
+func writeMirrorConfigs(dir string, cfg *config.Config) error {
+	mirrors := repositoryMirrors(cfg)
+	manifests := map[string]mirrorManifest{
+		"imagecontentsourcepolicy.yaml": {
+			APIVersion: "operator.openshift.io/v1alpha1",
+			Kind:       "ImageContentSourcePolicy",
+			Metadata:   map[string]string{"name": mirrorConfigName},
+			Spec:       map[string]any{"repositoryDigestMirrors": mirrors},
+		},
+		"imagedigestmirrorset.yaml": {
+			APIVersion: "config.openshift.io/v1",
+			Kind:       "ImageDigestMirrorSet",
+			Metadata:   map[string]string{"name": mirrorConfigName},
+			Spec:       map[string]any{"imageDigestMirrors": mirrors},
+		},
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for name, manifest := range manifests {
+		var data bytes.Buffer
+		encoder := yaml.NewEncoder(&data)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(manifest); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+
+	hosts, skipped := hostMirrors(cfg)
+	for host, hostMirrors := range hosts {
+		hostDir := filepath.Join(dir, "certs.d", host)
+		if err := os.MkdirAll(hostDir, 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(hostDir, "hosts.toml"), hostsTOML(host, hostMirrors), 0o644); err != nil {
+			return err
+		}
+	}
+	for _, registry := range skipped {
+		log.Printf("No containerd mirror for %s, its destination path doesn't end with the source repository", registry)
+	}
+	return nil
+}
+
+// repositoryMirrors lists the destinations of every source repository in the
+// order of the configuration.
+func repositoryMirrors(cfg *config.Config) []repositoryMirror {
+	mirrors := []repositoryMirror{}
+	index := map[string]int{}
+	for _, registry := range cfg.Registries {
+		// Local image stores aren't reachable by cluster nodes
+		destinations := slices.DeleteFunc(registry.AllDestinations(), config.Destination.Local)
+		if len(destinations) == 0 {
+			continue
+		}
+		source := config.ImagePath(registry.SourceRegistry, registry.SourceRepository)
+		i, ok := index[source]
+		if !ok {
+			i = len(mirrors)
+			index[source] = i
+			mirrors = append(mirrors, repositoryMirror{Source: source, Mirrors: []string{}})
+		}
+		for _, dest := range destinations {
+			if !slices.Contains(mirrors[i].Mirrors, dest.String()) {
+				mirrors[i].Mirrors = append(mirrors[i].Mirrors, dest.String())
+			}
+		}
+	}
+	return mirrors
+}
+
+// hostMirrors groups the destinations by source registry. containerd keeps
+// the repository path of a pull, so only destinations whose path is the
+// source repository below a common prefix can serve as mirrors. The others
+// are returned as skipped.
+func hostMirrors(cfg *config.Config) (map[string][]hostMirror, []string) {
+	hosts := map[string][]hostMirror{}
+	skipped := []string{}
+	for _, registry := range cfg.Registries {
+		// A path prefix of the source registry is part of the pulled repository
+		host, repository, _ := strings.Cut(config.ImagePath(registry.SourceRegistry, registry.SourceRepository), "/")
+		for _, dest := range slices.DeleteFunc(registry.AllDestinations(), config.Destination.Local) {
+			prefix, ok := strings.CutSuffix(dest.DestRepository, repository)
+			if !ok || (prefix != "" && !strings.HasSuffix(prefix, "/")) {
+				skipped = append(skipped, fmt.Sprintf("%s/%s -> %s", host, repository, dest))
+				continue
+			}
+			mirror := hostMirror{registry: dest.DestRegistry, prefix: strings.TrimSuffix(prefix, "/"), resolveTag: registry.TagRewrite == nil}
+			i := slices.IndexFunc(hosts[host], func(m hostMirror) bool {
+				return m.registry == mirror.registry && m.prefix == mirror.prefix
+			})
+			if i < 0 {
+				hosts[host] = append(hosts[host], mirror)
+			} else if !mirror.resolveTag {
+				hosts[host][i].resolveTag = false
+			}
+		}
+	}
+	return hosts, skipped
+}
+
+// hostsTOML renders a containerd hosts.toml trying the mirrors before host.
+func hostsTOML(host string, mirrors []hostMirror) []byte {
+	server := host
+	if host == "docker.io" {
+		server = "registry-1.docker.io"
+	}
+	var toml strings.Builder
+	fmt.Fprintf(&toml, "server = %q\n", "https://"+server)
+	for _, mirror := range mirrors {
+		capabilities := `["pull"]`
+		if mirror.resolveTag {
+			capabilities = `["pull", "resolve"]`
+		}
+		fmt.Fprintln(&toml)
+		if mirror.prefix == "" {
+			fmt.Fprintf(&toml, "[host.%q]\n", "https://"+mirror.registry)
+			fmt.Fprintf(&toml, "  capabilities = %s\n", capabilities)
+			continue
+		}
+		// override_path makes containerd use the path as the API root
+		fmt.Fprintf(&toml, "[host.%q]\n", "https://"+mirror.registry+"/v2/"+mirror.prefix)
+		fmt.Fprintf(&toml, "  capabilities = %s\n", capabilities)
+		fmt.Fprintln(&toml, "  override_path = true")
+	}
+	return []byte(toml.String())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"registries-sync/pkg/config"
+)
+
+// onlyFilter narrows a run down to some registry entries and tags, set with
+// -only-registry, -only-repo and -only-tag.
+type onlyFilter struct {
+	registry   string
+	repository string
+	tags       []string
+}
+
+func (f onlyFilter) empty() bool {
+	return f.registry == "" && f.repository == "" && len(f.tags) == 0
+}
+
+func (f onlyFilter) String() string {
+	parts := []string{}
+	if f.registry != "" {
+		parts = append(parts, "registry "+f.registry)
+	}
+	if f.repository != "" {
+		parts = append(parts, "repository "+f.repository)
+	}
+	if len(f.tags) > 0 {
+		parts = append(parts, "tags "+strings.Join(f.tags, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches reports whether f selects the source of registry. The repository
+// matches with or without the source registry in front.
+func (f onlyFilter) matches(registry config.RegistryConfig) bool {
+	path := config.ImagePath(registry.SourceRegistry, registry.SourceRepository)
+	if f.registry != "" && config.RegistryMatches(f.registry, path) == 0 {
+		return false
+	}
+	if f.repository == "" {
+		return true
+	}
+	if filterHost, filterRepository, ok := strings.Cut(f.repository, "/"); ok && config.ImagePath(filterHost, filterRepository) == path {
+		return true
+	}
+	return config.ImagePath(registry.SourceRegistry, f.repository) == path ||
+		config.ImagePath(config.RegistryHost(registry.SourceRegistry), f.repository) == path
+}
+
+// apply returns a copy of cfg with the entries f selects. With tags, the
+// entries mirror exactly those source tags, and the pinned digests among
+// them, whatever their filters.
+func (f onlyFilter) apply(cfg *config.Config) (*config.Config, error) {
+	if len(f.tags) > 0 && f.registry == "" && f.repository == "" {
+		return nil, errors.New("-only-tag needs -only-repo or -only-registry")
+	}
+	subset := *cfg
+	subset.Registries = []config.RegistryConfig{}
+	for _, registry := range cfg.Registries {
+		if !f.matches(registry) {
+			continue
+		}
+		if len(f.tags) > 0 {
+			registry.Tags, registry.PinTags = nil, nil
+			registry.TagLimit, registry.PatternLimits = 0, nil
+			digests := []config.DigestConfig{}
+			for _, tag := range f.tags {
+				if slices.ContainsFunc(registry.Digests, func(pinned config.DigestConfig) bool { return pinned.Digest == tag }) {
+					continue
+				}
+				registry.Tags = append(registry.Tags, tag)
+			}
+			for _, pinned := range registry.Digests {
+				if slices.Contains(f.tags, pinned.Digest) {
+					digests = append(digests, pinned)
+				}
+			}
+			registry.Digests = digests
+			if len(registry.Tags) == 0 && len(registry.Digests) == 0 {
+				continue
+			}
+		}
+		subset.Registries = append(subset.Registries, registry)
+	}
+	if len(subset.Registries) == 0 {
+		return nil, fmt.Errorf("no registry entry matches %s", f)
+	}
+	return &subset, nil
+}
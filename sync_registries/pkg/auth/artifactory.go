@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// artifactoryProvider logs in to JFrog Artifactory with an API key, access
+// token or reference token in the password. The username may be left out for
+// access tokens, whose subject names the user.
+type artifactoryProvider struct {
+	secret config.SecretConfig
+}
+
+func (p artifactoryProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	if p.secret.Password == "" {
+		return types.DockerAuthConfig{}, fmt.Errorf("artifactory secret for %s needs an API key or token in password", registry)
+	}
+	username := p.secret.Username
+	if username == "" {
+		username = artifactoryTokenUser(p.secret.Password)
+		if username == "" {
+			return types.DockerAuthConfig{}, fmt.Errorf("artifactory secret for %s needs a username, the password is not an access token", registry)
+		}
+	}
+	return types.DockerAuthConfig{Username: username, Password: p.secret.Password}, nil
+}
+
+// artifactoryTokenUser returns the user an Artifactory access token was issued
+// to, from a subject like jfrt@01abc/users/admin, or "" when token is not a
+// JWT. API keys and reference tokens are opaque.
+func artifactoryTokenUser(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	_, user, ok := strings.Cut(claims.Subject, "/users/")
+	if !ok {
+		return ""
+	}
+	return user
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+var (
+	clientCertDirsMu sync.Mutex
+	clientCertDirs   = map[string]string{} // By certificate and key path
+)
+
+// SecretSystemContext is SystemContext with the registry token and the client
+// certificate of secret, for registries requiring mutual TLS.
+func SecretSystemContext(secret config.SecretConfig, credentials types.DockerAuthConfig) (*types.SystemContext, error) {
+	sys := SystemContext(credentials)
+	sys.DockerBearerRegistryToken = secret.RegistryToken
+	if secret.ClientCert == "" && secret.ClientKey == "" {
+		return sys, nil
+	}
+	dir, err := clientCertDir(secret.ClientCert, secret.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate for %s: %w", secret.DestRegistry, err)
+	}
+	sys.DockerCertPath = dir
+	return sys, nil
+}
+
+// clientCertDir returns a directory laid out like
+// /etc/containers/certs.d/<host>, the only way containers/image takes client
+// certificates: a .cert file and the .key file of the same name. It links to
+// certFile and keyFile, which are checked to form a pair first, so rotated
+// certificates are picked up by the next copy.
+func clientCertDir(certFile, keyFile string) (string, error) {
+	if certFile == "" || keyFile == "" {
+		return "", fmt.Errorf("client_cert and client_key must be set together")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return "", err
+	}
+	certFile, err := filepath.Abs(certFile)
+	if err != nil {
+		return "", err
+	}
+	keyFile, err = filepath.Abs(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	clientCertDirsMu.Lock()
+	defer clientCertDirsMu.Unlock()
+	key := certFile + "\x00" + keyFile
+	if dir, ok := clientCertDirs[key]; ok {
+		return dir, nil
+	}
+	// Named after the pair, so runs reuse the directory rather than leaving
+	// one behind each
+	sum := sha256.Sum256([]byte(key))
+	dir := filepath.Join(os.TempDir(), "registries-sync-certs-"+hex.EncodeToString(sum[:6]))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	for link, target := range map[string]string{"client.cert": certFile, "client.key": keyFile} {
+		link = filepath.Join(dir, link)
+		os.Remove(link)
+		if err := os.Symlink(target, link); err != nil {
+			return "", fmt.Errorf("failed to link %s: %w", target, err)
+		}
+	}
+	clientCertDirs[key] = dir
+	return dir, nil
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+
+	"registries-sync/pkg/config"
+)
+
+// ResolveSecretReferences replaces username and password values that
+// reference a cloud secret manager with the secret they point to:
+//
+//	awssm://<name or ARN>[#<json key>]
+//	gcpsm://<project>/<secret>[/<version>][#<json key>]
+//	azkv://<vault>/<secret>[#<json key>]
+//
+// The optional json key selects a field when the secret holds a JSON object.
+func ResolveSecretReferences(ctx context.Context, secrets *config.Secrets) error {
+	for i := range secrets.Secrets {
+		secret := &secrets.Secrets[i]
+		for _, value := range []*string{&secret.Username, &secret.Password} {
+			resolved, err := resolveSecretReference(ctx, *value)
+			if err != nil {
+				return fmt.Errorf("secret for %s: %w", secret.DestRegistry, err)
+			}
+			*value = resolved
+		}
+	}
+	return nil
+}
+
+// resolveSecretReference returns value unchanged unless it is a secret
+// manager reference.
+func resolveSecretReference(ctx context.Context, value string) (string, error) {
+	scheme, reference, ok := strings.Cut(value, "://")
+	if !ok {
+		return value, nil
+	}
+	reference, key, _ := strings.Cut(reference, "#")
+
+	var secret string
+	var err error
+	switch scheme {
+	case "awssm":
+		secret, err = getAWSSecret(ctx, reference)
+	case "gcpsm":
+		secret, err = getGCPSecret(ctx, reference)
+	case "azkv":
+		secret, err = getAzureSecret(ctx, reference)
+	default:
+		return value, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", value, err)
+	}
+	if key == "" {
+		return secret, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("failed to resolve %s: secret is not a JSON object", value)
+	}
+	field, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("failed to resolve %s: no string field %q", value, key)
+	}
+	return field, nil
+}
+
+// getAWSSecret reads a Secrets Manager secret with the default AWS credential
+// chain. The region is taken from the ARN, if given, or from the default AWS
+// configuration.
+func getAWSSecret(ctx context.Context, name string) (string, error) {
+	opts := []func(*awsconfig.LoadOptions) error{}
+	if parts := strings.Split(name, ":"); len(parts) > 3 && parts[0] == "arn" {
+		opts = append(opts, awsconfig.WithRegion(parts[3]))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return "", fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	if cfg.Region == "" {
+		return "", fmt.Errorf("no AWS region configured")
+	}
+
+	output, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		return "", err
+	}
+	if output.SecretString != nil {
+		return *output.SecretString, nil
+	}
+	return string(output.SecretBinary), nil
+}
+
+// getGCPSecret accesses a Secret Manager secret version, "latest" unless
+// given, with application default credentials.
+func getGCPSecret(ctx context.Context, reference string) (string, error) {
+	parts := strings.Split(reference, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", fmt.Errorf("expected gcpsm://<project>/<secret>[/<version>]")
+	}
+	version := "latest"
+	if len(parts) == 3 {
+		version = parts[2]
+	}
+
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to create Secret Manager client: %w", err)
+	}
+	defer client.Close()
+	response, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/%s", parts[0], parts[1], version),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(response.GetPayload().GetData()), nil
+}
+
+// getAzureSecret reads a Key Vault secret with the default Azure credential
+// chain.
+func getAzureSecret(ctx context.Context, reference string) (string, error) {
+	vault, name, ok := strings.Cut(reference, "/")
+	if !ok || vault == "" || name == "" {
+		return "", fmt.Errorf("expected azkv://<vault>/<secret>")
+	}
+
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create Azure credential: %w", err)
+	}
+	client, err := azsecrets.NewClient(fmt.Sprintf("https://%s.vault.azure.net", vault), credential, nil)
+	if err != nil {
+		return "", err
+	}
+	// An empty version reads the current one
+	response, err := client.GetSecret(ctx, name, "", nil)
+	if err != nil {
+		return "", err
+	}
+	if response.Value == nil {
+		return "", nil
+	}
+	return *response.Value, nil
+}
+
+// getAzureToken returns an access token for resource from the default Azure
+// credential chain: the AZURE_* service principal, workload identity, the
+// managed identity and the Azure CLI, in that order.
+func getAzureToken(ctx context.Context, resource string) (string, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create Azure credential: %w", err)
+	}
+	token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{resource + "/.default"}})
+	if err != nil {
+		return "", fmt.Errorf("failed to get Azure token: %w", err)
+	}
+	return token.Token, nil
+}
+
+func doSecretRequest(req *http.Request, out interface{}) error {
+	return doSecretRequestWith(http.DefaultClient, req, out)
+}
+
+// doSecretRequestWith sends req and decodes the JSON response into out.
+func doSecretRequestWith(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// GitHub answers 201 Created with a new token
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,74 @@
+// Package auth resolves the credentials used to talk to registries, from
+// secrets.yaml, Vault, cloud secret managers or service account keys.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"slices"
+
+	"github.com/containers/image/v5/types"
+	"golang.org/x/oauth2/google"
+
+	"registries-sync/pkg/config"
+)
+
+// SecretFor returns the secret configured for pushing to registry, or an
+// empty secret when there is none.
+func SecretFor(registry string, secrets []config.SecretConfig) config.SecretConfig {
+	return SecretForRole(registry, config.RolePush, secrets)
+}
+
+// SecretForRole returns the secret of registry for role. Registries are
+// compared normalized, so "Registry.internal:443" matches
+// "registry.internal", and a secret for a host also applies to path prefixes
+// such as "registry.internal:5000/team" that have no secret of their own.
+// Among the secrets of the most specific registry, the one with that role
+// wins, else the one without a role. Reading falls back to the push secret,
+// pushing never uses a pull secret. The secret is empty when there is none.
+func SecretForRole(registry, role string, secrets []config.SecretConfig) config.SecretConfig {
+	preferences := []string{role, ""}
+	if role == config.RolePull {
+		preferences = append(preferences, config.RolePush)
+	}
+	best, bestLength, bestPreference := config.SecretConfig{}, 0, len(preferences)
+	for _, secret := range secrets {
+		length := config.RegistryMatches(secret.DestRegistry, registry)
+		preference := slices.Index(preferences, secret.Role)
+		if length == 0 || preference < 0 {
+			continue
+		}
+		if length > bestLength || (length == bestLength && preference < bestPreference) {
+			best, bestLength, bestPreference = secret, length, preference
+		}
+	}
+	return best
+}
+
+// GoogleToken exchanges a service account key for an OAuth access token.
+func GoogleToken(serviceAccountKeyPath string, scopes ...string) (string, error) {
+	data, err := ioutil.ReadFile(serviceAccountKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account key file: %w", err)
+	}
+
+	conf, err := google.JWTConfigFromJSON(data, scopes...)
+	if err != nil {
+		return "", fmt.Errorf("failed to create JWT config from JSON: %w", err)
+	}
+
+	// Get the token from the JWT config
+	token, err := conf.TokenSource(context.Background()).Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve OAuth token: %w", err)
+	}
+
+	return token.AccessToken, nil
+}
+
+// SystemContext builds the system context used to talk to a registry with
+// the given credentials. Empty credentials mean anonymous access.
+func SystemContext(credentials types.DockerAuthConfig) *types.SystemContext {
+	return &types.SystemContext{DockerAuthConfig: &credentials}
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"testing"
+
+	"registries-sync/pkg/config"
+)
+
+func TestSecretForRole(t *testing.T) {
+	secrets := []config.SecretConfig{
+		{DestRegistry: "registry.internal", Username: "default-port"},
+		{DestRegistry: "registry.internal:5000", Username: "host"},
+		{DestRegistry: "registry.internal:5000/team", Username: "team"},
+		{DestRegistry: "registry.internal:5000/team/app", Username: "app"},
+		{DestRegistry: "harbor.internal", Role: config.RolePull, Username: "reader"},
+		{DestRegistry: "harbor.internal", Role: config.RolePush, Username: "writer"},
+		{DestRegistry: "harbor.internal/project", Username: "project"},
+		{DestRegistry: "push-only.internal", Role: config.RolePush, Username: "push-only"},
+		{DestRegistry: "pull-only.internal", Role: config.RolePull, Username: "pull-only"},
+		{DestRegistry: "index.docker.io", Username: "hub"},
+	}
+	for _, test := range []struct {
+		registry, role, want string
+	}{
+		{"registry.internal", config.RolePush, "default-port"},
+		{"REGISTRY.internal:443", config.RolePush, "default-port"},
+		{"https://registry.internal/", config.RolePull, "default-port"},
+		{"registry.internal:5000", config.RolePush, "host"},
+		{"registry.internal:5001", config.RolePush, ""},
+		{"registry.internal:5000/other", config.RolePush, "host"},
+		{"registry.internal:5000/team", config.RolePush, "team"},
+		{"registry.internal:5000/team/other", config.RolePush, "team"},
+		{"registry.internal:5000/team/app", config.RolePush, "app"},
+		{"registry.internal:5000/team/application", config.RolePush, "team"},
+		{"registry.internal:5000/teams", config.RolePush, "host"},
+		{"harbor.internal", config.RolePull, "reader"},
+		{"harbor.internal", config.RolePush, "writer"},
+		{"harbor.internal/other", config.RolePull, "reader"},
+		{"harbor.internal/project", config.RolePull, "project"},
+		{"harbor.internal/project", config.RolePush, "project"},
+		{"push-only.internal", config.RolePull, "push-only"},
+		{"pull-only.internal", config.RolePush, ""},
+		{"docker.io", config.RolePush, "hub"},
+		{"registry-1.docker.io/library", config.RolePull, "hub"},
+	} {
+		if got := SecretForRole(test.registry, test.role, secrets).Username; got != test.want {
+			t.Errorf("SecretForRole(%q, %q) = %q, want %q", test.registry, test.role, got, test.want)
+		}
+	}
+}
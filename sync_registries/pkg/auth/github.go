@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"golang.org/x/oauth2/jws"
+
+	"registries-sync/pkg/config"
+)
+
+// gitlabJobTokenUser is the username GitLab expects with CI job tokens.
+const gitlabJobTokenUser = "gitlab-ci-token"
+
+// gitlabProvider logs in to the GitLab container registry with a personal,
+// project or deploy token in the password, or the CI_JOB_TOKEN of the running
+// job without one. GitLab exchanges them for registry tokens itself.
+type gitlabProvider struct {
+	secret config.SecretConfig
+}
+
+func (p gitlabProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	if p.secret.Password != "" {
+		username := p.secret.Username
+		if username == "" {
+			username = gitlabJobTokenUser
+		}
+		return types.DockerAuthConfig{Username: username, Password: p.secret.Password}, nil
+	}
+	token := os.Getenv("CI_JOB_TOKEN")
+	if token == "" {
+		return types.DockerAuthConfig{}, fmt.Errorf("gitlab secret for %s has no password and CI_JOB_TOKEN is not set", registry)
+	}
+	return types.DockerAuthConfig{Username: gitlabJobTokenUser, Password: token}, nil
+}
+
+// ghcrProvider logs in to the GitHub container registry with the personal
+// access token in the password, or with an installation token of the
+// github_app.
+type ghcrProvider struct {
+	secret config.SecretConfig
+}
+
+func (p ghcrProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	if p.secret.GitHubApp == nil {
+		if p.secret.Password == "" {
+			return types.DockerAuthConfig{}, fmt.Errorf("ghcr secret for %s needs a password or a github_app", registry)
+		}
+		username := p.secret.Username
+		if username == "" {
+			// The registry only checks the token
+			username = "x-access-token"
+		}
+		return types.DockerAuthConfig{Username: username, Password: p.secret.Password}, nil
+	}
+	token, err := githubInstallationToken(ctx, p.secret.GitHubApp)
+	if err != nil {
+		return types.DockerAuthConfig{}, err
+	}
+	return types.DockerAuthConfig{Username: "x-access-token", Password: token}, nil
+}
+
+// githubInstallationToken signs a JWT as the App and exchanges it for an
+// installation token, valid for an hour.
+func githubInstallationToken(ctx context.Context, app *config.GitHubAppConfig) (string, error) {
+	key, err := readRSAPrivateKey(app.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to read GitHub App private key: %w", err)
+	}
+	// Backdated to allow for clock drift, GitHub rejects expiries over 10 minutes
+	now := time.Now()
+	assertion, err := jws.Encode(&jws.Header{Algorithm: "RS256", Typ: "JWT"}, &jws.ClaimSet{
+		Iss: app.AppID,
+		Iat: now.Add(-time.Minute).Unix(),
+		Exp: now.Add(9 * time.Minute).Unix(),
+	}, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %w", err)
+	}
+
+	apiURL := app.APIURL
+	if apiURL == "" {
+		apiURL = "https://api.github.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/app/installations/%d/access_tokens", strings.TrimSuffix(apiURL, "/"), app.InstallationID), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+assertion)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := doSecretRequest(req, &response); err != nil {
+		return "", fmt.Errorf("failed to get GitHub App installation token: %w", err)
+	}
+	return response.Token, nil
+}
+
+// readRSAPrivateKey reads a PKCS #1 or PKCS #8 PEM RSA key, as GitHub issues
+// them.
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an RSA key", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// AuthProvider supplies the credentials used to talk to a registry.
+type AuthProvider interface {
+	Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error)
+}
+
+// ProviderFactory creates the provider for a secret of the type it was
+// registered for.
+type ProviderFactory func(secret config.SecretConfig) AuthProvider
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]ProviderFactory{}
+)
+
+func init() {
+	Register("anonymous", func(config.SecretConfig) AuthProvider { return anonymousProvider{} })
+	Register("basic", func(secret config.SecretConfig) AuthProvider { return basicProvider{secret} })
+	Register("dockerconfig", func(secret config.SecretConfig) AuthProvider { return dockerConfigProvider{secret} })
+	Register("gcr", func(secret config.SecretConfig) AuthProvider { return gcrProvider{secret} })
+	Register("ecr", func(secret config.SecretConfig) AuthProvider { return ecrProvider{secret} })
+	Register("acr", func(secret config.SecretConfig) AuthProvider { return acrProvider{secret} })
+	Register("harbor", func(secret config.SecretConfig) AuthProvider { return harborProvider{secret} })
+	Register("gitlab", func(secret config.SecretConfig) AuthProvider { return gitlabProvider{secret} })
+	Register("ghcr", func(secret config.SecretConfig) AuthProvider { return ghcrProvider{secret} })
+	Register("artifactory", func(secret config.SecretConfig) AuthProvider { return artifactoryProvider{secret} })
+	Register("quay", func(secret config.SecretConfig) AuthProvider { return quayProvider{secret} })
+	Register("token", func(secret config.SecretConfig) AuthProvider { return tokenProvider{secret} })
+}
+
+// Register makes a provider available for secrets with the given type,
+// replacing any provider already registered for it.
+func Register(secretType string, factory ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[secretType] = factory
+}
+
+// NewProvider returns the provider registered for the type of secret. Secrets
+// of other types use their username and password when set, and the docker
+// config otherwise.
+func NewProvider(secret config.SecretConfig) AuthProvider {
+	providersMu.RLock()
+	factory, ok := providers[secret.Type]
+	providersMu.RUnlock()
+	if ok {
+		return factory(secret)
+	}
+	if secret.Username != "" {
+		return basicProvider{secret}
+	}
+	return dockerConfigProvider{secret}
+}
+
+// ResolveCredentials returns the credentials for registry described by
+// secret. Vault references are read first, so every provider sees the
+// username and password stored there.
+func ResolveCredentials(ctx context.Context, registry string, secret config.SecretConfig) (types.DockerAuthConfig, error) {
+	if secret.Vault != nil {
+		var err error
+		secret, err = resolveVaultSecret(ctx, secret)
+		if err != nil {
+			return types.DockerAuthConfig{}, err
+		}
+	}
+	return NewProvider(secret).Resolve(ctx, registry)
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	dockerconfig "github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+	"golang.org/x/oauth2/google"
+
+	"registries-sync/pkg/config"
+)
+
+// anonymousProvider sends no credentials, not even those in the docker config.
+type anonymousProvider struct{}
+
+func (anonymousProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	return types.DockerAuthConfig{}, nil
+}
+
+// basicProvider uses the username and password of the secret as they are.
+type basicProvider struct {
+	secret config.SecretConfig
+}
+
+func (p basicProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	return types.DockerAuthConfig{Username: p.secret.Username, Password: p.secret.Password}, nil
+}
+
+// dockerConfigProvider looks the registry up in auth_file, or in the files and
+// credential helpers podman and docker use when it is not set.
+type dockerConfigProvider struct {
+	secret config.SecretConfig
+}
+
+func (p dockerConfigProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	credentials, err := dockerconfig.GetCredentials(&types.SystemContext{AuthFilePath: p.secret.AuthFile}, registry)
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("failed to read docker config: %w", err)
+	}
+	return credentials, nil
+}
+
+// harborProvider logs in with the robot account of the secret, and otherwise
+// like secrets without a type.
+type harborProvider struct {
+	secret config.SecretConfig
+}
+
+func (p harborProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	if robot := p.secret.Robot; robot != nil {
+		password := robot.Secret
+		if password == "" {
+			password = p.secret.Password
+		}
+		return types.DockerAuthConfig{Username: robot.Username(), Password: password}, nil
+	}
+	if p.secret.Username != "" {
+		return basicProvider{p.secret}.Resolve(ctx, registry)
+	}
+	return dockerConfigProvider{p.secret}.Resolve(ctx, registry)
+}
+
+// quayProvider logs in to Quay with a robot account, named <org>+<robot>,
+// or with an OAuth application token in the password and no username.
+type quayProvider struct {
+	secret config.SecretConfig
+}
+
+func (p quayProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	switch {
+	case p.secret.Username != "":
+		return basicProvider{p.secret}.Resolve(ctx, registry)
+	case p.secret.Password != "":
+		// Quay's fixed username for OAuth tokens
+		return types.DockerAuthConfig{Username: "$oauthtoken", Password: p.secret.Password}, nil
+	}
+	return dockerConfigProvider{p.secret}.Resolve(ctx, registry)
+}
+
+// tokenProvider uses a pre-generated token instead of a password: an
+// identity token, the OAuth2 refresh token exchanged at the token endpoint of
+// the registry, or a registry token sent as the bearer token as it is, which
+// SecretSystemContext sets.
+type tokenProvider struct {
+	secret config.SecretConfig
+}
+
+func (p tokenProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	identityToken := p.secret.IdentityToken
+	if identityToken == "" {
+		// e.g. read from Vault
+		identityToken = p.secret.Password
+	}
+	if identityToken == "" && p.secret.RegistryToken == "" {
+		return types.DockerAuthConfig{}, fmt.Errorf("token secret for %s has no identity_token, registry_token or password", registry)
+	}
+	return types.DockerAuthConfig{Username: p.secret.Username, IdentityToken: identityToken}, nil
+}
+
+// gcrProvider exchanges the service account key for an access token. Without
+// a key it falls back to the username and password, and then to the
+// application default credentials.
+type gcrProvider struct {
+	secret config.SecretConfig
+}
+
+func (p gcrProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	const scope = "https://www.googleapis.com/auth/devstorage.read_write"
+	switch {
+	case p.secret.ServiceAccountKey != "":
+		token, err := GoogleToken(p.secret.ServiceAccountKey, scope)
+		if err != nil {
+			return types.DockerAuthConfig{}, fmt.Errorf("failed to get GCR token: %w", err)
+		}
+		return types.DockerAuthConfig{Username: "oauth2accesstoken", Password: token}, nil
+	case p.secret.Username != "":
+		return basicProvider{p.secret}.Resolve(ctx, registry)
+	}
+
+	tokenSource, err := google.DefaultTokenSource(ctx, scope)
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("failed to find application default credentials: %w", err)
+	}
+	token, err := tokenSource.Token()
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("failed to get GCR token: %w", err)
+	}
+	return types.DockerAuthConfig{Username: "oauth2accesstoken", Password: token.AccessToken}, nil
+}
+
+// ecrProvider requests an authorization token from ECR with the default AWS
+// credentials, unless the secret has a username and password.
+type ecrProvider struct {
+	secret config.SecretConfig
+}
+
+func (p ecrProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	if p.secret.Username != "" {
+		return basicProvider{p.secret}.Resolve(ctx, registry)
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(ECRRegion(registry)))
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	output, err := ecr.NewFromConfig(cfg).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("failed to get ECR authorization token: %w", err)
+	}
+	if len(output.AuthorizationData) == 0 || output.AuthorizationData[0].AuthorizationToken == nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("ECR returned no authorization token")
+	}
+
+	// The token is base64 of "AWS:<password>"
+	decoded, err := base64.StdEncoding.DecodeString(*output.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("failed to decode ECR authorization token: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return types.DockerAuthConfig{}, fmt.Errorf("malformed ECR authorization token")
+	}
+	return types.DockerAuthConfig{Username: username, Password: password}, nil
+}
+
+// acrProvider uses the service principal in the username and password. Without
+// them it exchanges an Azure AD token from the default Azure credential chain
+// for an ACR refresh token.
+type acrProvider struct {
+	secret config.SecretConfig
+}
+
+func (p acrProvider) Resolve(ctx context.Context, registry string) (types.DockerAuthConfig, error) {
+	if p.secret.Username != "" {
+		return basicProvider{p.secret}.Resolve(ctx, registry)
+	}
+
+	token, err := getAzureToken(ctx, "https://management.azure.com")
+	if err != nil {
+		return types.DockerAuthConfig{}, err
+	}
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"access_token": {token},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://%s/oauth2/exchange", registry), strings.NewReader(form.Encode()))
+	if err != nil {
+		return types.DockerAuthConfig{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var response struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := doSecretRequest(req, &response); err != nil {
+		return types.DockerAuthConfig{}, fmt.Errorf("failed to exchange Azure token for an ACR token: %w", err)
+	}
+	// ACR expects this fixed username with refresh tokens
+	return types.DockerAuthConfig{Username: "00000000-0000-0000-0000-000000000000", Password: response.RefreshToken}, nil
+}
+
+// IsECR reports whether host is an ECR registry, such as
+// 123456789012.dkr.ecr.eu-central-1.amazonaws.com.
+func IsECR(host string) bool {
+	return strings.Contains(host, ".dkr.ecr.") && strings.Contains(host, ".amazonaws.com")
+}
+
+// ECRRegion extracts the region from an ECR registry host.
+func ECRRegion(host string) string {
+	parts := strings.Split(host, ".")
+	for i, part := range parts {
+		if part == "ecr" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
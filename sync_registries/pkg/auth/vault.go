@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"registries-sync/internal/rest"
+	"registries-sync/pkg/config"
+)
+
+const kubernetesServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultTokenRenewBefore is how long before its lease ends a cached Vault
+// token is replaced by logging in again, at most half of the lease.
+const vaultTokenRenewBefore = time.Minute
+
+// vaultTokens caches the tokens obtained by logging in, keyed by address and
+// auth settings, so a run logs in once per Vault rather than once per secret.
+var vaultTokens sync.Map // of vaultToken
+
+// vaultToken is a token obtained by logging in, used until renew, or
+// indefinitely when that is zero.
+type vaultToken struct {
+	token string
+	renew time.Time
+}
+
+func (t vaultToken) valid() bool {
+	return t.renew.IsZero() || time.Now().Before(t.renew)
+}
+
+// resolveVaultSecret reads the username and password of secret from Vault.
+func resolveVaultSecret(ctx context.Context, secret config.SecretConfig) (config.SecretConfig, error) {
+	cfg := secret.Vault
+	address := cfg.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return secret, fmt.Errorf("no Vault address, set vault.address or VAULT_ADDR")
+	}
+	address = strings.TrimSuffix(address, "/")
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+
+	token, err := vaultLogin(ctx, address, namespace, cfg.Auth)
+	if err != nil {
+		return secret, err
+	}
+
+	status, body, err := rest.DoJSON(ctx, http.MethodGet, address+"/v1/"+strings.TrimPrefix(cfg.Path, "/"), nil, vaultAuth(token, namespace))
+	if err == nil && status == http.StatusForbidden && forgetVaultToken(address, namespace, cfg.Auth) {
+		// The token was revoked or its lease ended early, log in again once
+		if token, err = vaultLogin(ctx, address, namespace, cfg.Auth); err != nil {
+			return secret, err
+		}
+		status, body, err = rest.DoJSON(ctx, http.MethodGet, address+"/v1/"+strings.TrimPrefix(cfg.Path, "/"), nil, vaultAuth(token, namespace))
+	}
+	if err != nil {
+		return secret, fmt.Errorf("failed to read Vault secret %s: %w", cfg.Path, err)
+	}
+	if status != http.StatusOK {
+		return secret, fmt.Errorf("unexpected status %d reading Vault secret %s: %s", status, cfg.Path, body)
+	}
+
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return secret, fmt.Errorf("invalid response for Vault secret %s: %w", cfg.Path, err)
+	}
+	data := response.Data
+	// KV v2 nests the secret under data.data next to data.metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	usernameField, passwordField := cfg.UsernameField, cfg.PasswordField
+	if usernameField == "" {
+		usernameField = "username"
+	}
+	if passwordField == "" {
+		passwordField = "password"
+	}
+	password, ok := data[passwordField].(string)
+	if !ok {
+		return secret, fmt.Errorf("Vault secret %s has no field %q", cfg.Path, passwordField)
+	}
+	if username, ok := data[usernameField].(string); ok {
+		secret.Username = username
+	} else if secret.Username == "" {
+		return secret, fmt.Errorf("Vault secret %s has no field %q", cfg.Path, usernameField)
+	}
+	secret.Password = password
+	return secret, nil
+}
+
+// vaultTokenKey is the key of the tokens of auth in vaultTokens.
+func vaultTokenKey(address, namespace string, auth config.VaultAuthConfig) string {
+	return strings.Join([]string{address, namespace, auth.Method, auth.Mount, auth.RoleID, auth.Role}, "|")
+}
+
+// forgetVaultToken drops the cached login token of auth, and reports whether
+// there was one.
+func forgetVaultToken(address, namespace string, auth config.VaultAuthConfig) bool {
+	_, ok := vaultTokens.LoadAndDelete(vaultTokenKey(address, namespace, auth))
+	return ok
+}
+
+// vaultLogin returns a Vault token for auth, logging in if needed: when
+// there is no cached token or its lease is about to end.
+func vaultLogin(ctx context.Context, address, namespace string, auth config.VaultAuthConfig) (string, error) {
+	method := auth.Method
+	if method == "" {
+		method = "token"
+	}
+	if method == "token" {
+		if auth.Token != "" {
+			return auth.Token, nil
+		}
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("no Vault token, set vault.auth.token or VAULT_TOKEN")
+	}
+
+	key := vaultTokenKey(address, namespace, auth)
+	if token, ok := vaultTokens.Load(key); ok && token.(vaultToken).valid() {
+		return token.(vaultToken).token, nil
+	}
+
+	mount := auth.Mount
+	if mount == "" {
+		mount = method
+	}
+	var payload map[string]string
+	switch method {
+	case "approle":
+		payload = map[string]string{"role_id": auth.RoleID, "secret_id": auth.SecretID}
+	case "kubernetes":
+		jwtPath := auth.JWTPath
+		if jwtPath == "" {
+			jwtPath = kubernetesServiceAccountToken
+		}
+		jwt, err := ioutil.ReadFile(jwtPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read service account token: %w", err)
+		}
+		payload = map[string]string{"role": auth.Role, "jwt": strings.TrimSpace(string(jwt))}
+	default:
+		return "", fmt.Errorf("unknown Vault auth method %q, expected token, approle or kubernetes", method)
+	}
+
+	status, body, err := rest.DoJSON(ctx, http.MethodPost, fmt.Sprintf("%s/v1/auth/%s/login", address, mount), payload, vaultAuth("", namespace))
+	if err != nil {
+		return "", fmt.Errorf("failed to log in to Vault: %w", err)
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d logging in to Vault: %s", status, body)
+	}
+	var response struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"` // Seconds, 0 for tokens that don't expire
+		} `json:"auth"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Auth.ClientToken == "" {
+		return "", fmt.Errorf("invalid Vault login response: %s", body)
+	}
+
+	token := vaultToken{token: response.Auth.ClientToken}
+	if response.Auth.LeaseDuration > 0 {
+		lease := time.Duration(response.Auth.LeaseDuration) * time.Second
+		token.renew = time.Now().Add(lease - min(vaultTokenRenewBefore, lease/2))
+	}
+	vaultTokens.Store(key, token)
+	return token.token, nil
+}
+
+func vaultAuth(token, namespace string) func(*http.Request) {
+	return func(req *http.Request) {
+		if token != "" {
+			req.Header.Set("X-Vault-Token", token)
+		}
+		if namespace != "" {
+			req.Header.Set("X-Vault-Namespace", namespace)
+		}
+	}
+}
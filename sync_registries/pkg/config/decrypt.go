@@ -0,0 +1,100 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReadFile reads a configuration or secrets file, decrypting it when
+// it is SOPS or age encrypted, and expands environment variable references.
+func ReadFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case isAgeEncrypted(data):
+		data, err = decryptAge(filename)
+	case isSOPSEncrypted(data):
+		data, err = decryptSOPS(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return expandEnv(data)
+}
+
+// isSOPSEncrypted reports whether data is a YAML document encrypted by SOPS,
+// which adds a top-level "sops" key holding the metadata.
+func isSOPSEncrypted(data []byte) bool {
+	var document struct {
+		SOPS *struct {
+			MAC string `yaml:"mac"`
+		} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return false
+	}
+	return document.SOPS != nil && document.SOPS.MAC != ""
+}
+
+func isAgeEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("age-encryption.org/")) ||
+		bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN AGE ENCRYPTED FILE-----"))
+}
+
+// decryptSOPS runs "sops --decrypt". SOPS finds its keys itself: age keys via
+// SOPS_AGE_KEY_FILE or SOPS_AGE_KEY, PGP keys from the keyring, and AWS KMS,
+// GCP KMS, Azure Key Vault or Vault transit through their usual credentials.
+func decryptSOPS(filename string) ([]byte, error) {
+	sops := os.Getenv("SOPS_PATH")
+	if sops == "" {
+		sops = "sops"
+	}
+	output, err := runDecrypt(exec.Command(sops, "--decrypt", "--input-type", "yaml", "--output-type", "yaml", filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s with sops: %w", filename, err)
+	}
+	return output, nil
+}
+
+// decryptAge runs "age --decrypt" with the identity in SOPS_AGE_KEY_FILE, or
+// in SOPS' default key location, so the same key file serves both formats.
+func decryptAge(filename string) ([]byte, error) {
+	identity := os.Getenv("SOPS_AGE_KEY_FILE")
+	if identity == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate age key file, set SOPS_AGE_KEY_FILE: %w", err)
+		}
+		identity = filepath.Join(configDir, "sops", "age", "keys.txt")
+	}
+	age := os.Getenv("AGE_PATH")
+	if age == "" {
+		age = "age"
+	}
+	output, err := runDecrypt(exec.Command(age, "--decrypt", "--identity", identity, filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s with age: %w", filename, err)
+	}
+	return output, nil
+}
+
+func runDecrypt(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RegistryDefaults holds the settings of the defaults section, inherited by
+// every registry entry that doesn't set them itself. An entry overrides a
+// default by setting the key, even to 0 or an empty list.
+type RegistryDefaults struct {
+	TagLimit        int      `yaml:"tag_limit,omitempty"`
+	ExcludePatterns []string `yaml:"exclude_patterns,omitempty"`
+	IncludePatterns []string `yaml:"include_patterns,omitempty"`
+	ParallelLayers  int      `yaml:"parallel_layers,omitempty"` // Layers of an image copied at the same time
+	CopyTimeout     string   `yaml:"copy_timeout,omitempty"`
+	MaxBandwidth    string   `yaml:"max_bandwidth,omitempty"`
+	IfExists        string   `yaml:"if_exists,omitempty"`
+}
+
+// entry returns a registry entry holding the defaults.
+func (d *RegistryDefaults) entry() RegistryConfig {
+	return RegistryConfig{
+		TagLimit:        d.TagLimit,
+		ExcludePatterns: slices.Clone(d.ExcludePatterns),
+		IncludePatterns: slices.Clone(d.IncludePatterns),
+		ParallelLayers:  d.ParallelLayers,
+		CopyTimeout:     d.CopyTimeout,
+		MaxBandwidth:    d.MaxBandwidth,
+		IfExists:        d.IfExists,
+	}
+}
+
+// applyDefaults decodes the registry entries of data again on top of the
+// defaults, so the keys an entry sets replace them and the others are
+// inherited.
+func applyDefaults(config *Config, data []byte) error {
+	if config.Defaults == nil {
+		return nil
+	}
+	var raw struct {
+		Registries []yaml.Node `yaml:"registries"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for i := range raw.Registries {
+		registry := config.Defaults.entry()
+		if err := raw.Registries[i].Decode(&registry); err != nil {
+			return fmt.Errorf("registry entry %d: %w", i+1, err)
+		}
+		config.Registries[i] = registry
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFiles lists the *.yaml files of dir in name order, the files LoadDir
+// merges.
+func ConfigFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.yaml files in %s", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// LoadDir reads every *.yaml file of dir like Load and merges them into one
+// configuration, e.g. one file per team. The registry entries of all files
+// are synced in file name order, and the defaults of a file only apply to its
+// own entries. Any other setting may only be set in one file, and entries of
+// different files may not push to the same destination repository.
+func LoadDir(dir string) (*Config, error) {
+	files, err := ConfigFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loading configuration from %d files in %s", len(files), dir)
+
+	merged := &Config{}
+	registries := []RegistryConfig{}
+	settings := map[string]string{}     // Setting to the file setting it
+	destinations := map[string]string{} // Destination repository to the file pushing to it
+	for _, file := range files {
+		data, err := ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		var keys map[string]yaml.Node
+		if err := yaml.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for key := range keys {
+			if key == "registries" || key == "defaults" {
+				continue
+			}
+			if other, ok := settings[key]; ok {
+				return nil, fmt.Errorf("%s is set in both %s and %s, it may only be set in one file", key, other, file)
+			}
+			settings[key] = file
+		}
+		// Only keys of the file are decoded, which no other file sets
+		if err := yaml.Unmarshal(data, merged); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		fileDestinations := map[string]bool{}
+		for _, registry := range cfg.Registries {
+			for _, dest := range registry.AllDestinations() {
+				key := strings.ToLower(dest.String())
+				if other, ok := destinations[key]; ok && other != file {
+					return nil, fmt.Errorf("%s/%s in %s pushes to %s, which %s pushes to as well", registry.SourceRegistry, registry.SourceRepository, file, dest, other)
+				}
+				fileDestinations[key] = true
+			}
+		}
+		for key := range fileDestinations {
+			destinations[key] = file
+		}
+		registries = append(registries, cfg.Registries...)
+	}
+	merged.Registries = registries
+	merged.Defaults = nil // Applied to the entries of each file
+	mapArtifactoryRepositories(merged)
+
+	return merged, nil
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${NAME} with the value of the environment variable NAME,
+// or with default for ${NAME:-default} when NAME is unset or empty. Bare $NAME
+// is left alone. Referencing an unset variable without a default is an error,
+// so a missing CI secret isn't silently turned into an empty password.
+//
+// References are expanded in the scalar values of the parsed document, not
+// in its text, so a value holding "#", ": ", quotes or newlines stays a
+// single value, and references in comments and keys are ignored.
+func expandEnv(data []byte) ([]byte, error) {
+	if !envReference.Match(data) {
+		return data, nil
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	expandNode(&document, &missing)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("undefined environment variables: %s", strings.Join(missing, ", "))
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// expandNode expands the references in the scalar values below node,
+// collecting the unset variables in missing. Aliases are expanded where
+// their anchor is.
+func expandNode(node *yaml.Node, missing *[]string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		expanded := expandValue(node.Value, missing)
+		if expanded == node.Value {
+			return
+		}
+		node.Value = expanded
+		if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 && node.Tag == "!!str" {
+			// An unquoted reference takes the type of its value, e.g.
+			// port: ${PORT} is a number
+			node.Tag = ""
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			expandNode(node.Content[i], missing)
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			expandNode(child, missing)
+		}
+	}
+}
+
+func expandValue(value string, missing *[]string) string {
+	return envReference.ReplaceAllStringFunc(value, func(match string) string {
+		groups := envReference.FindStringSubmatch(match)
+		name := groups[1]
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		if _, ok := os.LookupEnv(name); !ok {
+			*missing = append(*missing, name)
+		}
+		return ""
+	})
+}
@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("SYNC_TEST_PASSWORD", "s3cr#t: 'x'")
+	t.Setenv("SYNC_TEST_PORT", "5000")
+	t.Setenv("SYNC_TEST_EMPTY", "")
+	for _, test := range []struct {
+		data, want string
+		wantErr    bool
+	}{
+		{"password: plain\n", "password: plain\n", false},
+		{"password: ${SYNC_TEST_PASSWORD}\n", "password: 's3cr#t: ''x'''\n", false},
+		{"url: https://${SYNC_TEST_HOST:-registry.internal}/v2\n", "url: https://registry.internal/v2\n", false},
+		{"value: ${SYNC_TEST_EMPTY:-fallback}\n", "value: fallback\n", false},
+		{"value: \"${SYNC_TEST_EMPTY}\"\n", "value: \"\"\n", false},
+		{"port: ${SYNC_TEST_PORT}\n", "port: 5000\n", false},
+		{"port: \"${SYNC_TEST_PORT}\"\n", "port: \"5000\"\n", false},
+		{"value: $SYNC_TEST_PORT\n", "value: $SYNC_TEST_PORT\n", false},
+		{"# ${SYNC_TEST_UNSET}\nkey: value\n", "# ${SYNC_TEST_UNSET}\nkey: value\n", false},
+		{"list:\n  - ${SYNC_TEST_PORT}\n", "list:\n  - 5000\n", false},
+		{"password: ${SYNC_TEST_UNSET}\n", "", true},
+	} {
+		got, err := expandEnv([]byte(test.data))
+		if (err != nil) != test.wantErr {
+			t.Errorf("expandEnv(%q) error = %v, want error %t", test.data, err, test.wantErr)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", test.data, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// HooksConfig lists the hooks run around every registry entry sync and
+// every tag copy. Hooks of a phase run in order.
+type HooksConfig struct {
+	PreSync  []HookConfig `yaml:"pre_sync,omitempty"`  // Before an entry is synced, a failure fails the entry
+	PostSync []HookConfig `yaml:"post_sync,omitempty"` // After an entry was synced, whatever the result
+	PreCopy  []HookConfig `yaml:"pre_copy,omitempty"`  // Before a tag is copied, a failure fails the tag
+	PostCopy []HookConfig `yaml:"post_copy,omitempty"` // After a tag was copied, skipped or failed
+}
+
+// HookConfig is a command to run, or a URL the event is POSTed to as JSON.
+// Exactly one of them must be set.
+type HookConfig struct {
+	Command []string `yaml:"command,omitempty"` // Program and arguments, not run through a shell
+	URL     string   `yaml:"url,omitempty"`
+	Timeout string   `yaml:"timeout,omitempty"` // Defaults to "1m"
+}
+
+// Validate checks every hook of every phase.
+func (c *HooksConfig) Validate() error {
+	phases := []struct {
+		name  string
+		hooks []HookConfig
+	}{{"pre_sync", c.PreSync}, {"post_sync", c.PostSync}, {"pre_copy", c.PreCopy}, {"post_copy", c.PostCopy}}
+	for _, phase := range phases {
+		for i, hook := range phase.hooks {
+			if (len(hook.Command) == 0) == (hook.URL == "") {
+				return fmt.Errorf("hooks.%s[%d] requires either command or url", phase.name, i)
+			}
+			if hook.Timeout != "" {
+				if _, err := time.ParseDuration(hook.Timeout); err != nil {
+					return fmt.Errorf("hooks.%s[%d]: invalid timeout: %w", phase.name, i, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// NotifyConfig configures the notifications sent when a run finishes.
+type NotifyConfig struct {
+	Email *EmailConfig `yaml:"email,omitempty"`
+}
+
+// EmailConfig sends a summary of the run by email. Subject and Body are Go
+// templates rendered with the run report.
+type EmailConfig struct {
+	SMTPServer    string   `yaml:"smtp_server"` // host:port, STARTTLS is used when offered, port 465 uses TLS
+	Username      string   `yaml:"username,omitempty"`
+	Password      string   `yaml:"password,omitempty"`
+	From          string   `yaml:"from"`
+	To            []string `yaml:"to"`
+	Subject       string   `yaml:"subject,omitempty"` // Defaults to a one line summary
+	Body          string   `yaml:"body,omitempty"`    // Defaults to a summary of every registry entry
+	OnlyOnFailure bool     `yaml:"only_on_failure,omitempty"`
+}
+
+// Validate checks the email settings. The templates are parsed by the sync
+// package, which provides their functions.
+func (c *NotifyConfig) Validate() error {
+	email := c.Email
+	if email == nil {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(email.SMTPServer); err != nil {
+		return fmt.Errorf("notify.email.smtp_server must be host:port: %w", err)
+	}
+	if email.From == "" || len(email.To) == 0 {
+		return fmt.Errorf("notify.email requires from and to")
+	}
+	return nil
+}
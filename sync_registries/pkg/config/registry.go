@@ -0,0 +1,65 @@
+package config
+
+import "strings"
+
+// NormalizeRegistry returns registry, a host with an optional port and path
+// prefix such as "registry.internal:5000/prefix", in the form registries are
+// compared in: without a scheme or trailing slash, with a lowercase host,
+// without the default HTTPS port and with the Docker Hub aliases mapped to
+// docker.io.
+func NormalizeRegistry(registry string) string {
+	registry = strings.TrimSpace(registry)
+	for _, scheme := range []string{"https://", "http://"} {
+		if len(registry) >= len(scheme) && strings.EqualFold(registry[:len(scheme)], scheme) {
+			registry = registry[len(scheme):]
+			break
+		}
+	}
+	registry = strings.TrimRight(registry, "/")
+	host, prefix, hasPrefix := strings.Cut(registry, "/")
+	host = strings.TrimSuffix(strings.ToLower(host), ":443")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		host = "docker.io"
+	}
+	if hasPrefix {
+		return host + "/" + prefix
+	}
+	return host
+}
+
+// RegistryHost returns the normalized host[:port] of registry, without its
+// path prefix.
+func RegistryHost(registry string) string {
+	host, _, _ := strings.Cut(NormalizeRegistry(registry), "/")
+	return host
+}
+
+// ImagePath returns the normalized host/repository path of repository at
+// registry, so that repository "app" at "registry.internal:5000/prefix" is
+// the same as "prefix/app" at "registry.internal:5000". Docker Hub official
+// images get their implicit "library/" namespace.
+func ImagePath(registry, repository string) string {
+	path := NormalizeRegistry(registry) + "/" + strings.Trim(repository, "/")
+	host, repository, _ := strings.Cut(path, "/")
+	if host == "docker.io" && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return host + "/" + repository
+}
+
+// RegistryMatches reports whether a setting for pattern, such as the secret
+// of a registry, applies to registry: when both are the same registry, or
+// pattern is the host or a path prefix of registry. The result is the length
+// of the match, so the most specific pattern can be preferred, and 0 when
+// pattern doesn't apply.
+func RegistryMatches(pattern, registry string) int {
+	pattern, registry = NormalizeRegistry(pattern), NormalizeRegistry(registry)
+	if pattern == "" {
+		return 0
+	}
+	if registry == pattern || strings.HasPrefix(registry, pattern+"/") {
+		return len(pattern)
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package config
+
+import "testing"
+
+func TestNormalizeRegistry(t *testing.T) {
+	for _, test := range []struct {
+		registry, want string
+	}{
+		{"registry.internal", "registry.internal"},
+		{"Registry.Internal", "registry.internal"},
+		{"registry.internal:443", "registry.internal"},
+		{"https://registry.internal:443/", "registry.internal"},
+		{"HTTP://registry.internal:5000", "registry.internal:5000"},
+		{"registry.internal:5000", "registry.internal:5000"},
+		{"registry.internal:5000/Prefix/", "registry.internal:5000/Prefix"},
+		{"registry.internal:4430", "registry.internal:4430"},
+		{" docker.io ", "docker.io"},
+		{"index.docker.io", "docker.io"},
+		{"registry-1.docker.io", "docker.io"},
+		{"registry.hub.docker.com:443", "docker.io"},
+		{"", ""},
+	} {
+		if got := NormalizeRegistry(test.registry); got != test.want {
+			t.Errorf("NormalizeRegistry(%q) = %q, want %q", test.registry, got, test.want)
+		}
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	for _, test := range []struct {
+		registry, want string
+	}{
+		{"registry.internal:5000/prefix", "registry.internal:5000"},
+		{"Registry.internal:443/prefix", "registry.internal"},
+		{"index.docker.io/library", "docker.io"},
+	} {
+		if got := RegistryHost(test.registry); got != test.want {
+			t.Errorf("RegistryHost(%q) = %q, want %q", test.registry, got, test.want)
+		}
+	}
+}
+
+func TestImagePath(t *testing.T) {
+	for _, test := range []struct {
+		registry, repository, want string
+	}{
+		{"registry.internal:5000/prefix", "app", "registry.internal:5000/prefix/app"},
+		{"registry.internal:5000", "prefix/app", "registry.internal:5000/prefix/app"},
+		{"registry.internal:443", "/app/", "registry.internal/app"},
+		{"docker.io", "nginx", "docker.io/library/nginx"},
+		{"registry-1.docker.io", "library/nginx", "docker.io/library/nginx"},
+		{"docker.io", "bitnami/nginx", "docker.io/bitnami/nginx"},
+		{"registry.internal", "nginx", "registry.internal/nginx"},
+	} {
+		if got := ImagePath(test.registry, test.repository); got != test.want {
+			t.Errorf("ImagePath(%q, %q) = %q, want %q", test.registry, test.repository, got, test.want)
+		}
+	}
+}
+
+func TestRegistryMatches(t *testing.T) {
+	for _, test := range []struct {
+		pattern, registry string
+		want              int
+	}{
+		{"registry.internal", "registry.internal", len("registry.internal")},
+		{"registry.internal", "Registry.internal:443", len("registry.internal")},
+		{"https://registry.internal/", "registry.internal", len("registry.internal")},
+		{"registry.internal:5000", "registry.internal", 0},
+		{"registry.internal", "registry.internal:5000", 0},
+		{"registry.internal:5000", "registry.internal:5000/team", len("registry.internal:5000")},
+		{"registry.internal:5000/team", "registry.internal:5000/team/app", len("registry.internal:5000/team")},
+		{"registry.internal:5000/team", "registry.internal:5000", 0},
+		{"registry.internal:5000/pre", "registry.internal:5000/prefix", 0},
+		{"registry.internal:5000/prefix", "registry.internal:5000/pre", 0},
+		{"registry.internal", "registry.internal.example.com", 0},
+		{"index.docker.io", "docker.io/bitnami", len("docker.io")},
+		{"", "registry.internal", 0},
+	} {
+		if got := RegistryMatches(test.pattern, test.registry); got != test.want {
+			t.Errorf("RegistryMatches(%q, %q) = %d, want %d", test.pattern, test.registry, got, test.want)
+		}
+	}
+}
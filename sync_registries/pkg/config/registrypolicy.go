@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// RegistryPolicyConfig restricts the registries entries may pull from and push
+// to. Hosts are exact names or shell patterns such as "*.example.com". An empty
+// allow list allows every host that isn't denied.
+type RegistryPolicyConfig struct {
+	AllowedSources      []string `yaml:"allowed_sources,omitempty"`
+	DeniedSources       []string `yaml:"denied_sources,omitempty"`
+	AllowedDestinations []string `yaml:"allowed_destinations,omitempty"`
+	DeniedDestinations  []string `yaml:"denied_destinations,omitempty"`
+}
+
+// Validate checks the host patterns.
+func (c *RegistryPolicyConfig) Validate() error {
+	for _, patterns := range [][]string{c.AllowedSources, c.DeniedSources, c.AllowedDestinations, c.DeniedDestinations} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("registry_policy: invalid host pattern %q", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Check returns an error when registry pulls from, falls back to or pushes to
+// a host the policy doesn't allow. Local destinations aren't registries and
+// are always allowed.
+func (c *RegistryPolicyConfig) Check(registry RegistryConfig) error {
+	for _, source := range append([]string{registry.SourceRegistry}, registry.SourceFallbacks...) {
+		if !hostAllowed(source, c.AllowedSources, c.DeniedSources) {
+			return fmt.Errorf("source registry %s is not allowed by registry_policy", source)
+		}
+	}
+	for _, dest := range registry.AllDestinations() {
+		if !dest.Local() && !hostAllowed(dest.DestRegistry, c.AllowedDestinations, c.DeniedDestinations) {
+			return fmt.Errorf("destination registry %s is not allowed by registry_policy", dest.DestRegistry)
+		}
+	}
+	return nil
+}
+
+// hostAllowed matches the host of registry, which may carry a path prefix,
+// against the allow and deny lists.
+func hostAllowed(registry string, allowed, denied []string) bool {
+	host := RegistryHost(registry)
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(denied) {
+		return false
+	}
+	return len(allowed) == 0 || matches(allowed)
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScanConfig configures the vulnerability scan that gates every copy.
+type ScanConfig struct {
+	Scanner       string `yaml:"scanner,omitempty"`        // "trivy" (default) or "grype"
+	Severity      string `yaml:"severity,omitempty"`       // Lowest severity that blocks a copy, defaults to HIGH
+	Action        string `yaml:"action,omitempty"`         // "skip" (default) reports the image, "fail" fails the copy
+	IgnoreUnfixed bool   `yaml:"ignore_unfixed,omitempty"` // Ignore vulnerabilities without a fix
+	ScannerPath   string `yaml:"scanner_path,omitempty"`   // Defaults to the scanner name on the PATH
+}
+
+var severityRanks = map[string]int{
+	"UNKNOWN":    0,
+	"NEGLIGIBLE": 1,
+	"LOW":        2,
+	"MEDIUM":     3,
+	"HIGH":       4,
+	"CRITICAL":   5,
+}
+
+// Validate checks the scanner, severity and action.
+func (c *ScanConfig) Validate() error {
+	switch c.Scanner {
+	case "", "trivy", "grype":
+	default:
+		return fmt.Errorf("unsupported scanner %q", c.Scanner)
+	}
+	if _, ok := severityRanks[strings.ToUpper(c.Threshold())]; !ok {
+		return fmt.Errorf("unsupported severity %q", c.Severity)
+	}
+	switch c.Action {
+	case "", "skip", "fail":
+	default:
+		return fmt.Errorf("unsupported scan action %q", c.Action)
+	}
+	return nil
+}
+
+// Threshold is the lowest severity that blocks a copy.
+func (c *ScanConfig) Threshold() string {
+	if c.Severity == "" {
+		return "HIGH"
+	}
+	return strings.ToUpper(c.Severity)
+}
+
+// Blocks reports whether a vulnerability of the given severity blocks a copy.
+func (c *ScanConfig) Blocks(severity string) bool {
+	return severityRanks[strings.ToUpper(severity)] >= severityRanks[c.Threshold()]
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// SignConfig configures cosign signing of pushed images. Exactly one of Key
+// or Keyless must be set.
+type SignConfig struct {
+	Key           string `yaml:"key,omitempty"`            // Key file or KMS URI (awskms://, gcpkms://, azurekms://, hashivault://)
+	Keyless       bool   `yaml:"keyless,omitempty"`        // Sign with a Fulcio certificate obtained through OIDC
+	IdentityToken string `yaml:"identity_token,omitempty"` // OIDC token, or path to a file holding it, for keyless signing
+	TlogUpload    *bool  `yaml:"tlog_upload,omitempty"`    // Upload to the Rekor transparency log, defaults to true
+	CosignPath    string `yaml:"cosign_path,omitempty"`    // Defaults to "cosign" on the PATH
+}
+
+// Validate checks that exactly one signing mode is configured.
+func (c *SignConfig) Validate() error {
+	if c.Key != "" && c.Keyless {
+		return fmt.Errorf("sign.key and sign.keyless are mutually exclusive")
+	}
+	if c.Key == "" && !c.Keyless {
+		return fmt.Errorf("sign requires either key or keyless")
+	}
+	return nil
+}
+
+// VerifySignaturesConfig configures the pass that checks, after every sync
+// of an entry, that all images at its destinations have a cosign signature
+// satisfying the policy. Exactly one of Key or the certificate identity and
+// issuer must be set.
+type VerifySignaturesConfig struct {
+	Key                         string `yaml:"key,omitempty"`                            // Public key file or KMS URI the images are signed with
+	CertificateIdentity         string `yaml:"certificate_identity,omitempty"`           // Keyless: identity of the signing certificate, e.g. a workflow URL
+	CertificateIdentityRegexp   string `yaml:"certificate_identity_regexp,omitempty"`    // Keyless: regular expression instead of certificate_identity
+	CertificateOIDCIssuer       string `yaml:"certificate_oidc_issuer,omitempty"`        // Keyless: OIDC issuer of the signing certificate
+	CertificateOIDCIssuerRegexp string `yaml:"certificate_oidc_issuer_regexp,omitempty"` // Keyless: regular expression instead of certificate_oidc_issuer
+	Delete                      bool   `yaml:"delete,omitempty"`                         // Delete images failing verification from the destination
+	DryRun                      bool   `yaml:"dry_run,omitempty"`                        // With delete, only log the images that would be deleted
+	MaxDeletes                  int    `yaml:"max_deletes,omitempty"`                    // Images deleted per pass at most, defaults to 10
+	CosignPath                  string `yaml:"cosign_path,omitempty"`                    // Defaults to "cosign" on the PATH
+}
+
+// Validate checks that either a key or a certificate identity and issuer are
+// configured.
+func (c *VerifySignaturesConfig) Validate() error {
+	keyless := c.CertificateIdentity != "" || c.CertificateIdentityRegexp != "" || c.CertificateOIDCIssuer != "" || c.CertificateOIDCIssuerRegexp != ""
+	if c.Key != "" && keyless {
+		return fmt.Errorf("verify_signatures.key and the certificate settings are mutually exclusive")
+	}
+	if c.MaxDeletes < 0 {
+		return fmt.Errorf("verify_signatures.max_deletes must not be negative")
+	}
+	if c.Key != "" {
+		return nil
+	}
+	if c.CertificateIdentity == "" && c.CertificateIdentityRegexp == "" {
+		return fmt.Errorf("verify_signatures requires either key or certificate_identity (or certificate_identity_regexp)")
+	}
+	if c.CertificateOIDCIssuer == "" && c.CertificateOIDCIssuerRegexp == "" {
+		return fmt.Errorf("verify_signatures requires certificate_oidc_issuer (or certificate_oidc_issuer_regexp) with a certificate identity")
+	}
+	for _, pattern := range []string{c.CertificateIdentityRegexp, c.CertificateOIDCIssuerRegexp} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid verify_signatures regular expression %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// skopeoRegistry is a registry of a `skopeo sync --src yaml` file.
+type skopeoRegistry struct {
+	Images           map[string][]string `yaml:"images"`              // Repository to tags and digests, all tags when empty
+	ImagesByTagRegex map[string]string   `yaml:"images-by-tag-regex"` // Repository to a tag regex
+	ImagesBySemver   map[string]string   `yaml:"images-by-semver"`
+	Credentials      *SourceCredentials  `yaml:"credentials"`
+	TLSVerify        *bool               `yaml:"tls-verify"`
+	CertDir          string              `yaml:"cert-dir"`
+}
+
+// SkopeoDestination is where the images of a skopeo sync file are mirrored,
+// like the --dest and --scoped arguments of skopeo sync.
+type SkopeoDestination struct {
+	Dest   string // Registry and optional path prefix, e.g. "mirror.example.com/upstream"
+	Scoped bool   // Keep the source registry and full repository path under Dest
+}
+
+// LoadSkopeo reads a `skopeo sync --src yaml` file and converts it to
+// registry entries mirroring to dest. Encrypted files are decrypted and
+// ${ENV_VAR} references expanded as with Load.
+func LoadSkopeo(filename string, dest SkopeoDestination) (*Config, error) {
+	log.Printf("Loading skopeo sync configuration from file: %s", filename)
+	data, err := ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseSkopeo(data, dest)
+}
+
+// ParseSkopeo is LoadSkopeo for content read from elsewhere than a file.
+func ParseSkopeo(data []byte, dest SkopeoDestination) (*Config, error) {
+	data, err := expandEnv(data)
+	if err != nil {
+		return nil, err
+	}
+	return parseSkopeo(data, dest)
+}
+
+func parseSkopeo(data []byte, dest SkopeoDestination) (*Config, error) {
+	var registries map[string]skopeoRegistry
+	if err := yaml.Unmarshal(data, &registries); err != nil {
+		return nil, err
+	}
+	destRegistry, destPrefix, _ := strings.Cut(strings.TrimPrefix(dest.Dest, "docker://"), "/")
+	if destRegistry == "" {
+		return nil, fmt.Errorf("invalid skopeo destination %q, expected registry[/path]", dest.Dest)
+	}
+
+	var cfg Config
+	for _, host := range sortedKeys(registries) {
+		source := registries[host]
+		if len(source.ImagesBySemver) > 0 {
+			return nil, fmt.Errorf("registry %s: images-by-semver is not supported, use images-by-tag-regex", host)
+		}
+		entry := func(repository string) RegistryConfig {
+			repository = strings.Trim(repository, "/")
+			if (host == "docker.io" || host == "index.docker.io") && !strings.Contains(repository, "/") {
+				repository = "library/" + repository
+			}
+			// skopeo sync keeps only the last path component unless scoped
+			destRepository := path.Base(repository)
+			if dest.Scoped {
+				destRepository = path.Join(host, repository)
+			}
+			return RegistryConfig{
+				SourceRegistry:    host,
+				SourceRepository:  repository,
+				DestRegistry:      destRegistry,
+				DestRepository:    path.Join(destPrefix, destRepository),
+				SourceCredentials: source.Credentials,
+				SourceTLSVerify:   source.TLSVerify,
+				SourceCertDir:     source.CertDir,
+			}
+		}
+
+		for _, repository := range sortedKeys(source.Images) {
+			registry := entry(repository)
+			for _, reference := range source.Images[repository] {
+				if strings.Contains(reference, ":") {
+					registry.Digests = append(registry.Digests, DigestConfig{Digest: reference})
+				} else {
+					registry.Tags = append(registry.Tags, reference)
+				}
+			}
+			cfg.Registries = append(cfg.Registries, registry)
+		}
+		for _, repository := range sortedKeys(source.ImagesByTagRegex) {
+			registry := entry(repository)
+			registry.IncludePatterns = []string{source.ImagesByTagRegex[repository]}
+			cfg.Registries = append(cfg.Registries, registry)
+		}
+	}
+	return &cfg, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// TagFilterConfig selects a plugin narrowing down the tags listed from the
+// source of an entry, before the patterns and limits apply. Exactly one of
+// Command, Wasm and Name must be set.
+type TagFilterConfig struct {
+	// Command gets the entry and its tags as JSON on stdin and prints the
+	// tags to keep as a JSON array. Not run through a shell.
+	Command []string `yaml:"command,omitempty"`
+	// Wasm is a WebAssembly module, a WASI command with the input and
+	// output of Command, run sandboxed in-process.
+	Wasm string `yaml:"wasm,omitempty"`
+	// Name is a filter registered by a program embedding the sync engine.
+	Name    string `yaml:"name,omitempty"`
+	Timeout string `yaml:"timeout,omitempty"` // Defaults to "1m", commands and modules only
+}
+
+// Validate checks that exactly one plugin is selected and the timeout.
+func (c *TagFilterConfig) Validate() error {
+	selected := 0
+	for _, set := range []bool{len(c.Command) > 0, c.Wasm != "", c.Name != ""} {
+		if set {
+			selected++
+		}
+	}
+	if selected != 1 {
+		return fmt.Errorf("tag_filter requires exactly one of command, wasm or name")
+	}
+	if c.Timeout != "" {
+		if _, err := time.ParseDuration(c.Timeout); err != nil {
+			return fmt.Errorf("tag_filter: invalid timeout: %w", err)
+		}
+	}
+	return nil
+}
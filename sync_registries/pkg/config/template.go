@@ -0,0 +1,182 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// repositoryTemplateData holds the variables available to
+// dest_repository_template and templated values. For
+// registry.k8s.io/kube-state-metrics/kube-state-metrics SourceNamespace is
+// "kube-state-metrics" and SourceRepo "kube-state-metrics".
+type repositoryTemplateData struct {
+	SourceRegistry   string
+	SourceRepository string // Full repository path
+	SourceNamespace  string // Repository path without the last component
+	SourceRepo       string // Last component of the repository path
+}
+
+func newRepositoryTemplateData(sourceRegistry, sourceRepository string) repositoryTemplateData {
+	namespace := path.Dir(sourceRepository)
+	if namespace == "." {
+		namespace = ""
+	}
+	return repositoryTemplateData{
+		SourceRegistry:   sourceRegistry,
+		SourceRepository: sourceRepository,
+		SourceNamespace:  namespace,
+		SourceRepo:       path.Base(sourceRepository),
+	}
+}
+
+// templateFuncs are the functions available to templates, with date
+// formatting loaded as the load time.
+func templateFuncs(loaded time.Time) template.FuncMap {
+	return template.FuncMap{
+		// env returns an environment variable, or the fallback when it is
+		// unset or empty. An unset variable without a fallback is an error,
+		// like a ${NAME} reference.
+		"env": func(name string, fallback ...string) (string, error) {
+			if value := os.Getenv(name); value != "" {
+				return value, nil
+			}
+			if len(fallback) > 0 {
+				return fallback[0], nil
+			}
+			if _, ok := os.LookupEnv(name); !ok {
+				return "", fmt.Errorf("undefined environment variable %s", name)
+			}
+			return "", nil
+		},
+		// date formats the load time in UTC with a Go time layout
+		"date": func(layout string) string {
+			return loaded.UTC().Format(layout)
+		},
+	}
+}
+
+// renderDestRepositories renders the templated destination registries,
+// repositories and annotations of every entry, then fills in dest_repository,
+// for the entry and for each of its destinations, from
+// dest_repository_template where it is not set.
+func renderDestRepositories(config *Config) error {
+	funcs := templateFuncs(time.Now())
+	for i := range config.Registries {
+		registry := &config.Registries[i]
+		data := newRepositoryTemplateData(registry.SourceRegistry, registry.SourceRepository)
+		if err := renderTemplatedValues(registry, data, funcs); err != nil {
+			return fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+		if registry.DestRepositoryTemplate == "" {
+			continue
+		}
+
+		rendered, err := renderRepositoryTemplate("dest_repository_template", registry.DestRepositoryTemplate, data, funcs)
+		if err != nil {
+			return fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+		if registry.DestRegistry != "" && registry.DestRepository == "" {
+			registry.DestRepository = rendered
+		}
+		for j := range registry.Destinations {
+			if registry.Destinations[j].DestRepository == "" {
+				registry.Destinations[j].DestRepository = rendered
+			}
+		}
+	}
+	return nil
+}
+
+// renderTemplatedValues renders the values of registry holding a template:
+// dest_registry and dest_repository, of the entry and of its destinations,
+// and annotations.
+func renderTemplatedValues(registry *RegistryConfig, data repositoryTemplateData, funcs template.FuncMap) error {
+	var err error
+	if registry.DestRegistry, err = renderValue("dest_registry", registry.DestRegistry, data, funcs); err != nil {
+		return err
+	}
+	if templated(registry.DestRepository) {
+		if registry.DestRepository, err = renderRepositoryTemplate("dest_repository", registry.DestRepository, data, funcs); err != nil {
+			return err
+		}
+	}
+	for j := range registry.Destinations {
+		dest := &registry.Destinations[j]
+		if dest.DestRegistry, err = renderValue("dest_registry", dest.DestRegistry, data, funcs); err != nil {
+			return err
+		}
+		if templated(dest.DestRepository) {
+			if dest.DestRepository, err = renderRepositoryTemplate("dest_repository", dest.DestRepository, data, funcs); err != nil {
+				return err
+			}
+		}
+	}
+	for key, value := range registry.Annotations {
+		if registry.Annotations[key], err = renderValue("annotation "+key, value, data, funcs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func templated(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// renderValue renders value when it holds a template and returns it as it is
+// otherwise.
+func renderValue(field, value string, data repositoryTemplateData, funcs template.FuncMap) (string, error) {
+	if !templated(value) {
+		return value, nil
+	}
+	tmpl, err := template.New(field).Funcs(funcs).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid template in %s: %w", field, err)
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", field, err)
+	}
+	return rendered.String(), nil
+}
+
+// mapArtifactoryRepositories prefixes destination repositories on the hosts of
+// artifactory_repositories with their repository key, unless they already
+// start with it.
+func mapArtifactoryRepositories(config *Config) {
+	prefix := func(registry, repository, transport string) string {
+		key, ok := config.ArtifactoryRepositories[registry]
+		if !ok || repository == "" || (Destination{Transport: transport}).Local() || strings.HasPrefix(repository, key+"/") {
+			return repository
+		}
+		return key + "/" + repository
+	}
+	for i := range config.Registries {
+		registry := &config.Registries[i]
+		registry.DestRepository = prefix(registry.DestRegistry, registry.DestRepository, registry.DestTransport)
+		for j := range registry.Destinations {
+			dest := &registry.Destinations[j]
+			dest.DestRepository = prefix(dest.DestRegistry, dest.DestRepository, dest.Transport)
+		}
+	}
+}
+
+// renderRepositoryTemplate renders a repository template. Empty path
+// components, e.g. of an empty namespace, are dropped.
+func renderRepositoryTemplate(field, text string, data repositoryTemplateData, funcs template.FuncMap) (string, error) {
+	rendered, err := renderValue(field, text, data, funcs)
+	if err != nil {
+		return "", err
+	}
+
+	// An empty namespace must not leave a leading or doubled slash behind
+	result := strings.Trim(rendered, "/")
+	for strings.Contains(result, "//") {
+		result = strings.ReplaceAll(result, "//", "/")
+	}
+	return result, nil
+}
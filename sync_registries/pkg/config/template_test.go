@@ -0,0 +1,33 @@
+package config
+
+import "testing"
+
+func TestRenderDestRepositories(t *testing.T) {
+	t.Setenv("SYNC_TEST_TEAM", "platform")
+	for _, test := range []struct {
+		registry           RegistryConfig
+		wantRegistry, want string
+		wantErr            bool
+	}{
+		{RegistryConfig{SourceRegistry: "registry.k8s.io", SourceRepository: "kube-state-metrics/kube-state-metrics", DestRegistry: "mirror.internal", DestRepositoryTemplate: "k8s/{{.SourceRepo}}"}, "mirror.internal", "k8s/kube-state-metrics", false},
+		{RegistryConfig{SourceRegistry: "quay.io", SourceRepository: "prometheus/node-exporter", DestRegistry: "mirror.internal", DestRepositoryTemplate: "{{.SourceNamespace}}-{{.SourceRepo}}"}, "mirror.internal", "prometheus-node-exporter", false},
+		{RegistryConfig{SourceRegistry: "docker.io", SourceRepository: "nginx", DestRegistry: "mirror.internal", DestRepository: "web/nginx", DestRepositoryTemplate: "{{.SourceRepository}}"}, "mirror.internal", "web/nginx", false},
+		{RegistryConfig{SourceRegistry: "docker.io", SourceRepository: "nginx", DestRegistry: "{{env \"SYNC_TEST_TEAM\"}}.mirror.internal", DestRepository: "{{.SourceRegistry}}/{{.SourceRepository}}"}, "platform.mirror.internal", "docker.io/nginx", false},
+		{RegistryConfig{SourceRegistry: "docker.io", SourceRepository: "nginx", DestRegistry: "mirror.internal", DestRepository: "{{env \"SYNC_TEST_UNSET\" \"shared\"}}/nginx"}, "mirror.internal", "shared/nginx", false},
+		{RegistryConfig{SourceRegistry: "docker.io", SourceRepository: "nginx", DestRegistry: "mirror.internal", DestRepository: "{{env \"SYNC_TEST_UNSET\"}}/nginx"}, "", "", true},
+		{RegistryConfig{SourceRegistry: "docker.io", SourceRepository: "nginx", DestRegistry: "mirror.internal", DestRepositoryTemplate: "{{.Unknown}}"}, "", "", true},
+	} {
+		config := &Config{Registries: []RegistryConfig{test.registry}}
+		err := renderDestRepositories(config)
+		if (err != nil) != test.wantErr {
+			t.Errorf("renderDestRepositories(%s/%s) error = %v, want error %t", test.registry.SourceRegistry, test.registry.SourceRepository, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := config.Registries[0]; got.DestRegistry != test.wantRegistry || got.DestRepository != test.want {
+			t.Errorf("renderDestRepositories(%s/%s) = %s/%s, want %s/%s", test.registry.SourceRegistry, test.registry.SourceRepository, got.DestRegistry, got.DestRepository, test.wantRegistry, test.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package sync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseAge parses the max_age or max_tag_age setting of a registry entry, a Go
+// duration such as "720h" or a number of days such as "180d". Empty means no
+// limit.
+func ParseAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid age %q, expected a number of days or a duration", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid age %q, expected a number of days or a duration", value)
+	}
+	return age, nil
+}
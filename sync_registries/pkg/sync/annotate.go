@@ -0,0 +1,127 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"registries-sync/pkg/config"
+)
+
+// Provenance annotations added with provenance_annotations.
+const (
+	annotationSource       = "io.mirror.source"
+	annotationSourceDigest = "io.mirror.source-digest"
+	annotationSyncedAt     = "io.mirror.synced-at"
+)
+
+// annotatesManifests reports whether images of registry are pushed with
+// added annotations, and so with a digest different from the source.
+func annotatesManifests(registry config.RegistryConfig) bool {
+	return registry.ProvenanceAnnotations || len(registry.Annotations) > 0
+}
+
+// manifestAnnotations returns the annotations to add to the images of
+// registry copied from sourceImage, which resolved to sourceDigest.
+func manifestAnnotations(registry config.RegistryConfig, sourceImage string, sourceDigest digest.Digest, syncedAt time.Time) map[string]string {
+	annotations := maps.Clone(registry.Annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	if registry.ProvenanceAnnotations {
+		annotations[annotationSource] = sourceImage
+		annotations[annotationSourceDigest] = sourceDigest.String()
+		annotations[annotationSyncedAt] = syncedAt.UTC().Format(time.RFC3339)
+	}
+	return annotations
+}
+
+// annotatingReference wraps a destination reference to add annotations to
+// the OCI manifest pushed to it. Annotations the manifest already has are
+// kept. The manifest is pushed with a new digest, pushed returns it.
+type annotatingReference struct {
+	types.ImageReference
+	annotations map[string]string
+	manifest    []byte
+}
+
+// newAnnotatingReference wraps ref, or returns it unchanged when there are no
+// annotations to add.
+func newAnnotatingReference(ref types.ImageReference, annotations map[string]string) types.ImageReference {
+	if len(annotations) == 0 {
+		return ref
+	}
+	return &annotatingReference{ImageReference: ref, annotations: annotations}
+}
+
+// pushedManifest returns the manifest pushed to ref, or copied when ref didn't
+// change it.
+func pushedManifest(ref types.ImageReference, copied []byte) []byte {
+	if r, ok := ref.(*annotatingReference); ok && r.manifest != nil {
+		return r.manifest
+	}
+	return copied
+}
+
+func (r *annotatingReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &annotatingDestination{ImageDestination: dest, ref: r}, nil
+}
+
+type annotatingDestination struct {
+	types.ImageDestination
+	ref *annotatingReference
+}
+
+func (d *annotatingDestination) PutManifest(ctx context.Context, m []byte, instanceDigest *digest.Digest) error {
+	if instanceDigest == nil {
+		annotated, err := addAnnotations(m, d.ref.annotations)
+		if err != nil {
+			return err
+		}
+		m = annotated
+		d.ref.manifest = annotated
+	}
+	return d.ImageDestination.PutManifest(ctx, m, instanceDigest)
+}
+
+// addAnnotations returns the OCI manifest or index m with annotations added
+// to those it has. Every other field is kept as it is.
+func addAnnotations(m []byte, annotations map[string]string) ([]byte, error) {
+	switch mimeType := manifest.GuessMIMEType(m); mimeType {
+	case imgspecv1.MediaTypeImageManifest, imgspecv1.MediaTypeImageIndex:
+	default:
+		return nil, fmt.Errorf("can't annotate a manifest of type %q", mimeType)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(m, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	existing := map[string]string{}
+	if raw, ok := fields["annotations"]; ok {
+		if err := json.Unmarshal(raw, &existing); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest annotations: %w", err)
+		}
+	}
+	for key, value := range annotations {
+		if _, ok := existing[key]; !ok {
+			existing[key] = value
+		}
+	}
+	raw, err := json.Marshal(existing)
+	if err != nil {
+		return nil, err
+	}
+	fields["annotations"] = raw
+	return json.Marshal(fields)
+}
@@ -0,0 +1,65 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// helmConfigMediaType is the config media type of Helm charts pushed with
+// helm push.
+const helmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+
+// Kinds of artifacts, as returned by artifactKind.
+const (
+	kindImage    = "image"
+	kindHelm     = "helm"
+	kindArtifact = "artifact" // Any other OCI artifact
+)
+
+// artifactKind fetches the manifest of ref and tells container images, Helm
+// charts and other OCI artifacts apart by the config media type.
+func artifactKind(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) (string, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	blob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	if manifest.MIMETypeIsMultiImage(manifest.NormalizedMIMEType(mimeType)) {
+		return kindImage, nil
+	}
+
+	var parsed imgspecv1.Manifest
+	if err := json.Unmarshal(blob, &parsed); err != nil {
+		return "", fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	switch parsed.Config.MediaType {
+	case helmConfigMediaType:
+		return kindHelm, nil
+	case "", imgspecv1.MediaTypeImageConfig, manifest.DockerV2Schema2ConfigMediaType:
+		// Schema 1 manifests have no config at all
+		return kindImage, nil
+	default:
+		return kindArtifact, nil
+	}
+}
+
+// wantsArtifact reports whether artifact_type selects artifacts of kind.
+func wantsArtifact(artifactType, kind string) bool {
+	switch artifactType {
+	case "", "any":
+		return true
+	case "helm":
+		return kind == kindHelm
+	default:
+		return kind == kindImage
+	}
+}
@@ -0,0 +1,203 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// auditTailSize is how much of the end of the audit log is read to find the
+// last record. Records are far smaller.
+const auditTailSize = 64 * 1024
+
+// AuditLog appends a record of every image pushed to a destination to a JSON
+// lines file. Every record holds the hash of the one before it, so changing,
+// removing or reordering records breaks the chain, which VerifyAuditLog
+// detects. A nil AuditLog records nothing.
+type AuditLog struct {
+	file     *os.File
+	hostname string
+
+	// mu serializes appends of this process, which flock doesn't, since
+	// all goroutines share the open file
+	mu sync.Mutex
+}
+
+// AuditRecord is a line of the audit log.
+type AuditRecord struct {
+	Time        time.Time       `json:"time"`
+	Source      string          `json:"source"`
+	Destination string          `json:"destination"`
+	Digest      string          `json:"digest"` // Manifest digest pushed to the destination
+	Credential  AuditCredential `json:"credential"`
+	Host        string          `json:"host"`      // Machine that pushed the image
+	PrevHash    string          `json:"prev_hash"` // Empty for the first record
+	Hash        string          `json:"hash,omitempty"`
+}
+
+// AuditCredential identifies the credential a destination was pushed with,
+// without its secret.
+type AuditCredential struct {
+	Type      string `json:"type"` // Auth provider of the secret, e.g. "basic", "ecr"
+	Username  string `json:"username,omitempty"`
+	VaultPath string `json:"vault_path,omitempty"` // Where the username and password were read from
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if
+// needed.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	return &AuditLog{file: file, hostname: hostname}, nil
+}
+
+// Close closes the audit log.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// record appends r, chained to the last record in the file. Appends are
+// serialized and the file is locked meanwhile, so concurrent syncs and
+// processes sharing it keep a single chain.
+func (a *AuditLog) record(ctx context.Context, r AuditRecord) {
+	if a == nil {
+		return
+	}
+	if err := a.append(r); err != nil {
+		logf(ctx, "Failed to record push of %s in audit log: %v", r.Destination, err)
+	}
+}
+
+func (a *AuditLog) append(r AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := lockFile(a.file); err != nil {
+		return err
+	}
+	defer unlockFile(a.file)
+
+	prevHash, err := lastAuditHash(a.file)
+	if err != nil {
+		return err
+	}
+	r.Time = r.Time.UTC()
+	r.Host = a.hostname
+	r.PrevHash = prevHash
+	if r.Hash, err = auditHash(r); err != nil {
+		return err
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// lastAuditHash returns the hash of the last record in file, or "" when it
+// is empty.
+func lastAuditHash(file *os.File) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := max(info.Size()-auditTailSize, 0)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return "", err
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return "", nil
+	}
+	last := tail[bytes.LastIndexByte(tail, '\n')+1:]
+	var r AuditRecord
+	if err := json.Unmarshal(last, &r); err != nil || r.Hash == "" {
+		return "", fmt.Errorf("last record of the audit log is corrupt")
+	}
+	return r.Hash, nil
+}
+
+// auditHash is the SHA-256 of the JSON encoding of r without its hash.
+func auditHash(r AuditRecord) (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// VerifyAuditLog checks the hash chain of the audit log at path. It returns
+// the number of records and the hash of the last one, which can be compared
+// with a copy kept elsewhere to also detect records removed from the end.
+func VerifyAuditLog(path string) (int, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, auditTailSize), auditTailSize)
+	count, prevHash := 0, ""
+	for scanner.Scan() {
+		count++
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return count, prevHash, fmt.Errorf("record %d is not valid JSON: %w", count, err)
+		}
+		if r.PrevHash != prevHash {
+			return count, prevHash, fmt.Errorf("record %d doesn't follow the record before it", count)
+		}
+		hash, err := auditHash(r)
+		if err != nil {
+			return count, prevHash, err
+		}
+		if hash != r.Hash {
+			return count, prevHash, fmt.Errorf("record %d was modified", count)
+		}
+		prevHash = r.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return count, prevHash, err
+	}
+	return count, prevHash, nil
+}
+
+// auditCredential describes the credential resolved from secret, typed the
+// way auth.NewProvider picks the provider.
+func auditCredential(secret config.SecretConfig, credentials types.DockerAuthConfig) AuditCredential {
+	credential := AuditCredential{Type: secret.Type, Username: credentials.Username}
+	if credential.Type == "" {
+		credential.Type = "dockerconfig"
+		if secret.Username != "" || secret.Vault != nil {
+			credential.Type = "basic"
+		}
+	}
+	if secret.Vault != nil {
+		credential.VaultPath = secret.Vault.Path
+	}
+	return credential
+}
@@ -0,0 +1,124 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/docker/go-units"
+	"golang.org/x/time/rate"
+)
+
+// ParseBandwidth converts a human readable rate such as "50MiB/s" or "10MB/s"
+// into bytes per second. Binary suffixes (KiB, MiB, ...) are 1024 based and
+// decimal suffixes (KB, MB, ...) are 1000 based.
+func ParseBandwidth(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSuffix(value, "/s")
+	if value == "" {
+		return 0, nil
+	}
+
+	var (
+		bytes int64
+		err   error
+	)
+	if strings.Contains(strings.ToLower(value), "i") {
+		bytes, err = units.RAMInBytes(value)
+	} else {
+		bytes, err = units.FromHumanSize(value)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q: %w", value, err)
+	}
+	if bytes <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q: must be greater than zero", value)
+	}
+	return bytes, nil
+}
+
+// newBandwidthLimiter returns a limiter for the given rate, or nil when no
+// limit is configured. The burst is one second worth of transfer.
+func newBandwidthLimiter(value string) (*rate.Limiter, error) {
+	bytesPerSecond, err := ParseBandwidth(value)
+	if err != nil || bytesPerSecond == 0 {
+		return nil, err
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond)), nil
+}
+
+// throttledReader delays reads so that the combined throughput stays under
+// every attached limiter.
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.ReadCloser
+	limiters []*rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	for _, limiter := range t.limiters {
+		if burst := limiter.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		for _, limiter := range t.limiters {
+			if waitErr := limiter.WaitN(t.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
+
+func (t *throttledReader) Close() error {
+	return t.reader.Close()
+}
+
+// throttledReference wraps a source image reference so that every blob read
+// through it is rate limited. containers/image does not allow a custom HTTP
+// transport, so throttling happens on the blob streams instead.
+type throttledReference struct {
+	types.ImageReference
+	limiters []*rate.Limiter
+}
+
+// newThrottledReference wraps ref with the non-nil limiters. If none are set
+// the original reference is returned unchanged.
+func newThrottledReference(ref types.ImageReference, limiters ...*rate.Limiter) types.ImageReference {
+	active := []*rate.Limiter{}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			active = append(active, limiter)
+		}
+	}
+	if len(active) == 0 {
+		return ref
+	}
+	return &throttledReference{ImageReference: ref, limiters: active}
+}
+
+func (r *throttledReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledSource{ImageSource: src, limiters: r.limiters}, nil
+}
+
+type throttledSource struct {
+	types.ImageSource
+	limiters []*rate.Limiter
+}
+
+func (s *throttledSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	reader, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &throttledReader{ctx: ctx, reader: reader, limiters: s.limiters}, size, nil
+}
@@ -0,0 +1,171 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// blobCache is a content addressed store of source blobs on local disk. Base
+// layers shared by many tags and repositories are pulled from the source once
+// and served from disk afterwards. A nil *blobCache disables caching.
+type blobCache struct {
+	dir string
+}
+
+func newBlobCache(dir string) (*blobCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "info"), 0o755); err != nil {
+		return nil, err
+	}
+	return &blobCache{dir: dir}, nil
+}
+
+// infoDir is used as SystemContext.BlobInfoCacheDir, so containers/image
+// remembers where blobs already exist and can reuse or mount them instead of
+// uploading them again.
+func (c *blobCache) infoDir() string {
+	if c == nil {
+		return ""
+	}
+	return filepath.Join(c.dir, "info")
+}
+
+func (c *blobCache) path(d digest.Digest) string {
+	return filepath.Join(c.dir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// cachingReference wraps a source reference so blobs are read from the cache
+// when present and stored in it while being pulled otherwise.
+type cachingReference struct {
+	types.ImageReference
+	cache *blobCache
+}
+
+// newCachingReference wraps ref with cache, or returns ref unchanged when
+// caching is disabled.
+func newCachingReference(ref types.ImageReference, cache *blobCache) types.ImageReference {
+	if cache == nil {
+		return ref
+	}
+	return &cachingReference{ImageReference: ref, cache: cache}
+}
+
+func (r *cachingReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingSource{ImageSource: src, cache: r.cache}, nil
+}
+
+type cachingSource struct {
+	types.ImageSource
+	cache *blobCache
+}
+
+func (s *cachingSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	if info.Digest == "" || info.Digest.Validate() != nil {
+		return s.ImageSource.GetBlob(ctx, info, cache)
+	}
+
+	path := s.cache.path(info.Digest)
+	if file, err := os.Open(path); err == nil {
+		stat, err := file.Stat()
+		if err == nil {
+			return file, stat.Size(), nil
+		}
+		file.Close()
+	}
+
+	reader, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("Not caching blob %s: %v", info.Digest, err)
+		return reader, size, nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		log.Printf("Not caching blob %s: %v", info.Digest, err)
+		return reader, size, nil
+	}
+	return &cachingReader{
+		reader:   reader,
+		tmp:      tmp,
+		hash:     info.Digest.Algorithm().Hash(),
+		expected: info.Digest,
+		path:     path,
+	}, size, nil
+}
+
+// cachingReader tees a blob stream into a temporary file and moves it into
+// the cache once the whole blob was read and its digest verified.
+type cachingReader struct {
+	reader   io.ReadCloser
+	tmp      *os.File
+	hash     hash.Hash
+	expected digest.Digest
+	path     string
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 && r.tmp != nil {
+		r.hash.Write(p[:n])
+		if _, writeErr := r.tmp.Write(p[:n]); writeErr != nil {
+			log.Printf("Not caching blob %s: %v", r.expected, writeErr)
+			r.discard()
+		}
+	}
+	if errors.Is(err, io.EOF) && r.tmp != nil {
+		r.commit()
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	r.discard()
+	return r.reader.Close()
+}
+
+func (r *cachingReader) commit() {
+	name := r.tmp.Name()
+	if err := r.tmp.Close(); err != nil {
+		os.Remove(name)
+		r.tmp = nil
+		return
+	}
+	r.tmp = nil
+
+	if digest.NewDigest(r.expected.Algorithm(), r.hash) != r.expected {
+		os.Remove(name)
+		return
+	}
+	if err := os.Rename(name, r.path); err != nil {
+		os.Remove(name)
+	}
+}
+
+func (r *cachingReader) discard() {
+	if r.tmp == nil {
+		return
+	}
+	r.tmp.Close()
+	os.Remove(r.tmp.Name())
+	r.tmp = nil
+}
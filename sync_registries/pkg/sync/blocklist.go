@@ -0,0 +1,52 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// blockedDigests returns the global blocked_digests and those of the entry.
+func blockedDigests(cfg *config.Config, registry config.RegistryConfig) []string {
+	return append(slices.Clip(cfg.BlockedDigests), registry.BlockedDigests...)
+}
+
+// findBlockedDigest returns the digest out of blocked that ref resolves to,
+// as an image or manifest list or as an instance of the list, or "" when
+// there is none.
+func findBlockedDigest(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, blocked []string) (string, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	rawManifest, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	manifestDigest, err := manifest.Digest(rawManifest)
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(blocked, manifestDigest.String()) {
+		return manifestDigest.String(), nil
+	}
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(rawManifest, mimeType)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+		for _, instanceDigest := range list.Instances() {
+			if slices.Contains(blocked, instanceDigest.String()) {
+				return instanceDigest.String(), nil
+			}
+		}
+	}
+	return "", nil
+}
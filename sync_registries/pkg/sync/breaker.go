@@ -0,0 +1,148 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/docker/distribution/registry/api/errcode"
+
+	"registries-sync/pkg/config"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 10 * time.Minute
+)
+
+// errCircuitOpen is returned for tags whose destinations are all skipped by
+// the circuit breaker.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker stops copying to a destination registry after consecutive
+// authentication or server errors, instead of letting every remaining tag
+// fail the same way. After the cooldown one more copy is let through, and
+// closes the circuit again if it succeeds.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu     sync.Mutex
+	hosts  map[string]*breakerState
+	opened []string // Every host whose circuit opened, with the reason
+}
+
+type breakerState struct {
+	failures int
+	openedAt time.Time // Zero while closed
+}
+
+func newCircuitBreaker(cfg config.CircuitBreakerConfig) (*circuitBreaker, error) {
+	b := &circuitBreaker{
+		failures: defaultBreakerFailures,
+		cooldown: defaultBreakerCooldown,
+		hosts:    map[string]*breakerState{},
+	}
+	if cfg.Failures < 0 {
+		return nil, fmt.Errorf("invalid circuit_breaker failures %d: must not be negative", cfg.Failures)
+	}
+	if cfg.Failures > 0 {
+		b.failures = cfg.Failures
+	}
+	if cfg.Cooldown != "" {
+		cooldown, err := time.ParseDuration(cfg.Cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit_breaker cooldown %q: %w", cfg.Cooldown, err)
+		}
+		b.cooldown = cooldown
+	}
+	return b, nil
+}
+
+func (b *circuitBreaker) state(host string) *breakerState {
+	state, ok := b.hosts[limiterHost(host)]
+	if !ok {
+		state = &breakerState{}
+		b.hosts[limiterHost(host)] = state
+	}
+	return state
+}
+
+// allow reports whether copies to host may be attempted.
+func (b *circuitBreaker) allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state(host)
+	return state.openedAt.IsZero() || time.Since(state.openedAt) >= b.cooldown
+}
+
+// record updates the circuit of host with the result of a copy. Errors that
+// don't point at the registry itself, such as a missing source tag, end the
+// run of consecutive failures like a success does.
+func (b *circuitBreaker) record(ctx context.Context, host string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state(host)
+	if err == nil || !isRegistryFailure(err) {
+		state.failures = 0
+		state.openedAt = time.Time{}
+		return
+	}
+
+	state.failures++
+	if state.failures < b.failures {
+		return
+	}
+	reopened := !state.openedAt.IsZero()
+	state.openedAt = time.Now()
+	if reopened {
+		return
+	}
+	logf(ctx, "Circuit breaker open for %s after %d consecutive failures, skipping it for %v: %v", host, state.failures, b.cooldown, err)
+	b.opened = append(b.opened, fmt.Sprintf("%s: %v", host, err))
+}
+
+// allowedTargets drops the targets whose registry the circuit breaker skips.
+func (s *Syncer) allowedTargets(targets []destinationTarget) []destinationTarget {
+	allowed := []destinationTarget{}
+	for _, target := range targets {
+		if s.breaker.allow(target.DestRegistry) {
+			allowed = append(allowed, target)
+		}
+	}
+	return allowed
+}
+
+// openedCircuits returns every host whose circuit opened, with the error that
+// opened it.
+func (b *circuitBreaker) openedCircuits() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	opened := append([]string{}, b.opened...)
+	sort.Strings(opened)
+	return opened
+}
+
+var serverErrorPattern = regexp.MustCompile(`(StatusCode: |status code from registry |unexpected HTTP status: )5\d\d\b`)
+
+// isRegistryFailure reports whether err is an authentication failure or a
+// server error, which are likely to repeat for every tag.
+func isRegistryFailure(err error) bool {
+	var unauthorized docker.ErrUnauthorizedForCredentials
+	if errors.As(err, &unauthorized) {
+		return true
+	}
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) {
+		switch coder.ErrorCode() {
+		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied, errcode.ErrorCodeUnavailable:
+			return true
+		}
+	}
+	return serverErrorPattern.MatchString(err.Error())
+}
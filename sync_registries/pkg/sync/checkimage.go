@@ -0,0 +1,151 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+
+	"registries-sync/pkg/config"
+)
+
+// ImageCheck is the result of CheckImage.
+type ImageCheck struct {
+	Image  string // The destination image checked
+	Digest string // Its digest, empty when it doesn't exist
+
+	// Source is the image the registry entry mirrors Image from, empty
+	// without an entry. SourceDigests are the digests a mirrored copy of it
+	// has: that of the tag and, for a manifest list, that of the platform or
+	// the list of platforms the sync copies.
+	Source        string
+	SourceDigests []string
+}
+
+// Exists reports whether the image exists at the destination.
+func (c *ImageCheck) Exists() bool {
+	return c.Digest != ""
+}
+
+// MatchesSource reports whether the image exists and, when it was compared
+// with its source, has the digest of a mirrored copy of the source.
+func (c *ImageCheck) MatchesSource() bool {
+	return c.Exists() && (c.Source == "" || slices.Contains(c.SourceDigests, c.Digest))
+}
+
+// CheckImage looks up image, a tag or digest reference at a destination
+// registry, with destCtx. With registry, the entry mirroring the image, the
+// source image it is mirrored from is looked up as well.
+func CheckImage(ctx context.Context, image string, destCtx *types.SystemContext, registry *config.RegistryConfig) (*ImageCheck, error) {
+	ref, err := docker.ParseReference("//" + image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %s: %w", image, err)
+	}
+	check := &ImageCheck{Image: image}
+	destDigest, err := docker.GetDigest(ctx, destCtx, ref)
+	switch {
+	case err == nil:
+		check.Digest = destDigest.String()
+	case !isNotFound(err):
+		return nil, fmt.Errorf("failed to get digest of %s: %w", image, err)
+	}
+	if registry == nil {
+		return check, nil
+	}
+
+	tagged, ok := ref.DockerReference().(reference.NamedTagged)
+	if !ok {
+		return nil, errors.New("only tags can be compared with the source, a digest reference names the image it expects")
+	}
+	check.Source, err = mirroredSource(*registry, tagged.Tag())
+	if err != nil {
+		return nil, err
+	}
+	check.SourceDigests, err = mirroredDigests(ctx, *registry, check.Source)
+	if err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// mirroredSource returns the source image the entry mirrors to destTag.
+func mirroredSource(registry config.RegistryConfig, destTag string) (string, error) {
+	switch {
+	case registry.Compression != "":
+		return "", fmt.Errorf("images of %s/%s are recompressed, they never have the source digest", registry.SourceRegistry, registry.SourceRepository)
+	case annotatesManifests(registry):
+		return "", fmt.Errorf("images of %s/%s are annotated, they never have the source digest", registry.SourceRegistry, registry.SourceRepository)
+	}
+	for _, pinned := range registry.Digests {
+		if pinned.DestTag() == destTag {
+			return fmt.Sprintf("%s/%s@%s", registry.SourceRegistry, registry.SourceRepository, pinned.Digest), nil
+		}
+	}
+	if registry.TagRewrite != nil {
+		return "", fmt.Errorf("the source tag of %s can't be told with tag_rewrite set", destTag)
+	}
+	return fmt.Sprintf("%s/%s:%s", registry.SourceRegistry, registry.SourceRepository, destTag), nil
+}
+
+// mirroredDigests returns the digests a copy of source made by the entry
+// has: that of source, and for a manifest list that of the instance copied,
+// or of the list of the instances copied when the filters select several.
+func mirroredDigests(ctx context.Context, registry config.RegistryConfig, source string) ([]string, error) {
+	ref, err := docker.ParseReference("//" + source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source image reference %s: %w", source, err)
+	}
+	sys := sourceSystemContext(registry)
+	var instances []digest.Digest
+	if filtersPlatforms(registry) {
+		selection, err := selectPlatforms(ctx, registry, sys, ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect %s: %w", source, err)
+		}
+		if selection.Platform == nil {
+			return nil, fmt.Errorf("%s has no platform matching os and architectures", source)
+		}
+		sys = withPlatform(sys, *selection.Platform)
+		instances, _ = selection.withoutAttestations(registry.StripAttestations)
+	}
+
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access %s: %w", source, err)
+	}
+	defer src.Close()
+	rawManifest, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest of %s: %w", source, err)
+	}
+	manifestDigest, err := manifest.Digest(rawManifest)
+	if err != nil {
+		return nil, err
+	}
+	digests := []string{manifestDigest.String()}
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(rawManifest, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest list of %s: %w", source, err)
+		}
+		if instances != nil {
+			// Several platforms are copied as a list of just those
+			filtered, err := filterManifestList(rawManifest, instances)
+			if err != nil {
+				return nil, err
+			}
+			return append(digests, digest.FromBytes(filtered).String()), nil
+		}
+		// Artifacts without platforms are copied whole
+		if instanceDigest, err := list.ChooseInstance(sys); err == nil {
+			digests = append(digests, instanceDigest.String())
+		}
+	}
+	return digests, nil
+}
@@ -0,0 +1,48 @@
+package sync
+
+import (
+	"fmt"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// ParseCompression parses the compression setting of a registry entry, e.g.
+// "zstd". An empty name keeps the layers as they are and returns nil.
+func ParseCompression(name string) (*compression.Algorithm, error) {
+	if name == "" {
+		return nil, nil
+	}
+	switch name {
+	case compression.Gzip.Name(), compression.Zstd.Name(), compression.ZstdChunked.Name():
+	default:
+		return nil, fmt.Errorf("invalid compression %q, expected gzip, zstd or zstd:chunked", name)
+	}
+	algorithm, err := compression.AlgorithmByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &algorithm, nil
+}
+
+// applyCompression makes the copy recompress every layer that isn't already
+// compressed with the algorithm configured for registry.
+func applyCompression(options *copy.Options, registry config.RegistryConfig) error {
+	algorithm, err := ParseCompression(registry.Compression)
+	if err != nil || algorithm == nil {
+		return err
+	}
+	// The destination context is shared by every copy to the target
+	var destCtx types.SystemContext
+	if options.DestinationCtx != nil {
+		destCtx = *options.DestinationCtx
+	}
+	destCtx.CompressionFormat = algorithm
+	destCtx.CompressionLevel = registry.CompressionLevel
+	options.DestinationCtx = &destCtx
+	options.ForceCompressionFormat = true
+	return nil
+}
@@ -0,0 +1,45 @@
+package sync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+type copyIDKey struct{}
+
+// newCopyID returns a random ID correlating the log lines, report entry,
+// hook and broker events and spans of one tag copy.
+func newCopyID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// withCopyID marks ctx as belonging to the tag copy id.
+func withCopyID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, copyIDKey{}, id)
+}
+
+// copyIDFrom returns the ID of the tag copy ctx belongs to, or "".
+func copyIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(copyIDKey{}).(string)
+	return id
+}
+
+// copyPrefix returns the prefix of the log lines of the tag copy ctx belongs
+// to, or "" outside of one.
+func copyPrefix(ctx context.Context) string {
+	if id := copyIDFrom(ctx); id != "" {
+		return "[copy " + id + "] "
+	}
+	return ""
+}
+
+// logf logs like log.Printf, prefixed with the copy ID of ctx, so the lines
+// of copies running in parallel can be told apart.
+func logf(ctx context.Context, format string, args ...any) {
+	log.Output(2, copyPrefix(ctx)+fmt.Sprintf(format, args...))
+}
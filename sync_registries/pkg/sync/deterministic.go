@@ -0,0 +1,51 @@
+package sync
+
+import (
+	"sort"
+	"time"
+
+	"registries-sync/pkg/config"
+)
+
+// sortedRegistries returns the registry entries sorted by source repository.
+// Entries of the same repository keep their configuration order.
+func sortedRegistries(registries []config.RegistryConfig) []config.RegistryConfig {
+	sorted := append([]config.RegistryConfig{}, registries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].SourceRegistry+"/"+sorted[i].SourceRepository < sorted[j].SourceRegistry+"/"+sorted[j].SourceRepository
+	})
+	return sorted
+}
+
+// stabilize sorts the lists of the report and clears its timing, which
+// differs between runs against the same state.
+func (r *Report) stabilize() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Started = time.Time{}
+	r.DurationSeconds = 0
+	sort.SliceStable(r.Registries, func(i, j int) bool { return r.Registries[i].Source < r.Registries[j].Source })
+	for _, registry := range r.Registries {
+		registry.DurationSeconds = 0
+		sort.Strings(registry.VerificationFailures)
+		sort.Strings(registry.UnverifiedSignatures)
+		sort.Strings(registry.MissingPlatforms)
+		sort.Strings(registry.StrippedAttestations)
+		sort.SliceStable(registry.Platforms, func(i, j int) bool { return registry.Platforms[i].Image < registry.Platforms[j].Image })
+		sort.Strings(registry.SyncedImages)
+		if registry.MirrorLag != nil && registry.MirrorLag.NewestMirroredTag == "" {
+			// Measured against the current time
+			registry.MirrorLag.Seconds = 0
+		}
+		for i := range registry.Copies {
+			// Random, unlike the rest of the report
+			registry.Copies[i].ID = ""
+		}
+		sort.SliceStable(registry.Copies, func(i, j int) bool { return registry.Copies[i].Image < registry.Copies[j].Image })
+	}
+	sort.Strings(r.Skipped)
+	sort.Strings(r.OpenedCircuits)
+}
@@ -0,0 +1,272 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/go-units"
+
+	"registries-sync/pkg/config"
+)
+
+// RegistryDiff describes how the destination differs from what a sync would
+// produce for a single registry entry.
+type RegistryDiff struct {
+	Missing        []string // selected at source but absent at destination (destination tag names)
+	Skipped        []string // absent at destination, but skipped by a sync on purpose, with the reason
+	Excluded       []string // present at destination but not selected by the filters
+	BeyondLimit    []string // present at destination, selected by the filters but not among the latest tags tag_limit keeps
+	DigestMismatch []string // present on both sides with different digests
+}
+
+// Diff compares the source tag set of a registry entry with that of one of
+// its destinations without copying anything. Tags the destination lacks are
+// checked like a sync of cfg would before copying them, so those it skips on
+// purpose, e.g. for max_age or blocked_digests, aren't reported missing.
+func Diff(ctx context.Context, cfg *config.Config, entry config.RegistryConfig, dest config.Destination, destCtx *types.SystemContext) (*RegistryDiff, error) {
+	if dest.Local() {
+		return nil, fmt.Errorf("tags of %s destinations can't be listed", dest.Transport)
+	}
+	failures, err := newFailureTracker(cfg.Quarantine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quarantine file: %w", err)
+	}
+	skips := &skipChecks{cfg: cfg, entry: entry, failures: failures}
+	registry := entry.WithDestination(dest)
+	sourceCtx := sourceSystemContext(registry)
+	sourceImage := fmt.Sprintf("%s/%s", registry.SourceRegistry, registry.SourceRepository)
+	destImage := fmt.Sprintf("%s/%s", registry.DestRegistry, registry.DestRepository)
+
+	sourceTags, err := listTags(ctx, sourceCtx, sourceImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source tags: %w", err)
+	}
+	if len(registry.Tags) == 0 {
+		// Named filters are only known to the program registering them
+		if sourceTags, err = applyTagFilter(ctx, registry, nil, sourceTags); err != nil {
+			return nil, err
+		}
+	}
+	destTags, err := listTags(ctx, destCtx, destImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get destination tags: %w", err)
+	}
+
+	selected := selectTags(sourceTags, registry)
+	selectedSet := map[string]bool{}
+	destSet := map[string]bool{}
+	for _, tag := range destTags {
+		destSet[tag] = true
+	}
+
+	diff := &RegistryDiff{}
+	for _, tag := range selected {
+		destTag, err := rewriteTag(registry.TagRewrite, tag)
+		if err != nil {
+			return nil, err
+		}
+		selectedSet[destTag] = true
+
+		if !destSet[destTag] {
+			reason, err := skips.reason(ctx, registry, sourceCtx, tag, selected)
+			if err != nil {
+				return nil, err
+			}
+			if reason != "" {
+				diff.Skipped = append(diff.Skipped, fmt.Sprintf("%s (%s)", destTag, reason))
+			} else {
+				diff.Missing = append(diff.Missing, destTag)
+			}
+			continue
+		}
+		if registry.Compression != "" || annotatesManifests(registry) {
+			// Recompressed and annotated images never have the source digest
+			continue
+		}
+
+		// A copy of a manifest list has the digest of the platforms copied
+		sourceDigests, err := mirroredDigests(ctx, registry, fmt.Sprintf("%s:%s", sourceImage, tag))
+		if err != nil {
+			return nil, err
+		}
+		destDigest, err := imageDigest(ctx, destCtx, fmt.Sprintf("%s:%s", destImage, destTag))
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(sourceDigests, destDigest) {
+			diff.DigestMismatch = append(diff.DigestMismatch, fmt.Sprintf("%s (source %s, destination %s)", destTag, sourceDigests[len(sourceDigests)-1], destDigest))
+		}
+	}
+	for _, pinned := range registry.Digests {
+		destTag := pinned.DestTag()
+		selectedSet[destTag] = true
+		if !destSet[destTag] {
+			reason, err := skips.reason(ctx, registry, sourceCtx, pinned.Digest, selected)
+			if err != nil {
+				return nil, err
+			}
+			if reason != "" {
+				diff.Skipped = append(diff.Skipped, fmt.Sprintf("%s (%s)", destTag, reason))
+			} else {
+				diff.Missing = append(diff.Missing, destTag)
+			}
+			continue
+		}
+		if registry.Compression != "" || annotatesManifests(registry) {
+			continue
+		}
+		sourceDigests, err := mirroredDigests(ctx, registry, fmt.Sprintf("%s@%s", sourceImage, pinned.Digest))
+		if err != nil {
+			return nil, err
+		}
+		destDigest, err := imageDigest(ctx, destCtx, fmt.Sprintf("%s:%s", destImage, destTag))
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(sourceDigests, destDigest) {
+			diff.DigestMismatch = append(diff.DigestMismatch, fmt.Sprintf("%s (pinned %s, destination %s)", destTag, pinned.Digest, destDigest))
+		}
+	}
+	// Tags the filters select but the limits drop, by destination tag name
+	limited := map[string]bool{}
+	for _, tag := range sourceTags {
+		if registry.PinsOnly() || !TagSelected(tag, registry) {
+			continue
+		}
+		if destTag, err := rewriteTag(registry.TagRewrite, tag); err == nil && !selectedSet[destTag] {
+			limited[destTag] = true
+		}
+	}
+	for _, tag := range destTags {
+		switch {
+		case selectedSet[tag]:
+		case limited[tag]:
+			diff.BeyondLimit = append(diff.BeyondLimit, tag)
+		default:
+			diff.Excluded = append(diff.Excluded, tag)
+		}
+	}
+
+	return diff, nil
+}
+
+// skipChecks runs the checks a sync makes before copying a tag, for Diff to
+// tell the tags it skips on purpose. The vulnerability scan is left out.
+type skipChecks struct {
+	cfg      *config.Config
+	entry    config.RegistryConfig // With every destination, as the sync sees it
+	failures *failureTracker
+}
+
+// reason returns why a sync would skip tag, a tag or pinned digest selected
+// out of tags, or "" when it would copy it.
+func (c *skipChecks) reason(ctx context.Context, registry config.RegistryConfig, sys *types.SystemContext, tag string, tags []string) (string, error) {
+	if failure, ok := c.failures.quarantined(c.entry, tag); ok {
+		return fmt.Sprintf("quarantined after %d failed runs", failure.Runs), nil
+	}
+	source := fmt.Sprintf("%s/%s:%s", registry.SourceRegistry, registry.SourceRepository, tag)
+	_, isPinned := registry.PinnedDigest(tag)
+	if isPinned {
+		source = fmt.Sprintf("%s/%s@%s", registry.SourceRegistry, registry.SourceRepository, tag)
+	}
+	ref, err := docker.ParseReference("//" + source)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse source image reference for %s: %w", source, err)
+	}
+
+	if blocked := blockedDigests(c.cfg, registry); len(blocked) > 0 {
+		blockedDigest, err := findBlockedDigest(ctx, sys, ref, blocked)
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect %s: %w", source, err)
+		}
+		if blockedDigest != "" {
+			return "blocked digest " + blockedDigest, nil
+		}
+	}
+	kind := kindImage
+	if registry.ArtifactType != "" {
+		if kind, err = artifactKind(ctx, sys, ref); err != nil {
+			return "", fmt.Errorf("failed to inspect %s: %w", source, err)
+		}
+		if !wantsArtifact(registry.ArtifactType, kind) {
+			return fmt.Sprintf("a %s, artifact_type is %s", kind, registry.ArtifactType), nil
+		}
+	}
+	if filtersPlatforms(registry) && kind == kindImage {
+		selection, err := selectPlatforms(ctx, registry, sys, ref)
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect %s: %w", source, err)
+		}
+		if selection.Platform == nil {
+			return "no platform matching os and architectures", nil
+		}
+		sys = withPlatform(sys, *selection.Platform)
+	}
+
+	checkAge := registry.MaxAge != "" && !isPinned && !slices.Contains(registry.PinTags, tag)
+	checkLabels := len(registry.RequireLabels) > 0 || len(registry.ExcludeLabels) > 0
+	if (checkAge || registry.MaxImageSize != "" || checkLabels) && kind == kindImage {
+		info, err := inspectImage(ctx, sys, ref, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect %s: %w", source, err)
+		}
+		if checkLabels {
+			if reason := labelMismatch(registry, info); reason != "" {
+				return reason, nil
+			}
+		}
+		if checkAge {
+			maxAge, err := ParseAge(registry.MaxAge)
+			if err != nil {
+				return "", err
+			}
+			if info.Created != nil && time.Since(*info.Created) > maxAge {
+				return "older than max_age", nil
+			}
+		}
+		if registry.MaxImageSize != "" {
+			maxSize, err := ParseSize(registry.MaxImageSize)
+			if err != nil {
+				return "", err
+			}
+			if info.Size > maxSize {
+				return fmt.Sprintf("%s, over max_image_size", units.BytesSize(float64(info.Size))), nil
+			}
+		}
+	}
+
+	if c.cfg.PolicyHook != nil {
+		allowed, reason, err := checkPolicyHook(ctx, c.cfg.PolicyHook, c.entry, sys, ref, tag, tags, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to evaluate policy: %w", err)
+		}
+		if !allowed {
+			return "denied by policy: " + reason, nil
+		}
+	}
+	return "", nil
+}
+
+func listTags(ctx context.Context, sys *types.SystemContext, image string) ([]string, error) {
+	ref, err := docker.ParseReference("//" + image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image reference for %s: %w", image, err)
+	}
+	return docker.GetRepositoryTags(ctx, sys, ref)
+}
+
+func imageDigest(ctx context.Context, sys *types.SystemContext, image string) (string, error) {
+	ref, err := docker.ParseReference("//" + image)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image reference for %s: %w", image, err)
+	}
+	digest, err := docker.GetDigest(ctx, sys, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to get digest of %s: %w", image, err)
+	}
+	return digest.String(), nil
+}
@@ -0,0 +1,144 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExportedDigest is the destination digest of a mirrored tag in the digest
+// export.
+type ExportedDigest struct {
+	Digest  string    `json:"digest"`
+	Source  string    `json:"source,omitempty"` // The source image, not kept by the properties format
+	Updated time.Time `json:"updated"`
+}
+
+// digestExport maps every tag pushed to a registry destination to its
+// digest, so dependency update bots can pin deployments to mirror digests.
+// Tags pushed by earlier runs are kept, and the file is written after every
+// push. It is read again under a lock before, so the tags pushed by other
+// syncers sharing it, e.g. of a configuration the daemon reloaded, are kept
+// too. A nil *digestExport exports nothing.
+type digestExport struct {
+	path       string
+	properties bool // image=digest lines instead of JSON
+
+	mu     sync.Mutex
+	images map[string]ExportedDigest // By destination image
+}
+
+// openDigestExport loads the digest export at path, in format "json" or
+// "properties", when it exists.
+func openDigestExport(path, format string) (*digestExport, error) {
+	if format != "json" && format != "properties" {
+		return nil, fmt.Errorf("unknown digest export format %q, expected json or properties", format)
+	}
+	e := &digestExport{path: path, properties: format == "properties"}
+	var err error
+	if e.images, err = e.load(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// load reads the images of the export, none when it doesn't exist.
+func (e *digestExport) load() (map[string]ExportedDigest, error) {
+	images := map[string]ExportedDigest{}
+	data, err := os.ReadFile(e.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return images, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !e.properties {
+		if err := json.Unmarshal(data, &images); err != nil {
+			return nil, fmt.Errorf("invalid digest export %s: %w", e.path, err)
+		}
+		return images, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		image, digest, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line in digest export %s: %s", e.path, line)
+		}
+		images[image] = ExportedDigest{Digest: digest}
+	}
+	return images, scanner.Err()
+}
+
+// record exports the digest image was pushed with.
+func (e *digestExport) record(image, digest, source string) {
+	if e == nil || digest == "" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.update(image, ExportedDigest{Digest: digest, Source: source, Updated: time.Now().UTC()}); err != nil {
+		log.Printf("Failed to write digest export: %v", err)
+	}
+}
+
+// update merges image into the export on disk, with e.mu held. The file is
+// replaced on every save, so a lock file next to it is locked instead.
+func (e *digestExport) update(image string, exported ExportedDigest) error {
+	lock, err := os.OpenFile(e.path+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	images, err := e.load()
+	if err != nil {
+		return err
+	}
+	e.images = images
+	e.images[image] = exported
+	return e.save()
+}
+
+// save writes the export atomically, sorted by image, with e.mu held.
+func (e *digestExport) save() error {
+	var data []byte
+	if e.properties {
+		images := make([]string, 0, len(e.images))
+		for image := range e.images {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+		var buf bytes.Buffer
+		for _, image := range images {
+			fmt.Fprintf(&buf, "%s=%s\n", image, e.images[image].Digest)
+		}
+		data = buf.Bytes()
+	} else {
+		var err error
+		// Maps are encoded with sorted keys
+		if data, err = json.MarshalIndent(e.images, "", "  "); err != nil {
+			return err
+		}
+	}
+	tmp := e.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.path)
+}
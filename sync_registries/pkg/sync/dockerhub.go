@@ -0,0 +1,231 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// The rate limit is reported on manifest requests for this repository.
+// HEAD requests are not counted against the limit.
+const (
+	dockerHubTokenURL     = "https://auth.docker.io/token?service=registry.docker.io&scope=repository:ratelimitpreview/test:pull"
+	dockerHubRateLimitURL = "https://registry-1.docker.io/v2/ratelimitpreview/test/manifests/latest"
+)
+
+// DockerHubQuota is the pull budget last reported by Docker Hub.
+type DockerHubQuota struct {
+	Limit     int `json:"limit" yaml:"limit"`
+	Remaining int `json:"remaining" yaml:"remaining"`
+}
+
+// dockerHubLimiter pauses pulls from Docker Hub when the pull budget is nearly
+// exhausted and retries pulls rejected with 429 Too Many Requests.
+type dockerHubLimiter struct {
+	minRemaining int
+	pause        time.Duration
+	maxRetries   int
+	username     string
+	password     string
+	headers      *registryHeaders
+
+	mu    sync.Mutex
+	quota *DockerHubQuota // nil until Docker Hub reported a limit
+}
+
+func newDockerHubLimiter(cfg config.DockerHubConfig, credentials types.DockerAuthConfig, headers *registryHeaders) (*dockerHubLimiter, error) {
+	l := &dockerHubLimiter{
+		minRemaining: 5,
+		pause:        10 * time.Minute,
+		maxRetries:   5,
+		username:     credentials.Username,
+		password:     credentials.Password,
+		headers:      headers,
+	}
+	if cfg.MinRemaining > 0 {
+		l.minRemaining = cfg.MinRemaining
+	}
+	if cfg.Pause != "" {
+		pause, err := time.ParseDuration(cfg.Pause)
+		if err != nil {
+			return nil, fmt.Errorf("invalid docker_hub pause %q: %w", cfg.Pause, err)
+		}
+		l.pause = pause
+	}
+	if cfg.MaxRetries > 0 {
+		l.maxRetries = cfg.MaxRetries
+	}
+	return l, nil
+}
+
+func isDockerHub(host string) bool {
+	return config.RegistryHost(host) == "docker.io"
+}
+
+// dockerHubSecret returns the secret configured for Docker Hub, if any,
+// preferring the pull secret.
+func dockerHubSecret(secrets []config.SecretConfig) config.SecretConfig {
+	for _, role := range []string{config.RolePull, "", config.RolePush} {
+		for _, secret := range secrets {
+			if isDockerHub(secret.DestRegistry) && secret.Role == role {
+				return secret
+			}
+		}
+	}
+	return config.SecretConfig{}
+}
+
+// lastQuota returns the pull budget last reported by Docker Hub, or nil.
+func (l *dockerHubLimiter) lastQuota() *DockerHubQuota {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.quota == nil {
+		return nil
+	}
+	quota := *l.quota
+	return &quota
+}
+
+// waitForQuota blocks while fewer than min_remaining pulls are left. Accounts
+// without a pull limit don't report one and never wait.
+func (l *dockerHubLimiter) waitForQuota(ctx context.Context) error {
+	for {
+		quota, err := l.checkQuota(ctx)
+		if err != nil {
+			logf(ctx, "Failed to check Docker Hub pull quota: %v", err)
+			return nil
+		}
+		if quota == nil || quota.Remaining >= l.minRemaining {
+			return nil
+		}
+
+		logf(ctx, "Docker Hub pull quota nearly exhausted (%d of %d remaining), pausing for %s", quota.Remaining, quota.Limit, l.pause)
+		if err := sleepContext(ctx, l.pause); err != nil {
+			return err
+		}
+	}
+}
+
+// retry calls pull until it succeeds, fails with an error other than 429 or
+// runs out of retries, backing off exponentially starting at one minute.
+func (l *dockerHubLimiter) retry(ctx context.Context, pull func() error) error {
+	delay := time.Minute
+	for attempt := 0; ; attempt++ {
+		err := pull()
+		if err == nil || !isTooManyRequests(err) || attempt >= l.maxRetries {
+			return err
+		}
+
+		logf(ctx, "Docker Hub rate limit reached, retrying in %s (%d/%d)", delay, attempt+1, l.maxRetries)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+		if delay > l.pause {
+			delay = l.pause
+		}
+	}
+}
+
+// checkQuota asks Docker Hub for the remaining pull budget and remembers it.
+func (l *dockerHubLimiter) checkQuota(ctx context.Context) (*DockerHubQuota, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dockerHubTokenURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.headers.set(req)
+	if l.username != "" {
+		req.SetBasicAuth(l.username, l.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s requesting a Docker Hub token", resp.Status)
+	}
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodHead, dockerHubRateLimitURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.headers.set(req)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	limit, limitOK := parseRateLimitHeader(resp.Header.Get("RateLimit-Limit"))
+	remaining, remainingOK := parseRateLimitHeader(resp.Header.Get("RateLimit-Remaining"))
+	if !limitOK || !remainingOK {
+		return nil, nil
+	}
+
+	quota := &DockerHubQuota{Limit: limit, Remaining: remaining}
+	l.mu.Lock()
+	l.quota = quota
+	l.mu.Unlock()
+	return quota, nil
+}
+
+// parseRateLimitHeader parses values like "100;w=21600".
+func parseRateLimitHeader(value string) (int, bool) {
+	value = strings.TrimSpace(strings.SplitN(value, ";", 2)[0])
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil
+}
+
+func isTooManyRequests(err error) bool {
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "toomanyrequests") || strings.Contains(message, "too many requests")
+}
+
+// sleepContext waits for d or until ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pullFrom runs pull, a copy reading from sourceRegistry. Pulls from Docker
+// Hub first wait for enough pull quota and are retried when rate limited.
+func (s *Syncer) pullFrom(ctx context.Context, sourceRegistry string, pull func() error) error {
+	if !isDockerHub(sourceRegistry) {
+		return pull()
+	}
+	if err := s.dockerHub.waitForQuota(ctx); err != nil {
+		return err
+	}
+	return s.dockerHub.retry(ctx, pull)
+}
@@ -0,0 +1,89 @@
+package sync
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/docker/go-units"
+
+	"registries-sync/pkg/config"
+)
+
+// bytesPerGB is the GB of egress pricing, 2^30 bytes as cloud providers bill.
+const bytesPerGB = 1 << 30
+
+// SourceTransfer is the traffic pulled from a source registry host in a run.
+type SourceTransfer struct {
+	Registry         string   `json:"registry" yaml:"registry"`
+	BytesTransferred int64    `json:"bytes_transferred" yaml:"bytes_transferred"`               // Cache hits excluded
+	EstimatedCost    *float64 `json:"estimated_cost,omitempty" yaml:"estimated_cost,omitempty"` // From egress_cost_per_gb
+}
+
+// sourceCounter returns the counter of bytes pulled from the host of
+// sourceRegistry, or nil.
+func (r *Report) sourceCounter(sourceRegistry string) *int64 {
+	if r == nil {
+		return nil
+	}
+	host := config.RegistryHost(sourceRegistry)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, transfer := range r.SourceRegistries {
+		if transfer.Registry == host {
+			return &transfer.BytesTransferred
+		}
+	}
+	transfer := &SourceTransfer{Registry: host}
+	r.SourceRegistries = append(r.SourceRegistries, transfer)
+	return &transfer.BytesTransferred
+}
+
+// ValidateEgressCosts checks that no two hosts of egress_cost_per_gb name
+// the same registry, which would make the price picked depend on map order.
+func ValidateEgressCosts(cfg *config.Config) error {
+	hosts := make([]string, 0, len(cfg.EgressCostPerGB))
+	for host := range cfg.EgressCostPerGB {
+		hosts = append(hosts, host)
+	}
+	return distinctRegistryHosts("egress_cost_per_gb", hosts)
+}
+
+// distinctRegistryHosts returns an error naming the first two of hosts, keys
+// of setting, that are the same registry host once normalized.
+func distinctRegistryHosts(setting string, hosts []string) error {
+	sort.Strings(hosts)
+	seen := map[string]string{}
+	for _, host := range hosts {
+		normalized := config.RegistryHost(host)
+		if other, ok := seen[normalized]; ok {
+			return fmt.Errorf("%s has both %s and %s, which are the same registry", setting, other, host)
+		}
+		seen[normalized] = host
+	}
+	return nil
+}
+
+// estimateEgressCosts prices the traffic of every source registry with
+// egress_cost_per_gb, where "*" prices the hosts not listed, and logs it.
+// Called with r.mu held.
+func (r *Report) estimateEgressCosts(cfg *config.Config) {
+	sort.Slice(r.SourceRegistries, func(i, j int) bool { return r.SourceRegistries[i].Registry < r.SourceRegistries[j].Registry })
+	for _, transfer := range r.SourceRegistries {
+		price, ok := 0.0, false
+		for host, hostPrice := range cfg.EgressCostPerGB {
+			if config.RegistryHost(host) == transfer.Registry {
+				price, ok = hostPrice, true
+			}
+		}
+		if !ok {
+			price, ok = cfg.EgressCostPerGB["*"]
+		}
+		if !ok {
+			continue
+		}
+		cost := float64(transfer.BytesTransferred) / bytesPerGB * price
+		transfer.EstimatedCost = &cost
+		log.Printf("Pulled %s from %s, estimated egress cost %.2f", units.BytesSize(float64(transfer.BytesTransferred)), transfer.Registry, cost)
+	}
+}
@@ -0,0 +1,49 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// stageImage copies src into a temporary directory using the dir: transport,
+// which keeps manifests byte for byte so digests are preserved. The returned
+// reference can then be pushed to several destinations while the source is
+// only pulled once. The cleanup function removes the staging directory.
+// Foreign layers are always downloaded into it, downloadForeignLayers also
+// marks them distributable. With instances, those of a manifest list are
+// staged together with the list.
+func stageImage(ctx context.Context, policyContext *signature.PolicyContext, src types.ImageReference, sourceCtx *types.SystemContext, instances []digest.Digest, preserveDigests, downloadForeignLayers bool, parallelism layerParallelism, progress *copyProgress) (types.ImageReference, func(), error) {
+	// Next to the other big files, the system temporary directory by default
+	dir, err := os.MkdirTemp(sourceCtx.BigFilesTemporaryDir, "registries-sync-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	ref, err := directory.NewReference(dir)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to create staging reference: %w", err)
+	}
+
+	options := &copy.Options{SourceCtx: sourceCtx, PreserveDigests: preserveDigests, DownloadForeignLayers: downloadForeignLayers}
+	if instances != nil {
+		options.ImageListSelection = copy.CopySpecificImages
+		options.Instances = instances
+	}
+	parallelism.apply(options)
+	progress.apply(options)
+	_, err = copy.Image(ctx, policyContext, ref, src, options)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return ref, cleanup, nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package sync
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile waits for an exclusive lock on file, shared with other processes.
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// registryHeaders holds user_agent and registry_headers. containers/image
+// only lets the User-Agent be set, so the extra headers are only added to
+// the requests made to registries directly. A nil *registryHeaders leaves
+// requests unchanged.
+type registryHeaders struct {
+	userAgent string
+	byHost    map[string]map[string]string
+}
+
+func newRegistryHeaders(cfg *config.Config) *registryHeaders {
+	if cfg.UserAgent == "" && len(cfg.RegistryHeaders) == 0 {
+		return nil
+	}
+	return &registryHeaders{userAgent: cfg.UserAgent, byHost: cfg.RegistryHeaders}
+}
+
+// ValidateRegistryHeaders checks user_agent, the names and values of
+// registry_headers and that its hosts are distinct.
+func ValidateRegistryHeaders(cfg *config.Config) error {
+	if strings.ContainsAny(cfg.UserAgent, "\r\n") {
+		return fmt.Errorf("user_agent must be a single line")
+	}
+	hosts := make([]string, 0, len(cfg.RegistryHeaders))
+	for host, headers := range cfg.RegistryHeaders {
+		hosts = append(hosts, host)
+		for name, value := range headers {
+			switch {
+			case !headerNamePattern.MatchString(name):
+				return fmt.Errorf("registry_headers of %s: invalid header name %q", host, name)
+			case http.CanonicalHeaderKey(name) == "Authorization" || http.CanonicalHeaderKey(name) == "Host" || http.CanonicalHeaderKey(name) == "User-Agent":
+				return fmt.Errorf("registry_headers of %s: %s can't be set, it is managed by the sync or by user_agent", host, name)
+			case strings.ContainsAny(value, "\r\n"):
+				return fmt.Errorf("registry_headers of %s: value of %s must be a single line", host, name)
+			}
+		}
+	}
+	return distinctRegistryHosts("registry_headers", hosts)
+}
+
+// apply sets the User-Agent of the requests containers/image makes with sys.
+func (h *registryHeaders) apply(sys *types.SystemContext) {
+	if h != nil {
+		sys.DockerRegistryUserAgent = h.userAgent
+	}
+}
+
+// set adds the User-Agent and the headers of the registry host req is sent
+// to, compared normalized. The headers of docker.io apply to every Docker Hub
+// host.
+func (h *registryHeaders) set(req *http.Request) {
+	if h == nil {
+		return
+	}
+	if h.userAgent != "" {
+		req.Header.Set("User-Agent", h.userAgent)
+	}
+	for host, headers := range h.byHost {
+		if config.RegistryHost(host) != config.RegistryHost(req.URL.Host) {
+			continue
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+	}
+}
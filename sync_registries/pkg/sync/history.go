@@ -0,0 +1,194 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind        TEXT NOT NULL,
+	started_at  TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP,
+	result      TEXT NOT NULL DEFAULT 'running'
+);
+CREATE TABLE IF NOT EXISTS copies (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id      INTEGER NOT NULL REFERENCES runs(id),
+	source      TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	digest      TEXT NOT NULL DEFAULT '',
+	bytes       INTEGER NOT NULL DEFAULT 0,
+	started_at  TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP NOT NULL,
+	result      TEXT NOT NULL,
+	error       TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS copies_run_id ON copies(run_id);
+CREATE INDEX IF NOT EXISTS copies_destination ON copies(destination);
+`
+
+// History records every run and every image copy in a SQLite database, for
+// audits of when an image entered a destination. A nil History records
+// nothing.
+type History struct {
+	db *sql.DB
+}
+
+// HistoryRun is a run read back from the history.
+type HistoryRun struct {
+	ID         int64
+	Kind       string // "sync-all", "sync-registry" for a single entry synced on its own, or the kind given to WithRunKind
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Result     string // "running", "completed", "failed" or "interrupted"
+}
+
+// HistoryCopy is an image copy read back from the history.
+type HistoryCopy struct {
+	RunID       int64
+	Source      string
+	Destination string
+	Digest      string
+	Bytes       int64 // Pulled from the source, shared by the destinations of a tag
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	Result      string // "synced" or "failed"
+	Error       string
+}
+
+// OpenHistory opens the history database at path, creating it if needed.
+func OpenHistory(path string) (*History, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history database: %w", err)
+	}
+	// SQLite allows a single writer, parallel registries share the connection
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create history tables: %w", err)
+	}
+	return &History{db: db}, nil
+}
+
+// Close closes the database.
+func (h *History) Close() error {
+	if h == nil {
+		return nil
+	}
+	return h.db.Close()
+}
+
+// startRun records the start of a run and returns its id, 0 when it couldn't
+// be recorded.
+func (h *History) startRun(ctx context.Context, kind string) int64 {
+	if h == nil {
+		return 0
+	}
+	result, err := h.db.Exec(`INSERT INTO runs (kind, started_at) VALUES (?, ?)`, kind, time.Now().UTC())
+	if err != nil {
+		logf(ctx, "Failed to record run in history: %v", err)
+		return 0
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+func (h *History) finishRun(ctx context.Context, id int64, result string) {
+	if h == nil || id == 0 {
+		return
+	}
+	if _, err := h.db.Exec(`UPDATE runs SET finished_at = ?, result = ? WHERE id = ?`, time.Now().UTC(), result, id); err != nil {
+		logf(ctx, "Failed to record run in history: %v", err)
+	}
+}
+
+func (h *History) recordCopy(ctx context.Context, c HistoryCopy) {
+	if h == nil || c.RunID == 0 {
+		return
+	}
+	_, err := h.db.Exec(`INSERT INTO copies (run_id, source, destination, digest, bytes, started_at, finished_at, result, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.RunID, c.Source, c.Destination, c.Digest, c.Bytes, c.StartedAt.UTC(), c.FinishedAt.UTC(), c.Result, c.Error)
+	if err != nil {
+		logf(ctx, "Failed to record copy of %s in history: %v", c.Destination, err)
+	}
+}
+
+// Runs returns the most recent runs, newest first.
+func (h *History) Runs(limit int) ([]HistoryRun, error) {
+	rows, err := h.db.Query(`SELECT id, kind, started_at, finished_at, result FROM runs ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []HistoryRun{}
+	for rows.Next() {
+		var run HistoryRun
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&run.ID, &run.Kind, &run.StartedAt, &finishedAt, &run.Result); err != nil {
+			return nil, err
+		}
+		if finishedAt.Valid {
+			run.FinishedAt = &finishedAt.Time
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// Copies returns the copies of a run, or of every run when runID is 0, whose
+// source or destination contains image. The newest come first.
+func (h *History) Copies(runID int64, image string, limit int) ([]HistoryCopy, error) {
+	rows, err := h.db.Query(`SELECT run_id, source, destination, digest, bytes, started_at, finished_at, result, error FROM copies
+		WHERE (? = 0 OR run_id = ?) AND (source LIKE '%' || ? || '%' OR destination LIKE '%' || ? || '%')
+		ORDER BY id DESC LIMIT ?`, runID, runID, image, image, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	copies := []HistoryCopy{}
+	for rows.Next() {
+		var c HistoryCopy
+		if err := rows.Scan(&c.RunID, &c.Source, &c.Destination, &c.Digest, &c.Bytes, &c.StartedAt, &c.FinishedAt, &c.Result, &c.Error); err != nil {
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	return copies, rows.Err()
+}
+
+type historyRunKey struct{}
+
+// withHistoryRun marks ctx as belonging to a recorded run.
+func withHistoryRun(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, historyRunKey{}, id)
+}
+
+func historyRunFrom(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(historyRunKey{}).(int64)
+	return id, ok
+}
+
+type runKindKey struct{}
+
+// WithRunKind records the SyncRegistry calls with ctx in the history as runs
+// of kind, e.g. "manual", instead of "sync-registry".
+func WithRunKind(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, runKindKey{}, kind)
+}
+
+// runKind returns the kind of the runs of SyncRegistry calls with ctx.
+func runKind(ctx context.Context) string {
+	if kind, ok := ctx.Value(runKindKey{}).(string); ok {
+		return kind
+	}
+	return "sync-registry"
+}
@@ -0,0 +1,152 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"registries-sync/internal/rest"
+	"registries-sync/pkg/config"
+)
+
+// defaultHookTimeout bounds a hook without a timeout of its own.
+const defaultHookTimeout = time.Minute
+
+// Hook phases, as passed in SYNC_HOOK_PHASE.
+const (
+	hookPreSync  = "pre_sync"
+	hookPostSync = "post_sync"
+	hookPreCopy  = "pre_copy"
+	hookPostCopy = "post_copy"
+)
+
+// hookEvent describes what a hook runs for. Command hooks get it as SYNC_*
+// environment variables, URL hooks as the JSON body.
+type hookEvent struct {
+	Phase        string   `json:"phase"`
+	Source       string   `json:"source"`            // Source repository, or image for copy hooks
+	Destinations []string `json:"destinations"`      // Destination repositories, or images for copy hooks
+	Tag          string   `json:"tag,omitempty"`     // Source tag or pinned digest, copy hooks only
+	CopyID       string   `json:"copy_id,omitempty"` // Correlates the copy's log lines, copy hooks only
+	Result       string   `json:"result,omitempty"`  // "synced", "skipped" or "failed", post hooks only
+	Error        string   `json:"error,omitempty"`
+}
+
+func (e hookEvent) environment() []string {
+	return []string{
+		"SYNC_HOOK_PHASE=" + e.Phase,
+		"SYNC_SOURCE=" + e.Source,
+		"SYNC_DESTINATIONS=" + strings.Join(e.Destinations, ","),
+		"SYNC_TAG=" + e.Tag,
+		"SYNC_COPY_ID=" + e.CopyID,
+		"SYNC_RESULT=" + e.Result,
+		"SYNC_ERROR=" + e.Error,
+	}
+}
+
+// finished returns the post hook event for e with the outcome of what e
+// describes.
+func (e hookEvent) finished(phase string, skipped bool, err error) hookEvent {
+	e.Phase = phase
+	switch {
+	case err != nil:
+		e.Result = "failed"
+		e.Error = err.Error()
+	case skipped:
+		e.Result = "skipped"
+	default:
+		e.Result = "synced"
+	}
+	return e
+}
+
+// hooksFor returns the hooks of a registry entry, falling back to the global
+// ones. It returns nil when there are none.
+func (s *Syncer) hooksFor(registry config.RegistryConfig) *config.HooksConfig {
+	if registry.Hooks != nil {
+		return registry.Hooks
+	}
+	return s.config.Hooks
+}
+
+// runHooks runs the hooks of event.Phase for registry in order, stopping at
+// the first failure.
+func (s *Syncer) runHooks(ctx context.Context, registry config.RegistryConfig, event hookEvent) error {
+	hooks := s.hooksFor(registry)
+	if hooks == nil {
+		return nil
+	}
+	phases := map[string][]config.HookConfig{
+		hookPreSync:  hooks.PreSync,
+		hookPostSync: hooks.PostSync,
+		hookPreCopy:  hooks.PreCopy,
+		hookPostCopy: hooks.PostCopy,
+	}
+	for i, hook := range phases[event.Phase] {
+		if err := runHook(ctx, hook, event); err != nil {
+			return fmt.Errorf("%s hook %d failed: %w", event.Phase, i, err)
+		}
+	}
+	return nil
+}
+
+// runPostHooks runs post hooks, which can't change the outcome, so failures
+// are only logged.
+func (s *Syncer) runPostHooks(ctx context.Context, registry config.RegistryConfig, event hookEvent) {
+	if err := s.runHooks(ctx, registry, event); err != nil {
+		logf(ctx, "Hook for %s: %v", event.Source, err)
+	}
+}
+
+func runHook(ctx context.Context, hook config.HookConfig, event hookEvent) error {
+	timeout := defaultHookTimeout
+	if hook.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(hook.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if hook.URL != "" {
+		status, body, err := rest.DoJSON(ctx, http.MethodPost, hook.URL, event, nil)
+		if err != nil {
+			return err
+		}
+		if status < 200 || status > 299 {
+			return fmt.Errorf("unexpected status %d from %s: %s", status, hook.URL, strings.TrimSpace(string(body)))
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(), event.environment()...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", hook.Command[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// copyHookEvent describes the copy of tag from registry, with the image
+// references at the source and at every destination.
+func copyHookEvent(phase string, registry config.RegistryConfig, tag string) hookEvent {
+	source := fmt.Sprintf("%s/%s:%s", registry.SourceRegistry, registry.SourceRepository, tag)
+	destTag := tag
+	if pinned, ok := registry.PinnedDigest(tag); ok {
+		source = fmt.Sprintf("%s/%s@%s", registry.SourceRegistry, registry.SourceRepository, pinned.Digest)
+		destTag = pinned.DestTag()
+	} else if rewritten, err := rewriteTag(registry.TagRewrite, tag); err == nil {
+		destTag = rewritten
+	}
+	destinations := []string{}
+	for _, dest := range registry.AllDestinations() {
+		destinations = append(destinations, dest.String()+":"+destTag)
+	}
+	return hookEvent{Phase: phase, Source: source, Destinations: destinations, Tag: tag}
+}
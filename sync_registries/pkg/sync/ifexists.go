@@ -0,0 +1,86 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+
+	"registries-sync/pkg/config"
+)
+
+// existingTargets returns the targets that already have destTag. Only
+// registry entries with if_exists set to skip or fail are checked.
+func existingTargets(ctx context.Context, registry config.RegistryConfig, targets []destinationTarget, destTag string) (existing, missing []destinationTarget, err error) {
+	if registry.IfExists == "" || registry.IfExists == "overwrite" {
+		return nil, targets, nil
+	}
+	for _, target := range targets {
+		image := fmt.Sprintf("%s:%s", target.Destination, destTag)
+		ref, err := destinationReference(target.Destination, destTag)
+		if err != nil {
+			return nil, nil, err
+		}
+		exists, err := imageExists(ctx, target.SystemContext, ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check whether %s exists: %w", image, err)
+		}
+		if exists {
+			existing = append(existing, target)
+		} else {
+			missing = append(missing, target)
+		}
+	}
+	return existing, missing, nil
+}
+
+func imageExists(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) (bool, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err == nil {
+		defer src.Close()
+		_, _, err = src.GetManifest(ctx, nil)
+	}
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// isNotFound reports whether err says the manifest or the whole repository
+// does not exist. Registries differ in how they say so.
+func isNotFound(err error) bool {
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) {
+		switch coder.ErrorCode() {
+		case v2.ErrorCodeManifestUnknown, v2.ErrorCodeNameUnknown:
+			return true
+		}
+	}
+	var e errcode.Error
+	if errors.As(err, &e) && e.ErrorCode() == errcode.ErrorCodeUnknown && strings.Contains(strings.ToLower(e.Message), "not found") {
+		return true
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// A dir: destination without the tag
+		return true
+	}
+	// The Docker daemon and containers-storage don't use registry errors
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "statuscode: 404") || strings.Contains(message, "no such image") || strings.Contains(message, "image not known")
+}
+
+func destinationNames(targets []destinationTarget) string {
+	names := []string{}
+	for _, target := range targets {
+		names = append(names, target.Destination.String())
+	}
+	return strings.Join(names, ", ")
+}
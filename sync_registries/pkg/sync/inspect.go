@@ -0,0 +1,145 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// imageInfo holds the metadata of a source image used by the filters and
+// policy checks that run before a copy.
+type imageInfo struct {
+	Digest      string            `json:"digest"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"` // Of the OCI manifest or index
+	Platforms   []string          `json:"platforms"`             // os/arch[/variant] of every image in a manifest list
+	Created     *time.Time        `json:"created,omitempty"`
+	Size        int64             `json:"size"` // Compressed size of the layers of the instance matching sys, -1 when unknown
+}
+
+// maxInspectCacheEntries bounds the inspect cache of a long running daemon.
+const maxInspectCacheEntries = 10000
+
+// inspectCache keeps the imageInfo of manifests already inspected, so a config
+// is fetched once however many filters and runs look at it. Entries are keyed
+// by manifest digest and platform, which never change what they describe. A
+// nil cache caches nothing.
+type inspectCache struct {
+	mu      sync.Mutex
+	entries map[string]*imageInfo
+}
+
+func newInspectCache() *inspectCache {
+	return &inspectCache{entries: map[string]*imageInfo{}}
+}
+
+func (c *inspectCache) get(key string) *imageInfo {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+func (c *inspectCache) put(key string, info *imageInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxInspectCacheEntries {
+		clear(c.entries)
+	}
+	c.entries[key] = info
+}
+
+// inspectImage fetches the manifest and config of ref. For manifest lists the
+// labels are those of the instance matching sys, and Platforms lists every
+// instance. Only the manifest is fetched when cache has seen it before.
+func inspectImage(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, cache *inspectCache) (*imageInfo, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	rawManifest, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	manifestDigest, err := manifest.Digest(rawManifest)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := manifestDigest.String()
+	if sys != nil {
+		cacheKey += " " + platformString(imgspecv1.Platform{OS: sys.OSChoice, Architecture: sys.ArchitectureChoice, Variant: sys.VariantChoice})
+	}
+	if cached := cache.get(cacheKey); cached != nil {
+		return cached, nil
+	}
+	info := &imageInfo{Digest: manifestDigest.String()}
+	// Docker manifests have no annotations, decoding leaves them nil
+	var annotated struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(rawManifest, &annotated); err == nil {
+		info.Annotations = annotated.Annotations
+	}
+
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(rawManifest, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+		for _, instanceDigest := range list.Instances() {
+			instance, err := list.Instance(instanceDigest)
+			if err != nil {
+				return nil, err
+			}
+			if instance.ReadOnly.Platform != nil {
+				info.Platforms = append(info.Platforms, platformString(*instance.ReadOnly.Platform))
+			}
+		}
+	}
+
+	img, err := image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(src, nil))
+	if err != nil {
+		return nil, err
+	}
+	inspect, err := img.Inspect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image: %w", err)
+	}
+	info.Labels = inspect.Labels
+	info.Created = inspect.Created
+	for _, layer := range img.LayerInfos() {
+		if layer.Size < 0 {
+			// Schema 1 manifests don't record layer sizes
+			info.Size = -1
+			break
+		}
+		info.Size += layer.Size
+	}
+	if len(info.Platforms) == 0 {
+		info.Platforms = []string{platformString(imgspecv1.Platform{OS: inspect.Os, Architecture: inspect.Architecture, Variant: inspect.Variant})}
+	}
+
+	cache.put(cacheKey, info)
+	return info, nil
+}
+
+func platformString(platform imgspecv1.Platform) string {
+	if platform.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", platform.OS, platform.Architecture, platform.Variant)
+	}
+	return fmt.Sprintf("%s/%s", platform.OS, platform.Architecture)
+}
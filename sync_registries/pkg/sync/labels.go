@@ -0,0 +1,50 @@
+package sync
+
+import (
+	"fmt"
+	"sort"
+
+	"registries-sync/pkg/config"
+)
+
+// anyLabelValue matches every value of a label in require_labels and
+// exclude_labels.
+const anyLabelValue = "*"
+
+// labelMismatch returns why the image described by info is filtered out by the
+// require_labels and exclude_labels of registry, or "" when it is selected.
+// Labels of the image config are looked up first, then manifest annotations.
+func labelMismatch(registry config.RegistryConfig, info *imageInfo) string {
+	for _, key := range labelKeys(registry.RequireLabels) {
+		want := registry.RequireLabels[key]
+		if value, ok := imageLabel(info, key); !ok || (want != anyLabelValue && value != want) {
+			return fmt.Sprintf("label %s=%s required", key, want)
+		}
+	}
+	for _, key := range labelKeys(registry.ExcludeLabels) {
+		unwanted := registry.ExcludeLabels[key]
+		if value, ok := imageLabel(info, key); ok && (unwanted == anyLabelValue || value == unwanted) {
+			return fmt.Sprintf("label %s=%s excluded", key, value)
+		}
+	}
+	return ""
+}
+
+func imageLabel(info *imageInfo, key string) (string, bool) {
+	if value, ok := info.Labels[key]; ok {
+		return value, true
+	}
+	value, ok := info.Annotations[key]
+	return value, ok
+}
+
+// labelKeys returns the keys of labels sorted, so the reported reason doesn't
+// change between runs.
+func labelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
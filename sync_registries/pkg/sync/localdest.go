@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/daemon"
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// destinationReference returns the reference tag is copied to at dest, in
+// the registry or the local image store of its transport.
+func destinationReference(dest config.Destination, tag string) (types.ImageReference, error) {
+	image := fmt.Sprintf("%s/%s:%s", dest.DestRegistry, dest.DestRepository, tag)
+	switch dest.Transport {
+	case "", "docker":
+		return docker.ParseReference("//" + image)
+	case "docker-daemon":
+		return daemon.ParseReference(image)
+	case "containers-storage":
+		return storageReference(image)
+	case "dir":
+		// A directory per tag below dest_registry/dest_repository
+		dir := filepath.Join(dest.DestRegistry, dest.DestRepository)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		return directory.NewReference(filepath.Join(dir, tag))
+	default:
+		return nil, fmt.Errorf("unknown transport %q", dest.Transport)
+	}
+}
+
+// ValidateTransport checks the transport of dest and that the entry doesn't
+// ask for what only registries support.
+func ValidateTransport(registry config.RegistryConfig, dest config.Destination) error {
+	switch dest.Transport {
+	case "", "docker", "docker-daemon", "containers-storage", "dir":
+	default:
+		return fmt.Errorf("invalid transport %q for %s/%s, expected docker, docker-daemon, containers-storage or dir", dest.Transport, dest.DestRegistry, dest.DestRepository)
+	}
+	if !dest.Local() {
+		return nil
+	}
+	switch {
+	case registry.AutoCreate:
+		return fmt.Errorf("auto_create is not supported for %s", dest)
+	case registry.Verify:
+		return fmt.Errorf("verify is not supported for %s", dest)
+	case registry.Referrers:
+		return fmt.Errorf("referrers are not supported for %s", dest)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+// ErrMaxFailures is the cause of runs aborted after max_failures failed tag
+// copies.
+var ErrMaxFailures = errors.New("aborted after reaching max_failures")
+
+// failureBudget counts the failed tag copies of a run, and cancels it once
+// there are max of them.
+type failureBudget struct {
+	max    int64
+	failed atomic.Int64
+	abort  context.CancelCauseFunc
+}
+
+type failureBudgetKey struct{}
+
+// withFailureBudget returns a context of the run that is cancelled with
+// ErrMaxFailures after max failed copies, never when max is 0.
+func withFailureBudget(ctx context.Context, max int) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if max <= 0 {
+		return ctx, cancel
+	}
+	return context.WithValue(ctx, failureBudgetKey{}, &failureBudget{max: int64(max), abort: cancel}), cancel
+}
+
+// copiesFailed counts n failed copies against the budget of the run of ctx,
+// if it has one.
+func copiesFailed(ctx context.Context, n int) {
+	budget, ok := ctx.Value(failureBudgetKey{}).(*failureBudget)
+	if !ok {
+		return
+	}
+	failed := budget.failed.Add(int64(n))
+	if failed >= budget.max && failed-int64(n) < budget.max {
+		log.Printf("Aborting the run after %d failed copies, max_failures is %d", failed, budget.max)
+		budget.abort(ErrMaxFailures)
+	}
+}
@@ -0,0 +1,139 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+
+	"registries-sync/pkg/config"
+)
+
+// maxLagCandidates bounds the tags checked at the destinations for the
+// newest mirrored one.
+const maxLagCandidates = 20
+
+// MirrorLag compares the newest tag a registry entry selects at the source
+// with the newest of them present at every destination, the latest tags
+// being those tag_limit keeps.
+type MirrorLag struct {
+	NewestSourceTag   string `json:"newest_source_tag" yaml:"newest_source_tag"`
+	NewestMirroredTag string `json:"newest_mirrored_tag,omitempty" yaml:"newest_mirrored_tag,omitempty"` // Empty when none of the newest tags is mirrored
+
+	// Creation times of the images, only looked up while the mirror lags
+	NewestSourceCreated   *time.Time `json:"newest_source_created,omitempty" yaml:"newest_source_created,omitempty"`
+	NewestMirroredCreated *time.Time `json:"newest_mirrored_created,omitempty" yaml:"newest_mirrored_created,omitempty"`
+
+	// Seconds the newest mirrored image was created before the newest
+	// source image, or since the newest source image was created when none
+	// is mirrored. 0 when the newest source tag is mirrored.
+	Seconds float64 `json:"seconds" yaml:"seconds"`
+}
+
+// measureMirrorLag compares the newest of the selected tags with the newest
+// one at every target, and records the result for MirrorLag.
+func (s *Syncer) measureMirrorLag(ctx context.Context, registry config.RegistryConfig, source pullSource, targets []destinationTarget, selected []string, stats *RegistryReport) {
+	tags := []string{}
+	for _, tag := range selected {
+		if _, pinned := registry.PinnedDigest(tag); !pinned {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 || len(targets) == 0 {
+		return
+	}
+
+	lag := MirrorLag{NewestSourceTag: tags[0]}
+	for _, tag := range tags[:min(len(tags), maxLagCandidates)] {
+		mirrored, err := mirroredEverywhere(ctx, registry, targets, tag)
+		if err != nil {
+			logf(ctx, "Failed to measure the mirror lag of %s/%s: %v", registry.SourceRegistry, registry.SourceRepository, err)
+			return
+		}
+		if mirrored {
+			lag.NewestMirroredTag = tag
+			break
+		}
+	}
+
+	if lag.NewestMirroredTag != lag.NewestSourceTag {
+		var err error
+		if lag.NewestSourceCreated, err = s.sourceCreated(ctx, source, lag.NewestSourceTag); err != nil {
+			logf(ctx, "Failed to measure the mirror lag of %s/%s: %v", registry.SourceRegistry, registry.SourceRepository, err)
+			return
+		}
+		if lag.NewestMirroredTag != "" {
+			if lag.NewestMirroredCreated, err = s.sourceCreated(ctx, source, lag.NewestMirroredTag); err != nil {
+				logf(ctx, "Failed to measure the mirror lag of %s/%s: %v", registry.SourceRegistry, registry.SourceRepository, err)
+				return
+			}
+		}
+		switch {
+		case lag.NewestSourceCreated == nil:
+			// Without a creation time only the tags can be told
+		case lag.NewestMirroredTag == "":
+			lag.Seconds = time.Since(*lag.NewestSourceCreated).Seconds()
+		case lag.NewestMirroredCreated != nil:
+			lag.Seconds = max(lag.NewestSourceCreated.Sub(*lag.NewestMirroredCreated).Seconds(), 0)
+		}
+		logf(ctx, "Mirror of %s/%s lags %s behind: newest tag %s, newest mirrored tag %q", registry.SourceRegistry, registry.SourceRepository,
+			time.Duration(lag.Seconds*float64(time.Second)).Round(time.Second), lag.NewestSourceTag, lag.NewestMirroredTag)
+	}
+
+	stats.mirrorLag(lag)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lags[registryKey(registry)] = lag
+}
+
+// MirrorLag returns the mirror lag measured by the latest sync of the
+// registry entry that selected its tags, if any did.
+func (s *Syncer) MirrorLag(registry config.RegistryConfig) (MirrorLag, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lag, ok := s.lags[registryKey(registry)]
+	return lag, ok
+}
+
+// mirroredEverywhere reports whether tag, rewritten for the destinations,
+// exists at every target.
+func mirroredEverywhere(ctx context.Context, registry config.RegistryConfig, targets []destinationTarget, tag string) (bool, error) {
+	destTag, err := rewriteTag(registry.TagRewrite, tag)
+	if err != nil {
+		return false, err
+	}
+	for _, target := range targets {
+		ref, err := destinationReference(target.Destination, destTag)
+		if err != nil {
+			return false, err
+		}
+		exists, err := imageExists(ctx, target.SystemContext, ref)
+		if err != nil {
+			return false, fmt.Errorf("failed to check whether %s:%s exists: %w", target.Destination, destTag, err)
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sourceCreated returns the creation time of the source image of tag, nil
+// when its config has none.
+func (s *Syncer) sourceCreated(ctx context.Context, source pullSource, tag string) (*time.Time, error) {
+	image := fmt.Sprintf("%s/%s:%s", source.registry.SourceRegistry, source.registry.SourceRepository, tag)
+	ref, err := docker.ParseReference("//" + image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse source image reference for %s: %w", image, err)
+	}
+	var info *imageInfo
+	err = s.pullFrom(ctx, source.registry.SourceRegistry, func() (err error) {
+		info, err = inspectImage(ctx, source.sys, newRateLimitedReference(ref, s.requestLimiter(source.registry.SourceRegistry)), s.inspected)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect %s: %w", image, err)
+	}
+	return info.Created, nil
+}
@@ -0,0 +1,203 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"registries-sync/pkg/config"
+)
+
+// emailTimeout bounds sending the notification email, including the SMTP
+// dialog.
+const emailTimeout = time.Minute
+
+const defaultEmailSubject = `registries-sync {{if .Interrupted}}interrupted{{else if .Failed}}failed{{else}}completed{{end}} after {{seconds .DurationSeconds}}`
+
+const defaultEmailBody = `Run started {{.Started.Format "2006-01-02 15:04:05 MST"}}, took {{seconds .DurationSeconds}}{{if .Interrupted}}, interrupted{{end}}.
+{{with .Changes}}
+Since the previous run:
+{{- range .NewlyFailing}}
+  Newly failing: {{.}}{{end}}
+{{- range .Resolved}}
+  Resolved: {{.}}{{end}}
+{{- range .NewlySynced}}
+  Newly synced: {{.}}{{end}}
+{{- if not (or .NewlyFailing .Resolved .NewlySynced)}}
+  No changes{{end}}
+{{end}}{{range .Registries}}
+{{.Source}}: {{.TagsSynced}} synced, {{.TagsSkipped}} skipped, {{.TagsFailed}} failed of {{.TagsConsidered}} tags, {{bytes .BytesTransferred}}
+{{- if .Error}}
+  Error: {{.Error}}{{end}}
+{{- range .VerificationFailures}}
+  Verification failed: {{.}}{{end}}
+{{- range .UnverifiedSignatures}}
+  Signature unverified: {{.}}{{end}}
+{{- range .MissingPlatforms}}
+  Missing platforms: {{.}}{{end}}
+{{- with .MirrorLag}}{{if ne .NewestSourceTag .NewestMirroredTag}}
+  Mirror lag: {{seconds .Seconds}}, newest tag {{.NewestSourceTag}}, newest mirrored tag {{or .NewestMirroredTag "none"}}{{end}}{{end}}
+{{- end}}
+{{if .Skipped}}
+Skipped images:
+{{range .Skipped}}  {{.}}
+{{end}}{{end}}
+{{- if .SourceRegistries}}
+Pulled from source registries:
+{{range .SourceRegistries}}  {{.Registry}}: {{bytes .BytesTransferred}}{{with .EstimatedCost}}, estimated egress cost {{cost .}}{{end}}
+{{end}}{{end}}
+{{- if .OpenedCircuits}}
+Destinations skipped by the circuit breaker:
+{{range .OpenedCircuits}}  {{.}}
+{{end}}{{end}}
+{{- if .PersistentFailures}}
+Persistently failing tags:
+{{range .PersistentFailures}}  {{.}}
+{{end}}{{end}}`
+
+// emailNotifier mails the run report. A nil emailNotifier sends nothing.
+type emailNotifier struct {
+	cfg     *config.EmailConfig
+	subject *template.Template
+	body    *template.Template
+}
+
+// ParseEmailTemplates parses the subject and body templates of cfg, falling
+// back to the default ones.
+func ParseEmailTemplates(cfg *config.EmailConfig) (subject, body *template.Template, err error) {
+	subjectText, bodyText := cfg.Subject, cfg.Body
+	if subjectText == "" {
+		subjectText = defaultEmailSubject
+	}
+	if bodyText == "" {
+		bodyText = defaultEmailBody
+	}
+	if subject, err = template.New("subject").Funcs(reportFuncs).Parse(subjectText); err != nil {
+		return nil, nil, fmt.Errorf("invalid notify.email.subject: %w", err)
+	}
+	if body, err = template.New("body").Funcs(reportFuncs).Parse(bodyText); err != nil {
+		return nil, nil, fmt.Errorf("invalid notify.email.body: %w", err)
+	}
+	return subject, body, nil
+}
+
+func newEmailNotifier(cfg *config.NotifyConfig) (*emailNotifier, error) {
+	if cfg == nil || cfg.Email == nil {
+		return nil, nil
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	subject, body, err := ParseEmailTemplates(cfg.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &emailNotifier{cfg: cfg.Email, subject: subject, body: body}, nil
+}
+
+// notify mails report, unless only failures are reported and the run
+// succeeded. Failures are logged.
+func (n *emailNotifier) notify(ctx context.Context, report *Report) {
+	if n == nil || (n.cfg.OnlyOnFailure && !report.Failed()) {
+		return
+	}
+	// Also notify about interrupted runs
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), emailTimeout)
+	defer cancel()
+
+	report.mu.Lock()
+	var subject, body bytes.Buffer
+	err := n.subject.Execute(&subject, report)
+	if err == nil {
+		err = n.body.Execute(&body, report)
+	}
+	report.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to render notification email: %v", err)
+		return
+	}
+
+	if err := sendMail(ctx, n.cfg, strings.TrimSpace(subject.String()), body.String()); err != nil {
+		log.Printf("Failed to send notification email to %s: %v", strings.Join(n.cfg.To, ", "), err)
+		return
+	}
+	log.Printf("Sent notification email to %s", strings.Join(n.cfg.To, ", "))
+}
+
+// sendMail delivers a plain text message through the SMTP server of cfg.
+func sendMail(ctx context.Context, cfg *config.EmailConfig, subject, body string) error {
+	host, port, err := net.SplitHostPort(cfg.SMTPServer)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.SMTPServer)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if port == "465" {
+		// SMTPS, TLS from the start instead of STARTTLS
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if cfg.Username != "" {
+		// PlainAuth refuses to send the password unencrypted, except to localhost
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	if err := client.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", to, err)
+		}
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(emailMessage(cfg, subject, body)); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func emailMessage(cfg *config.EmailConfig, subject, body string) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return message.Bytes()
+}
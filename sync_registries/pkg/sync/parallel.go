@@ -0,0 +1,31 @@
+package sync
+
+import (
+	"github.com/containers/image/v5/copy"
+	"golang.org/x/sync/semaphore"
+
+	"registries-sync/pkg/config"
+)
+
+// layerParallelism limits the layers copied at the same time: within a single
+// image with the parallel_layers of its entry, or across every copy of the run
+// with max_parallel_layers.
+type layerParallelism struct {
+	perImage uint
+	shared   *semaphore.Weighted // nil without max_parallel_layers
+}
+
+// layerParallelism returns the limits for the copies of registry. The
+// parallel_layers of an entry takes precedence over the shared limit, which
+// containers/image would otherwise apply instead.
+func (s *Syncer) layerParallelism(registry config.RegistryConfig) layerParallelism {
+	if registry.ParallelLayers > 0 {
+		return layerParallelism{perImage: uint(registry.ParallelLayers)}
+	}
+	return layerParallelism{shared: s.layerCopies}
+}
+
+func (p layerParallelism) apply(options *copy.Options) {
+	options.MaxParallelDownloads = p.perImage
+	options.ConcurrentBlobCopiesSemaphore = p.shared
+}
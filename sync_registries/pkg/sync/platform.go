@@ -0,0 +1,324 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"registries-sync/pkg/config"
+)
+
+// filtersPlatforms reports whether the entry only copies some platforms.
+func filtersPlatforms(registry config.RegistryConfig) bool {
+	return len(registry.OS) > 0 || len(registry.Architectures) > 0
+}
+
+// platformAllowed reports whether platform passes the os and architectures
+// filters of the entry.
+func platformAllowed(registry config.RegistryConfig, platform imgspecv1.Platform) bool {
+	return (len(registry.OS) == 0 || slices.Contains(registry.OS, platform.OS)) &&
+		(len(registry.Architectures) == 0 || slices.Contains(registry.Architectures, platform.Architecture))
+}
+
+// platformSelection is what an entry copies of a source image with its os
+// and architectures filters.
+type platformSelection struct {
+	// Platform is the one the checks before the copy inspect: the one the
+	// copy would pick anyway when it passes the filters, the first instance
+	// of a manifest list that passes otherwise. Nil when none passes.
+	Platform *imgspecv1.Platform
+
+	Platforms []imgspecv1.Platform // Every platform passing the filters
+	Missing   []string             // Platforms the filters ask for that the source lacks
+
+	// Instances are the instances of a manifest list to copy when more than
+	// one passes the filters, with the attestation manifests of those. Nil
+	// when a single image is copied.
+	Instances    []digest.Digest
+	Attestations []digest.Digest // The attestation manifests among Instances
+}
+
+// Annotations BuildKit marks the attestation manifests of an image with in
+// its manifest list.
+const (
+	annotationReferenceType   = "vnd.docker.reference.type"
+	annotationReferenceDigest = "vnd.docker.reference.digest"
+)
+
+// isAttestation reports whether an instance of a manifest list is not an
+// image but an attestation manifest, or another unknown/unknown entry.
+func isAttestation(instance manifest.ListUpdate) bool {
+	platform := instance.ReadOnly.Platform
+	return instance.ReadOnly.Annotations[annotationReferenceType] == "attestation-manifest" ||
+		(platform != nil && platform.OS == "unknown" && platform.Architecture == "unknown")
+}
+
+// withoutAttestations returns the instances of selection to push to a
+// destination, and those left out of them.
+func (s *platformSelection) withoutAttestations(strip bool) (kept, stripped []digest.Digest) {
+	if s == nil {
+		return nil, nil
+	}
+	if !strip || len(s.Attestations) == 0 {
+		return s.Instances, nil
+	}
+	for _, instance := range s.Instances {
+		if slices.Contains(s.Attestations, instance) {
+			stripped = append(stripped, instance)
+		} else {
+			kept = append(kept, instance)
+		}
+	}
+	return kept, stripped
+}
+
+// stagedAttestations returns the instances of the manifest list ref holds
+// other than its attestation manifests, and those attestation manifests.
+// Both are nil when ref holds a single image or a list without attestations.
+func stagedAttestations(ctx context.Context, ref types.ImageReference) (kept, attestations []digest.Digest, err error) {
+	src, err := ref.NewImageSource(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+	rawManifest, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return nil, nil, nil
+	}
+	list, err := manifest.ListFromBlob(rawManifest, mimeType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse manifest list: %w", err)
+	}
+	for _, instanceDigest := range list.Instances() {
+		instance, err := list.Instance(instanceDigest)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isAttestation(instance) {
+			attestations = append(attestations, instanceDigest)
+		} else {
+			kept = append(kept, instanceDigest)
+		}
+	}
+	if len(attestations) == 0 {
+		return nil, nil, nil
+	}
+	return kept, attestations, nil
+}
+
+// selectPlatforms matches the platforms of ref against the os and
+// architectures filters of the entry. Unlike inspectImage it doesn't need an
+// instance for the platform of sys, e.g. for Windows-only images.
+func selectPlatforms(ctx context.Context, registry config.RegistryConfig, sys *types.SystemContext, ref types.ImageReference) (*platformSelection, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	rawManifest, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	platforms := []imgspecv1.Platform{}
+	instances := []digest.Digest{}
+	attestations := map[digest.Digest]digest.Digest{} // By the image they attest
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(rawManifest, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+		for _, instanceDigest := range list.Instances() {
+			instance, err := list.Instance(instanceDigest)
+			if err != nil {
+				return nil, err
+			}
+			if isAttestation(instance) {
+				if subject, err := digest.Parse(instance.ReadOnly.Annotations[annotationReferenceDigest]); err == nil {
+					attestations[instanceDigest] = subject
+				}
+				continue
+			}
+			if instance.ReadOnly.Platform != nil {
+				platforms = append(platforms, *instance.ReadOnly.Platform)
+				instances = append(instances, instanceDigest)
+			}
+		}
+	} else {
+		img, err := image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(src, nil))
+		if err != nil {
+			return nil, err
+		}
+		inspect, err := img.Inspect(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect image: %w", err)
+		}
+		platforms = append(platforms, imgspecv1.Platform{OS: inspect.Os, Architecture: inspect.Architecture, Variant: inspect.Variant})
+	}
+
+	wantOS, wantArch := runtime.GOOS, runtime.GOARCH
+	if sys != nil && sys.OSChoice != "" {
+		wantOS = sys.OSChoice
+	}
+	if sys != nil && sys.ArchitectureChoice != "" {
+		wantArch = sys.ArchitectureChoice
+	}
+	selection := &platformSelection{Missing: missingPlatforms(registry, platforms)}
+	preferred := false
+	for i, platform := range platforms {
+		if !platformAllowed(registry, platform) {
+			continue
+		}
+		selection.Platforms = append(selection.Platforms, platform)
+		if i < len(instances) {
+			selection.Instances = append(selection.Instances, instances[i])
+		}
+		matches := platform.OS == wantOS && platform.Architecture == wantArch
+		if selection.Platform == nil || (matches && !preferred) {
+			selection.Platform, preferred = &platforms[i], matches
+		}
+	}
+	if len(selection.Instances) < 2 {
+		selection.Instances = nil
+		return selection, nil
+	}
+	// A list keeps the attestations of the images it holds
+	for attestation, subject := range attestations {
+		if slices.Contains(selection.Instances, subject) {
+			selection.Attestations = append(selection.Attestations, attestation)
+		}
+	}
+	slices.Sort(selection.Attestations)
+	selection.Instances = append(selection.Instances, selection.Attestations...)
+	return selection, nil
+}
+
+// requestedPlatforms lists every combination of the os and architectures
+// filters of the entry as os/architecture, with "*" for a filter that isn't
+// set.
+func requestedPlatforms(registry config.RegistryConfig) []string {
+	oses, architectures := registry.OS, registry.Architectures
+	if len(oses) == 0 {
+		oses = []string{"*"}
+	}
+	if len(architectures) == 0 {
+		architectures = []string{"*"}
+	}
+	requested := []string{}
+	for _, osName := range oses {
+		for _, architecture := range architectures {
+			requested = append(requested, osName+"/"+architecture)
+		}
+	}
+	return requested
+}
+
+// missingPlatforms lists the requestedPlatforms of the entry that no
+// platform among platforms has.
+func missingPlatforms(registry config.RegistryConfig, platforms []imgspecv1.Platform) []string {
+	missing := []string{}
+	for _, requested := range requestedPlatforms(registry) {
+		osName, architecture, _ := strings.Cut(requested, "/")
+		found := slices.ContainsFunc(platforms, func(platform imgspecv1.Platform) bool {
+			return (osName == "*" || platform.OS == osName) && (architecture == "*" || platform.Architecture == architecture)
+		})
+		if !found {
+			missing = append(missing, requested)
+		}
+	}
+	return missing
+}
+
+// withPlatform returns a copy of sys picking platform out of manifest lists.
+func withPlatform(sys *types.SystemContext, platform imgspecv1.Platform) *types.SystemContext {
+	copied := types.SystemContext{}
+	if sys != nil {
+		copied = *sys
+	}
+	copied.OSChoice = platform.OS
+	copied.ArchitectureChoice = platform.Architecture
+	copied.VariantChoice = platform.Variant
+	return &copied
+}
+
+// instanceFilteringReference wraps a source whose manifest list is copied for
+// some of its instances only. The list it returns holds just those, so the
+// destination gets no references to manifests that were never pushed.
+type instanceFilteringReference struct {
+	types.ImageReference
+	instances []digest.Digest
+}
+
+// newInstanceFilteringReference wraps ref, or returns it unchanged when
+// instances is nil.
+func newInstanceFilteringReference(ref types.ImageReference, instances []digest.Digest) types.ImageReference {
+	if instances == nil {
+		return ref
+	}
+	return &instanceFilteringReference{ImageReference: ref, instances: instances}
+}
+
+func (r *instanceFilteringReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &instanceFilteringSource{ImageSource: src, instances: r.instances}, nil
+}
+
+type instanceFilteringSource struct {
+	types.ImageSource
+	instances []digest.Digest
+}
+
+func (s *instanceFilteringSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	m, mimeType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	if err != nil || instanceDigest != nil || !manifest.MIMETypeIsMultiImage(mimeType) {
+		return m, mimeType, err
+	}
+	filtered, err := filterManifestList(m, s.instances)
+	return filtered, mimeType, err
+}
+
+// filterManifestList returns the manifest list or OCI index m with only the
+// given instances. Every other field is kept as it is.
+func filterManifestList(m []byte, instances []digest.Digest) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(m, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest list: %w", err)
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(fields["manifests"], &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest list: %w", err)
+	}
+	kept := []json.RawMessage{}
+	for _, entry := range entries {
+		var descriptor struct {
+			Digest digest.Digest `json:"digest"`
+		}
+		if err := json.Unmarshal(entry, &descriptor); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+		if slices.Contains(instances, descriptor.Digest) {
+			kept = append(kept, entry)
+		}
+	}
+	raw, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	fields["manifests"] = raw
+	return json.Marshal(fields)
+}
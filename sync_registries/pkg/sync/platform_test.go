@@ -0,0 +1,36 @@
+package sync
+
+import (
+	"slices"
+	"testing"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"registries-sync/pkg/config"
+)
+
+func TestMissingPlatforms(t *testing.T) {
+	platforms := []imgspecv1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "windows", Architecture: "amd64"},
+	}
+	for _, test := range []struct {
+		name      string
+		registry  config.RegistryConfig
+		platforms []imgspecv1.Platform
+		want      []string
+	}{
+		{"no filters", config.RegistryConfig{}, platforms, []string{}},
+		{"all architectures present", config.RegistryConfig{Architectures: []string{"amd64", "arm64"}}, platforms, []string{}},
+		{"missing architecture", config.RegistryConfig{Architectures: []string{"amd64", "s390x"}}, platforms, []string{"*/s390x"}},
+		{"missing os", config.RegistryConfig{OS: []string{"linux", "freebsd"}}, platforms, []string{"freebsd/*"}},
+		{"os and architectures combined", config.RegistryConfig{OS: []string{"linux", "windows"}, Architectures: []string{"amd64", "arm64"}}, platforms, []string{"windows/arm64"}},
+		{"single image", config.RegistryConfig{Architectures: []string{"arm64"}}, []imgspecv1.Platform{{OS: "linux", Architecture: "amd64"}}, []string{"*/arm64"}},
+		{"no platforms", config.RegistryConfig{OS: []string{"linux"}}, nil, []string{"linux/*"}},
+	} {
+		if got := missingPlatforms(test.registry, test.platforms); !slices.Equal(got, test.want) {
+			t.Errorf("%s: missingPlatforms() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
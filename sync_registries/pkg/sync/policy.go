@@ -0,0 +1,38 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/v5/signature"
+
+	"registries-sync/pkg/config"
+)
+
+// LoadSignaturePolicy returns the containers signature policy that source
+// images must satisfy before they are mirrored. It is read from
+// signature_policy_file (a containers policy.json) or from the inline
+// signature_policy section, which uses the same structure written as YAML.
+// Without either, every image is accepted.
+func LoadSignaturePolicy(cfg *config.Config) (*signature.Policy, error) {
+	switch {
+	case cfg.SignaturePolicyFile != "" && cfg.SignaturePolicy != nil:
+		return nil, fmt.Errorf("signature_policy and signature_policy_file are mutually exclusive")
+	case cfg.SignaturePolicyFile != "":
+		return signature.NewPolicyFromFile(cfg.SignaturePolicyFile)
+	case cfg.SignaturePolicy != nil:
+		data, err := json.Marshal(cfg.SignaturePolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode signature_policy: %w", err)
+		}
+		return signature.NewPolicyFromBytes(data)
+	default:
+		return insecureAcceptAnythingPolicy(), nil
+	}
+}
+
+func insecureAcceptAnythingPolicy() *signature.Policy {
+	return &signature.Policy{
+		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+	}
+}
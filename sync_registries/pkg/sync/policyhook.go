@@ -0,0 +1,115 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/internal/rest"
+	"registries-sync/pkg/config"
+)
+
+// policyInput is sent to the policy as "input".
+type policyInput struct {
+	Image            string            `json:"image"`
+	SourceRegistry   string            `json:"source_registry"`
+	SourceRepository string            `json:"source_repository"`
+	Tag              string            `json:"tag"`
+	Tags             []string          `json:"tags"` // Every tag selected for the registry entry
+	Destinations     []string          `json:"destinations"`
+	Digest           string            `json:"digest"`
+	Labels           map[string]string `json:"labels"`
+	Platforms        []string          `json:"platforms"`
+}
+
+// evaluatePolicyHook asks the policy whether input may be mirrored. An
+// undefined decision denies the copy.
+func evaluatePolicyHook(ctx context.Context, cfg *config.PolicyHookConfig, input policyInput) (bool, string, error) {
+	if cfg.Wasm != "" {
+		return evaluateWasmPolicy(ctx, cfg, input)
+	}
+	status, body, err := rest.DoJSON(ctx, http.MethodPost, cfg.URL, map[string]interface{}{"input": input}, rest.BearerAuth(cfg.Token))
+	if err != nil {
+		return false, "", fmt.Errorf("failed to query policy: %w", err)
+	}
+	if status != http.StatusOK {
+		return false, "", fmt.Errorf("unexpected status %d from policy: %s", status, body)
+	}
+
+	var response struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false, "", fmt.Errorf("invalid policy response: %w", err)
+	}
+	if len(response.Result) == 0 {
+		return false, "policy decision is undefined", nil
+	}
+	return parsePolicyDecision(response.Result)
+}
+
+// evaluateWasmPolicy runs the policy WebAssembly module with input on stdin.
+// It prints the decision as the OPA result would be.
+func evaluateWasmPolicy(ctx context.Context, cfg *config.PolicyHookConfig, input policyInput) (bool, string, error) {
+	module, err := loadWasmModule(ctx, cfg.Wasm)
+	if err != nil {
+		return false, "", fmt.Errorf("policy_hook: %w", err)
+	}
+	timeout := defaultHookTimeout
+	if cfg.Timeout != "" {
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return false, "", fmt.Errorf("invalid policy_hook timeout: %w", err)
+		}
+	}
+	var result json.RawMessage
+	if err := module.call(ctx, timeout, input, &result); err != nil {
+		return false, "", fmt.Errorf("failed to evaluate policy: %w", err)
+	}
+	return parsePolicyDecision(result)
+}
+
+// parsePolicyDecision reads a boolean decision or an object with allow and
+// reason.
+func parsePolicyDecision(result json.RawMessage) (bool, string, error) {
+	var allowed bool
+	if err := json.Unmarshal(result, &allowed); err == nil {
+		return allowed, "", nil
+	}
+	var decision struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(result, &decision); err != nil {
+		return false, "", fmt.Errorf("invalid policy decision: %w", err)
+	}
+	return decision.Allow, decision.Reason, nil
+}
+
+// checkPolicyHook inspects the source image and evaluates the policy hook for
+// a single tag.
+func checkPolicyHook(ctx context.Context, hook *config.PolicyHookConfig, registry config.RegistryConfig, sys *types.SystemContext, ref types.ImageReference, tag string, tags []string, cache *inspectCache) (bool, string, error) {
+	info, err := inspectImage(ctx, sys, ref, cache)
+	if err != nil {
+		return false, "", err
+	}
+
+	destinations := []string{}
+	for _, dest := range registry.AllDestinations() {
+		destinations = append(destinations, dest.String())
+	}
+	return evaluatePolicyHook(ctx, hook, policyInput{
+		Image:            fmt.Sprintf("%s/%s:%s", registry.SourceRegistry, registry.SourceRepository, tag),
+		SourceRegistry:   registry.SourceRegistry,
+		SourceRepository: registry.SourceRepository,
+		Tag:              tag,
+		Tags:             tags,
+		Destinations:     destinations,
+		Digest:           info.Digest,
+		Labels:           info.Labels,
+		Platforms:        info.Platforms,
+	})
+}
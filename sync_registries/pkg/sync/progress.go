@@ -0,0 +1,182 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/types"
+	units "github.com/docker/go-units"
+	"golang.org/x/term"
+)
+
+// progressMode selects how copy progress is shown.
+type progressMode int
+
+const (
+	progressNone     progressMode = iota
+	progressTerminal              // Per-layer lines redrawn in place
+	progressLog                   // A log line per layer every progressLogInterval
+)
+
+const progressLogInterval = 10 * time.Second
+
+// detectProgressMode redraws progress in place when stdout is a terminal
+// and nothing else writes to it concurrently, and logs it otherwise. CI
+// systems that allocate a pseudo-terminal set CI and get log lines too.
+func detectProgressMode(parallel bool) progressMode {
+	if !parallel && os.Getenv("CI") == "" && term.IsTerminal(int(os.Stdout.Fd())) {
+		return progressTerminal
+	}
+	return progressLog
+}
+
+// copyProgress reports the progress of a single copy.Image call. A nil
+// copyProgress reports nothing.
+type copyProgress struct {
+	mode   progressMode
+	label  string // e.g. "Pulling docker.io/library/nginx:1.27"
+	out    io.Writer
+	events chan types.ProgressProperties
+	done   chan struct{}
+
+	layers []*layerProgress
+	lines  int // Lines drawn on the terminal by the last redraw
+}
+
+type layerProgress struct {
+	digest  string
+	size    int64 // -1 when unknown
+	offset  uint64
+	started time.Time
+	elapsed time.Duration // Set once done
+	state   string        // "", "done" or "exists"
+}
+
+// startProgress starts reporting progress of a copy, or returns nil when mode
+// is progressNone. Pass it to copy.Options with apply and call stop once the
+// copy returned.
+func startProgress(mode progressMode, label string) *copyProgress {
+	if mode == progressNone {
+		return nil
+	}
+	p := &copyProgress{
+		mode:   mode,
+		label:  label,
+		out:    os.Stdout,
+		events: make(chan types.ProgressProperties),
+		done:   make(chan struct{}),
+	}
+	if mode == progressTerminal {
+		fmt.Fprintln(p.out, label)
+	}
+	go p.run()
+	return p
+}
+
+func (p *copyProgress) apply(options *copy.Options) {
+	if p == nil {
+		return
+	}
+	options.Progress = p.events
+	options.ProgressInterval = 200 * time.Millisecond
+	if p.mode == progressLog {
+		options.ProgressInterval = progressLogInterval
+	}
+}
+
+func (p *copyProgress) stop() {
+	if p == nil {
+		return
+	}
+	close(p.events)
+	<-p.done
+}
+
+func (p *copyProgress) run() {
+	defer close(p.done)
+	for event := range p.events {
+		layer := p.layer(event.Artifact)
+		switch event.Event {
+		case types.ProgressEventNewArtifact:
+			layer.started = time.Now()
+		case types.ProgressEventRead:
+			layer.offset = event.Offset
+			if p.mode == progressLog {
+				log.Printf("%s: %s", p.label, layer)
+			}
+		case types.ProgressEventDone:
+			layer.offset = event.Offset
+			layer.elapsed = time.Since(layer.started)
+			layer.state = "done"
+			if p.mode == progressLog {
+				log.Printf("%s: %s", p.label, layer)
+			}
+		case types.ProgressEventSkipped:
+			layer.state = "exists"
+		}
+		if p.mode == progressTerminal {
+			p.redraw()
+		}
+	}
+}
+
+func (p *copyProgress) layer(artifact types.BlobInfo) *layerProgress {
+	digest := artifact.Digest.String()
+	for _, layer := range p.layers {
+		if layer.digest == digest {
+			return layer
+		}
+	}
+	layer := &layerProgress{digest: digest, size: artifact.Size, started: time.Now()}
+	p.layers = append(p.layers, layer)
+	return layer
+}
+
+// redraw moves the cursor back over the lines drawn last time and draws a
+// line per layer.
+func (p *copyProgress) redraw() {
+	var b strings.Builder
+	if p.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA", p.lines)
+	}
+	for _, layer := range p.layers {
+		fmt.Fprintf(&b, "\r\033[K  %s\n", layer)
+	}
+	p.lines = len(p.layers)
+	io.WriteString(p.out, b.String())
+}
+
+func (l *layerProgress) String() string {
+	name := strings.TrimPrefix(l.digest, "sha256:")
+	if len(name) > 12 {
+		name = name[:12]
+	}
+	switch l.state {
+	case "exists":
+		return name + ": already exists"
+	case "done":
+		return fmt.Sprintf("%s: done, %s in %v", name, units.BytesSize(float64(l.offset)), l.elapsed.Round(time.Second))
+	}
+
+	elapsed := time.Since(l.started).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(l.offset) / elapsed
+	}
+	if l.size <= 0 {
+		return fmt.Sprintf("%s: %s at %s/s", name, units.BytesSize(float64(l.offset)), units.BytesSize(rate))
+	}
+
+	percent := float64(l.offset) * 100 / float64(l.size)
+	eta := "unknown"
+	if rate > 0 {
+		remaining := float64(l.size) - float64(l.offset)
+		eta = time.Duration(max(remaining, 0) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s: %3.0f%% %s of %s at %s/s, ETA %s", name, percent, units.BytesSize(float64(l.offset)), units.BytesSize(float64(l.size)), units.BytesSize(rate), eta)
+}
@@ -0,0 +1,377 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/internal/rest"
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+)
+
+// ensureDestRepository creates the destination repository (or project) when
+// the destination registry requires it to exist before a push.
+func ensureDestRepository(ctx context.Context, registry config.RegistryConfig, secret config.SecretConfig, credentials types.DockerAuthConfig) error {
+	switch {
+	case isECRDestination(registry, secret):
+		return ensureECRRepository(ctx, registry)
+	case isArtifactRegistry(registry.DestRegistry):
+		return ensureArtifactRegistryRepository(ctx, registry, secret)
+	case secret.Type == "harbor":
+		return ensureHarborProject(ctx, registry, credentials)
+	default:
+		log.Printf("Registry %s creates repositories on push, nothing to do.", registry.DestRegistry)
+		return nil
+	}
+}
+
+func isArtifactRegistry(host string) bool {
+	return strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+// isECRDestination reports whether the destination of registry is an ECR
+// repository.
+func isECRDestination(registry config.RegistryConfig, secret config.SecretConfig) bool {
+	return auth.IsECR(registry.DestRegistry) || secret.Type == "ecr"
+}
+
+func newECRClient(ctx context.Context, registry config.RegistryConfig) (*ecr.Client, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(auth.ECRRegion(registry.DestRegistry)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	return ecr.NewFromConfig(cfg), nil
+}
+
+func ensureECRRepository(ctx context.Context, registry config.RegistryConfig) error {
+	client, err := newECRClient(ctx, registry)
+	if err != nil {
+		return err
+	}
+
+	mutability := ecrtypes.ImageTagMutabilityMutable
+	if registry.ECR.ImmutableTags {
+		mutability = ecrtypes.ImageTagMutabilityImmutable
+	}
+
+	_, err = client.CreateRepository(ctx, &ecr.CreateRepositoryInput{
+		RepositoryName:     aws.String(registry.DestRepository),
+		ImageTagMutability: mutability,
+		ImageScanningConfiguration: &ecrtypes.ImageScanningConfiguration{
+			ScanOnPush: registry.ECR.ScanOnPush,
+		},
+	})
+	var exists *ecrtypes.RepositoryAlreadyExistsException
+	if errors.As(err, &exists) {
+		log.Printf("ECR repository %s already exists.", registry.DestRepository)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create ECR repository %s: %w", registry.DestRepository, err)
+	}
+
+	log.Printf("Created ECR repository %s (tag mutability %s, scan on push %t).", registry.DestRepository, mutability, registry.ECR.ScanOnPush)
+	return nil
+}
+
+// artifactRegistryOperationTimeout bounds the wait for a repository to be
+// created.
+const artifactRegistryOperationTimeout = 2 * time.Minute
+
+// ensureArtifactRegistryRepository creates the Artifact Registry repository
+// for a destination like europe-west3-docker.pkg.dev/<project>/<repository>/<image>.
+func ensureArtifactRegistryRepository(ctx context.Context, registry config.RegistryConfig, secret config.SecretConfig) error {
+	location := strings.TrimSuffix(registry.DestRegistry, "-docker.pkg.dev")
+	parts := strings.SplitN(registry.DestRepository, "/", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("destination repository %s must be in the form <project>/<repository>/<image>", registry.DestRepository)
+	}
+	project, repository := parts[0], parts[1]
+
+	if secret.ServiceAccountKey == "" {
+		return fmt.Errorf("a service account key is required to create Artifact Registry repositories")
+	}
+	token, err := auth.GoogleToken(secret.ServiceAccountKey, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return err
+	}
+
+	parent := fmt.Sprintf("https://artifactregistry.googleapis.com/v1/projects/%s/locations/%s/repositories", project, location)
+	status, body, err := rest.DoJSON(ctx, http.MethodGet, parent+"/"+repository, nil, rest.BearerAuth(token))
+	if err != nil {
+		return fmt.Errorf("failed to look up Artifact Registry repository: %w", err)
+	}
+	if status == http.StatusOK {
+		log.Printf("Artifact Registry repository %s/%s already exists.", project, repository)
+		return nil
+	}
+	if status != http.StatusNotFound {
+		return fmt.Errorf("unexpected status %d looking up Artifact Registry repository: %s", status, body)
+	}
+
+	status, body, err = rest.DoJSON(ctx, http.MethodPost, parent+"?repositoryId="+url.QueryEscape(repository), map[string]string{"format": "DOCKER"}, rest.BearerAuth(token))
+	if err != nil {
+		return fmt.Errorf("failed to create Artifact Registry repository: %w", err)
+	}
+	if status == http.StatusConflict {
+		log.Printf("Artifact Registry repository %s/%s already exists.", project, repository)
+		return nil
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d creating Artifact Registry repository: %s", status, body)
+	}
+	// The repository is created by a long-running operation, pushes fail until it is done
+	if err := waitArtifactRegistryOperation(ctx, body, token); err != nil {
+		return fmt.Errorf("failed to create Artifact Registry repository: %w", err)
+	}
+
+	log.Printf("Created Artifact Registry repository %s/%s in %s.", project, repository, location)
+	return nil
+}
+
+// artifactRegistryOperation is the part of a long-running operation the
+// provisioning reads.
+type artifactRegistryOperation struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// waitArtifactRegistryOperation polls the operation in body until it is done,
+// for at most artifactRegistryOperationTimeout.
+func waitArtifactRegistryOperation(ctx context.Context, body []byte, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, artifactRegistryOperationTimeout)
+	defer cancel()
+	for {
+		var op artifactRegistryOperation
+		if err := json.Unmarshal(body, &op); err != nil {
+			return fmt.Errorf("invalid operation: %w", err)
+		}
+		if op.Error != nil {
+			return errors.New(op.Error.Message)
+		}
+		if op.Done {
+			return nil
+		}
+		if op.Name == "" {
+			return fmt.Errorf("operation without a name: %s", body)
+		}
+		if err := sleepContext(ctx, time.Second); err != nil {
+			return fmt.Errorf("operation %s not done: %w", op.Name, err)
+		}
+		status, respBody, err := rest.DoJSON(ctx, http.MethodGet, "https://artifactregistry.googleapis.com/v1/"+op.Name, nil, rest.BearerAuth(token))
+		if err != nil {
+			return fmt.Errorf("failed to poll operation %s: %w", op.Name, err)
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("unexpected status %d polling operation %s: %s", status, op.Name, respBody)
+		}
+		body = respBody
+	}
+}
+
+// harborProject is the part of a Harbor project the provisioning reads.
+type harborProject struct {
+	ProjectID int               `json:"project_id"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+// ensureHarborProject creates the Harbor project that holds the destination
+// repository, i.e. the first path component of dest_repository, and applies
+// the storage quota and auto-scan setting of the harbor block to it.
+func ensureHarborProject(ctx context.Context, registry config.RegistryConfig, credentials types.DockerAuthConfig) error {
+	project := strings.SplitN(registry.DestRepository, "/", 2)[0]
+	api := fmt.Sprintf("https://%s/api/v2.0", registry.DestRegistry)
+	basicAuth := rest.BasicAuth(credentials.Username, credentials.Password)
+	// Project names like "1234" would otherwise be taken for IDs
+	byName := func(req *http.Request) {
+		basicAuth(req)
+		req.Header.Set("X-Is-Resource-Name", "true")
+	}
+	storageLimit := int64(-1)
+	if registry.Harbor.StorageLimit != "" {
+		limit, err := ParseSize(registry.Harbor.StorageLimit)
+		if err != nil {
+			return err
+		}
+		storageLimit = limit
+	}
+
+	status, body, err := rest.DoJSON(ctx, http.MethodGet, api+"/projects/"+url.PathEscape(project), nil, byName)
+	if err != nil {
+		return fmt.Errorf("failed to look up Harbor project: %w", err)
+	}
+	switch status {
+	case http.StatusOK:
+		var existing harborProject
+		if err := json.Unmarshal(body, &existing); err != nil {
+			return fmt.Errorf("invalid Harbor project %s: %w", project, err)
+		}
+		log.Printf("Harbor project %s already exists.", project)
+		return updateHarborProject(ctx, api, project, existing, registry.Harbor, storageLimit, byName)
+	case http.StatusNotFound:
+	default:
+		return fmt.Errorf("unexpected status %d looking up Harbor project: %s", status, body)
+	}
+
+	metadata := map[string]string{"public": strconv.FormatBool(registry.Harbor.Public)}
+	if registry.Harbor.AutoScan != nil {
+		metadata["auto_scan"] = strconv.FormatBool(*registry.Harbor.AutoScan)
+	}
+	status, body, err = rest.DoJSON(ctx, http.MethodPost, api+"/projects", map[string]interface{}{
+		"project_name":  project,
+		"metadata":      metadata,
+		"storage_limit": storageLimit,
+	}, basicAuth)
+	if err != nil {
+		return fmt.Errorf("failed to create Harbor project: %w", err)
+	}
+	if status != http.StatusCreated && status != http.StatusConflict {
+		return fmt.Errorf("unexpected status %d creating Harbor project: %s", status, body)
+	}
+
+	log.Printf("Created Harbor project %s.", project)
+	return nil
+}
+
+// updateHarborProject brings the auto-scan setting and storage quota of an
+// existing project in line with the harbor block. Settings left out of the
+// block are not touched.
+func updateHarborProject(ctx context.Context, api, project string, existing harborProject, cfg config.HarborConfig, storageLimit int64, auth func(*http.Request)) error {
+	if cfg.AutoScan != nil && existing.Metadata["auto_scan"] != strconv.FormatBool(*cfg.AutoScan) {
+		status, body, err := rest.DoJSON(ctx, http.MethodPut, api+"/projects/"+url.PathEscape(project), map[string]interface{}{
+			"metadata": map[string]string{"auto_scan": strconv.FormatBool(*cfg.AutoScan)},
+		}, auth)
+		if err != nil {
+			return fmt.Errorf("failed to update Harbor project: %w", err)
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("unexpected status %d updating Harbor project: %s", status, body)
+		}
+		log.Printf("Set auto_scan of Harbor project %s to %t.", project, *cfg.AutoScan)
+	}
+	if cfg.StorageLimit == "" {
+		return nil
+	}
+
+	status, body, err := rest.DoJSON(ctx, http.MethodGet, fmt.Sprintf("%s/quotas?reference=project&reference_id=%d", api, existing.ProjectID), nil, auth)
+	if err != nil {
+		return fmt.Errorf("failed to look up Harbor quota: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d looking up Harbor quota: %s", status, body)
+	}
+	var quotas []struct {
+		ID   int              `json:"id"`
+		Hard map[string]int64 `json:"hard"`
+	}
+	if err := json.Unmarshal(body, &quotas); err != nil {
+		return fmt.Errorf("invalid Harbor quota: %w", err)
+	}
+	if len(quotas) == 0 {
+		return fmt.Errorf("no quota found for Harbor project %s", project)
+	}
+	if quotas[0].Hard["storage"] == storageLimit {
+		return nil
+	}
+	status, body, err = rest.DoJSON(ctx, http.MethodPut, fmt.Sprintf("%s/quotas/%d", api, quotas[0].ID), map[string]interface{}{
+		"hard": map[string]int64{"storage": storageLimit},
+	}, auth)
+	if err != nil {
+		return fmt.Errorf("failed to update Harbor quota: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d updating Harbor quota: %s", status, body)
+	}
+	log.Printf("Set storage quota of Harbor project %s to %s.", project, cfg.StorageLimit)
+	return nil
+}
+
+// ecrLifecycleRule is a rule of an ECR lifecycle policy document.
+type ecrLifecycleRule struct {
+	RulePriority int    `json:"rulePriority"`
+	Description  string `json:"description"`
+	Selection    struct {
+		TagStatus   string `json:"tagStatus"`
+		CountType   string `json:"countType"`
+		CountUnit   string `json:"countUnit,omitempty"`
+		CountNumber int    `json:"countNumber"`
+	} `json:"selection"`
+	Action struct {
+		Type string `json:"type"`
+	} `json:"action"`
+}
+
+// ValidateECRLifecyclePolicy checks the settings of policy and that it
+// renders to a JSON document.
+func ValidateECRLifecyclePolicy(policy *config.ECRLifecyclePolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	_, err := ecrLifecyclePolicyText(policy)
+	return err
+}
+
+// ecrLifecyclePolicyText returns the lifecycle policy document of policy.
+// ECR requires the rule selecting any tag status to come last.
+func ecrLifecyclePolicyText(policy *config.ECRLifecyclePolicy) (string, error) {
+	if policy.Policy != "" {
+		if !json.Valid([]byte(policy.Policy)) {
+			return "", fmt.Errorf("ecr.lifecycle_policy.policy is not valid JSON")
+		}
+		return policy.Policy, nil
+	}
+	rules := []ecrLifecycleRule{}
+	if policy.ExpireUntaggedDays > 0 {
+		rule := ecrLifecycleRule{RulePriority: len(rules) + 1, Description: fmt.Sprintf("Expire untagged images after %d days", policy.ExpireUntaggedDays)}
+		rule.Selection.TagStatus, rule.Selection.CountType, rule.Selection.CountUnit, rule.Selection.CountNumber = "untagged", "sinceImagePushed", "days", policy.ExpireUntaggedDays
+		rule.Action.Type = "expire"
+		rules = append(rules, rule)
+	}
+	if policy.KeepLast > 0 {
+		rule := ecrLifecycleRule{RulePriority: len(rules) + 1, Description: fmt.Sprintf("Keep the last %d images", policy.KeepLast)}
+		rule.Selection.TagStatus, rule.Selection.CountType, rule.Selection.CountNumber = "any", "imageCountMoreThan", policy.KeepLast
+		rule.Action.Type = "expire"
+		rules = append(rules, rule)
+	}
+	text, err := json.Marshal(map[string]any{"rules": rules})
+	return string(text), err
+}
+
+// applyECRLifecyclePolicy sets the lifecycle policy of the ECR destination
+// repository and returns the applied policy document.
+func applyECRLifecyclePolicy(ctx context.Context, registry config.RegistryConfig) (string, error) {
+	text, err := ecrLifecyclePolicyText(registry.ECR.LifecyclePolicy)
+	if err != nil {
+		return "", err
+	}
+	client, err := newECRClient(ctx, registry)
+	if err != nil {
+		return "", err
+	}
+	_, err = client.PutLifecyclePolicy(ctx, &ecr.PutLifecyclePolicyInput{
+		RepositoryName:      aws.String(registry.DestRepository),
+		LifecyclePolicyText: aws.String(text),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to apply lifecycle policy to ECR repository %s: %w", registry.DestRepository, err)
+	}
+	log.Printf("Applied lifecycle policy to ECR repository %s.", registry.DestRepository)
+	return text, nil
+}
@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"registries-sync/internal/nats"
+	"registries-sync/internal/rest"
+	"registries-sync/pkg/config"
+)
+
+// kafkaJSONContentType is the content type of JSON records sent to the v2
+// API of a Kafka REST Proxy.
+const kafkaJSONContentType = "application/vnd.kafka.json.v2+json"
+
+// imageEvent is published for every image copied to a destination.
+type imageEvent struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Digest      string    `json:"digest"`
+	Platforms   []string  `json:"platforms"`
+	Duration    float64   `json:"duration_seconds"`
+	Time        time.Time `json:"time"`
+	CopyID      string    `json:"copy_id"`
+}
+
+// publisher sends image events to the configured message brokers. A nil
+// publisher publishes nothing.
+type publisher struct {
+	cfg  config.PublishConfig
+	nats *nats.Conn
+}
+
+func newPublisher(cfg config.PublishConfig) (*publisher, error) {
+	if cfg.NATS == nil && cfg.Kafka == nil {
+		return nil, nil
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	p := &publisher{cfg: cfg}
+	if cfg.NATS != nil {
+		conn, err := nats.New(cfg.NATS.URL, "registries-sync")
+		if err != nil {
+			return nil, fmt.Errorf("publish.nats: %w", err)
+		}
+		p.nats = conn
+	}
+	return p, nil
+}
+
+// publish sends event to every broker. Failures are logged, they don't fail
+// the copy.
+func (p *publisher) publish(ctx context.Context, event imageEvent) {
+	if p == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		logf(ctx, "Failed to encode event for %s: %v", event.Destination, err)
+		return
+	}
+	if p.nats != nil {
+		if err := p.nats.Publish(ctx, p.cfg.NATS.Subject, data); err != nil {
+			logf(ctx, "Failed to publish %s to NATS: %v", event.Destination, err)
+		}
+	}
+	if p.cfg.Kafka != nil {
+		if err := produceKafka(ctx, p.cfg.Kafka, event); err != nil {
+			logf(ctx, "Failed to publish %s to Kafka: %v", event.Destination, err)
+		}
+	}
+}
+
+func (p *publisher) Close() error {
+	if p == nil || p.nats == nil {
+		return nil
+	}
+	return p.nats.Close()
+}
+
+// produceKafka sends event as a record keyed by its destination, so events
+// of an image stay in order within their partition.
+func produceKafka(ctx context.Context, cfg *config.KafkaPublishConfig, event imageEvent) error {
+	endpoint := strings.TrimSuffix(cfg.RESTProxyURL, "/") + "/topics/" + url.PathEscape(cfg.Topic)
+	records := map[string]any{"records": []map[string]any{{"key": event.Destination, "value": event}}}
+	status, body, err := rest.DoJSON(ctx, http.MethodPost, endpoint, records, func(req *http.Request) {
+		req.Header.Set("Content-Type", kafkaJSONContentType)
+		req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+		rest.BasicAuth(cfg.Username, cfg.Password)(req)
+	})
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from REST proxy: %s", status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// copiedPlatforms returns the platforms of an image pushed as copiedManifest
+// to ref: those of the instances of a manifest list, or the platform in the
+// config of a single image, which is fetched from ref.
+func copiedPlatforms(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, copiedManifest []byte) ([]imgspecv1.Platform, error) {
+	mimeType := manifest.GuessMIMEType(copiedManifest)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(copiedManifest, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		platforms := []imgspecv1.Platform{}
+		for _, instanceDigest := range list.Instances() {
+			instance, err := list.Instance(instanceDigest)
+			if err != nil {
+				return nil, err
+			}
+			if instance.ReadOnly.Platform != nil {
+				platforms = append(platforms, *instance.ReadOnly.Platform)
+			}
+		}
+		return platforms, nil
+	}
+
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	img, err := image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(src, nil))
+	if err != nil {
+		return nil, err
+	}
+	inspect, err := img.Inspect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.Os == "" {
+		// Not an image, e.g. a Helm chart
+		return []imgspecv1.Platform{}, nil
+	}
+	return []imgspecv1.Platform{{OS: inspect.Os, Architecture: inspect.Architecture, Variant: inspect.Variant}}, nil
+}
+
+// platformStrings formats platforms with platformString.
+func platformStrings(platforms []imgspecv1.Platform) []string {
+	formatted := []string{}
+	for _, platform := range platforms {
+		formatted = append(formatted, platformString(platform))
+	}
+	return formatted
+}
@@ -0,0 +1,156 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"registries-sync/internal/rest"
+	"registries-sync/pkg/config"
+)
+
+// pushTimeout bounds pushing the metrics of a run.
+const pushTimeout = 30 * time.Second
+
+// pushMetrics replaces the metrics of the run's group on the Pushgateway with
+// those of report. Failures are logged.
+func pushMetrics(ctx context.Context, cfg *config.PushgatewayConfig, report *Report) {
+	if cfg == nil {
+		return
+	}
+	// Also push the metrics of interrupted runs
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+	defer cancel()
+
+	endpoint := pushgatewayURL(cfg)
+	report.mu.Lock()
+	metrics := runMetrics(report)
+	report.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(metrics))
+	if err != nil {
+		log.Printf("Failed to push metrics: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	rest.BasicAuth(cfg.Username, cfg.Password)(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to push metrics to %s: %v", cfg.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("Failed to push metrics to %s: unexpected status %d: %s", cfg.URL, resp.StatusCode, strings.TrimSpace(string(body)))
+		return
+	}
+	log.Printf("Pushed run metrics to %s", cfg.URL)
+}
+
+// pushgatewayURL returns the URL of the grouping key of cfg, e.g.
+// http://pushgateway:9091/metrics/job/registries-sync/instance/cluster-a.
+func pushgatewayURL(cfg *config.PushgatewayConfig) string {
+	job := cfg.Job
+	if job == "" {
+		job = "registries-sync"
+	}
+	path := "/metrics" + groupingSegment("job", job)
+	names := make([]string, 0, len(cfg.Labels))
+	for name := range cfg.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path += groupingSegment(name, cfg.Labels[name])
+	}
+	return strings.TrimSuffix(cfg.URL, "/") + path
+}
+
+// groupingSegment encodes a label of the grouping key. Values the path can't
+// hold, such as those containing a slash, are base64 encoded.
+func groupingSegment(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
+
+// runMetrics renders report in the Prometheus text format.
+func runMetrics(report *Report) []byte {
+	var out bytes.Buffer
+	gauge := func(name, help string) {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	success := 1
+	if report.Failed() {
+		success = 0
+	}
+	gauge("registries_sync_last_run_success", "Whether the last run finished without failures.")
+	fmt.Fprintf(&out, "registries_sync_last_run_success %d\n", success)
+	gauge("registries_sync_last_run_duration_seconds", "Duration of the last run.")
+	fmt.Fprintf(&out, "registries_sync_last_run_duration_seconds %g\n", report.DurationSeconds)
+	gauge("registries_sync_last_run_timestamp_seconds", "When the last run finished, as a Unix timestamp.")
+	fmt.Fprintf(&out, "registries_sync_last_run_timestamp_seconds %d\n", report.Started.Add(time.Duration(report.DurationSeconds*float64(time.Second))).Unix())
+	gauge("registries_sync_last_run_skipped_images", "Images not copied because of the scan, the policy hook or the age and size limits.")
+	fmt.Fprintf(&out, "registries_sync_last_run_skipped_images %d\n", len(report.Skipped))
+	gauge("registries_sync_persistently_failing_tags", "Tags that failed in at least quarantine.after consecutive runs.")
+	fmt.Fprintf(&out, "registries_sync_persistently_failing_tags %d\n", len(report.PersistentFailures))
+
+	perRegistry := []struct {
+		name, help string
+		value      func(*RegistryReport) float64
+	}{
+		{"registries_sync_last_run_tags_synced", "Tags copied by the last run.", func(r *RegistryReport) float64 { return float64(r.TagsSynced) }},
+		{"registries_sync_last_run_tags_skipped", "Tags skipped by the last run.", func(r *RegistryReport) float64 { return float64(r.TagsSkipped) }},
+		{"registries_sync_last_run_tags_failed", "Tags that failed in the last run.", func(r *RegistryReport) float64 { return float64(r.TagsFailed) }},
+		{"registries_sync_last_run_bytes_transferred", "Bytes pulled from the source by the last run.", func(r *RegistryReport) float64 { return float64(r.BytesTransferred) }},
+		{"registries_sync_last_run_unverified_signatures", "Destination images failing signature verification in the last run.", func(r *RegistryReport) float64 { return float64(len(r.UnverifiedSignatures)) }},
+		{"registries_sync_last_run_registry_failed", "Whether the registry entry failed in the last run.", func(r *RegistryReport) float64 {
+			if r.Error != "" {
+				return 1
+			}
+			return 0
+		}},
+	}
+	for _, metric := range perRegistry {
+		gauge(metric.name, metric.help)
+		for _, registry := range report.Registries {
+			fmt.Fprintf(&out, "%s{source=\"%s\"} %g\n", metric.name, escapeLabelValue(registry.Source), metric.value(registry))
+		}
+	}
+
+	gauge("registries_sync_mirror_lag_seconds", "How far the newest mirrored tag is behind the newest source tag, for entries selecting their tags from the source.")
+	for _, registry := range report.Registries {
+		if registry.MirrorLag != nil {
+			fmt.Fprintf(&out, "registries_sync_mirror_lag_seconds{source=\"%s\"} %g\n", escapeLabelValue(registry.Source), registry.MirrorLag.Seconds)
+		}
+	}
+
+	gauge("registries_sync_last_run_source_bytes", "Bytes pulled from the source registry by the last run.")
+	for _, transfer := range report.SourceRegistries {
+		fmt.Fprintf(&out, "registries_sync_last_run_source_bytes{source_registry=\"%s\"} %d\n", escapeLabelValue(transfer.Registry), transfer.BytesTransferred)
+	}
+	gauge("registries_sync_last_run_egress_cost", "Estimated egress cost of the traffic pulled from the source registry by the last run.")
+	for _, transfer := range report.SourceRegistries {
+		if transfer.EstimatedCost != nil {
+			fmt.Fprintf(&out, "registries_sync_last_run_egress_cost{source_registry=\"%s\"} %g\n", escapeLabelValue(transfer.Registry), *transfer.EstimatedCost)
+		}
+	}
+	return out.Bytes()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,259 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"registries-sync/pkg/config"
+)
+
+// FailedTag is a tag that failed in consecutive runs, as recorded in the
+// quarantine file.
+type FailedTag struct {
+	Entry      string    `json:"entry"` // The registry entry, its source and destinations
+	Tag        string    `json:"tag"`
+	Source     string    `json:"source"` // The source image
+	Runs       int       `json:"runs"`   // Consecutive runs the tag failed in
+	LastError  string    `json:"last_error"`
+	LastFailed time.Time `json:"last_failed"`
+}
+
+type failuresFile struct {
+	Tags []FailedTag `json:"tags"`
+}
+
+// failureTracker counts the consecutive runs every tag failed in. The
+// quarantine file is read again when a run starts, so tags cleared between
+// runs are retried, and saved after every change. A nil *failureTracker
+// tracks nothing.
+type failureTracker struct {
+	path  string
+	after int
+	skip  bool
+
+	mu     sync.Mutex
+	tags   map[string]*FailedTag // By failureKey
+	failed map[string]bool       // Tags that already failed in the current run
+}
+
+func newFailureTracker(cfg *config.QuarantineConfig) (*failureTracker, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	t := &failureTracker{path: cfg.Path(), after: cfg.After, skip: cfg.Skip, failed: map[string]bool{}}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func failureKey(entry, tag string) string {
+	return entry + " " + tag
+}
+
+func (t *failureTracker) load() error {
+	tags, err := LoadFailedTags(t.path)
+	if err != nil {
+		return err
+	}
+	t.tags = map[string]*FailedTag{}
+	for i := range tags {
+		t.tags[failureKey(tags[i].Entry, tags[i].Tag)] = &tags[i]
+	}
+	return nil
+}
+
+// startRun begins counting the failures of a new run.
+func (t *failureTracker) startRun() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.load(); err != nil {
+		log.Printf("Failed to reload quarantine file, keeping the failures known so far: %v", err)
+	}
+	t.failed = map[string]bool{}
+}
+
+// quarantined returns the failures of tag when it is not retried, because it
+// failed in at least after consecutive runs and skip is set.
+func (t *failureTracker) quarantined(registry config.RegistryConfig, tag string) (FailedTag, bool) {
+	if t == nil || !t.skip {
+		return FailedTag{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failure, ok := t.tags[failureKey(registryKey(registry), tag)]
+	if !ok || failure.Runs < t.after {
+		return FailedTag{}, false
+	}
+	return *failure, true
+}
+
+// tagFailed counts a failure of tag, once per run however often the tag is
+// retried within it.
+func (t *failureTracker) tagFailed(registry config.RegistryConfig, tag, source string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := failureKey(registryKey(registry), tag)
+	failure, ok := t.tags[key]
+	if !ok {
+		failure = &FailedTag{Entry: registryKey(registry), Tag: tag, Source: source}
+		t.tags[key] = failure
+	}
+	if !t.failed[key] {
+		t.failed[key] = true
+		failure.Runs++
+		if failure.Runs == t.after && t.skip {
+			log.Printf("%s failed in %d consecutive runs, it is quarantined until cleared", source, failure.Runs)
+		} else if failure.Runs == t.after {
+			log.Printf("%s failed in %d consecutive runs", source, failure.Runs)
+		}
+	}
+	failure.LastError = err.Error()
+	failure.LastFailed = time.Now()
+	t.save()
+}
+
+// tagSucceeded forgets the failures of tag once it was synced or skipped.
+func (t *failureTracker) tagSucceeded(registry config.RegistryConfig, tag string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := failureKey(registryKey(registry), tag)
+	_, ok := t.tags[key]
+	delete(t.tags, key)
+	if ok {
+		t.save()
+	}
+}
+
+// prune forgets the failures of the tags of registry that are no longer
+// selected.
+func (t *failureTracker) prune(registry config.RegistryConfig, selected []string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pruned := false
+	for key, failure := range t.tags {
+		if failure.Entry == registryKey(registry) && !slices.Contains(selected, failure.Tag) {
+			delete(t.tags, key)
+			pruned = true
+		}
+	}
+	if pruned {
+		t.save()
+	}
+}
+
+// persistent lists the tags that failed in at least after consecutive runs,
+// with the number of runs and the last error.
+func (t *failureTracker) persistent() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	persistent := []string{}
+	for _, failure := range t.tags {
+		if failure.Runs >= t.after {
+			persistent = append(persistent, fmt.Sprintf("%s (%d runs): %s", failure.Source, failure.Runs, failure.LastError))
+		}
+	}
+	sort.Strings(persistent)
+	return persistent
+}
+
+// save writes the quarantine file, with t.mu held so writes don't interleave.
+func (t *failureTracker) save() {
+	tags := []FailedTag{}
+	for _, failure := range t.tags {
+		tags = append(tags, *failure)
+	}
+	if err := saveFailedTags(t.path, tags); err != nil {
+		log.Printf("Failed to save quarantine file: %v", err)
+	}
+}
+
+// LoadFailedTags reads the quarantine file at path. It holds no tags when it
+// doesn't exist.
+func LoadFailedTags(path string) ([]FailedTag, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []FailedTag{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file failuresFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid quarantine file %s: %w", path, err)
+	}
+	return file.Tags, nil
+}
+
+// ClearFailedTags removes the tags whose source image or source repository is
+// among images from the quarantine file at path, every tag when images is
+// empty, so the next run retries them. It returns the number of tags removed.
+func ClearFailedTags(path string, images []string) (int, error) {
+	tags, err := LoadFailedTags(path)
+	if err != nil {
+		return 0, err
+	}
+	kept := []FailedTag{}
+	for _, failure := range tags {
+		if len(images) > 0 && !slices.Contains(images, failure.Source) && !slices.Contains(images, sourceRepository(failure.Source)) {
+			kept = append(kept, failure)
+		}
+	}
+	if len(kept) == len(tags) {
+		return 0, nil
+	}
+	return len(tags) - len(kept), saveFailedTags(path, kept)
+}
+
+// sourceRepository returns image without its tag or digest.
+func sourceRepository(image string) string {
+	if repository, _, ok := strings.Cut(image, "@"); ok {
+		return repository
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+// saveFailedTags writes the quarantine file atomically, sorted by source.
+func saveFailedTags(path string, tags []FailedTag) error {
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Source != tags[j].Source {
+			return tags[i].Source < tags[j].Source
+		}
+		return tags[i].Entry < tags[j].Entry
+	})
+	data, err := json.MarshalIndent(failuresFile{Tags: tags}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
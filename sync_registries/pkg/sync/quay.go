@@ -0,0 +1,95 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"registries-sync/internal/rest"
+	"registries-sync/pkg/config"
+)
+
+// quayOAuthUser is the username that marks the password as an OAuth
+// application token, at the registry and in source_credentials.
+const quayOAuthUser = "$oauthtoken"
+
+// quayTag is a tag listed by the Quay API.
+type quayTag struct {
+	Name         string `json:"name"`
+	LastModified string `json:"last_modified"` // RFC 1123, e.g. "Thu, 02 May 2024 10:00:00 -0000"
+}
+
+// usesQuayAPI reports whether the tags of the source of registry are listed
+// with the Quay API, which returns every tag with its push time in far fewer
+// requests than the registry API.
+func usesQuayAPI(registry config.RegistryConfig) bool {
+	switch registry.SourceAPI {
+	case "quay":
+		return true
+	case "registry":
+		return false
+	}
+	return registry.SourceRegistry == "quay.io"
+}
+
+// listQuayTags lists the active tags of the source repository with the Quay
+// API. Tags last pushed before max_tag_age are left out, except pinned ones.
+// The API only accepts OAuth application tokens, given as the source_credentials
+// password with the username $oauthtoken. Public repositories need none.
+func (s *Syncer) listQuayTags(ctx context.Context, registry config.RegistryConfig) ([]string, error) {
+	maxTagAge, err := ParseAge(registry.MaxTagAge)
+	if err != nil {
+		return nil, err
+	}
+	token := ""
+	if credentials := registry.SourceCredentials; credentials != nil && credentials.Username == quayOAuthUser {
+		token = credentials.Password
+	}
+
+	tags, old := []string{}, 0
+	for page := 1; ; page++ {
+		if err := s.waitForRequest(ctx, registry.SourceRegistry); err != nil {
+			return nil, err
+		}
+		endpoint := fmt.Sprintf("https://%s/api/v1/repository/%s/tag/?onlyActiveTags=true&limit=100&page=%d", registry.SourceRegistry, registry.SourceRepository, page)
+		status, body, err := rest.DoJSON(ctx, http.MethodGet, endpoint, nil, func(req *http.Request) {
+			s.headers.set(req)
+			rest.BearerAuth(token)(req)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d from the Quay API: %s", status, strings.TrimSpace(string(body)))
+		}
+		var response struct {
+			Tags          []quayTag `json:"tags"`
+			HasAdditional bool      `json:"has_additional"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("invalid response from the Quay API: %w", err)
+		}
+		for _, tag := range response.Tags {
+			if maxTagAge > 0 && !slices.Contains(registry.PinTags, tag.Name) {
+				modified, err := time.Parse(time.RFC1123Z, tag.LastModified)
+				if err == nil && time.Since(modified) > maxTagAge {
+					old++
+					continue
+				}
+			}
+			tags = append(tags, tag.Name)
+		}
+		if !response.HasAdditional {
+			break
+		}
+	}
+	if old > 0 {
+		log.Printf("Left out %d tags of %s/%s last pushed over max_tag_age of %s ago", old, registry.SourceRegistry, registry.SourceRepository, registry.MaxTagAge)
+	}
+	return tags, nil
+}
@@ -0,0 +1,152 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/time/rate"
+
+	"registries-sync/pkg/config"
+)
+
+// newRequestLimiters creates a limiter per registry host of the
+// requests_per_second setting. The burst is one second worth of requests.
+func newRequestLimiters(requestsPerSecond map[string]float64) (map[string]*rate.Limiter, error) {
+	limiters := map[string]*rate.Limiter{}
+	for host, rps := range requestsPerSecond {
+		if rps <= 0 {
+			return nil, fmt.Errorf("invalid requests_per_second %v for %s: must be greater than zero", rps, host)
+		}
+		limiters[limiterHost(host)] = rate.NewLimiter(rate.Limit(rps), int(math.Ceil(rps)))
+	}
+	return limiters, nil
+}
+
+// addSourceLimiters gives every source host of registries without a
+// requests_per_second entry a limiter of source_requests_per_second, shared
+// by every entry pulling from the host.
+func addSourceLimiters(limiters map[string]*rate.Limiter, rps float64, registries []config.RegistryConfig) error {
+	if rps == 0 {
+		return nil
+	}
+	if rps < 0 {
+		return fmt.Errorf("invalid source_requests_per_second %v: must be greater than zero", rps)
+	}
+	for _, registry := range registries {
+		for _, host := range append([]string{registry.SourceRegistry}, registry.SourceFallbacks...) {
+			if _, ok := limiters[limiterHost(host)]; !ok {
+				limiters[limiterHost(host)] = rate.NewLimiter(rate.Limit(rps), int(math.Ceil(rps)))
+			}
+		}
+	}
+	return nil
+}
+
+// limiterHost folds the names of a registry together, Docker Hub answers
+// under several, and a host with the default port is the same host. A path
+// after the host, as in source fallbacks, is ignored.
+func limiterHost(host string) string {
+	return config.RegistryHost(host)
+}
+
+// requestLimiter returns the request limiter of host, or nil.
+func (s *Syncer) requestLimiter(host string) *rate.Limiter {
+	return s.requestLimiters[limiterHost(host)]
+}
+
+// waitForRequest blocks until the limiter of host allows another request.
+func (s *Syncer) waitForRequest(ctx context.Context, host string) error {
+	if limiter := s.requestLimiter(host); limiter != nil {
+		return limiter.Wait(ctx)
+	}
+	return nil
+}
+
+// rateLimitedReference wraps an image reference so that every registry
+// operation made by copy.Image waits for the request limiter first. As with
+// bandwidth throttling, containers/image doesn't take a custom HTTP
+// transport, so each manifest and blob operation counts as one request.
+type rateLimitedReference struct {
+	types.ImageReference
+	limiter *rate.Limiter
+}
+
+// newRateLimitedReference wraps ref, or returns it unchanged when limiter is
+// nil.
+func newRateLimitedReference(ref types.ImageReference, limiter *rate.Limiter) types.ImageReference {
+	if limiter == nil {
+		return ref
+	}
+	return &rateLimitedReference{ImageReference: ref, limiter: limiter}
+}
+
+func (r *rateLimitedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitedSource{ImageSource: src, limiter: r.limiter}, nil
+}
+
+func (r *rateLimitedReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitedDestination{ImageDestination: dest, limiter: r.limiter}, nil
+}
+
+type rateLimitedSource struct {
+	types.ImageSource
+	limiter *rate.Limiter
+}
+
+func (s *rateLimitedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, "", err
+	}
+	return s.ImageSource.GetManifest(ctx, instanceDigest)
+}
+
+func (s *rateLimitedSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, 0, err
+	}
+	return s.ImageSource.GetBlob(ctx, info, cache)
+}
+
+type rateLimitedDestination struct {
+	types.ImageDestination
+	limiter *rate.Limiter
+}
+
+func (d *rateLimitedDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	if err := d.limiter.Wait(ctx); err != nil {
+		return false, types.BlobInfo{}, err
+	}
+	return d.ImageDestination.TryReusingBlob(ctx, info, cache, canSubstitute)
+}
+
+func (d *rateLimitedDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	if err := d.limiter.Wait(ctx); err != nil {
+		return types.BlobInfo{}, err
+	}
+	return d.ImageDestination.PutBlob(ctx, stream, inputInfo, cache, isConfig)
+}
+
+func (d *rateLimitedDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	if err := d.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return d.ImageDestination.PutManifest(ctx, manifest, instanceDigest)
+}
@@ -0,0 +1,278 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxReferrerDepth bounds how far referrers of referrers, such as the
+// signature of an SBOM, are followed.
+const maxReferrerDepth = 3
+
+// copyReferrers copies the artifacts that refer to subject in the source
+// repository, SBOMs, provenance and other attestations, to target, followed
+// by their own referrers. It returns the number of artifacts copied. Sources
+// without the OCI 1.1 referrers API have none.
+func (s *Syncer) copyReferrers(ctx context.Context, registry repositoryRef, sourceCtx *types.SystemContext, target destinationTarget, subject digest.Digest) (int, error) {
+	policyContext, err := signature.NewPolicyContext(insecureAcceptAnythingPolicy())
+	if err != nil {
+		return 0, fmt.Errorf("failed to create policy context: %w", err)
+	}
+	defer policyContext.Destroy()
+
+	seen := map[digest.Digest]bool{subject: true}
+	subjects := []digest.Digest{subject}
+	copied := 0
+	for depth := 0; depth < maxReferrerDepth && len(subjects) > 0; depth++ {
+		next := []digest.Digest{}
+		for _, subject := range subjects {
+			if err := s.waitForRequest(ctx, registry.host); err != nil {
+				return copied, err
+			}
+			referrers, err := listReferrers(ctx, sourceCtx, s.headers, registry, subject)
+			if err != nil {
+				return copied, fmt.Errorf("failed to list referrers of %s: %w", subject, err)
+			}
+			for _, referrer := range referrers {
+				if seen[referrer.Digest] {
+					continue
+				}
+				seen[referrer.Digest] = true
+				if err := s.copyReferrer(ctx, policyContext, registry, sourceCtx, target, referrer); err != nil {
+					return copied, err
+				}
+				copied++
+				next = append(next, referrer.Digest)
+			}
+		}
+		subjects = next
+	}
+	return copied, nil
+}
+
+// copyReferrer copies a single referrer by digest. The artifact is only
+// reachable through an image that passed the signature policy, so it is
+// copied without checking signatures of its own.
+func (s *Syncer) copyReferrer(ctx context.Context, policyContext *signature.PolicyContext, registry repositoryRef, sourceCtx *types.SystemContext, target destinationTarget, referrer imgspecv1.Descriptor) error {
+	sourceImage := fmt.Sprintf("%s@%s", registry, referrer.Digest)
+	destImage := fmt.Sprintf("%s@%s", target.Destination, referrer.Digest)
+	srcRef, err := docker.ParseReference("//" + sourceImage)
+	if err != nil {
+		return fmt.Errorf("failed to parse referrer reference %s: %w", sourceImage, err)
+	}
+	destRef, err := docker.ParseReference("//" + destImage)
+	if err != nil {
+		return fmt.Errorf("failed to parse referrer reference %s: %w", destImage, err)
+	}
+
+	err = s.pullFrom(ctx, registry.host, func() error {
+		_, err := copy.Image(ctx, policyContext, newRateLimitedReference(newTracedReference(destRef), s.requestLimiter(target.DestRegistry)), newRateLimitedReference(newTracedReference(srcRef), s.requestLimiter(registry.host)), &copy.Options{
+			SourceCtx:          sourceCtx,
+			DestinationCtx:     target.SystemContext,
+			PreserveDigests:    true, // The subject field must stay intact
+			ImageListSelection: copy.CopyAllImages,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy referrer %s to %s: %w", sourceImage, destImage, err)
+	}
+	artifactType := referrer.ArtifactType
+	if artifactType == "" {
+		artifactType = referrer.MediaType
+	}
+	logf(ctx, "Copied referrer %s (%s)", destImage, artifactType)
+	return nil
+}
+
+// repositoryRef is a source repository as written in the configuration.
+type repositoryRef struct {
+	host       string // e.g. docker.io
+	repository string
+}
+
+func (r repositoryRef) String() string {
+	return r.host + "/" + r.repository
+}
+
+// apiHost returns the host serving the registry API and the normalized
+// repository, library/nginx rather than nginx on Docker Hub.
+func (r repositoryRef) apiHost() (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(r.String())
+	if err != nil {
+		return "", "", err
+	}
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	return host, reference.Path(named), nil
+}
+
+// listReferrers lists the referrers of subject with the OCI 1.1 referrers
+// API. A registry without the API answers 404 and has no referrers.
+func listReferrers(ctx context.Context, sys *types.SystemContext, headers *registryHeaders, registry repositoryRef, subject digest.Digest) ([]imgspecv1.Descriptor, error) {
+	host, repository, err := registry.apiHost()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("https://%s/v2/%s/referrers/%s", host, repository, subject)
+	resp, err := registryGet(ctx, sys, headers, endpoint, repository, imgspecv1.MediaTypeImageIndex)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, endpoint)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), imgspecv1.MediaTypeImageIndex) {
+		// Answered by something other than the referrers API, e.g. a login page
+		return nil, nil
+	}
+	var index imgspecv1.Index
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to decode referrers of %s: %w", subject, err)
+	}
+	return index.Manifests, nil
+}
+
+// registryGet sends an authenticated GET to the registry API. The credentials
+// of sys are sent as basic auth or exchanged for a pull token, depending on
+// the challenge the registry answers with.
+func registryGet(ctx context.Context, sys *types.SystemContext, headers *registryHeaders, endpoint, repository, accept string) (*http.Response, error) {
+	var username, password string
+	if sys != nil && sys.DockerAuthConfig != nil {
+		username, password = sys.DockerAuthConfig.Username, sys.DockerAuthConfig.Password
+	}
+
+	get := func(authorize func(*http.Request)) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		headers.set(req)
+		req.Header.Set("Accept", accept)
+		if authorize != nil {
+			authorize(req)
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	resp, err := get(nil)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	resp.Body.Close()
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return get(func(req *http.Request) { req.SetBasicAuth(username, password) })
+	case "bearer":
+		scope := params["scope"]
+		if scope == "" {
+			scope = "repository:" + repository + ":pull"
+		}
+		token, err := fetchToken(ctx, headers, params["realm"], params["service"], scope, username, password)
+		if err != nil {
+			return nil, err
+		}
+		return get(func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) })
+	}
+	return nil, fmt.Errorf("unsupported authentication challenge %q from %s", scheme, endpoint)
+}
+
+// fetchToken requests a pull token from a token server, as described in the
+// distribution token authentication specification.
+func fetchToken(ctx context.Context, headers *registryHeaders, realm, service, scope, username, password string) (string, error) {
+	if realm == "" {
+		return "", fmt.Errorf("authentication challenge without a realm")
+	}
+	endpoint, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+	query := endpoint.Query()
+	if service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	headers.set(req)
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request a token from %s: %w", realm, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("unexpected status %s requesting a token from %s: %s", resp.Status, realm, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to decode token from %s: %w", realm, err)
+	}
+	if token.Token == "" {
+		return token.AccessToken, nil
+	}
+	return token.Token, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`
+// into its scheme and parameters. Quoted values may contain commas.
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(value)
+		}
+	}
+	return scheme, params
+}
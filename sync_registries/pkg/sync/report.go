@@ -0,0 +1,480 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v3"
+
+	"registries-sync/pkg/config"
+)
+
+// Report summarizes a run. A nil *Report disables collecting it.
+type Report struct {
+	mu sync.Mutex
+
+	Started         time.Time         `json:"started" yaml:"started"`
+	DurationSeconds float64           `json:"duration_seconds" yaml:"duration_seconds"`
+	Interrupted     bool              `json:"interrupted" yaml:"interrupted"`
+	Registries      []*RegistryReport `json:"registries" yaml:"registries"`
+	Skipped         []string          `json:"skipped_images,omitempty" yaml:"skipped_images,omitempty"`
+	DockerHubQuota  *DockerHubQuota   `json:"docker_hub_quota,omitempty" yaml:"docker_hub_quota,omitempty"`
+	OpenedCircuits  []string          `json:"opened_circuits,omitempty" yaml:"opened_circuits,omitempty"`
+
+	// PersistentFailures are the tags that failed in at least
+	// quarantine.after consecutive runs
+	PersistentFailures []string `json:"persistent_failures,omitempty" yaml:"persistent_failures,omitempty"`
+
+	// SourceRegistries is the traffic of the run by source registry host
+	SourceRegistries []*SourceTransfer `json:"source_registries,omitempty" yaml:"source_registries,omitempty"`
+
+	// Changes compares the run with the previous one, with
+	// Options.PreviousReport set
+	Changes *ReportChanges `json:"changes,omitempty" yaml:"changes,omitempty"`
+}
+
+// RegistryReport summarizes a single registry entry. A nil *RegistryReport
+// ignores all updates.
+type RegistryReport struct {
+	Source           string    `json:"source" yaml:"source"`
+	Destinations     []string  `json:"destinations" yaml:"destinations"`
+	TagsConsidered   int       `json:"tags_considered" yaml:"tags_considered"`
+	TagsSynced       int       `json:"tags_synced" yaml:"tags_synced"`
+	TagsSkipped      int       `json:"tags_skipped" yaml:"tags_skipped"`
+	TagsFailed       int       `json:"tags_failed" yaml:"tags_failed"`
+	ChartsSynced     int       `json:"charts_synced,omitempty" yaml:"charts_synced,omitempty"` // Helm charts among the synced tags
+	BytesTransferred int64     `json:"bytes_transferred" yaml:"bytes_transferred"`             // Pulled from the source, cache hits excluded
+	BlobsReused      int64     `json:"blobs_reused" yaml:"blobs_reused"`                       // Already at a destination, or mounted there from another repository
+	BlobsUploaded    int64     `json:"blobs_uploaded" yaml:"blobs_uploaded"`
+	DurationSeconds  float64   `json:"duration_seconds" yaml:"duration_seconds"`
+	SyncedImages     []string  `json:"synced_images,omitempty" yaml:"synced_images,omitempty"`
+	Copies           []TagCopy `json:"copies,omitempty" yaml:"copies,omitempty"`
+	Error            string    `json:"error,omitempty" yaml:"error,omitempty"`
+
+	// VerificationFailures lists pushed images whose destination manifest
+	// didn't match, with verify set
+	VerificationFailures []string `json:"verification_failures,omitempty" yaml:"verification_failures,omitempty"`
+
+	// UnverifiedSignatures lists destination images failing the
+	// verify_signatures pass
+	UnverifiedSignatures []string `json:"unverified_signatures,omitempty" yaml:"unverified_signatures,omitempty"`
+
+	// MissingPlatforms lists source images lacking platforms the os and
+	// architectures filters ask for, without require_platforms
+	MissingPlatforms []string `json:"missing_platforms,omitempty" yaml:"missing_platforms,omitempty"`
+
+	// Platforms compares the platforms of every pushed image with those the
+	// os and architectures filters request, for entries setting them
+	Platforms []PlatformCopy `json:"platforms,omitempty" yaml:"platforms,omitempty"`
+
+	// StrippedAttestations lists the attestation manifests left out of
+	// pushed manifest lists with strip_attestations, by digest
+	StrippedAttestations []string `json:"stripped_attestations,omitempty" yaml:"stripped_attestations,omitempty"`
+
+	// MirrorLag compares the newest selected source tag with the newest
+	// mirrored one, for entries selecting their tags from the source
+	MirrorLag *MirrorLag `json:"mirror_lag,omitempty" yaml:"mirror_lag,omitempty"`
+
+	// LifecyclePolicies are the ECR lifecycle policy documents applied, by
+	// destination
+	LifecyclePolicies map[string]string `json:"lifecycle_policies,omitempty" yaml:"lifecycle_policies,omitempty"`
+
+	started time.Time
+}
+
+// TagCopy is the outcome of a tag copy, with the ID its log lines, hook and
+// broker events and spans carry.
+type TagCopy struct {
+	ID     string `json:"id,omitempty" yaml:"id,omitempty"`
+	Image  string `json:"image" yaml:"image"`   // Source image
+	Result string `json:"result" yaml:"result"` // "synced", "skipped" or "failed"
+	Error  string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// PlatformCopy lists the platforms pushed as an image next to those the os
+// and architectures filters of its entry request.
+type PlatformCopy struct {
+	Image     string   `json:"image" yaml:"image"` // Destination image
+	Requested []string `json:"requested" yaml:"requested"`
+	Copied    []string `json:"copied" yaml:"copied"`
+}
+
+func (c PlatformCopy) String() string {
+	return fmt.Sprintf("%s: copied %s of requested %s", c.Image, strings.Join(c.Copied, ", "), strings.Join(c.Requested, ", "))
+}
+
+func newReport() *Report {
+	return &Report{Started: time.Now(), Registries: []*RegistryReport{}}
+}
+
+// startRegistry adds a registry entry to the report.
+func (r *Report) startRegistry(registry config.RegistryConfig) *RegistryReport {
+	if r == nil {
+		return nil
+	}
+	destinations := []string{}
+	for _, dest := range registry.AllDestinations() {
+		destinations = append(destinations, dest.String())
+	}
+	report := &RegistryReport{
+		Source:       registry.SourceRegistry + "/" + registry.SourceRepository,
+		Destinations: destinations,
+		started:      time.Now(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Registries = append(r.Registries, report)
+	return report
+}
+
+func (r *RegistryReport) considered(n int) {
+	if r != nil {
+		r.TagsConsidered = n
+	}
+}
+
+func (r *RegistryReport) synced(image string) {
+	if r != nil {
+		r.TagsSynced++
+		r.SyncedImages = append(r.SyncedImages, image)
+	}
+}
+
+// copied records the outcome of a tag copy from its post_copy hook event.
+func (r *RegistryReport) copied(event hookEvent) {
+	if r != nil {
+		r.Copies = append(r.Copies, TagCopy{ID: event.CopyID, Image: event.Source, Result: event.Result, Error: event.Error})
+	}
+}
+
+func (r *RegistryReport) chartSynced() {
+	if r != nil {
+		r.ChartsSynced++
+	}
+}
+
+func (r *RegistryReport) verificationFailed(image string, err error) {
+	if r != nil {
+		r.VerificationFailures = append(r.VerificationFailures, fmt.Sprintf("%s: %v", image, err))
+	}
+}
+
+func (r *RegistryReport) signatureUnverified(image string, err error) {
+	if r != nil {
+		r.UnverifiedSignatures = append(r.UnverifiedSignatures, fmt.Sprintf("%s: %v", image, err))
+	}
+}
+
+func (r *RegistryReport) platformsMissing(image string, platforms []string) {
+	if r != nil {
+		r.MissingPlatforms = append(r.MissingPlatforms, fmt.Sprintf("%s: %s", image, strings.Join(platforms, ", ")))
+	}
+}
+
+func (r *RegistryReport) platformsCopied(image string, requested, copied []string) {
+	if r != nil {
+		r.Platforms = append(r.Platforms, PlatformCopy{Image: image, Requested: requested, Copied: copied})
+	}
+}
+
+func (r *RegistryReport) attestationsStripped(image string, digests []digest.Digest) {
+	if r != nil {
+		formatted := []string{}
+		for _, d := range digests {
+			formatted = append(formatted, d.String())
+		}
+		r.StrippedAttestations = append(r.StrippedAttestations, fmt.Sprintf("%s: %s", image, strings.Join(formatted, ", ")))
+	}
+}
+
+func (r *RegistryReport) mirrorLag(lag MirrorLag) {
+	if r != nil {
+		r.MirrorLag = &lag
+	}
+}
+
+func (r *RegistryReport) lifecyclePolicyApplied(destination, policy string) {
+	if r != nil {
+		if r.LifecyclePolicies == nil {
+			r.LifecyclePolicies = map[string]string{}
+		}
+		r.LifecyclePolicies[destination] = policy
+	}
+}
+
+func (r *RegistryReport) skipped() {
+	if r != nil {
+		r.TagsSkipped++
+	}
+}
+
+func (r *RegistryReport) failed() {
+	if r != nil {
+		r.TagsFailed++
+	}
+}
+
+// byteCounter returns the counter of bytes pulled from the source, or nil.
+func (r *RegistryReport) byteCounter() *int64 {
+	if r == nil {
+		return nil
+	}
+	return &r.BytesTransferred
+}
+
+func (r *RegistryReport) finish(err error) {
+	if r == nil {
+		return
+	}
+	r.DurationSeconds = time.Since(r.started).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// finish completes the report with the run-wide results.
+func (r *Report) finish(s *Syncer, interrupted bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DurationSeconds = time.Since(r.Started).Seconds()
+	r.Interrupted = interrupted
+	s.mu.Lock()
+	r.Skipped = append([]string{}, s.skipped...)
+	s.mu.Unlock()
+	r.DockerHubQuota = s.dockerHub.lastQuota()
+	r.OpenedCircuits = s.breaker.openedCircuits()
+	r.PersistentFailures = s.failures.persistent()
+	r.estimateEgressCosts(s.config)
+	r.compare(s.previousReport)
+}
+
+// Failed reports whether the run was interrupted, or a registry entry or a
+// tag failed.
+func (r *Report) Failed() bool {
+	if r.Interrupted {
+		return true
+	}
+	for _, registry := range r.Registries {
+		if registry.failedAny() {
+			return true
+		}
+	}
+	return false
+}
+
+// Write renders the report as json, yaml or html to path, or to stdout when
+// path is "-".
+func (r *Report) Write(path, format string) error {
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case "yaml":
+		encoder := yaml.NewEncoder(out)
+		defer encoder.Close()
+		return encoder.Encode(r)
+	case "html":
+		return reportTemplate.Execute(out, r)
+	default:
+		return fmt.Errorf("unknown report format %q, expected json, yaml or html", format)
+	}
+}
+
+// reportFuncs are available in the HTML report and the email templates.
+var reportFuncs = template.FuncMap{
+	"bytes": func(n int64) string {
+		const unit = 1024
+		if n < unit {
+			return fmt.Sprintf("%d B", n)
+		}
+		div, exp := int64(unit), 0
+		for m := n / unit; m >= unit; m /= unit {
+			div *= unit
+			exp++
+		}
+		return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+	},
+	"cost": func(cost *float64) string {
+		if cost == nil {
+			return ""
+		}
+		return fmt.Sprintf("%.2f", *cost)
+	},
+	"add": func(a, b int64) int64 {
+		return a + b
+	},
+	"seconds": func(s float64) string {
+		return (time.Duration(s) * time.Second).String()
+	},
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Registry sync report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.num { text-align: right; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Registry sync report</h1>
+{{if not .Started.IsZero}}<p>Started {{.Started.Format "2006-01-02 15:04:05 MST"}}, took {{seconds .DurationSeconds}}{{if .Interrupted}}, <strong class="failed">interrupted</strong>{{end}}.</p>{{else if .Interrupted}}<p><strong class="failed">Interrupted</strong>.</p>{{end}}
+{{with .Changes}}<h2>Changes since {{if .PreviousRun.IsZero}}the previous run{{else}}{{.PreviousRun.Format "2006-01-02 15:04:05 MST"}}{{end}}</h2>
+{{if .NewlyFailing}}<p class="failed">Newly failing:</p>
+<ul>
+{{range .NewlyFailing}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{if .Resolved}}<p>Resolved:</p>
+<ul>
+{{range .Resolved}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{if .NewlySynced}}<p>Newly synced:</p>
+<ul>
+{{range .NewlySynced}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{if not (or .NewlyFailing .Resolved .NewlySynced)}}<p>No changes.</p>
+{{end}}{{end}}<table>
+<tr><th>Source</th><th>Destinations</th><th>Considered</th><th>Synced</th><th>Charts</th><th>Skipped</th><th>Failed</th><th>Transferred</th><th>Blobs reused</th><th>Duration</th><th>Mirror lag</th><th>Error</th></tr>
+{{range .Registries}}<tr>
+<td>{{.Source}}</td>
+<td>{{range $i, $d := .Destinations}}{{if $i}}<br>{{end}}{{$d}}{{end}}</td>
+<td class="num">{{.TagsConsidered}}</td>
+<td class="num">{{.TagsSynced}}</td>
+<td class="num">{{.ChartsSynced}}</td>
+<td class="num">{{.TagsSkipped}}</td>
+<td class="num{{if .TagsFailed}} failed{{end}}">{{.TagsFailed}}</td>
+<td class="num">{{bytes .BytesTransferred}}</td>
+<td class="num">{{.BlobsReused}} of {{add .BlobsReused .BlobsUploaded}}</td>
+<td class="num">{{seconds .DurationSeconds}}</td>
+<td class="num">{{with .MirrorLag}}{{seconds .Seconds}}{{end}}</td>
+<td class="failed">{{.Error}}</td>
+</tr>
+{{end}}</table>
+{{range .Registries}}{{if .TagsFailed}}<h2 class="failed">Failed copies for {{.Source}}</h2>
+<ul>
+{{range .Copies}}{{if eq .Result "failed"}}<li>{{.Image}} (copy {{.ID}}): {{.Error}}</li>
+{{end}}{{end}}</ul>
+{{end}}{{end}}{{range .Registries}}{{if .VerificationFailures}}<h2 class="failed">Verification failures for {{.Source}}</h2>
+<ul>
+{{range .VerificationFailures}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{end}}{{range .Registries}}{{if .UnverifiedSignatures}}<h2 class="failed">Unverified signatures for {{.Source}}</h2>
+<ul>
+{{range .UnverifiedSignatures}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{end}}{{range .Registries}}{{if .MissingPlatforms}}<h2 class="failed">Missing platforms for {{.Source}}</h2>
+<ul>
+{{range .MissingPlatforms}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{end}}{{range .Registries}}{{if .Platforms}}<h2>Platforms copied for {{.Source}}</h2>
+<ul>
+{{range .Platforms}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{end}}{{range .Registries}}{{if .StrippedAttestations}}<h2>Attestations stripped for {{.Source}}</h2>
+<ul>
+{{range .StrippedAttestations}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{end}}{{range .Registries}}{{if .LifecyclePolicies}}<h2>ECR lifecycle policies for {{.Source}}</h2>
+<ul>
+{{range $dest, $policy := .LifecyclePolicies}}<li>{{$dest}}: <code>{{$policy}}</code></li>
+{{end}}</ul>
+{{end}}{{end}}{{if .OpenedCircuits}}<h2 class="failed">Destinations skipped by the circuit breaker</h2>
+<ul>
+{{range .OpenedCircuits}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{if .PersistentFailures}}<h2 class="failed">Persistently failing tags</h2>
+<ul>
+{{range .PersistentFailures}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{if .Skipped}}<h2>Skipped images</h2>
+<ul>
+{{range .Skipped}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{if .SourceRegistries}}<h2>Source registries</h2>
+<table>
+<tr><th>Registry</th><th>Transferred</th><th>Estimated egress cost</th></tr>
+{{range .SourceRegistries}}<tr><td>{{.Registry}}</td><td class="num">{{bytes .BytesTransferred}}</td><td class="num">{{cost .EstimatedCost}}</td></tr>
+{{end}}</table>
+{{end}}{{with .DockerHubQuota}}<p>Docker Hub pull quota: {{.Remaining}} of {{.Limit}} remaining.</p>
+{{end}}</body>
+</html>
+`))
+
+// countingReference counts the blob bytes read from a source image.
+type countingReference struct {
+	types.ImageReference
+	counter *int64
+}
+
+// newCountingReference wraps ref so blob reads are added to counter, or
+// returns ref unchanged when counter is nil.
+func newCountingReference(ref types.ImageReference, counter *int64) types.ImageReference {
+	if counter == nil {
+		return ref
+	}
+	return &countingReference{ImageReference: ref, counter: counter}
+}
+
+func (r *countingReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &countingSource{ImageSource: src, counter: r.counter}, nil
+}
+
+type countingSource struct {
+	types.ImageSource
+	counter *int64
+}
+
+func (s *countingSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	reader, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &countingReader{ReadCloser: reader, counter: s.counter}, size, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	counter *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.counter, int64(n))
+	return n, err
+}
@@ -0,0 +1,91 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// ReportChanges is what changed since the previous run.
+type ReportChanges struct {
+	PreviousRun  time.Time `json:"previous_run" yaml:"previous_run"`
+	NewlySynced  []string  `json:"newly_synced,omitempty" yaml:"newly_synced,omitempty"`   // Images synced by this run but not by the previous one
+	NewlyFailing []string  `json:"newly_failing,omitempty" yaml:"newly_failing,omitempty"` // Registry entries that failed, but not in the previous run
+	Resolved     []string  `json:"resolved,omitempty" yaml:"resolved,omitempty"`           // Registry entries that failed in the previous run only
+}
+
+// loadPreviousReport reads the report saved by the previous run, or returns
+// nil when there is none yet.
+func loadPreviousReport(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var previous Report
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return nil, fmt.Errorf("invalid previous report %s: %w", path, err)
+	}
+	return &previous, nil
+}
+
+// compare records the changes since previous. Called with r.mu held.
+func (r *Report) compare(previous *Report) {
+	if previous == nil {
+		return
+	}
+	previousSynced := map[string]bool{}
+	previousFailed := map[string]bool{}
+	for _, registry := range previous.Registries {
+		for _, image := range registry.SyncedImages {
+			previousSynced[image] = true
+		}
+		previousFailed[registry.Source] = registry.failedAny()
+	}
+
+	changes := &ReportChanges{PreviousRun: previous.Started}
+	for _, registry := range r.Registries {
+		for _, image := range registry.SyncedImages {
+			if !previousSynced[image] {
+				changes.NewlySynced = append(changes.NewlySynced, image)
+			}
+		}
+		failed, failedBefore := registry.failedAny(), previousFailed[registry.Source]
+		switch {
+		case failed && !failedBefore:
+			changes.NewlyFailing = append(changes.NewlyFailing, registry.Source)
+		case !failed && failedBefore:
+			changes.Resolved = append(changes.Resolved, registry.Source)
+		}
+	}
+	sort.Strings(changes.NewlySynced)
+	sort.Strings(changes.NewlyFailing)
+	sort.Strings(changes.Resolved)
+	r.Changes = changes
+}
+
+// failedAny reports whether anything of the registry entry failed.
+func (r *RegistryReport) failedAny() bool {
+	return r.Error != "" || r.TagsFailed > 0 || len(r.VerificationFailures) > 0
+}
+
+// save writes the report as JSON for the next run to compare with.
+func (r *Report) save(path string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed, so an interrupted write keeps the old one
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
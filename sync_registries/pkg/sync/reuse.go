@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// blobReuseReference wraps a destination reference to count the blobs it
+// already held, or mounted from another repository, against those uploaded.
+// It also records the mount_from repositories in the blob info cache as
+// places the blob may be, so containers/image checks them and mounts from
+// them, even on a runner whose cache starts empty.
+type blobReuseReference struct {
+	types.ImageReference
+	scope     types.BICTransportScope
+	mountFrom []types.BICLocationReference
+	stats     *RegistryReport
+}
+
+// newBlobReuseReference wraps the reference of dest, or returns ref unchanged
+// for local destinations and when there is nothing to count or mount.
+func newBlobReuseReference(ref types.ImageReference, dest config.Destination, mountFrom []string, stats *RegistryReport) types.ImageReference {
+	if dest.Local() || (len(mountFrom) == 0 && stats == nil) {
+		return ref
+	}
+	r := &blobReuseReference{ImageReference: ref, scope: types.BICTransportScope{Opaque: dest.DestRegistry}, stats: stats}
+	for _, repository := range mountFrom {
+		r.mountFrom = append(r.mountFrom, types.BICLocationReference{Opaque: dest.DestRegistry + "/" + repository})
+	}
+	return r
+}
+
+func (r *blobReuseReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReuseDestination{ImageDestination: dest, ref: r}, nil
+}
+
+type blobReuseDestination struct {
+	types.ImageDestination
+	ref *blobReuseReference
+}
+
+func (d *blobReuseDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	for _, location := range d.ref.mountFrom {
+		cache.RecordKnownLocation(d.ref.Transport(), d.ref.scope, info.Digest, location)
+	}
+	reused, blobInfo, err := d.ImageDestination.TryReusingBlob(ctx, info, cache, canSubstitute)
+	if reused {
+		d.ref.stats.blobReused()
+	}
+	return reused, blobInfo, err
+}
+
+func (d *blobReuseDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	blobInfo, err := d.ImageDestination.PutBlob(ctx, stream, inputInfo, cache, isConfig)
+	if err == nil {
+		d.ref.stats.blobUploaded()
+	}
+	return blobInfo, err
+}
+
+func (r *RegistryReport) blobReused() {
+	if r != nil {
+		atomic.AddInt64(&r.BlobsReused, 1)
+	}
+}
+
+func (r *RegistryReport) blobUploaded() {
+	if r != nil {
+		atomic.AddInt64(&r.BlobsUploaded, 1)
+	}
+}
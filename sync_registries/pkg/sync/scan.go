@@ -0,0 +1,141 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// scanConfigFor returns the scan configuration of a registry entry, falling
+// back to the global one. It returns nil when scanning is disabled.
+func (s *Syncer) scanConfigFor(registry config.RegistryConfig) *config.ScanConfig {
+	if registry.Scan != nil {
+		return registry.Scan
+	}
+	return s.config.Scan
+}
+
+// scanImage scans the staged image ref, the instance of a manifest list sys
+// picks, and returns the IDs of vulnerabilities at or above the configured
+// severity threshold. The scanners read an OCI archive of it written next to
+// the staging directory, so the image isn't pulled again and they need no
+// access to the source registry.
+func scanImage(ctx context.Context, cfg *config.ScanConfig, ref types.ImageReference, sys *types.SystemContext) ([]string, error) {
+	dir, err := os.MkdirTemp(sys.BigFilesTemporaryDir, "registries-sync-scan-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scan directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "image.tar")
+	archiveRef, err := ociarchive.NewReference(archive, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// The policy was enforced while staging
+	policyContext, err := signature.NewPolicyContext(insecureAcceptAnythingPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create policy context: %w", err)
+	}
+	defer policyContext.Destroy()
+	if _, err := copy.Image(ctx, policyContext, archiveRef, ref, &copy.Options{SourceCtx: sys}); err != nil {
+		return nil, fmt.Errorf("failed to write the image for the scanner: %w", err)
+	}
+
+	if cfg.Scanner == "grype" {
+		return scanWithGrype(ctx, cfg, archive)
+	}
+	return scanWithTrivy(ctx, cfg, archive)
+}
+
+func scanWithTrivy(ctx context.Context, cfg *config.ScanConfig, archive string) ([]string, error) {
+	args := []string{"image", "--quiet", "--format", "json", "--input", archive}
+	if cfg.IgnoreUnfixed {
+		args = append(args, "--ignore-unfixed")
+	}
+	output, err := runScanner(ctx, cfg, "trivy", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var report struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID string `json:"VulnerabilityID"`
+				Severity        string `json:"Severity"`
+			} `json:"Vulnerabilities"`
+		} `json:"Results"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse trivy report: %w", err)
+	}
+
+	blocking := []string{}
+	for _, result := range report.Results {
+		for _, vuln := range result.Vulnerabilities {
+			if cfg.Blocks(vuln.Severity) {
+				blocking = append(blocking, fmt.Sprintf("%s (%s)", vuln.VulnerabilityID, vuln.Severity))
+			}
+		}
+	}
+	return blocking, nil
+}
+
+func scanWithGrype(ctx context.Context, cfg *config.ScanConfig, archive string) ([]string, error) {
+	args := []string{"oci-archive:" + archive, "--output", "json", "--quiet"}
+	if cfg.IgnoreUnfixed {
+		args = append(args, "--only-fixed")
+	}
+	output, err := runScanner(ctx, cfg, "grype", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var report struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+			} `json:"vulnerability"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse grype report: %w", err)
+	}
+
+	blocking := []string{}
+	for _, match := range report.Matches {
+		if cfg.Blocks(match.Vulnerability.Severity) {
+			blocking = append(blocking, fmt.Sprintf("%s (%s)", match.Vulnerability.ID, strings.ToUpper(match.Vulnerability.Severity)))
+		}
+	}
+	return blocking, nil
+}
+
+func runScanner(ctx context.Context, cfg *config.ScanConfig, name string, args ...string) ([]byte, error) {
+	path := cfg.ScannerPath
+	if path == "" {
+		path = name
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
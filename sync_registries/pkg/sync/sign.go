@@ -0,0 +1,117 @@
+package sync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// signConfigFor returns the signing configuration of a registry entry,
+// falling back to the global one. It returns nil when signing is disabled.
+func (s *Syncer) signConfigFor(registry config.RegistryConfig) *config.SignConfig {
+	if registry.Sign != nil {
+		return registry.Sign
+	}
+	return s.config.Sign
+}
+
+// signImage signs image, which must be a digest reference, with cosign. The
+// destination credentials are handed to cosign through a temporary docker
+// config so they don't show up in the process list.
+func signImage(ctx context.Context, cfg *config.SignConfig, image string, sys *types.SystemContext) error {
+	args := []string{"sign", "--yes"}
+	if cfg.Key != "" {
+		args = append(args, "--key", cfg.Key)
+	}
+	if cfg.IdentityToken != "" {
+		args = append(args, "--identity-token", cfg.IdentityToken)
+	}
+	if cfg.TlogUpload != nil {
+		args = append(args, fmt.Sprintf("--tlog-upload=%t", *cfg.TlogUpload))
+	}
+	args = append(args, image)
+
+	output, err := runCosign(ctx, cfg.CosignPath, args, image, sys)
+	if err != nil {
+		return fmt.Errorf("cosign sign failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runCosign runs cosign, "cosign" on the PATH when path is empty, with the
+// credentials of sys for the registry of image, and returns its output.
+func runCosign(ctx context.Context, path string, args []string, image string, sys *types.SystemContext) ([]byte, error) {
+	if path == "" {
+		path = "cosign"
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = os.Environ()
+
+	if auth := dockerConfigAuth(sys); auth != nil {
+		dockerConfig, err := writeDockerConfig(strings.SplitN(image, "/", 2)[0], auth)
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dockerConfig)
+		cmd.Env = append(cmd.Env, "DOCKER_CONFIG="+dockerConfig)
+	}
+	return cmd.CombinedOutput()
+}
+
+// dockerConfigAuth returns the config.json entry holding the credentials of
+// sys: a username and password, an identity token or a registry token. It
+// returns nil when sys has none of them.
+func dockerConfigAuth(sys *types.SystemContext) map[string]string {
+	if sys == nil {
+		return nil
+	}
+	auth := map[string]string{}
+	if creds := sys.DockerAuthConfig; creds != nil {
+		if creds.Username != "" {
+			auth["auth"] = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+		}
+		if creds.IdentityToken != "" {
+			auth["identitytoken"] = creds.IdentityToken
+		}
+	}
+	if sys.DockerBearerRegistryToken != "" {
+		auth["registrytoken"] = sys.DockerBearerRegistryToken
+	}
+	if len(auth) == 0 {
+		return nil
+	}
+	return auth
+}
+
+// writeDockerConfig writes a config.json holding auth for registry into a new
+// temporary directory and returns the directory.
+func writeDockerConfig(registry string, auth map[string]string) (string, error) {
+	dir, err := os.MkdirTemp("", "registries-sync-auth-")
+	if err != nil {
+		return "", err
+	}
+
+	dockerConfig := map[string]interface{}{
+		"auths": map[string]interface{}{
+			registry: auth,
+		},
+	}
+	data, err := json.Marshal(dockerConfig)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "config.json"), data, 0o600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to write docker config: %w", err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,34 @@
+package sync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// ParseSize converts the max_image_size setting of a registry entry, e.g.
+// "10GiB" or "500MB", into bytes. Empty means no limit.
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	var (
+		bytes int64
+		err   error
+	)
+	if strings.Contains(strings.ToLower(value), "i") {
+		bytes, err = units.RAMInBytes(value)
+	} else {
+		bytes, err = units.FromHumanSize(value)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid max_image_size %q: %w", value, err)
+	}
+	if bytes <= 0 {
+		return 0, fmt.Errorf("invalid max_image_size %q: must be greater than zero", value)
+	}
+	return bytes, nil
+}
@@ -0,0 +1,239 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	dockerconfig "github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+
+	"registries-sync/pkg/config"
+)
+
+// maxTokenScopes caps the repositories a shared token is requested for, as
+// every scope makes the token and the request for it larger.
+const maxTokenScopes = 50
+
+// sharedToken is an anonymous pull token and when to stop using it.
+type sharedToken struct {
+	token   string
+	expires time.Time
+}
+
+// sourceTokens shares the anonymous pull token of a source host between the
+// registry entries pulling from it. Otherwise containers/image requests a
+// token for every image it opens, which adds up against the rate limits of
+// the token service. A nil *sourceTokens shares nothing.
+type sourceTokens struct {
+	groups map[string]string   // Token group of a repository, by name
+	scopes map[string][]string // Repository paths of a token group
+
+	mu       sync.Mutex
+	tokens   map[string]sharedToken // By token group
+	disabled map[string]bool        // Hosts left to containers/image
+}
+
+// newSourceTokens groups the repositories pulled anonymously from each host
+// with more than one of them. It returns nil when there is none.
+func newSourceTokens(registries []config.RegistryConfig) *sourceTokens {
+	byHost := map[string]map[string]bool{}
+	add := func(sourceRegistry, repository string) {
+		named, err := reference.ParseNormalizedNamed(sourceRegistry + "/" + repository)
+		if err != nil {
+			return
+		}
+		domain := reference.Domain(named)
+		if byHost[domain] == nil {
+			byHost[domain] = map[string]bool{}
+		}
+		byHost[domain][reference.Path(named)] = true
+	}
+	for _, registry := range registries {
+		if pullsAnonymously(registry) {
+			add(registry.SourceRegistry, registry.SourceRepository)
+		}
+		// Fallbacks are always pulled from anonymously
+		for _, fallback := range registry.SourceFallbacks {
+			add(fallback, registry.SourceRepository)
+		}
+	}
+
+	t := &sourceTokens{groups: map[string]string{}, scopes: map[string][]string{}, tokens: map[string]sharedToken{}, disabled: map[string]bool{}}
+	for domain, repositories := range byHost {
+		if len(repositories) < 2 {
+			continue
+		}
+		paths := make([]string, 0, len(repositories))
+		for path := range repositories {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for i, path := range paths {
+			group := fmt.Sprintf("%s#%d", domain, i/maxTokenScopes)
+			t.groups[domain+"/"+path] = group
+			t.scopes[group] = append(t.scopes[group], path)
+		}
+	}
+	if len(t.groups) == 0 {
+		return nil
+	}
+	return t
+}
+
+// pullsAnonymously reports whether the entry pulls from its source without
+// credentials and over TLS with the system defaults.
+func pullsAnonymously(registry config.RegistryConfig) bool {
+	if registry.SourceCredentials != nil || registry.SourceCertDir != "" || (registry.SourceTLSVerify != nil && !*registry.SourceTLSVerify) {
+		return false
+	}
+	options := registry.SystemContext
+	return options == nil || (options.RegistryToken == "" && options.AuthFile == "")
+}
+
+// apply returns sys with the shared token of the source repository of
+// registry, or sys itself when the repository doesn't share one.
+func (t *sourceTokens) apply(ctx context.Context, s *Syncer, registry config.RegistryConfig, sys *types.SystemContext) *types.SystemContext {
+	if t == nil || sys == nil || sys.DockerAuthConfig != nil || sys.DockerBearerRegistryToken != "" {
+		return sys
+	}
+	named, err := reference.ParseNormalizedNamed(registry.SourceRegistry + "/" + registry.SourceRepository)
+	if err != nil {
+		return sys
+	}
+	group, ok := t.groups[named.Name()]
+	if !ok {
+		return sys
+	}
+	token, err := t.token(ctx, s, reference.Domain(named), group)
+	if err != nil {
+		logf(ctx, "Failed to get a shared pull token for %s, requesting one per image: %v", reference.Domain(named), err)
+		return sys
+	}
+	if token == "" {
+		return sys
+	}
+	shared := *sys
+	shared.DockerBearerRegistryToken = token
+	return &shared
+}
+
+// token returns the token of group, requesting a new one when it is about to
+// expire. It returns "" for hosts that don't use bearer tokens or have stored
+// credentials, which containers/image then uses.
+func (t *sourceTokens) token(ctx context.Context, s *Syncer, host, group string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.disabled[host] {
+		return "", nil
+	}
+	if cached, ok := t.tokens[group]; ok && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	if credentials, err := dockerconfig.GetCredentials(&types.SystemContext{}, host); err == nil && (credentials.Username != "" || credentials.IdentityToken != "") {
+		t.disabled[host] = true
+		return "", nil
+	}
+	realm, service, err := bearerChallenge(ctx, s, host)
+	if err != nil {
+		t.disabled[host] = true
+		return "", err
+	}
+	if realm == "" {
+		t.disabled[host] = true
+		return "", nil
+	}
+
+	query := url.Values{}
+	if service != "" {
+		query.Set("service", service)
+	}
+	for _, path := range t.scopes[group] {
+		query.Add("scope", "repository:"+path+":pull")
+	}
+	if err := s.waitForRequest(ctx, host); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	s.headers.set(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from %s", resp.StatusCode, realm)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode token: %w", err)
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("no token in the response of %s", realm)
+	}
+	// 60 seconds when not given, per the distribution token spec. The margin
+	// leaves time for the copy that gets the token to authenticate with it.
+	lifetime := time.Duration(body.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = time.Minute
+	}
+	t.tokens[group] = sharedToken{token: token, expires: time.Now().Add(lifetime * 3 / 4)}
+	return token, nil
+}
+
+// bearerChallenge asks the registry at host how to authenticate. It returns
+// an empty realm when the registry doesn't use bearer tokens.
+func bearerChallenge(ctx context.Context, s *Syncer, host string) (realm, service string, err error) {
+	apiHost := host
+	if isDockerHub(host) {
+		apiHost = "registry-1.docker.io"
+	}
+	if err := s.waitForRequest(ctx, host); err != nil {
+		return "", "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+apiHost+"/v2/", nil)
+	if err != nil {
+		return "", "", err
+	}
+	s.headers.set(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	resp.Body.Close()
+
+	scheme, params, _ := strings.Cut(resp.Header.Get("WWW-Authenticate"), " ")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.EqualFold(scheme, "bearer") {
+		return "", "", nil
+	}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "realm":
+			realm = value
+		case "service":
+			service = value
+		}
+	}
+	return realm, service, nil
+}
@@ -0,0 +1,246 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/time/rate"
+
+	"registries-sync/pkg/config"
+)
+
+// stagedConfig returns a copy of cfg whose entries pull into dir: directories
+// below dir instead of pushing to their registry destinations, for PushStaged
+// to push later, e.g. after carrying dir into a disconnected network. Local
+// destinations are left out, and what needs the destination registry is left
+// to the push.
+func stagedConfig(cfg *config.Config, dir string) *config.Config {
+	staged := *cfg
+	staged.Registries = []config.RegistryConfig{}
+	for _, registry := range cfg.Registries {
+		destinations := []config.Destination{}
+		for _, dest := range registry.AllDestinations() {
+			if !dest.Local() {
+				destinations = append(destinations, stagedDestination(dir, dest))
+			}
+		}
+		if len(destinations) == 0 {
+			continue
+		}
+		registry.DestRegistry, registry.DestRepository, registry.DestTransport, registry.StripAttestations = "", "", "", false
+		registry.Destinations = destinations
+		registry.AutoCreate, registry.Verify, registry.Referrers = false, false, false
+		staged.Registries = append(staged.Registries, registry)
+	}
+	return &staged
+}
+
+// stagedDestination returns where images for dest are staged below dir:
+// a directory per tag in dir/<dest_registry>/<dest_repository>.
+func stagedDestination(dir string, dest config.Destination) config.Destination {
+	return config.Destination{DestRegistry: filepath.Join(dir, dest.DestRegistry), DestRepository: dest.DestRepository, Transport: "dir"}
+}
+
+// PushStaged pushes the images a run with Options.StageDir pulled into dir
+// to the registry destinations of every entry. Images are pushed as they
+// were pulled: the filters and the signature policy were applied by the pull.
+func (s *Syncer) PushStaged(ctx context.Context, dir string) error {
+	// The policy was enforced when pulling, the dir: copies are trusted
+	policyContext, err := signature.NewPolicyContext(insecureAcceptAnythingPolicy())
+	if err != nil {
+		return fmt.Errorf("failed to create policy context: %w", err)
+	}
+	defer policyContext.Destroy()
+
+	runID := s.history.startRun(ctx, "push-staged")
+	ctx = withHistoryRun(ctx, runID)
+	failed := 0
+	for _, registry := range s.config.Registries {
+		if ctx.Err() != nil {
+			break
+		}
+		destinations := []config.Destination{}
+		for _, dest := range registry.AllDestinations() {
+			if !dest.Local() {
+				destinations = append(destinations, dest)
+			}
+		}
+		if len(destinations) == 0 {
+			continue
+		}
+
+		stats := s.report.startRegistry(registry)
+		registryLimiter, err := newBandwidthLimiter(registry.MaxBandwidth)
+		if err != nil {
+			err = fmt.Errorf("failed to parse max_bandwidth: %w", err)
+			log.Printf("Failed to push staged images of %s/%s: %v", registry.SourceRegistry, registry.SourceRepository, err)
+			stats.finish(err)
+			failed++
+			continue
+		}
+		targets, err := s.destinationTargets(ctx, registry, destinations, stats)
+		if err != nil {
+			log.Printf("Failed to push staged images of %s/%s: %v", registry.SourceRegistry, registry.SourceRepository, err)
+			stats.finish(err)
+			failed++
+			continue
+		}
+		for _, target := range targets {
+			failed += s.pushStaged(ctx, policyContext, registry, target, stagedDestination(dir, target.Destination), registryLimiter, stats)
+		}
+		stats.finish(nil)
+	}
+	s.report.finish(s, ctx.Err() != nil)
+	s.history.finishRun(ctx, runID, runResult(ctx, failed > 0))
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d staged images or registry entries failed to push", failed)
+	}
+	return nil
+}
+
+// pushStaged pushes the tags staged for target and returns the number of
+// them that failed.
+func (s *Syncer) pushStaged(ctx context.Context, policyContext *signature.PolicyContext, registry config.RegistryConfig, target destinationTarget, staged config.Destination, registryLimiter *rate.Limiter, stats *RegistryReport) int {
+	stagedDir := filepath.Join(staged.DestRegistry, staged.DestRepository)
+	tags, err := stagedTags(stagedDir)
+	if err != nil {
+		log.Printf("Failed to read staged images for %s: %v", target.Destination, err)
+		return 1
+	}
+	if len(tags) == 0 {
+		log.Printf("Nothing staged for %s in %s", target.Destination, stagedDir)
+		return 0
+	}
+
+	failed := 0
+	for _, tag := range tags {
+		if ctx.Err() != nil {
+			break
+		}
+		fullDestImage := fmt.Sprintf("%s:%s", target.Destination, tag)
+		ctx := withCopyID(ctx, newCopyID())
+		if err := s.pushStagedTag(ctx, policyContext, registry, target, staged, registryLimiter, tag, stats); err != nil {
+			logf(ctx, "Failed to push %s: %v", fullDestImage, err)
+			stats.failed()
+			failed++
+		}
+	}
+	return failed
+}
+
+func (s *Syncer) pushStagedTag(ctx context.Context, policyContext *signature.PolicyContext, registry config.RegistryConfig, target destinationTarget, staged config.Destination, registryLimiter *rate.Limiter, tag string, stats *RegistryReport) error {
+	fullDestImage := fmt.Sprintf("%s:%s", target.Destination, tag)
+	existing, _, err := existingTargets(ctx, registry, []destinationTarget{target}, tag)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		if registry.IfExists == "fail" {
+			return fmt.Errorf("tag %s already exists", tag)
+		}
+		logf(ctx, "Not pushing %s, tag %s already exists", fullDestImage, tag)
+		stats.skipped()
+		return nil
+	}
+
+	srcRef, err := destinationReference(staged, tag)
+	if err != nil {
+		return err
+	}
+	destRef, err := destinationReference(target.Destination, tag)
+	if err != nil {
+		return err
+	}
+	source := transports.ImageName(srcRef)
+	var kept, stripped []digest.Digest
+	if target.StripAttestations {
+		if kept, stripped, err = stagedAttestations(ctx, srcRef); err != nil {
+			return fmt.Errorf("failed to read staged image %s: %w", source, err)
+		}
+	}
+	logf(ctx, "Pushing staged image %s to %s", source, fullDestImage)
+
+	start := time.Now()
+	// Manifest lists were staged with only the instances the filters select
+	options := &copy.Options{DestinationCtx: target.SystemContext, PreserveDigests: true, ImageListSelection: copy.CopyAllImages}
+	if stripped != nil {
+		options.RemoveSignatures = true
+	}
+	s.layerParallelism(registry).apply(options)
+	copiedManifest, err := copy.Image(ctx, policyContext, newBlobReuseReference(newRateLimitedReference(newTracedReference(destRef), s.requestLimiter(target.DestRegistry)), target.Destination, registry.MountFrom, stats), newThrottledReference(newInstanceFilteringReference(srcRef, kept), s.globalLimiter, registryLimiter), options)
+	record := HistoryCopy{Source: source, Destination: fullDestImage, StartedAt: start, FinishedAt: time.Now(), Result: "synced"}
+	record.RunID, _ = historyRunFrom(ctx)
+	if err != nil {
+		record.Result, record.Error = "failed", err.Error()
+		s.history.recordCopy(ctx, record)
+		return err
+	}
+	manifestDigest, err := manifest.Digest(copiedManifest)
+	if err != nil {
+		return fmt.Errorf("failed to compute digest: %w", err)
+	}
+	record.Digest = manifestDigest.String()
+	if registry.Verify {
+		if err := verifyPushed(ctx, target.SystemContext, fullDestImage, copiedManifest); err != nil {
+			record.Result, record.Error = "failed", "verification failed: "+err.Error()
+			s.history.recordCopy(ctx, record)
+			stats.verificationFailed(fullDestImage, err)
+			return fmt.Errorf("verification failed: %w", err)
+		}
+	}
+	if len(stripped) > 0 {
+		logf(ctx, "Left %d attestation manifests out of %s", len(stripped), fullDestImage)
+		stats.attestationsStripped(fullDestImage, stripped)
+	}
+	s.history.recordCopy(ctx, record)
+	s.audit.record(ctx, AuditRecord{Time: record.FinishedAt, Source: source, Destination: fullDestImage, Digest: record.Digest, Credential: target.Credential})
+	s.digests.record(fullDestImage, record.Digest, source)
+	stats.synced(source)
+	logf(ctx, "Successfully pushed %s to %s in %v", source, fullDestImage, record.FinishedAt.Sub(start))
+
+	if signConfig := s.signConfigFor(registry); signConfig != nil {
+		signedImage := fmt.Sprintf("%s@%s", target.Destination, manifestDigest)
+		if err := signImage(ctx, signConfig, signedImage, target.SystemContext); err != nil {
+			return fmt.Errorf("failed to sign %s: %w", signedImage, err)
+		}
+		logf(ctx, "Signed image %s", signedImage)
+	}
+	return nil
+}
+
+// stagedTags returns the tags staged in dir, the names of its subdirectories
+// holding an image.
+func stagedTags(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), "manifest.json")); err == nil {
+			tags = append(tags, entry.Name())
+		}
+	}
+	return tags, nil
+}
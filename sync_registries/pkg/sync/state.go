@@ -0,0 +1,148 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"registries-sync/pkg/config"
+)
+
+// runState records the progress of a run so an interrupted run can be
+// resumed. It is saved after every copied tag and removed once a run
+// completes. A nil *runState disables resuming.
+type runState struct {
+	path string
+	mu   sync.Mutex
+
+	// Tags copied to every destination, per registry entry
+	Completed map[string][]string `json:"completed"`
+	// Registry entries that were fully synced
+	Finished map[string]bool `json:"finished"`
+}
+
+// loadRunState reads the state left by an interrupted run, or starts a new
+// one when path doesn't exist.
+func loadRunState(path string) (*runState, error) {
+	if path == "" {
+		return nil, nil
+	}
+	state := &runState{path: path, Completed: map[string][]string{}, Finished: map[string]bool{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	if state.Completed == nil {
+		state.Completed = map[string][]string{}
+	}
+	if state.Finished == nil {
+		state.Finished = map[string]bool{}
+	}
+	return state, nil
+}
+
+// registryKey identifies a registry entry in the state file.
+func registryKey(registry config.RegistryConfig) string {
+	destinations := []string{}
+	for _, dest := range registry.AllDestinations() {
+		destinations = append(destinations, dest.String())
+	}
+	return registry.SourceRegistry + "/" + registry.SourceRepository + " -> " + strings.Join(destinations, ",")
+}
+
+func (s *runState) resuming() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Completed) > 0 || len(s.Finished) > 0
+}
+
+func (s *runState) registryFinished(registry config.RegistryConfig) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Finished[registryKey(registry)]
+}
+
+func (s *runState) tagCompleted(registry config.RegistryConfig, tag string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, completed := range s.Completed[registryKey(registry)] {
+		if completed == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *runState) completeTag(registry config.RegistryConfig, tag string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	key := registryKey(registry)
+	s.Completed[key] = append(s.Completed[key], tag)
+	s.mu.Unlock()
+	return s.save()
+}
+
+func (s *runState) finishRegistry(registry config.RegistryConfig) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	key := registryKey(registry)
+	s.Finished[key] = true
+	delete(s.Completed, key)
+	s.mu.Unlock()
+	return s.save()
+}
+
+// save writes the state atomically so a crash never leaves a torn file.
+func (s *runState) save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// clear removes the state file after a run completed.
+func (s *runState) clear() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
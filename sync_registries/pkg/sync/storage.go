@@ -0,0 +1,14 @@
+//go:build !containers_image_storage_stub
+
+package sync
+
+import (
+	"github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/types"
+)
+
+// storageReference returns a reference to image in the containers-storage of
+// the user, as configured in storage.conf.
+func storageReference(image string) (types.ImageReference, error) {
+	return storage.Transport.ParseReference(image)
+}
@@ -0,0 +1,13 @@
+//go:build containers_image_storage_stub
+
+package sync
+
+import (
+	"errors"
+
+	"github.com/containers/image/v5/types"
+)
+
+func storageReference(image string) (types.ImageReference, error) {
+	return nil, errors.New("containers-storage destinations are not supported by this build")
+}
@@ -0,0 +1,1511 @@
+// Package sync mirrors images between registries. A Syncer copies the tags
+// selected by each registry entry of a config.Config to its destinations.
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+)
+
+// Options configures a Syncer.
+type Options struct {
+	Config  *config.Config
+	Secrets *config.Secrets // Secret manager references must already be resolved
+
+	// StateFile records progress so an interrupted SyncAll can be resumed by
+	// the next one. Empty disables resuming.
+	StateFile string
+
+	// Report collects a summary of the run, see Syncer.Report.
+	Report bool
+
+	// HistoryFile is a SQLite database recording every run and image copy.
+	// Empty disables the history.
+	HistoryFile string
+
+	// AuditLog is a hash-chained JSON lines file recording every pushed image
+	// and the credential it was pushed with. Empty disables the audit log.
+	AuditLog string
+
+	// DigestExport is a file mapping every tag pushed to a registry
+	// destination to its digest, in DigestExportFormat: "json" (the default)
+	// or "properties". Empty disables the export.
+	DigestExport       string
+	DigestExportFormat string
+
+	// Progress reports the bytes copied per layer. It is redrawn in place when
+	// stdout is a terminal and registry entries are not synced in parallel,
+	// and logged periodically otherwise.
+	Progress bool
+
+	// PreviousReport is a file the report of every completed run is saved
+	// to, for the next run to report what changed since. Empty disables the
+	// comparison.
+	PreviousReport string
+
+	// Deterministic syncs the registry entries one at a time, sorted by
+	// source repository, and zeroes the timing in the report, so runs
+	// against the same state produce identical reports.
+	Deterministic bool
+
+	// TagFilters are the filters registry entries select with tag_filter.name.
+	TagFilters map[string]TagFilter
+
+	// StageDir makes the run pull the selected images into a directory per
+	// tag below StageDir instead of pushing them to the registry
+	// destinations, for PushStaged to push them later.
+	StageDir string
+}
+
+// Syncer holds the configuration and the state shared by every registry entry
+// synced during a run. It is safe for concurrent use.
+type Syncer struct {
+	config          *config.Config
+	secrets         *config.Secrets
+	globalLimiter   *rate.Limiter            // Shared by every copy in the run
+	requestLimiters map[string]*rate.Limiter // By registry host
+	blobCache       *blobCache
+	policy          *signature.Policy
+	state           *runState // Progress of the current run, nil when not resumable
+	dockerHub       *dockerHubLimiter
+	breaker         *circuitBreaker
+	report          *Report         // Summary of the current run, nil when not requested
+	history         *History        // nil when not requested
+	audit           *AuditLog       // nil when not requested
+	digests         *digestExport   // nil when not requested
+	publisher       *publisher      // nil when no broker is configured
+	notifier        *emailNotifier  // nil when no email is configured
+	failures        *failureTracker // Tags failing run after run, nil without quarantine
+	inspected       *inspectCache
+	headers         *registryHeaders // user_agent and registry_headers, nil when neither is set
+	tagFilters      map[string]TagFilter
+	sourceTokens    *sourceTokens // Anonymous pull tokens shared by the entries of a host, nil when none is
+	previousReport  *Report       // Saved by the previous run, nil when there is none
+	previousFile    string
+	layerCopies     *semaphore.Weighted // Layers copied at the same time across the run, nil when unlimited
+	progress        progressMode
+	deterministic   bool
+
+	// Images not copied because of the vulnerability scan or policy hook
+	mu      sync.Mutex
+	skipped []string
+	lags    map[string]MirrorLag // Latest mirror lag by registryKey
+}
+
+// New validates the configuration and prepares a Syncer.
+func New(opts Options) (_ *Syncer, err error) {
+	cfg := opts.Config
+	if opts.StageDir != "" {
+		cfg = stagedConfig(cfg, opts.StageDir)
+	}
+	globalLimiter, err := newBandwidthLimiter(cfg.MaxBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse max_bandwidth: %w", err)
+	}
+	blobCache, err := newBlobCache(cfg.BlobCacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize blob cache: %w", err)
+	}
+	policy, err := LoadSignaturePolicy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signature policy: %w", err)
+	}
+	dockerHubCredentials, err := auth.ResolveCredentials(context.Background(), "docker.io", dockerHubSecret(opts.Secrets.Secrets))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve Docker Hub credentials: %w", err)
+	}
+	if err := ValidateRegistryHeaders(cfg); err != nil {
+		return nil, err
+	}
+	headers := newRegistryHeaders(cfg)
+	dockerHub, err := newDockerHubLimiter(cfg.DockerHub, dockerHubCredentials, headers)
+	if err != nil {
+		return nil, err
+	}
+	breaker, err := newCircuitBreaker(cfg.CircuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Sign != nil {
+		if err := cfg.Sign.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.VerifySignatures != nil {
+		if err := cfg.VerifySignatures.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PolicyHook != nil {
+		if err := cfg.PolicyHook.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Hooks != nil {
+		if err := cfg.Hooks.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Scan != nil {
+		if err := cfg.Scan.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Pushgateway != nil {
+		if err := cfg.Pushgateway.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Quarantine != nil {
+		if err := cfg.Quarantine.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RegistryPolicy != nil {
+		if err := cfg.RegistryPolicy.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, blocked := range cfg.BlockedDigests {
+		if _, err := digest.Parse(blocked); err != nil {
+			return nil, fmt.Errorf("invalid blocked digest %q: %w", blocked, err)
+		}
+	}
+	for host, price := range cfg.EgressCostPerGB {
+		if price < 0 {
+			return nil, fmt.Errorf("egress_cost_per_gb of %s must not be negative", host)
+		}
+	}
+	if err := ValidateEgressCosts(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.MaxParallelLayers < 0 {
+		return nil, fmt.Errorf("max_parallel_layers must not be negative")
+	}
+	if cfg.MaxFailures < 0 {
+		return nil, fmt.Errorf("max_failures must not be negative")
+	}
+	requestLimiters, err := newRequestLimiters(cfg.RequestsPerSecond)
+	if err != nil {
+		return nil, err
+	}
+	if err := addSourceLimiters(requestLimiters, cfg.SourceRequestsPerSecond, cfg.Registries); err != nil {
+		return nil, err
+	}
+	for _, registry := range cfg.Registries {
+		if _, err := copyTimeout(registry); err != nil {
+			return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+		for _, pinned := range registry.Digests {
+			if _, err := digest.Parse(pinned.Digest); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: invalid digest %q: %w", registry.SourceRegistry, registry.SourceRepository, pinned.Digest, err)
+			}
+		}
+		for _, blocked := range registry.BlockedDigests {
+			if _, err := digest.Parse(blocked); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: invalid blocked digest %q: %w", registry.SourceRegistry, registry.SourceRepository, blocked, err)
+			}
+		}
+		switch registry.IfExists {
+		case "", "overwrite", "skip", "fail":
+		default:
+			return nil, fmt.Errorf("registry %s/%s: invalid if_exists %q, expected overwrite, skip or fail", registry.SourceRegistry, registry.SourceRepository, registry.IfExists)
+		}
+		if _, err := ParseCompression(registry.Compression); err != nil {
+			return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+		if registry.Compression != "" && registry.Referrers {
+			return nil, fmt.Errorf("registry %s/%s: referrers can't be copied with compression set, recompressed images have a new digest", registry.SourceRegistry, registry.SourceRepository)
+		}
+		if annotatesManifests(registry) && registry.Referrers {
+			return nil, fmt.Errorf("registry %s/%s: referrers can't be copied with annotations set, annotated images have a new digest", registry.SourceRegistry, registry.SourceRepository)
+		}
+		if _, err := ParseSize(registry.MaxImageSize); err != nil {
+			return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+		if _, err := ParseAge(registry.MaxAge); err != nil {
+			return nil, fmt.Errorf("registry %s/%s: max_age: %w", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+		if _, err := ParseAge(registry.MaxTagAge); err != nil {
+			return nil, fmt.Errorf("registry %s/%s: max_tag_age: %w", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+		switch registry.SourceAPI {
+		case "", "quay", "registry":
+		default:
+			return nil, fmt.Errorf("registry %s/%s: invalid source_api %q, expected quay or registry", registry.SourceRegistry, registry.SourceRepository, registry.SourceAPI)
+		}
+		switch registry.ArtifactType {
+		case "", "image", "helm", "any":
+		default:
+			return nil, fmt.Errorf("registry %s/%s: invalid artifact_type %q, expected image, helm or any", registry.SourceRegistry, registry.SourceRepository, registry.ArtifactType)
+		}
+		if registry.Sign != nil {
+			if err := registry.Sign.Validate(); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+		}
+		if registry.VerifySignatures != nil {
+			if err := registry.VerifySignatures.Validate(); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+		}
+		if registry.Scan != nil {
+			if err := registry.Scan.Validate(); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+		}
+		if registry.Hooks != nil {
+			if err := registry.Hooks.Validate(); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+		}
+		for _, dest := range registry.AllDestinations() {
+			if err := ValidateTransport(registry, dest); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+		}
+		if registry.ParallelLayers < 0 {
+			return nil, fmt.Errorf("registry %s/%s: parallel_layers must not be negative", registry.SourceRegistry, registry.SourceRepository)
+		}
+		if _, err := ParseSize(registry.Harbor.StorageLimit); err != nil {
+			return nil, fmt.Errorf("registry %s/%s: harbor.storage_limit: %w", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+		if registry.ECR.LifecyclePolicy != nil {
+			if err := ValidateECRLifecyclePolicy(registry.ECR.LifecyclePolicy); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+		}
+		if registry.TagFilter != nil {
+			if err := registry.TagFilter.Validate(); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+			if _, err := tagFilterFor(registry, opts.TagFilters); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+		}
+		if slices.Contains(registry.SourceFallbacks, "") {
+			return nil, fmt.Errorf("registry %s/%s: empty entry in source_fallbacks", registry.SourceRegistry, registry.SourceRepository)
+		}
+		if cfg.RegistryPolicy != nil {
+			if err := cfg.RegistryPolicy.Check(registry); err != nil {
+				return nil, fmt.Errorf("registry %s/%s: %w", registry.SourceRegistry, registry.SourceRepository, err)
+			}
+		}
+	}
+	publisher, err := newPublisher(cfg.Publish)
+	if err != nil {
+		return nil, err
+	}
+	var history *History
+	var audit *AuditLog
+	defer func() {
+		// Release what was opened when a later step fails
+		if err != nil {
+			publisher.Close()
+			audit.Close()
+			history.Close()
+		}
+	}()
+	notifier, err := newEmailNotifier(cfg.Notify)
+	if err != nil {
+		return nil, err
+	}
+	failures, err := newFailureTracker(cfg.Quarantine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quarantine file: %w", err)
+	}
+	state, err := loadRunState(opts.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state: %w", err)
+	}
+	if opts.HistoryFile != "" {
+		history, err = OpenHistory(opts.HistoryFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.AuditLog != "" {
+		audit, err = OpenAuditLog(opts.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var digests *digestExport
+	if opts.DigestExport != "" {
+		format := opts.DigestExportFormat
+		if format == "" {
+			format = "json"
+		}
+		if digests, err = openDigestExport(opts.DigestExport, format); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Syncer{
+		config:          cfg,
+		secrets:         opts.Secrets,
+		globalLimiter:   globalLimiter,
+		requestLimiters: requestLimiters,
+		blobCache:       blobCache,
+		policy:          policy,
+		state:           state,
+		dockerHub:       dockerHub,
+		breaker:         breaker,
+		history:         history,
+		audit:           audit,
+		digests:         digests,
+		publisher:       publisher,
+		notifier:        notifier,
+		failures:        failures,
+		inspected:       newInspectCache(),
+		headers:         headers,
+		tagFilters:      opts.TagFilters,
+		sourceTokens:    newSourceTokens(cfg.Registries),
+		deterministic:   opts.Deterministic,
+		lags:            map[string]MirrorLag{},
+	}
+	if cfg.MaxParallelLayers > 0 {
+		s.layerCopies = semaphore.NewWeighted(int64(cfg.MaxParallelLayers))
+	}
+	if opts.Progress && !opts.Deterministic {
+		s.progress = detectProgressMode(cfg.MaxParallelRegistries > 1)
+	}
+	if opts.Report || notifier != nil || cfg.Pushgateway != nil || len(cfg.EgressCostPerGB) > 0 || opts.PreviousReport != "" {
+		// The email, the pushed metrics and the cost estimate summarize the report
+		s.report = newReport()
+	}
+	if opts.PreviousReport != "" {
+		if s.previousReport, err = loadPreviousReport(opts.PreviousReport); err != nil {
+			return nil, err
+		}
+		s.previousFile = opts.PreviousReport
+	}
+	return s, nil
+}
+
+// Close releases the history database, the audit log and the broker
+// connections.
+func (s *Syncer) Close() error {
+	s.publisher.Close()
+	s.audit.Close()
+	return s.history.Close()
+}
+
+// Resuming reports whether the state file holds progress of an interrupted
+// run, which SyncAll continues from.
+func (s *Syncer) Resuming() bool {
+	return s.state.resuming()
+}
+
+// Report returns the summary of the run, or nil unless Options.Report was set,
+// Options.PreviousReport was set, or an email notification, a Pushgateway or
+// egress costs are configured.
+func (s *Syncer) Report() *Report {
+	return s.report
+}
+
+// Skipped returns the images deliberately not copied so far, because of the
+// vulnerability scan or the policy hook, with the reason.
+func (s *Syncer) Skipped() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.skipped...)
+}
+
+// DockerHubQuota returns the pull budget last reported by Docker Hub, or nil.
+func (s *Syncer) DockerHubQuota() *DockerHubQuota {
+	return s.dockerHub.lastQuota()
+}
+
+// OpenedCircuits lists the destination registries the circuit breaker
+// stopped copying to, with the error that opened the circuit.
+func (s *Syncer) OpenedCircuits() []string {
+	return s.breaker.openedCircuits()
+}
+
+// PersistentFailures lists the tags that failed in at least quarantine.after
+// consecutive runs, with the number of runs and the last error.
+func (s *Syncer) PersistentFailures() []string {
+	return s.failures.persistent()
+}
+
+// skip records an image that was deliberately not copied.
+func (s *Syncer) skip(image, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped = append(s.skipped, fmt.Sprintf("%s (%s)", image, reason))
+}
+
+// SyncAll syncs every registry entry not finished by an interrupted run.
+// Entries are independent, so up to max_parallel_registries of them run at
+// the same time. When ctx is cancelled the progress is saved to the state
+// file and ctx.Err() is returned, otherwise the state file is removed. A run
+// stopped by max_failures is saved the same way and returns ErrMaxFailures.
+// Failures of individual entries are logged, not returned.
+func (s *Syncer) SyncAll(ctx context.Context) error {
+	parallel := s.config.MaxParallelRegistries
+	registries := s.config.Registries
+	if parallel < 1 || s.deterministic {
+		parallel = 1
+	}
+	if s.deterministic {
+		registries = sortedRegistries(registries)
+	}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	ctx, abort := withFailureBudget(ctx, s.config.MaxFailures)
+	defer abort(nil)
+	runID := s.history.startRun(ctx, "sync-all")
+	ctx = withHistoryRun(ctx, runID)
+	var failed atomic.Bool
+	s.failures.startRun()
+
+	for _, registry := range registries {
+		if s.state.registryFinished(registry) {
+			log.Printf("Skipping %s/%s, already synced by the interrupted run", registry.SourceRegistry, registry.SourceRepository)
+			continue
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(registry config.RegistryConfig) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err := s.SyncRegistry(ctx, registry, nil)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to sync %s: %v", registry.SourceRepository, err)
+				failed.Store(true)
+				return
+			}
+			log.Printf("Completed sync for %s/%s", registry.SourceRegistry, registry.SourceRepository)
+			if err := s.state.finishRegistry(registry); err != nil {
+				log.Printf("Failed to save state: %v", err)
+			}
+		}(registry)
+	}
+
+	wg.Wait()
+	s.report.finish(s, ctx.Err() != nil)
+	s.notifier.notify(ctx, s.report)
+	pushMetrics(ctx, s.config.Pushgateway, s.report)
+	if s.previousFile != "" && ctx.Err() == nil {
+		// Interrupted runs are resumed, the next run compares with this one
+		if err := s.report.save(s.previousFile); err != nil {
+			log.Printf("Failed to save the report for the next run: %v", err)
+		}
+	}
+	if s.deterministic {
+		// After the email and the metrics, which need the timing
+		s.report.stabilize()
+	}
+	s.history.finishRun(ctx, runID, runResult(ctx, failed.Load()))
+
+	if ctx.Err() != nil {
+		if err := s.state.save(); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+		return context.Cause(ctx)
+	}
+	if err := s.state.clear(); err != nil {
+		log.Printf("Failed to remove state file: %v", err)
+	}
+	return nil
+}
+
+// SyncRegistry resolves the destination credentials for a registry entry
+// and syncs it. When tags is empty the tags are selected from the source using
+// the configured filters, otherwise only the given tags are copied.
+func (s *Syncer) SyncRegistry(ctx context.Context, registry config.RegistryConfig, tags []string) (err error) {
+	destinations := registry.AllDestinations()
+	destinationNames := []string{}
+	for _, dest := range destinations {
+		destinationNames = append(destinationNames, dest.String())
+	}
+
+	ctx, span := tracer.Start(ctx, "sync-registry", trace.WithAttributes(
+		attribute.String("source.repository", registry.SourceRegistry+"/"+registry.SourceRepository),
+		attribute.StringSlice("destination.repositories", destinationNames),
+	))
+	stats := s.report.startRegistry(registry)
+	defer func() {
+		stats.finish(err)
+		endSpan(span, err)
+	}()
+	if _, ok := historyRunFrom(ctx); !ok {
+		// Synced on its own rather than as part of SyncAll
+		runID := s.history.startRun(ctx, runKind(ctx))
+		ctx = withHistoryRun(ctx, runID)
+		defer func() { s.history.finishRun(ctx, runID, runResult(ctx, err != nil)) }()
+	}
+
+	log.Printf("Starting sync for registry: %s/%s to %s", registry.SourceRegistry, registry.SourceRepository, strings.Join(destinationNames, ", "))
+	if len(destinations) == 0 {
+		return fmt.Errorf("no destination configured")
+	}
+
+	syncEvent := hookEvent{Phase: hookPreSync, Source: registry.SourceRegistry + "/" + registry.SourceRepository, Destinations: destinationNames}
+	if err := s.runHooks(ctx, registry, syncEvent); err != nil {
+		return err
+	}
+	defer func() { s.runPostHooks(ctx, registry, syncEvent.finished(hookPostSync, false, err)) }()
+
+	targets, err := s.destinationTargets(ctx, registry, destinations, stats)
+	if err != nil {
+		return err
+	}
+	return s.syncRegistry(ctx, registry, targets, tags, stats)
+}
+
+// destinationTargets resolves the credentials of destinations and prepares
+// them for copies: repositories are created with auto_create and ECR
+// lifecycle policies applied.
+func (s *Syncer) destinationTargets(ctx context.Context, registry config.RegistryConfig, destinations []config.Destination, stats *RegistryReport) ([]destinationTarget, error) {
+	targets := []destinationTarget{}
+	for _, dest := range destinations {
+		if dest.Local() {
+			// Local image stores need no credentials
+			destCtx := &types.SystemContext{BlobInfoCacheDir: s.blobCache.infoDir()}
+			applySystemContextOptions(destCtx, registry)
+			s.headers.apply(destCtx)
+			targets = append(targets, destinationTarget{Destination: dest, SystemContext: destCtx, Credential: AuditCredential{Type: dest.Transport}})
+			continue
+		}
+
+		// Retrieve the credentials for the destination registry
+		secret := auth.SecretFor(dest.DestRegistry, s.secrets.Secrets)
+
+		credentials, err := auth.ResolveCredentials(ctx, dest.DestRegistry, secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve credentials for %s: %w", dest.DestRegistry, err)
+		}
+
+		if registry.AutoCreate {
+			if err := ensureDestRepository(ctx, registry.WithDestination(dest), secret, credentials); err != nil {
+				return nil, fmt.Errorf("failed to create destination repository %s: %w", dest, err)
+			}
+		}
+		if registry.ECR.LifecyclePolicy != nil && isECRDestination(registry.WithDestination(dest), secret) {
+			policy, err := applyECRLifecyclePolicy(ctx, registry.WithDestination(dest))
+			if err != nil {
+				return nil, err
+			}
+			stats.lifecyclePolicyApplied(dest.String(), policy)
+		}
+
+		destCtx, err := auth.SecretSystemContext(secret, credentials)
+		if err != nil {
+			return nil, err
+		}
+		destCtx.BlobInfoCacheDir = s.blobCache.infoDir()
+		applySystemContextOptions(destCtx, registry)
+		s.headers.apply(destCtx)
+		targets = append(targets, destinationTarget{Destination: dest, SystemContext: destCtx, Credential: auditCredential(secret, credentials)})
+	}
+	return targets, nil
+}
+
+// destinationTarget is a destination together with the system context holding
+// its credentials.
+type destinationTarget struct {
+	config.Destination
+	SystemContext *types.SystemContext
+	Credential    AuditCredential // Recorded in the audit log
+}
+
+func (s *Syncer) syncRegistry(ctx context.Context, registry config.RegistryConfig, targets []destinationTarget, tags []string, stats *RegistryReport) error {
+	registryLimiter, err := newBandwidthLimiter(registry.MaxBandwidth)
+	if err != nil {
+		return fmt.Errorf("failed to parse max_bandwidth: %w", err)
+	}
+
+	sources, err := s.pullSources(ctx, registry)
+	if err != nil {
+		return err
+	}
+	filteredTags := tags
+	if len(filteredTags) == 0 && len(registry.Tags) > 0 {
+		filteredTags = registry.Tags
+		for _, tag := range registry.PinTags {
+			if !slices.Contains(filteredTags, tag) {
+				filteredTags = append(slices.Clip(filteredTags), tag)
+			}
+		}
+		log.Printf("Syncing the listed tags of %s/%s: %v", registry.SourceRegistry, registry.SourceRepository, filteredTags)
+	} else if len(filteredTags) == 0 && registry.ListsTags() {
+		tags, err := s.listSourceTags(ctx, sources)
+		if err != nil {
+			return fmt.Errorf("failed to get tags: %w", err)
+		}
+		log.Printf("Fetched %d tags from source repository.", len(tags))
+		if tags, err = applyTagFilter(ctx, registry, s.tagFilters, tags); err != nil {
+			return err
+		}
+
+		_, filterSpan := tracer.Start(ctx, "filter-tags")
+		filteredTags = selectTags(tags, registry)
+		filterSpan.SetAttributes(attribute.Int("tags.selected", len(filteredTags)))
+		filterSpan.End()
+		log.Printf("Selected %d latest tags for syncing: %v", len(filteredTags), filteredTags)
+	}
+	if len(tags) == 0 {
+		for _, pinned := range registry.Digests {
+			filteredTags = append(filteredTags, pinned.Digest)
+		}
+		s.failures.prune(registry, filteredTags)
+	}
+
+	stats.considered(len(filteredTags))
+	failed := 0
+	for i, tag := range filteredTags {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if s.state.tagCompleted(registry, tag) {
+			log.Printf("Skipping tag %s, already synced by the interrupted run", tag)
+			continue
+		}
+
+		copyID := newCopyID()
+		ctx := withCopyID(ctx, copyID)
+		copyEvent := copyHookEvent(hookPreCopy, registry, tag)
+		copyEvent.CopyID = copyID
+		if failure, ok := s.failures.quarantined(registry, tag); ok {
+			logf(ctx, "Skipping %s, quarantined after %d failed runs: %s", copyEvent.Source, failure.Runs, failure.LastError)
+			s.skip(copyEvent.Source, fmt.Sprintf("quarantined after %d failed runs", failure.Runs))
+			stats.skipped()
+			stats.copied(copyEvent.finished(hookPostCopy, true, nil))
+			continue
+		}
+		skipped, err := false, s.runHooks(ctx, registry, copyEvent)
+		if err == nil {
+			skipped, err = s.syncTagFromSources(ctx, sources, targets, registryLimiter, tag, filteredTags, stats)
+		}
+		if errors.Is(err, errCircuitOpen) {
+			remaining := len(filteredTags) - i
+			logf(ctx, "Not syncing the remaining %d tags of %s/%s, the circuit breaker is open for every destination", remaining, registry.SourceRegistry, registry.SourceRepository)
+			for range remaining {
+				stats.failed()
+			}
+			failed += remaining
+			copiesFailed(ctx, remaining)
+			break
+		}
+		s.runPostHooks(ctx, registry, copyEvent.finished(hookPostCopy, skipped, err))
+		stats.copied(copyEvent.finished(hookPostCopy, skipped, err))
+		if err != nil {
+			logf(ctx, "Failed to sync %s/%s:%s: %v", registry.SourceRegistry, registry.SourceRepository, tag, err)
+			stats.failed()
+			failed++
+			if ctx.Err() == nil {
+				s.failures.tagFailed(registry, tag, copyEvent.Source, err)
+				copiesFailed(ctx, 1)
+			}
+			continue
+		}
+		s.failures.tagSucceeded(registry, tag)
+		if skipped {
+			stats.skipped()
+		} else {
+			stats.synced(copyEvent.Source)
+			if err := s.state.completeTag(registry, tag); err != nil {
+				logf(ctx, "Failed to save state: %v", err)
+			}
+		}
+	}
+
+	if len(tags) == 0 && registry.ListsTags() {
+		s.measureMirrorLag(ctx, registry, sources[0], s.allowedTargets(targets), filteredTags, stats)
+	}
+	if verifyConfig := s.verifySignaturesConfigFor(registry); verifyConfig != nil && len(tags) == 0 && ctx.Err() == nil {
+		if err := s.verifyDestinationSignatures(ctx, verifyConfig, s.allowedTargets(targets), stats); err != nil {
+			logf(ctx, "Stopped verifying the signatures of %s/%s: %v", registry.SourceRegistry, registry.SourceRepository, err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tags failed", failed, len(filteredTags))
+	}
+	return nil
+}
+
+// syncTagFromSources syncs tag from the first source, and from the next one
+// whenever that fails.
+func (s *Syncer) syncTagFromSources(ctx context.Context, sources []pullSource, targets []destinationTarget, registryLimiter *rate.Limiter, tag string, selectedTags []string, stats *RegistryReport) (skipped bool, err error) {
+	for i, source := range sources {
+		if i > 0 {
+			logf(ctx, "Failed to sync %s/%s:%s, trying %s: %v", sources[i-1].registry.SourceRegistry, source.registry.SourceRepository, tag, source.registry.SourceRegistry, err)
+		}
+		skipped, err = s.syncTag(ctx, source.registry, targets, source.sys, registryLimiter, tag, selectedTags, stats)
+		if err == nil || errors.Is(err, errCircuitOpen) || ctx.Err() != nil {
+			break
+		}
+	}
+	return skipped, err
+}
+
+// syncTag copies a single tag to every target. It returns skipped when the
+// image was deliberately not copied, e.g. because of the vulnerability scan,
+// the policy hook or because it already exists at every target.
+func (s *Syncer) syncTag(ctx context.Context, registry config.RegistryConfig, targets []destinationTarget, sourceCtx *types.SystemContext, registryLimiter *rate.Limiter, tag string, selectedTags []string, stats *RegistryReport) (bool, error) {
+	fullSourceImage := fmt.Sprintf("%s/%s:%s", registry.SourceRegistry, registry.SourceRepository, tag)
+	pinned, isPinned := registry.PinnedDigest(tag)
+	if isPinned {
+		fullSourceImage = fmt.Sprintf("%s/%s@%s", registry.SourceRegistry, registry.SourceRepository, pinned.Digest)
+	}
+
+	// Parse the source reference again with the tag
+	srcRef, err := docker.ParseReference("//" + fullSourceImage)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse source image reference for %s: %w", fullSourceImage, err)
+	}
+
+	destTag := pinned.DestTag()
+	if !isPinned {
+		destTag, err = rewriteTag(registry.TagRewrite, tag)
+		if err != nil {
+			return false, fmt.Errorf("failed to rewrite tag: %w", err)
+		}
+	}
+
+	targets = s.allowedTargets(targets)
+	if len(targets) == 0 {
+		return false, errCircuitOpen
+	}
+
+	existing, targets, err := existingTargets(ctx, registry, targets, destTag)
+	if err != nil {
+		return false, err
+	}
+	if len(existing) > 0 {
+		if registry.IfExists == "fail" {
+			return false, fmt.Errorf("tag %s already exists at %s", destTag, destinationNames(existing))
+		}
+		logf(ctx, "Not copying %s to %s, tag %s already exists", fullSourceImage, destinationNames(existing), destTag)
+		if len(targets) == 0 {
+			return true, nil
+		}
+	}
+
+	sourceCtx = s.sourceTokens.apply(ctx, s, registry, sourceCtx)
+	if blocked := blockedDigests(s.config, registry); len(blocked) > 0 {
+		var blockedDigest string
+		err := s.pullFrom(ctx, registry.SourceRegistry, func() (err error) {
+			blockedDigest, err = findBlockedDigest(ctx, sourceCtx, newRateLimitedReference(srcRef, s.requestLimiter(registry.SourceRegistry)), blocked)
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to inspect %s: %w", fullSourceImage, err)
+		}
+		if blockedDigest != "" {
+			logf(ctx, "Skipping image %s: digest %s is blocked", fullSourceImage, blockedDigest)
+			s.skip(fullSourceImage, "blocked digest "+blockedDigest)
+			return true, nil
+		}
+	}
+	kind := kindImage
+	if registry.ArtifactType != "" {
+		err := s.pullFrom(ctx, registry.SourceRegistry, func() (err error) {
+			kind, err = artifactKind(ctx, sourceCtx, newRateLimitedReference(srcRef, s.requestLimiter(registry.SourceRegistry)))
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to inspect %s: %w", fullSourceImage, err)
+		}
+		if !wantsArtifact(registry.ArtifactType, kind) {
+			logf(ctx, "Not copying %s, it is a %s and artifact_type is %s", fullSourceImage, kind, registry.ArtifactType)
+			return true, nil
+		}
+	}
+	// Charts and other artifacts are copied verbatim, their layers are not
+	// image layers that could be converted or recompressed
+	preserveDigests := kind != kindImage
+
+	// Instances of a manifest list to copy when the filters select several
+	var selection *platformSelection
+	var instances []digest.Digest
+	if filtersPlatforms(registry) && kind == kindImage {
+		err := s.pullFrom(ctx, registry.SourceRegistry, func() (err error) {
+			selection, err = selectPlatforms(ctx, registry, sourceCtx, newRateLimitedReference(srcRef, s.requestLimiter(registry.SourceRegistry)))
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to inspect %s: %w", fullSourceImage, err)
+		}
+		missing := selection.Missing
+		if len(missing) > 0 && registry.RequirePlatforms {
+			return false, fmt.Errorf("%s has no image for the requested platforms %s", fullSourceImage, strings.Join(missing, ", "))
+		}
+		if len(missing) > 0 && selection.Platform != nil {
+			logf(ctx, "Warning: %s has no image for the requested platforms %s", fullSourceImage, strings.Join(missing, ", "))
+			stats.platformsMissing(fullSourceImage, missing)
+		}
+		if selection.Platform == nil {
+			logf(ctx, "Skipping image %s: no platform matching os and architectures", fullSourceImage)
+			s.skip(fullSourceImage, "no platform matching os and architectures")
+			return true, nil
+		}
+		// The checks below inspect that platform. A single platform is also
+		// the one copied, several are copied as a manifest list.
+		sourceCtx = withPlatform(sourceCtx, *selection.Platform)
+		instances = selection.Instances
+	}
+
+	checkAge := registry.MaxAge != "" && !isPinned && !slices.Contains(registry.PinTags, tag)
+	checkLabels := len(registry.RequireLabels) > 0 || len(registry.ExcludeLabels) > 0
+	if (checkAge || registry.MaxImageSize != "" || checkLabels) && kind == kindImage {
+		var info *imageInfo
+		err := s.pullFrom(ctx, registry.SourceRegistry, func() (err error) {
+			info, err = inspectImage(ctx, sourceCtx, newRateLimitedReference(srcRef, s.requestLimiter(registry.SourceRegistry)), s.inspected)
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to inspect %s: %w", fullSourceImage, err)
+		}
+		if checkLabels {
+			if reason := labelMismatch(registry, info); reason != "" {
+				logf(ctx, "Skipping image %s: %s", fullSourceImage, reason)
+				s.skip(fullSourceImage, reason)
+				return true, nil
+			}
+		}
+		if checkAge {
+			maxAge, err := ParseAge(registry.MaxAge)
+			if err != nil {
+				return false, err
+			}
+			if info.Created != nil && time.Since(*info.Created) > maxAge {
+				logf(ctx, "Skipping image %s: created %s, older than max_age of %s", fullSourceImage, info.Created.Format(time.DateOnly), registry.MaxAge)
+				s.skip(fullSourceImage, "older than max_age")
+				return true, nil
+			}
+		}
+		if registry.MaxImageSize != "" {
+			maxSize, err := ParseSize(registry.MaxImageSize)
+			if err != nil {
+				return false, err
+			}
+			if info.Size > maxSize {
+				logf(ctx, "Skipping image %s: layers total %s, over max_image_size of %s", fullSourceImage, units.BytesSize(float64(info.Size)), registry.MaxImageSize)
+				s.skip(fullSourceImage, fmt.Sprintf("%s, over max_image_size", units.BytesSize(float64(info.Size))))
+				return true, nil
+			}
+		}
+	}
+
+	if s.config.PolicyHook != nil {
+		allowed, reason, err := checkPolicyHook(ctx, s.config.PolicyHook, registry, sourceCtx, srcRef, tag, selectedTags, s.inspected)
+		if err != nil {
+			return false, fmt.Errorf("failed to evaluate policy: %w", err)
+		}
+		if !allowed {
+			logf(ctx, "Skipping image %s: denied by policy: %s", fullSourceImage, reason)
+			s.skip(fullSourceImage, "denied by policy: "+reason)
+			return true, nil
+		}
+	}
+
+	var sourceDigest digest.Digest
+	if registry.ProvenanceAnnotations && !preserveDigests {
+		sourceDigest = digest.Digest(pinned.Digest)
+		if !isPinned {
+			err := s.pullFrom(ctx, registry.SourceRegistry, func() (err error) {
+				sourceDigest, err = docker.GetDigest(ctx, sourceCtx, srcRef)
+				return err
+			})
+			if err != nil {
+				return false, fmt.Errorf("failed to get digest of %s: %w", fullSourceImage, err)
+			}
+		}
+	}
+
+	// Copy the image from source to destination
+	policyContext, err := signature.NewPolicyContext(s.policy)
+	if err != nil {
+		return false, fmt.Errorf("failed to create policy context: %w", err)
+	}
+	defer policyContext.Destroy()
+
+	timeout, err := copyTimeout(registry)
+	if err != nil {
+		return false, err
+	}
+
+	// Cache hits are served locally and bypass the bandwidth limits
+	var tagBytes int64
+	var source types.ImageReference = newCachingReference(newCountingReference(newCountingReference(newCountingReference(newThrottledReference(newRateLimitedReference(newTracedReference(srcRef), s.requestLimiter(registry.SourceRegistry)), s.globalLimiter, registryLimiter), stats.byteCounter()), s.report.sourceCounter(registry.SourceRegistry)), &tagBytes), s.blobCache)
+	copySourceCtx := sourceCtx
+	pushPolicyContext := policyContext
+	scanConfig := s.scanConfigFor(registry)
+	if kind != kindImage {
+		scanConfig = nil
+	}
+	if len(targets) > 1 || instances != nil || scanConfig != nil {
+		// Pull once into a staging directory and push from there to every
+		// destination. Manifest lists are staged too: the source policy is
+		// enforced on the list as published, the push leaves out the
+		// instances that weren't copied. The scanners read the staged copy.
+		switch {
+		case len(targets) > 1:
+			logf(ctx, "Staging image %s for %d destinations", fullSourceImage, len(targets))
+		case instances != nil:
+			logf(ctx, "Staging %d platforms of image %s", len(instances), fullSourceImage)
+		default:
+			logf(ctx, "Staging image %s to scan it", fullSourceImage)
+		}
+		var staged types.ImageReference
+		var cleanup func()
+		err := s.pullFrom(ctx, registry.SourceRegistry, func() (err error) {
+			stageCtx, cancel := withTimeout(ctx, timeout)
+			defer cancel()
+			progress := startProgress(s.progress, copyPrefix(ctx)+"Pulling "+fullSourceImage)
+			defer progress.stop()
+			staged, cleanup, err = stageImage(stageCtx, policyContext, source, sourceCtx, instances, preserveDigests, registry.CopyForeignLayers, s.layerParallelism(registry), progress)
+			return timeoutError(ctx, stageCtx, timeout, err)
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to stage image: %w", err)
+		}
+		defer cleanup()
+		if scanConfig != nil {
+			logf(ctx, "Scanning image %s for vulnerabilities", fullSourceImage)
+			findings, err := scanImage(ctx, scanConfig, staged, sourceCtx)
+			if err != nil {
+				return false, fmt.Errorf("failed to scan image: %w", err)
+			}
+			if len(findings) > 0 {
+				if scanConfig.Action == "fail" {
+					return false, fmt.Errorf("%d vulnerabilities at or above %s: %s", len(findings), scanConfig.Threshold(), strings.Join(findings, ", "))
+				}
+				logf(ctx, "Skipping image %s: %d vulnerabilities at or above %s: %s", fullSourceImage, len(findings), scanConfig.Threshold(), strings.Join(findings, ", "))
+				s.skip(fullSourceImage, fmt.Sprintf("%d vulnerabilities", len(findings)))
+				return true, nil
+			}
+		}
+		// Each push reads the staged copy as fast as the limits of a pull allow
+		source = newThrottledReference(staged, s.globalLimiter, registryLimiter)
+		copySourceCtx = nil
+
+		// The policy was enforced while staging, the dir: copy is trusted
+		pushPolicyContext, err = signature.NewPolicyContext(insecureAcceptAnythingPolicy())
+		if err != nil {
+			return false, fmt.Errorf("failed to create policy context: %w", err)
+		}
+		defer pushPolicyContext.Destroy()
+	}
+
+	failed := 0
+	for _, target := range targets {
+		fullDestImage := fmt.Sprintf("%s:%s", target.Destination, destTag)
+		logf(ctx, "Syncing image %s to %s", fullSourceImage, fullDestImage)
+
+		destRef, err := destinationReference(target.Destination, destTag)
+		if err != nil {
+			logf(ctx, "Failed to parse destination image reference for %s: %v", fullDestImage, err)
+			failed++
+			continue
+		}
+
+		start := time.Now()
+		copyCtx, copySpan := tracer.Start(ctx, "copy-image", trace.WithAttributes(
+			attribute.String("source.image", fullSourceImage),
+			attribute.String("destination.image", fullDestImage),
+			attribute.String("copy.id", copyIDFrom(ctx)),
+		))
+		var copiedManifest []byte
+		var annotations map[string]string
+		if annotatesManifests(registry) && !preserveDigests {
+			annotations = manifestAnnotations(registry, fullSourceImage, sourceDigest, start)
+		}
+		pushInstances, stripped := selection.withoutAttestations(target.StripAttestations)
+		pushRef := newAnnotatingReference(newBlobReuseReference(newRateLimitedReference(newTracedReference(destRef), s.requestLimiter(target.DestRegistry)), target.Destination, registry.MountFrom, stats), annotations)
+		copyImage := func() (err error) {
+			timeoutCtx, cancel := withTimeout(copyCtx, timeout)
+			defer cancel()
+			progress := startProgress(s.progress, copyPrefix(ctx)+"Copying to "+fullDestImage)
+			defer progress.stop()
+			options := &copy.Options{
+				SourceCtx:             copySourceCtx,
+				DestinationCtx:        target.SystemContext,
+				PreserveDigests:       preserveDigests,
+				DownloadForeignLayers: registry.CopyForeignLayers,
+			}
+			if !preserveDigests {
+				if err := applyCompression(options, registry); err != nil {
+					return err
+				}
+			}
+			if len(annotations) > 0 {
+				// Only OCI manifests carry annotations. Signatures of the
+				// source manifest don't match the annotated one.
+				options.ForceManifestMIMEType = imgspecv1.MediaTypeImageManifest
+				options.RemoveSignatures = true
+			}
+			s.layerParallelism(registry).apply(options)
+			progress.apply(options)
+			if pushInstances != nil {
+				// The source signatures sign the list with every instance
+				options.ImageListSelection = copy.CopyAllImages
+				options.RemoveSignatures = true
+			}
+			copiedManifest, err = copy.Image(timeoutCtx, pushPolicyContext, pushRef, newInstanceFilteringReference(source, pushInstances), options)
+			copiedManifest = pushedManifest(pushRef, copiedManifest)
+			return timeoutError(copyCtx, timeoutCtx, timeout, err)
+		}
+		if copySourceCtx != nil {
+			// Not staged, the copy pulls from the source
+			err = s.pullFrom(copyCtx, registry.SourceRegistry, copyImage)
+		} else {
+			err = copyImage()
+		}
+		endSpan(copySpan, err)
+		s.breaker.record(ctx, target.DestRegistry, err)
+		duration := time.Since(start)
+
+		record := HistoryCopy{Source: fullSourceImage, Destination: fullDestImage, StartedAt: start, FinishedAt: start.Add(duration), Bytes: atomic.LoadInt64(&tagBytes), Result: "synced"}
+		record.RunID, _ = historyRunFrom(ctx)
+		if err != nil {
+			record.Result, record.Error = "failed", err.Error()
+			s.history.recordCopy(ctx, record)
+			logf(ctx, "Failed to sync image %s to %s: %v", fullSourceImage, fullDestImage, err)
+			failed++
+			continue
+		}
+		if manifestDigest, err := manifest.Digest(copiedManifest); err == nil {
+			record.Digest = manifestDigest.String()
+		}
+		if registry.Verify {
+			if err := verifyPushed(ctx, target.SystemContext, fullDestImage, copiedManifest); err != nil {
+				record.Result, record.Error = "failed", "verification failed: "+err.Error()
+				s.history.recordCopy(ctx, record)
+				logf(ctx, "Verification of %s failed: %v", fullDestImage, err)
+				stats.verificationFailed(fullDestImage, err)
+				failed++
+				continue
+			}
+		}
+		if filtersPlatforms(registry) && kind == kindImage {
+			// Compare what was pushed with what the filters ask for
+			copied, err := copiedPlatforms(ctx, target.SystemContext, destRef, copiedManifest)
+			var missing []string
+			if err != nil {
+				logf(ctx, "Failed to read the platforms of %s: %v", fullDestImage, err)
+			} else {
+				copied = slices.DeleteFunc(copied, func(platform imgspecv1.Platform) bool {
+					return platform.OS == "unknown" && platform.Architecture == "unknown"
+				})
+				stats.platformsCopied(fullDestImage, requestedPlatforms(registry), platformStrings(copied))
+				missing = missingPlatforms(registry, copied)
+			}
+			if registry.RequirePlatforms && (err != nil || len(missing) > 0) {
+				if err == nil {
+					err = fmt.Errorf("pushed without the requested platforms %s", strings.Join(missing, ", "))
+				}
+				record.Result, record.Error = "failed", err.Error()
+				s.history.recordCopy(ctx, record)
+				logf(ctx, "Failed to sync image %s to %s: %v", fullSourceImage, fullDestImage, err)
+				failed++
+				continue
+			}
+		}
+		if len(stripped) > 0 {
+			logf(ctx, "Left %d attestation manifests out of %s", len(stripped), fullDestImage)
+			stats.attestationsStripped(fullDestImage, stripped)
+		}
+		s.history.recordCopy(ctx, record)
+		s.audit.record(ctx, AuditRecord{Time: record.FinishedAt, Source: fullSourceImage, Destination: fullDestImage, Digest: record.Digest, Credential: target.Credential})
+		if !target.Destination.Local() {
+			s.digests.record(fullDestImage, record.Digest, fullSourceImage)
+		}
+		logf(ctx, "Successfully synced image %s to %s in %v", fullSourceImage, fullDestImage, duration)
+		if s.publisher != nil {
+			platforms, err := copiedPlatforms(ctx, target.SystemContext, destRef, copiedManifest)
+			if err != nil {
+				logf(ctx, "Failed to read the platforms of %s: %v", fullDestImage, err)
+			}
+			s.publisher.publish(ctx, imageEvent{Source: fullSourceImage, Destination: fullDestImage, Digest: record.Digest, Platforms: platformStrings(platforms), Duration: duration.Seconds(), Time: record.FinishedAt, CopyID: copyIDFrom(ctx)})
+		}
+
+		if registry.Referrers {
+			manifestDigest, err := manifest.Digest(copiedManifest)
+			if err == nil {
+				var copied int
+				copied, err = s.copyReferrers(ctx, repositoryRef{host: registry.SourceRegistry, repository: registry.SourceRepository}, sourceCtx, target, manifestDigest)
+				if copied > 0 {
+					logf(ctx, "Copied %d referrers of %s to %s", copied, fullSourceImage, target.Destination)
+				}
+			}
+			if err != nil {
+				logf(ctx, "Failed to copy referrers of %s to %s: %v", fullSourceImage, target.Destination, err)
+				failed++
+				continue
+			}
+		}
+
+		if signConfig := s.signConfigFor(registry); signConfig != nil && !target.Local() {
+			manifestDigest, err := manifest.Digest(copiedManifest)
+			if err != nil {
+				logf(ctx, "Failed to compute digest of %s: %v", fullDestImage, err)
+				failed++
+				continue
+			}
+			signedImage := fmt.Sprintf("%s@%s", target.Destination, manifestDigest)
+			if err := signImage(ctx, signConfig, signedImage, target.SystemContext); err != nil {
+				logf(ctx, "Failed to sign image %s: %v", signedImage, err)
+				failed++
+				continue
+			}
+			logf(ctx, "Signed image %s", signedImage)
+		}
+	}
+
+	if failed > 0 {
+		return false, fmt.Errorf("failed for %d of %d destinations", failed, len(targets))
+	}
+	if kind == kindHelm {
+		stats.chartSynced()
+	}
+	return false, nil
+}
+
+// runResult is the result recorded in the history for a finished run.
+func runResult(ctx context.Context, failed bool) string {
+	switch {
+	case ctx.Err() != nil:
+		return "interrupted"
+	case failed:
+		return "failed"
+	default:
+		return "completed"
+	}
+}
+
+// copyTimeout returns the copy_timeout of a registry entry, 0 when unset.
+func copyTimeout(registry config.RegistryConfig) (time.Duration, error) {
+	if registry.CopyTimeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(registry.CopyTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid copy_timeout %q: %w", registry.CopyTimeout, err)
+	}
+	return timeout, nil
+}
+
+// withTimeout is context.WithTimeout, except that a timeout of 0 means none.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// pullSource is a registry the images of an entry are pulled from.
+type pullSource struct {
+	registry config.RegistryConfig // The entry with its SourceRegistry set to the source
+	sys      *types.SystemContext
+}
+
+// pullSources returns the source registry of an entry followed by its
+// source_fallbacks. The credentials and TLS settings of the source registry
+// are not used for the fallbacks.
+func (s *Syncer) pullSources(ctx context.Context, registry config.RegistryConfig) ([]pullSource, error) {
+	sys, err := s.sourceContext(ctx, registry)
+	if err != nil {
+		return nil, err
+	}
+	sources := []pullSource{{registry: registry, sys: sys}}
+	for _, fallback := range registry.SourceFallbacks {
+		mirror := registry
+		mirror.SourceRegistry = fallback
+		mirror.SourceCredentials, mirror.SourceTLSVerify, mirror.SourceCertDir = nil, nil, ""
+		if registry.SystemContext != nil {
+			options := *registry.SystemContext
+			options.RegistryToken = ""
+			mirror.SystemContext = &options
+		}
+		sys, err := s.sourceContext(ctx, mirror)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, pullSource{registry: mirror, sys: sys})
+	}
+	return sources, nil
+}
+
+// sourceContext returns the system context to pull from the source of
+// registry with, sharing the blob info cache. Without credentials of its
+// own, the entry pulls with the pull secret of the source registry.
+func (s *Syncer) sourceContext(ctx context.Context, registry config.RegistryConfig) (*types.SystemContext, error) {
+	sys := sourceSystemContext(registry)
+	sys.BlobInfoCacheDir = s.blobCache.infoDir()
+	s.headers.apply(sys)
+	if sys.DockerAuthConfig == nil && sys.AuthFilePath == "" && sys.DockerBearerRegistryToken == "" {
+		if err := s.applyPullSecret(ctx, sys, registry.SourceRegistry); err != nil {
+			return nil, err
+		}
+	}
+	if isDockerHub(registry.SourceRegistry) && s.dockerHub.username != "" && sys.DockerAuthConfig == nil {
+		// Authenticated pulls get a larger Docker Hub pull budget
+		sys.DockerAuthConfig = &types.DockerAuthConfig{Username: s.dockerHub.username, Password: s.dockerHub.password}
+	}
+	return sys, nil
+}
+
+// applyPullSecret sets the credentials of the role: pull secret for source,
+// a registry with an optional path prefix, on sys if secrets.yaml has one.
+func (s *Syncer) applyPullSecret(ctx context.Context, sys *types.SystemContext, source string) error {
+	secret := auth.SecretForRole(source, config.RolePull, s.secrets.Secrets)
+	if secret.Role != config.RolePull {
+		return nil
+	}
+	credentials, err := auth.ResolveCredentials(ctx, source, secret)
+	if err != nil {
+		return fmt.Errorf("failed to resolve pull credentials for %s: %w", source, err)
+	}
+	secretCtx, err := auth.SecretSystemContext(secret, credentials)
+	if err != nil {
+		return err
+	}
+	sys.DockerAuthConfig = secretCtx.DockerAuthConfig
+	sys.DockerBearerRegistryToken = secretCtx.DockerBearerRegistryToken
+	if sys.DockerCertPath == "" {
+		sys.DockerCertPath = secretCtx.DockerCertPath
+	}
+	return nil
+}
+
+// listSourceTags lists the tags of the source repository, from the next
+// source whenever one fails.
+func (s *Syncer) listSourceTags(ctx context.Context, sources []pullSource) (tags []string, err error) {
+	for i, source := range sources {
+		if i > 0 {
+			log.Printf("Failed to get tags from %s, trying %s: %v", sources[i-1].registry.SourceRegistry, source.registry.SourceRegistry, err)
+		}
+		if tags, err = s.listRepositoryTags(ctx, source); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return tags, err
+}
+
+func (s *Syncer) listRepositoryTags(ctx context.Context, source pullSource) ([]string, error) {
+	// Create a source image reference to fetch tags
+	log.Printf("Fetching tags from source repository: %s/%s", source.registry.SourceRegistry, source.registry.SourceRepository)
+	sourceImage := fmt.Sprintf("%s/%s", source.registry.SourceRegistry, source.registry.SourceRepository)
+	sourceRef, err := docker.ParseReference("//" + sourceImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse source image reference for %s: %w", sourceImage, err)
+	}
+
+	listCtx, listSpan := tracer.Start(ctx, "list-tags")
+	if usesQuayAPI(source.registry) {
+		tags, err := s.listQuayTags(listCtx, source.registry)
+		if err == nil || source.registry.MaxTagAge != "" || ctx.Err() != nil {
+			listSpan.SetAttributes(attribute.Int("tags.count", len(tags)))
+			endSpan(listSpan, err)
+			return tags, err
+		}
+		log.Printf("Failed to list tags with the Quay API, listing them from the registry: %v", err)
+	} else if source.registry.MaxTagAge != "" {
+		log.Printf("Not applying max_tag_age to %s, push times are only known from the Quay API", source.registry.SourceRegistry)
+	}
+	if err := s.waitForRequest(listCtx, source.registry.SourceRegistry); err != nil {
+		listSpan.End()
+		return nil, err
+	}
+	tags, err := docker.GetRepositoryTags(listCtx, s.sourceTokens.apply(listCtx, s, source.registry, source.sys), sourceRef)
+	listSpan.SetAttributes(attribute.Int("tags.count", len(tags)))
+	endSpan(listSpan, err)
+	return tags, err
+}
+
+// sourceSystemContext returns the system context to pull from the source
+// registry of an entry with.
+func sourceSystemContext(registry config.RegistryConfig) *types.SystemContext {
+	sys := &types.SystemContext{DockerCertPath: registry.SourceCertDir}
+	if registry.SourceCredentials != nil {
+		sys.DockerAuthConfig = &types.DockerAuthConfig{Username: registry.SourceCredentials.Username, Password: registry.SourceCredentials.Password}
+	}
+	if registry.SourceTLSVerify != nil && !*registry.SourceTLSVerify {
+		sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	if options := registry.SystemContext; options != nil {
+		sys.OSChoice = options.OS
+		sys.ArchitectureChoice = options.Architecture
+		sys.VariantChoice = options.Variant
+		sys.DockerBearerRegistryToken = options.RegistryToken
+		sys.AuthFilePath = options.AuthFile
+	}
+	applySystemContextOptions(sys, registry)
+	return sys
+}
+
+// applySystemContextOptions sets the system_context options of registry that
+// apply to the source and the destinations alike.
+func applySystemContextOptions(sys *types.SystemContext, registry config.RegistryConfig) {
+	if options := registry.SystemContext; options != nil {
+		sys.BigFilesTemporaryDir = options.BigFilesTemporaryDir
+		sys.DockerDaemonHost = options.DockerDaemonHost
+	}
+}
+
+// timeoutError points out when err was caused by the copy_timeout expiring
+// rather than by ctx being cancelled.
+func timeoutError(ctx, timeoutCtx context.Context, timeout time.Duration, err error) error {
+	if err != nil && ctx.Err() == nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("copy timed out after %v: %w", timeout, err)
+	}
+	return err
+}
+
+// selectTags selects the tags to mirror out of the source tags: the latest
+// ones, or the listed ones, and the pinned tags.
+func selectTags(tags []string, registry config.RegistryConfig) []string {
+	selected := selectLatestTags(tags, registry)
+	for _, tag := range registry.PinTags {
+		if !slices.Contains(tags, tag) {
+			log.Printf("Pinned tag %s doesn't exist at %s/%s", tag, registry.SourceRegistry, registry.SourceRepository)
+			continue
+		}
+		if !slices.Contains(selected, tag) {
+			selected = append(selected, tag)
+		}
+	}
+	return selected
+}
+
+// selectLatestTags applies the tag filters, sorts the remaining tags and
+// keeps the latest ones according to the pattern limits and the tag limit.
+// With an explicit tags list only those of the listed tags that exist are
+// selected.
+func selectLatestTags(tags []string, registry config.RegistryConfig) []string {
+	if len(registry.Tags) > 0 {
+		selected := []string{}
+		for _, tag := range tags {
+			if slices.Contains(registry.Tags, tag) {
+				selected = append(selected, tag)
+			}
+		}
+		return selected
+	}
+	if registry.PinsOnly() {
+		return []string{}
+	}
+
+	// Exclude tags based on patterns
+	filteredTags := FilterTags(includeTags(tags, registry.IncludePatterns), registry.ExcludePatterns)
+	log.Printf("Filtered tags: %v", filteredTags)
+
+	// Sort the tags (assuming semantic versioning)
+	log.Println("Sorting tags to determine the latest ones.")
+	sort.Slice(filteredTags, func(i, j int) bool {
+		return filteredTags[i] > filteredTags[j]
+	})
+
+	// Take the latest tags of every release line and of the other tags
+	selected := []string{}
+	counts := make([]int, len(registry.PatternLimits)+1)
+	for _, tag := range filteredTags {
+		line := len(registry.PatternLimits)
+		limit := registry.TagLimit
+		for i, patternLimit := range registry.PatternLimits {
+			if match, _ := regexp.MatchString(patternLimit.Pattern, tag); match {
+				line, limit = i, patternLimit.Limit
+				break
+			}
+		}
+		if limit > 0 && counts[line] >= limit {
+			continue
+		}
+		counts[line]++
+		selected = append(selected, tag)
+	}
+	return selected
+}
+
+// TagSelected reports whether tag is pinned or the filters of registry let it
+// through, regardless of the tag limit.
+func TagSelected(tag string, registry config.RegistryConfig) bool {
+	if slices.Contains(registry.PinTags, tag) {
+		return true
+	}
+	if len(registry.Tags) > 0 {
+		return slices.Contains(registry.Tags, tag)
+	}
+	return len(FilterTags(includeTags([]string{tag}, registry.IncludePatterns), registry.ExcludePatterns)) > 0
+}
+
+// includeTags keeps the tags matching any of the include patterns, or all of
+// them when there are none.
+func includeTags(tags []string, includePatterns []string) []string {
+	if len(includePatterns) == 0 {
+		return tags
+	}
+	included := []string{}
+	for _, tag := range tags {
+		for _, pattern := range includePatterns {
+			if match, _ := regexp.MatchString(pattern, tag); match {
+				included = append(included, tag)
+				break
+			}
+		}
+	}
+	return included
+}
+
+// FilterTags drops the tags matching any of the exclude patterns.
+func FilterTags(tags []string, excludePatterns []string) []string {
+	filteredTags := []string{}
+	for _, tag := range tags {
+		exclude := false
+		for _, pattern := range excludePatterns {
+			match, _ := regexp.MatchString(pattern, tag)
+			if match {
+				exclude = true
+				break
+			}
+		}
+		if !exclude {
+			filteredTags = append(filteredTags, tag)
+		}
+	}
+	return filteredTags
+}
@@ -0,0 +1,57 @@
+package sync
+
+import (
+	"slices"
+	"testing"
+
+	"registries-sync/pkg/config"
+)
+
+func TestSelectLatestTags(t *testing.T) {
+	tags := []string{"1.25.0", "1.26.0", "1.26.1", "1.27.0", "1.27.1", "latest", "1.27.1-alpine", "nightly"}
+	for _, test := range []struct {
+		name     string
+		registry config.RegistryConfig
+		want     []string
+	}{
+		{"tag_limit", config.RegistryConfig{TagLimit: 2}, []string{"nightly", "latest"}},
+		{"tag_limit 0 keeps every tag", config.RegistryConfig{TagLimit: 0}, []string{"nightly", "latest", "1.27.1-alpine", "1.27.1", "1.27.0", "1.26.1", "1.26.0", "1.25.0"}},
+		{"exclude_patterns", config.RegistryConfig{TagLimit: 3, ExcludePatterns: []string{"-alpine$", "^[a-z]"}}, []string{"1.27.1", "1.27.0", "1.26.1"}},
+		{"include_patterns", config.RegistryConfig{TagLimit: 2, IncludePatterns: []string{`^1\.26\.`}}, []string{"1.26.1", "1.26.0"}},
+		{"include and exclude_patterns", config.RegistryConfig{IncludePatterns: []string{`^1\.27\.`}, ExcludePatterns: []string{"-alpine$"}}, []string{"1.27.1", "1.27.0"}},
+		{"tags list", config.RegistryConfig{TagLimit: 1, Tags: []string{"1.25.0", "latest", "missing"}}, []string{"1.25.0", "latest"}},
+		{"pattern_limits", config.RegistryConfig{
+			TagLimit:        1,
+			ExcludePatterns: []string{"-alpine$"},
+			PatternLimits:   []config.PatternLimit{{Pattern: `^1\.27\.`, Limit: 1}, {Pattern: `^1\.26\.`, Limit: 2}},
+		}, []string{"nightly", "1.27.1", "1.26.1", "1.26.0"}},
+		{"pattern_limits without a limit", config.RegistryConfig{
+			TagLimit:        1,
+			ExcludePatterns: []string{"-alpine$", "^[a-z]"},
+			PatternLimits:   []config.PatternLimit{{Pattern: `^1\.27\.`, Limit: 0}},
+		}, []string{"1.27.1", "1.27.0", "1.26.1"}},
+		{"pinned digests only", config.RegistryConfig{Digests: []config.DigestConfig{{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000", Tag: "pinned"}}}, []string{}},
+	} {
+		if got := selectLatestTags(tags, test.registry); !slices.Equal(got, test.want) {
+			t.Errorf("%s: selectLatestTags() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSelectTags(t *testing.T) {
+	tags := []string{"1.0", "2.0", "3.0", "stable"}
+	for _, test := range []struct {
+		name     string
+		registry config.RegistryConfig
+		want     []string
+	}{
+		{"pin_tags beyond tag_limit", config.RegistryConfig{TagLimit: 1, ExcludePatterns: []string{"^stable$"}, PinTags: []string{"1.0"}}, []string{"3.0", "1.0"}},
+		{"pin_tags excluded by the filters", config.RegistryConfig{TagLimit: 1, ExcludePatterns: []string{"^stable$"}, PinTags: []string{"stable"}}, []string{"3.0", "stable"}},
+		{"pin_tags already selected", config.RegistryConfig{TagLimit: 2, PinTags: []string{"stable"}}, []string{"stable", "3.0"}},
+		{"missing pin_tags", config.RegistryConfig{TagLimit: 1, PinTags: []string{"4.0"}}, []string{"stable"}},
+	} {
+		if got := selectTags(tags, test.registry); !slices.Equal(got, test.want) {
+			t.Errorf("%s: selectTags() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"registries-sync/pkg/config"
+)
+
+// TagFilter narrows down the tags listed from the source of a registry entry
+// with tag_filter set, e.g. to the releases an internal API knows of. The
+// include and exclude patterns and the tag limits apply to the tags it keeps.
+type TagFilter interface {
+	FilterTags(ctx context.Context, registry config.RegistryConfig, tags []string) ([]string, error)
+}
+
+// TagFilterFunc adapts a function to a TagFilter.
+type TagFilterFunc func(ctx context.Context, registry config.RegistryConfig, tags []string) ([]string, error)
+
+// FilterTags calls f.
+func (f TagFilterFunc) FilterTags(ctx context.Context, registry config.RegistryConfig, tags []string) ([]string, error) {
+	return f(ctx, registry, tags)
+}
+
+// tagFilterInput is the JSON a tag_filter command gets on stdin.
+type tagFilterInput struct {
+	Source       string   `json:"source"`       // Source repository
+	Destinations []string `json:"destinations"` // Destination repositories
+	Tags         []string `json:"tags"`
+}
+
+// commandTagFilter runs a tag_filter command.
+type commandTagFilter struct {
+	command []string
+	timeout time.Duration
+}
+
+// newTagFilterInput returns the input of a tag_filter command or module.
+func newTagFilterInput(registry config.RegistryConfig, tags []string) tagFilterInput {
+	input := tagFilterInput{Source: registry.SourceRegistry + "/" + registry.SourceRepository, Destinations: []string{}, Tags: tags}
+	for _, dest := range registry.AllDestinations() {
+		input.Destinations = append(input.Destinations, dest.String())
+	}
+	return input
+}
+
+func (f commandTagFilter) FilterTags(ctx context.Context, registry config.RegistryConfig, tags []string) ([]string, error) {
+	data, err := json.Marshal(newTagFilterInput(registry, tags))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.command[0], f.command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", f.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	var kept []string
+	if err := json.Unmarshal(stdout.Bytes(), &kept); err != nil {
+		return nil, fmt.Errorf("%s printed no JSON array of tags: %w", f.command[0], err)
+	}
+	return kept, nil
+}
+
+// wasmTagFilter runs a tag_filter WebAssembly module, which gets the same
+// input and prints the same output as a command.
+type wasmTagFilter struct {
+	module  *wasmModule
+	timeout time.Duration
+}
+
+func (f wasmTagFilter) FilterTags(ctx context.Context, registry config.RegistryConfig, tags []string) ([]string, error) {
+	var kept []string
+	if err := f.module.call(ctx, f.timeout, newTagFilterInput(registry, tags), &kept); err != nil {
+		return nil, err
+	}
+	return kept, nil
+}
+
+// tagFilterFor returns the tag_filter of registry, or nil when it has none.
+// Named filters are looked up in named.
+func tagFilterFor(registry config.RegistryConfig, named map[string]TagFilter) (TagFilter, error) {
+	cfg := registry.TagFilter
+	switch {
+	case cfg == nil:
+		return nil, nil
+	case cfg.Name != "":
+		filter, ok := named[cfg.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tag_filter %q, it must be registered with Options.TagFilters", cfg.Name)
+		}
+		return filter, nil
+	}
+	timeout := defaultHookTimeout
+	if cfg.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid tag_filter timeout: %w", err)
+		}
+	}
+	if cfg.Wasm != "" {
+		module, err := loadWasmModule(context.Background(), cfg.Wasm)
+		if err != nil {
+			return nil, fmt.Errorf("tag_filter: %w", err)
+		}
+		return wasmTagFilter{module: module, timeout: timeout}, nil
+	}
+	return commandTagFilter{command: cfg.Command, timeout: timeout}, nil
+}
+
+// applyTagFilter narrows tags down with the tag_filter of registry. Pinned
+// tags are kept whatever the filter returns, and tags that weren't listed
+// are ignored.
+func applyTagFilter(ctx context.Context, registry config.RegistryConfig, named map[string]TagFilter, tags []string) ([]string, error) {
+	filter, err := tagFilterFor(registry, named)
+	if err != nil || filter == nil {
+		return tags, err
+	}
+	kept, err := filter.FilterTags(ctx, registry, slices.Clone(tags))
+	if err != nil {
+		return nil, fmt.Errorf("tag_filter failed: %w", err)
+	}
+	keep := map[string]bool{}
+	for _, tag := range kept {
+		keep[tag] = true
+	}
+	filtered := []string{}
+	for _, tag := range tags {
+		if keep[tag] || slices.Contains(registry.PinTags, tag) {
+			filtered = append(filtered, tag)
+		}
+		delete(keep, tag)
+	}
+	if len(keep) > 0 {
+		log.Printf("Ignoring %d tags returned by the tag_filter of %s/%s that the source doesn't list", len(keep), registry.SourceRegistry, registry.SourceRepository)
+	}
+	log.Printf("tag_filter kept %d of %d tags of %s/%s", len(filtered), len(tags), registry.SourceRegistry, registry.SourceRepository)
+	return filtered, nil
+}
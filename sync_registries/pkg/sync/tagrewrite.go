@@ -0,0 +1,33 @@
+package sync
+
+import (
+	"fmt"
+	"regexp"
+
+	"registries-sync/pkg/config"
+)
+
+// validTag is the tag grammar of the distribution spec.
+var validTag = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// rewriteTag returns the destination tag for a source tag.
+func rewriteTag(rewrite *config.TagRewriteConfig, tag string) (string, error) {
+	if rewrite == nil {
+		return tag, nil
+	}
+
+	rewritten := tag
+	for _, rule := range rewrite.Rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return "", fmt.Errorf("invalid tag rewrite pattern %q: %w", rule.Match, err)
+		}
+		rewritten = re.ReplaceAllString(rewritten, rule.Replace)
+	}
+	rewritten = rewrite.Prefix + rewritten + rewrite.Suffix
+
+	if !validTag.MatchString(rewritten) {
+		return "", fmt.Errorf("tag %s rewritten to invalid tag %q", tag, rewritten)
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,37 @@
+package sync
+
+import (
+	"testing"
+
+	"registries-sync/pkg/config"
+)
+
+func TestRewriteTag(t *testing.T) {
+	for _, test := range []struct {
+		rewrite *config.TagRewriteConfig
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{nil, "1.27.1", "1.27.1", false},
+		{&config.TagRewriteConfig{Prefix: "upstream-"}, "1.27.1", "upstream-1.27.1", false},
+		{&config.TagRewriteConfig{Suffix: "-mirror"}, "1.27.1", "1.27.1-mirror", false},
+		{&config.TagRewriteConfig{Rules: []config.TagRewriteRule{{Match: "^v", Replace: ""}}}, "v1.27.1", "1.27.1", false},
+		{&config.TagRewriteConfig{Rules: []config.TagRewriteRule{{Match: `^(\d+)\.(\d+)\.\d+$`, Replace: "$1.$2"}}}, "1.27.1", "1.27", false},
+		{&config.TagRewriteConfig{Rules: []config.TagRewriteRule{{Match: "^v", Replace: ""}, {Match: `\+`, Replace: "_"}}, Prefix: "x"}, "v1.0+build", "x1.0_build", false},
+		{&config.TagRewriteConfig{Rules: []config.TagRewriteRule{{Match: "alpine", Replace: "slim"}}}, "1.27.1", "1.27.1", false},
+		{&config.TagRewriteConfig{Rules: []config.TagRewriteRule{{Match: "(", Replace: ""}}}, "1.27.1", "", true},
+		{&config.TagRewriteConfig{Prefix: "."}, "1.27.1", "", true},
+		{&config.TagRewriteConfig{Rules: []config.TagRewriteRule{{Match: ".*", Replace: ""}}}, "1.27.1", "", true},
+		{&config.TagRewriteConfig{Rules: []config.TagRewriteRule{{Match: "/", Replace: ":"}}}, "a/b", "", true},
+	} {
+		got, err := rewriteTag(test.rewrite, test.tag)
+		if (err != nil) != test.wantErr {
+			t.Errorf("rewriteTag(%+v, %q) error = %v, want error %t", test.rewrite, test.tag, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("rewriteTag(%+v, %q) = %q, want %q", test.rewrite, test.tag, got, test.want)
+		}
+	}
+}
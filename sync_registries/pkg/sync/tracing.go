@@ -0,0 +1,142 @@
+package sync
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("registries-sync")
+
+// tracingEnabled is set by InitTracing when an OTLP endpoint is configured.
+var tracingEnabled bool
+
+// InitTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The exporter is configured
+// entirely through the standard OTEL_* environment variables. The returned
+// function flushes pending spans and must be called before exiting.
+func InitTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("registries-sync")))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	tracingEnabled = true
+	return provider.Shutdown, nil
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedReference wraps an image reference so that manifest fetches and blob
+// and manifest uploads made by copy.Image show up as individual spans.
+type tracedReference struct {
+	types.ImageReference
+}
+
+// newTracedReference wraps ref when tracing is enabled and returns it
+// unchanged otherwise.
+func newTracedReference(ref types.ImageReference) types.ImageReference {
+	if !tracingEnabled {
+		return ref
+	}
+	return &tracedReference{ImageReference: ref}
+}
+
+func (r *tracedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedSource{ImageSource: src}, nil
+}
+
+func (r *tracedReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedDestination{ImageDestination: dest}, nil
+}
+
+type tracedSource struct {
+	types.ImageSource
+}
+
+func (s *tracedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	ctx, span := tracer.Start(ctx, "fetch-manifest")
+	if instanceDigest != nil {
+		span.SetAttributes(attribute.String("image.instance_digest", instanceDigest.String()))
+	}
+	manifest, mimeType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	span.SetAttributes(attribute.String("image.manifest_type", mimeType))
+	endSpan(span, err)
+	return manifest, mimeType, err
+}
+
+func (s *tracedSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	ctx, span := tracer.Start(ctx, "fetch-blob", trace.WithAttributes(attribute.String("blob.digest", info.Digest.String())))
+	reader, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	span.SetAttributes(attribute.Int64("blob.size", size))
+	endSpan(span, err)
+	return reader, size, err
+}
+
+type tracedDestination struct {
+	types.ImageDestination
+}
+
+func (d *tracedDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	ctx, span := tracer.Start(ctx, "reuse-blob", trace.WithAttributes(attribute.String("blob.digest", info.Digest.String())))
+	reused, blobInfo, err := d.ImageDestination.TryReusingBlob(ctx, info, cache, canSubstitute)
+	span.SetAttributes(attribute.Bool("blob.reused", reused))
+	endSpan(span, err)
+	return reused, blobInfo, err
+}
+
+// PutBlob covers the whole blob transfer, since the source stream is read
+// while it is being uploaded.
+func (d *tracedDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	ctx, span := tracer.Start(ctx, "upload-blob", trace.WithAttributes(
+		attribute.String("blob.digest", inputInfo.Digest.String()),
+		attribute.Bool("blob.is_config", isConfig),
+	))
+	blobInfo, err := d.ImageDestination.PutBlob(ctx, stream, inputInfo, cache, isConfig)
+	span.SetAttributes(attribute.Int64("blob.size", blobInfo.Size))
+	endSpan(span, err)
+	return blobInfo, err
+}
+
+func (d *tracedDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	ctx, span := tracer.Start(ctx, "upload-manifest")
+	err := d.ImageDestination.PutManifest(ctx, manifest, instanceDigest)
+	endSpan(span, err)
+	return err
+}
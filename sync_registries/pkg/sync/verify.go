@@ -0,0 +1,86 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// verifyPushed fetches the manifest of image back from the destination and
+// compares it with the manifest copy.Image pushed. Registries check that
+// the blobs referenced by a manifest exist when it is pushed, so matching
+// layer digests mean the image is complete.
+func verifyPushed(ctx context.Context, sys *types.SystemContext, image string, pushed []byte) error {
+	ref, err := docker.ParseReference("//" + image)
+	if err != nil {
+		return err
+	}
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	actual, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	expectedDigest, err := manifest.Digest(pushed)
+	if err != nil {
+		return err
+	}
+	actualDigest, err := manifest.Digest(actual)
+	if err != nil {
+		return err
+	}
+	if actualDigest == expectedDigest {
+		return nil
+	}
+
+	problems := []string{fmt.Sprintf("manifest digest is %s, pushed %s", actualDigest, expectedDigest)}
+	expectedLayers, err := manifestDigests(pushed)
+	if err != nil {
+		return err
+	}
+	actualLayers, err := manifestDigests(actual)
+	if err != nil {
+		return fmt.Errorf("%s, failed to parse destination manifest: %w", problems[0], err)
+	}
+	if len(actualLayers) != len(expectedLayers) {
+		problems = append(problems, fmt.Sprintf("%d layers, pushed %d", len(actualLayers), len(expectedLayers)))
+	} else {
+		for i := range expectedLayers {
+			if actualLayers[i] != expectedLayers[i] {
+				problems = append(problems, fmt.Sprintf("layer %d is %s, pushed %s", i, actualLayers[i], expectedLayers[i]))
+			}
+		}
+	}
+	return fmt.Errorf("%s", strings.Join(problems, ", "))
+}
+
+// manifestDigests returns the layer digests of an image manifest, or the
+// instance digests of a manifest list.
+func manifestDigests(blob []byte) ([]digest.Digest, error) {
+	mimeType := manifest.GuessMIMEType(blob)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(blob, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		return list.Instances(), nil
+	}
+	parsed, err := manifest.FromBlob(blob, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	digests := []digest.Digest{}
+	for _, layer := range parsed.LayerInfos() {
+		digests = append(digests, layer.Digest)
+	}
+	return digests, nil
+}
@@ -0,0 +1,151 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+
+	"registries-sync/pkg/config"
+)
+
+// cosignArtifactTag matches the tags cosign stores signatures, attestations
+// and SBOMs under, which aren't images to verify.
+var cosignArtifactTag = regexp.MustCompile(`^sha256-[a-f0-9]{64}\.(sig|att|sbom)$`)
+
+// verifySignaturesConfigFor returns the verify_signatures configuration of a
+// registry entry, falling back to the global one. It returns nil when the
+// pass is disabled.
+func (s *Syncer) verifySignaturesConfigFor(registry config.RegistryConfig) *config.VerifySignaturesConfig {
+	if registry.VerifySignatures != nil {
+		return registry.VerifySignatures
+	}
+	return s.config.VerifySignatures
+}
+
+// defaultMaxDeletes bounds the images a verify_signatures pass deletes when
+// max_deletes isn't set.
+const defaultMaxDeletes = 10
+
+// errUnsigned is returned by verifySignature when cosign found no signature
+// of the image matching the policy, as opposed to cosign failing.
+var errUnsigned = errors.New("no matching signatures")
+
+// verifyDestinationSignatures runs cosign verify against every tag at the
+// registry targets, including tags this tool didn't push, and reports the
+// images failing it. With delete set they are removed from the destination,
+// up to max_deletes of them. Any other cosign failure, e.g. a missing binary
+// or an unreachable key, stops the pass before deleting anything more.
+func (s *Syncer) verifyDestinationSignatures(ctx context.Context, cfg *config.VerifySignaturesConfig, targets []destinationTarget, stats *RegistryReport) error {
+	maxDeletes := cfg.MaxDeletes
+	if maxDeletes == 0 {
+		maxDeletes = defaultMaxDeletes
+	}
+	deleted := 0
+	for _, target := range targets {
+		if target.Local() {
+			continue
+		}
+		tags, err := listTags(ctx, target.SystemContext, target.Destination.String())
+		if err != nil {
+			logf(ctx, "Failed to list the tags of %s for signature verification: %v", target.Destination, err)
+			continue
+		}
+		verified := 0
+		for _, tag := range tags {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if cosignArtifactTag.MatchString(tag) {
+				continue
+			}
+			image := fmt.Sprintf("%s:%s", target.Destination, tag)
+			digest, err := imageDigest(ctx, target.SystemContext, image)
+			if err != nil {
+				logf(ctx, "Failed to verify the signature of %s: %v", image, err)
+				continue
+			}
+			byDigest := fmt.Sprintf("%s@%s", target.Destination, digest)
+			err = verifySignature(ctx, cfg, byDigest, target)
+			if err == nil {
+				verified++
+				continue
+			}
+			if !errors.Is(err, errUnsigned) {
+				return fmt.Errorf("failed to verify the signature of %s: %w", image, err)
+			}
+			logf(ctx, "Signature verification of %s failed: %v", image, err)
+			switch {
+			case !cfg.Delete:
+			case cfg.DryRun:
+				logf(ctx, "Would delete unverified image %s (%s), dry_run is set", image, digest)
+			case deleted >= maxDeletes:
+				logf(ctx, "Not deleting unverified image %s, max_deletes %d reached", image, maxDeletes)
+			default:
+				// By digest, so a tag moved since verifying keeps its manifest
+				if err := deleteImage(ctx, target, byDigest); err != nil {
+					logf(ctx, "Failed to delete unverified image %s: %v", byDigest, err)
+				} else {
+					logf(ctx, "Deleted unverified image %s (%s)", image, digest)
+					deleted++
+					image += " (deleted)"
+				}
+			}
+			stats.signatureUnverified(image, err)
+		}
+		logf(ctx, "Verified the signatures of %d images at %s", verified, target.Destination)
+	}
+	return nil
+}
+
+// verifySignature runs cosign verify against image, a digest reference. The
+// error wraps errUnsigned when cosign ran and found no matching signature.
+func verifySignature(ctx context.Context, cfg *config.VerifySignaturesConfig, image string, target destinationTarget) error {
+	args := []string{"verify", "--output", "text"}
+	if cfg.Key != "" {
+		args = append(args, "--key", cfg.Key)
+	}
+	for _, option := range [][2]string{
+		{"--certificate-identity", cfg.CertificateIdentity},
+		{"--certificate-identity-regexp", cfg.CertificateIdentityRegexp},
+		{"--certificate-oidc-issuer", cfg.CertificateOIDCIssuer},
+		{"--certificate-oidc-issuer-regexp", cfg.CertificateOIDCIssuerRegexp},
+	} {
+		if option[1] != "" {
+			args = append(args, option[0], option[1])
+		}
+	}
+	args = append(args, image)
+
+	output, err := runCosign(ctx, cfg.CosignPath, args, image, target.SystemContext)
+	if err == nil {
+		return nil
+	}
+	message := strings.TrimSpace(string(output))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil && unsignedOutput(message) {
+		return fmt.Errorf("%w: %s", errUnsigned, message)
+	}
+	return fmt.Errorf("cosign verify failed: %w: %s", err, message)
+}
+
+// unsignedOutput reports whether the output of a failed cosign verify says
+// the image has no signature matching the policy.
+func unsignedOutput(output string) bool {
+	output = strings.ToLower(output)
+	return strings.Contains(output, "no matching signatures") || strings.Contains(output, "no signatures found")
+}
+
+// deleteImage deletes the manifest image refers to from the target, which
+// removes every tag of that manifest.
+func deleteImage(ctx context.Context, target destinationTarget, image string) error {
+	ref, err := docker.ParseReference("//" + image)
+	if err != nil {
+		return fmt.Errorf("failed to parse image reference for %s: %w", image, err)
+	}
+	return ref.DeleteImage(ctx, target.SystemContext)
+}
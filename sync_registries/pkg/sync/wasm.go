@@ -0,0 +1,112 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmMemoryLimitPages caps the memory of a WebAssembly plugin, 64 KiB pages.
+const wasmMemoryLimitPages = 4096 // 256 MiB
+
+// wasmRuntime runs the WebAssembly plugins of the process, created on first
+// use. Modules are compiled once per file and modification time.
+var wasmRuntime struct {
+	mu      sync.Mutex
+	runtime wazero.Runtime
+	modules map[string]*wasmModule
+}
+
+// wasmModule is a compiled WebAssembly plugin, a WASI command that reads its
+// input as JSON on stdin and prints its result as JSON on stdout, like
+// tag_filter commands. Every call runs in a fresh instance in-process,
+// without access to files, the network or the environment.
+type wasmModule struct {
+	path     string
+	modified time.Time
+	compiled wazero.CompiledModule
+}
+
+// loadWasmModule returns the compiled module at path, compiling it when it
+// is new or changed since.
+func loadWasmModule(ctx context.Context, path string) (*wasmModule, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load WebAssembly module: %w", err)
+	}
+
+	wasmRuntime.mu.Lock()
+	defer wasmRuntime.mu.Unlock()
+	if module, ok := wasmRuntime.modules[path]; ok && module.modified.Equal(info.ModTime()) {
+		return module, nil
+	}
+	if wasmRuntime.runtime == nil {
+		runtime := wazero.NewRuntimeWithConfig(context.Background(), wazero.NewRuntimeConfig().
+			WithCloseOnContextDone(true).
+			WithMemoryLimitPages(wasmMemoryLimitPages))
+		if _, err := wasi_snapshot_preview1.Instantiate(context.Background(), runtime); err != nil {
+			return nil, fmt.Errorf("failed to start WebAssembly runtime: %w", err)
+		}
+		wasmRuntime.runtime, wasmRuntime.modules = runtime, map[string]*wasmModule{}
+	}
+
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load WebAssembly module: %w", err)
+	}
+	compiled, err := wasmRuntime.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile WebAssembly module %s: %w", path, err)
+	}
+	if previous, ok := wasmRuntime.modules[path]; ok {
+		previous.compiled.Close(context.Background())
+	}
+	module := &wasmModule{path: path, modified: info.ModTime(), compiled: compiled}
+	wasmRuntime.modules[path] = module
+	return module, nil
+}
+
+// call runs the module with input as its stdin and decodes its stdout into
+// output. It is stopped after timeout.
+func (m *wasmModule) call(ctx context.Context, timeout time.Duration, input, output interface{}) error {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	// Anonymous, so calls can run concurrently in the shared runtime
+	moduleConfig := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(m.path).
+		WithStdin(bytes.NewReader(data)).
+		WithStdout(&stdout).
+		WithStderr(&stderr)
+	instance, err := wasmRuntime.runtime.InstantiateModule(ctx, m.compiled, moduleConfig)
+	if instance != nil {
+		instance.Close(context.Background())
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%s: %w: %s", m.path, err, message)
+		}
+		return fmt.Errorf("%s: %w", m.path, err)
+	}
+	if err := json.Unmarshal(stdout.Bytes(), output); err != nil {
+		return fmt.Errorf("%s printed no valid JSON: %w", m.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+)
+
+// dockerConfigAuth is a registry entry of a Docker config.json.
+type dockerConfigAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// runGenPullSecret implements the "gen-pull-secret" subcommand. It writes a
+// Docker config.json, or a kubernetes.io/dockerconfigjson Secret holding it,
+// with the credentials of every destination registry in secrets.yaml.
+func runGenPullSecret(args []string) {
+	flags := flag.NewFlagSet("gen-pull-secret", flag.ExitOnError)
+	secretsFile := flags.String("secrets", "secrets.yaml", "Path to the secrets file")
+	format := flags.String("format", "secret", "Output format: secret for a Kubernetes Secret manifest, or dockerconfigjson for a plain config.json")
+	name := flags.String("name", "registry-mirror-pull-secret", "Name of the Secret")
+	namespace := flags.String("namespace", "", "Namespace of the Secret, empty leaves it to kubectl")
+	output := flags.String("output", "-", "File to write to, \"-\" for stdout")
+	flags.Parse(args)
+
+	if *format != "secret" && *format != "dockerconfigjson" {
+		log.Fatalf("Unknown format %q, expected secret or dockerconfigjson", *format)
+	}
+	secrets, err := loadSecrets(*secretsFile)
+	if err != nil {
+		log.Fatalf("Failed to load secrets: %v", err)
+	}
+
+	ctx := context.Background()
+	auths := map[string]dockerConfigAuth{}
+	for _, secret := range secrets.Secrets {
+		if auth.SecretForRole(secret.DestRegistry, config.RolePull, secrets.Secrets).Role != secret.Role {
+			// Pods only pull, with the least privileged secret of the registry
+			continue
+		}
+		credentials, err := auth.ResolveCredentials(ctx, secret.DestRegistry, secret)
+		if err != nil {
+			log.Fatalf("Failed to resolve credentials for %s: %v", secret.DestRegistry, err)
+		}
+		if credentials.Username == "" && credentials.IdentityToken == "" {
+			log.Printf("Leaving out %s, it is accessed anonymously", secret.DestRegistry)
+			continue
+		}
+		entry := dockerConfigAuth{IdentityToken: credentials.IdentityToken}
+		if credentials.Username != "" {
+			entry.Auth = base64.StdEncoding.EncodeToString([]byte(credentials.Username + ":" + credentials.Password))
+		}
+		auths[dockerConfigKey(secret.DestRegistry)] = entry
+	}
+
+	dockerConfig, err := json.Marshal(map[string]any{"auths": auths})
+	if err != nil {
+		log.Fatalf("Failed to encode the Docker config: %v", err)
+	}
+	data := append(dockerConfig, '\n')
+	if *format == "secret" {
+		metadata := map[string]string{"name": *name}
+		if *namespace != "" {
+			metadata["namespace"] = *namespace
+		}
+		data, err = yaml.Marshal(map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   metadata,
+			"type":       "kubernetes.io/dockerconfigjson",
+			"data":       map[string]string{".dockerconfigjson": base64.StdEncoding.EncodeToString(dockerConfig)},
+		})
+		if err != nil {
+			log.Fatalf("Failed to encode the Secret: %v", err)
+		}
+	}
+
+	if *output == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*output, data, 0o600); err != nil {
+		log.Fatalf("Failed to write %s: %v", *output, err)
+	}
+	log.Printf("Wrote credentials for %d registries to %s", len(auths), *output)
+}
+
+// dockerConfigKey is the key of registry in config.json. Docker Hub is keyed
+// by its legacy index URL, which every client understands.
+func dockerConfigKey(registry string) string {
+	if config.RegistryHost(registry) == "docker.io" {
+		return "https://index.docker.io/v1/"
+	}
+	return registry
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	regsync "registries-sync/pkg/sync"
+)
+
+// runPush implements the "push" subcommand, the second phase of a staged
+// sync. It pushes the images a run with -stage-dir pulled to the registry
+// destinations of the configuration.
+func runPush(args []string) {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	configFile := flags.String("config", "registries.yaml", "Path to the registries configuration file")
+	configDir := flags.String("config-dir", "", "Directory whose *.yaml files are merged into the configuration, instead of -config")
+	secretsFile := flags.String("secrets", "secrets.yaml", "Path to the secrets file")
+	stageDir := flags.String("stage-dir", "", "Directory the images were pulled into with -stage-dir")
+	reportFile := flags.String("report", "", "Write a summary of the push to this file, \"-\" for stdout")
+	reportFormat := flags.String("report-format", "json", "Format of the summary: json, yaml or html")
+	historyFile := flags.String("history-db", "", "SQLite database recording every run and image copy, empty disables the history")
+	auditLog := flags.String("audit-log", "", "Hash-chained file recording every pushed image and the credential it was pushed with, empty disables the audit log")
+	digestExport := flags.String("digest-export", "", "File mapping every tag pushed to a registry destination to its digest, for dependency update bots, empty disables the export")
+	digestExportFormat := flags.String("digest-export-format", "json", "Format of -digest-export: json or properties")
+	logging := addLogFlags(flags)
+	flags.Parse(args)
+
+	closeLog, err := logging.apply()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeLog()
+	if *stageDir == "" {
+		log.Fatal("-stage-dir is required")
+	}
+
+	cfg, err := loadConfig(*configFile, *configDir)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	secrets, err := loadSecrets(*secretsFile)
+	if err != nil {
+		log.Fatalf("Failed to load secrets: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	syncer, err := regsync.New(regsync.Options{
+		Config:             cfg,
+		Secrets:            secrets,
+		Report:             *reportFile != "",
+		HistoryFile:        *historyFile,
+		AuditLog:           *auditLog,
+		DigestExport:       *digestExport,
+		DigestExportFormat: *digestExportFormat,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize push: %v", err)
+	}
+	defer syncer.Close()
+
+	log.Printf("Pushing staged images from %s", *stageDir)
+	err = syncer.PushStaged(ctx, *stageDir)
+	if report := syncer.Report(); report != nil && *reportFile != "" {
+		if err := report.Write(*reportFile, *reportFormat); err != nil {
+			log.Printf("Failed to write report: %v", err)
+		}
+	}
+	if err != nil {
+		log.Printf("Push failed: %v", err)
+		syncer.Close()
+		os.Exit(1)
+	}
+	log.Println("Push completed.")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	regsync "registries-sync/pkg/sync"
+)
+
+// runQuarantine implements the "quarantine" subcommand. It lists the tags
+// that failed in consecutive runs, or with -clear or -clear-all removes them
+// so the next run retries them.
+func runQuarantine(args []string) {
+	flags := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	configFile := flags.String("config", "registries.yaml", "Path to the registries configuration file, whose quarantine section names the file")
+	configDir := flags.String("config-dir", "", "Directory whose *.yaml files are merged into the configuration, instead of -config")
+	clearImages := flags.String("clear", "", "Comma-separated source images or repositories to retry, e.g. docker.io/library/nginx:1.27")
+	clearAll := flags.Bool("clear-all", false, "Retry every failing tag")
+	flags.Parse(args)
+
+	cfg, err := loadConfig(*configFile, *configDir)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if cfg.Quarantine == nil {
+		log.Fatal("The configuration has no quarantine section, failing tags are not tracked")
+	}
+	path := cfg.Quarantine.Path()
+
+	if *clearImages != "" || *clearAll {
+		if *clearImages != "" && *clearAll {
+			log.Fatal("-clear and -clear-all are mutually exclusive")
+		}
+		images := []string{}
+		if *clearImages != "" {
+			images = strings.Split(*clearImages, ",")
+		}
+		cleared, err := regsync.ClearFailedTags(path, images)
+		if err != nil {
+			log.Fatalf("Failed to clear %s: %v", path, err)
+		}
+		log.Printf("Cleared %d tags, the next run retries them", cleared)
+		return
+	}
+
+	failures, err := regsync.LoadFailedTags(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", path, err)
+	}
+	for _, failure := range failures {
+		status := "FAILING"
+		if failure.Runs >= cfg.Quarantine.After {
+			status = "PERSISTENT"
+			if cfg.Quarantine.Skip {
+				status = "QUARANTINED"
+			}
+		}
+		fmt.Printf("%-11s %s: %d runs, last at %s: %s\n", status, failure.Source, failure.Runs, failure.LastFailed.Local().Format(time.RFC3339), failure.LastError)
+	}
+}
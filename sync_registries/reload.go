@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"time"
+
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
+
+// watchConfig checks the configuration and secrets every interval and
+// reloads them when their content changed. A configuration that fails to load
+// or validate is logged and the current one kept. Syncers for reloaded
+// configurations are created with opts.
+func (d *daemon) watchConfig(ctx context.Context, source *configSource, loaded string, interval time.Duration, opts regsync.Options) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := source.fingerprint(ctx)
+		if err != nil {
+			log.Printf("Failed to check the configuration for changes: %v", err)
+			continue
+		}
+		if current == loaded {
+			continue
+		}
+		// A broken file is reported once rather than on every tick
+		loaded = current
+		if err := d.reload(ctx, source, opts); err != nil {
+			log.Printf("Failed to reload the configuration, keeping the current one: %v", err)
+		}
+	}
+}
+
+// reload loads and validates the configuration and hands it to the worker,
+// which switches to it before its next job.
+func (d *daemon) reload(ctx context.Context, source *configSource, opts regsync.Options) error {
+	cfg, secrets, err := source.load(ctx)
+	if err != nil {
+		return err
+	}
+	opts.Config, opts.Secrets = cfg, secrets
+	syncer, err := regsync.New(opts)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	previous := d.config
+	d.config = cfg
+	if d.nextSyncer != nil {
+		d.nextSyncer.Close()
+	}
+	d.nextSyncer = syncer
+	d.mu.Unlock()
+
+	added, removed, changed := compareRegistries(previous.Registries, cfg.Registries)
+	log.Printf("Reloaded the configuration: %d registry entries, %d added, %d removed, %d changed", len(cfg.Registries), added, removed, changed)
+	if !reflect.DeepEqual(previous.Events, cfg.Events) {
+		log.Printf("The events section changed, restarting the event consumers")
+		d.restartEventConsumers()
+	}
+	return nil
+}
+
+// currentConfig returns the configuration jobs are created from.
+func (d *daemon) currentConfig() *config.Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.config
+}
+
+// currentSyncer returns the syncer for the next job, switching to a reloaded
+// one first. Only the worker calls it, between jobs, so the syncer being
+// replaced is no longer in use.
+func (d *daemon) currentSyncer() *regsync.Syncer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.nextSyncer != nil {
+		d.syncer.Close()
+		d.syncer = d.nextSyncer
+		d.nextSyncer = nil
+	}
+	return d.syncer
+}
+
+// compareRegistries counts the registry entries added, removed and changed,
+// identifying entries by their source and destinations.
+func compareRegistries(previous, current []config.RegistryConfig) (added, removed, changed int) {
+	before := map[string]config.RegistryConfig{}
+	for _, registry := range previous {
+		before[registryKey(registry)] = registry
+	}
+	seen := map[string]bool{}
+	for _, registry := range current {
+		key := registryKey(registry)
+		seen[key] = true
+		old, ok := before[key]
+		switch {
+		case !ok:
+			added++
+		case !reflect.DeepEqual(old, registry):
+			changed++
+		}
+	}
+	for key := range before {
+		if !seen[key] {
+			removed++
+		}
+	}
+	return added, removed, changed
+}
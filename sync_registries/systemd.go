@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state, such as READY=1, to the systemd service manager. It
+// does nothing when the process wasn't started by systemd with Type=notify,
+// which sets NOTIFY_SOCKET. Socket names starting with @ are abstract.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// notifySystemd sends state to systemd, logging failures.
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Print(err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects WATCHDOG=1, half of the
+// unit's WatchdogSec, or 0 when the watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog pings the systemd watchdog every interval until ctx is done. It
+// stops pinging while a job has been running for longer than jobTimeout, so
+// systemd restarts a daemon whose worker is stuck. A jobTimeout of 0 only
+// checks that the process is responsive.
+func (d *daemon) watchdog(ctx context.Context, interval, jobTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	wedged := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		started := d.jobStarted.Load()
+		if jobTimeout > 0 && started != 0 && time.Since(time.Unix(0, started)) > jobTimeout {
+			if !wedged {
+				log.Printf("Job running for more than %s, no longer pinging the systemd watchdog", jobTimeout)
+				notifySystemd(fmt.Sprintf("STATUS=Job stuck for more than %s", jobTimeout))
+				wedged = true
+			}
+			continue
+		}
+		wedged = false
+		notifySystemd("WATCHDOG=1")
+	}
+}
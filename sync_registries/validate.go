@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/tls"
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+
+	"registries-sync/pkg/auth"
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
+
+//go:embed schemas/registries.schema.json
+var registriesSchema string
+
+//go:embed schemas/secrets.schema.json
+var secretsSchema string
+
+// configProblem is a single problem found by the validate subcommand.
+type configProblem struct {
+	file    string
+	line    int
+	path    string
+	message string
+}
+
+func (p configProblem) String() string {
+	location := p.file
+	if p.line > 0 {
+		location = fmt.Sprintf("%s:%d", p.file, p.line)
+	}
+	if p.path != "" {
+		return fmt.Sprintf("%s: %s: %s", location, p.path, p.message)
+	}
+	return fmt.Sprintf("%s: %s", location, p.message)
+}
+
+// runValidate implements the "validate" subcommand. It checks the
+// configuration and secrets files against their schemas and then checks what
+// a schema can't express: regular expressions, bandwidth limits, templates
+// and that every destination registry has a secret. Nothing is contacted.
+func runValidate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := flags.String("config", "registries.yaml", "Path to the registries configuration file")
+	configDir := flags.String("config-dir", "", "Directory whose *.yaml files are merged into the configuration, instead of -config")
+	secretsFile := flags.String("secrets", "secrets.yaml", "Path to the secrets file")
+	flags.Parse(args)
+
+	configFiles := []string{*configFile}
+	if *configDir != "" {
+		files, err := config.ConfigFiles(*configDir)
+		if err != nil {
+			fmt.Println(configProblem{file: *configDir, message: err.Error()})
+			os.Exit(1)
+		}
+		configFiles = files
+	}
+	problems := []configProblem{}
+	documents := []configDocument{}
+	for _, file := range configFiles {
+		root, fileProblems := validateSchema(file, registriesSchema)
+		problems = append(problems, fileProblems...)
+		documents = append(documents, configDocument{file: file, root: root})
+	}
+	_, secretsProblems := validateSchema(*secretsFile, secretsSchema)
+	problems = append(problems, secretsProblems...)
+
+	// The remaining checks need both files to decode cleanly
+	if len(problems) == 0 {
+		problems = validateConfig(*configFile, *configDir, *secretsFile, documents)
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found.\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("Configuration is valid.")
+}
+
+// validateSchema parses a YAML file and validates it against a JSON schema.
+// The parsed document is returned to look up line numbers.
+func validateSchema(filename, schema string) (*yaml.Node, []configProblem) {
+	data, err := config.ReadFile(filename)
+	if err != nil {
+		return nil, []configProblem{{file: filename, message: err.Error()}}
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, []configProblem{{file: filename, message: err.Error()}}
+	}
+	var document interface{}
+	if err := root.Decode(&document); err != nil {
+		return nil, []configProblem{{file: filename, message: err.Error()}}
+	}
+	if document == nil {
+		document = map[string]interface{}{}
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewStringLoader(schema), gojsonschema.NewGoLoader(document))
+	if err != nil {
+		return nil, []configProblem{{file: filename, message: err.Error()}}
+	}
+
+	problems := []configProblem{}
+	for _, resultErr := range result.Errors() {
+		path := []string{}
+		if field := resultErr.Field(); field != "(root)" {
+			path = strings.Split(field, ".")
+		}
+		// Point at the offending key rather than at its parent
+		if property, ok := resultErr.Details()["property"].(string); ok && resultErr.Type() == "additional_property_not_allowed" {
+			path = append(path, property)
+		}
+		problems = append(problems, configProblem{
+			file:    filename,
+			line:    nodeLine(&root, path...),
+			path:    strings.Join(path, "."),
+			message: resultErr.Description(),
+		})
+	}
+	return &root, problems
+}
+
+// configDocument is a parsed configuration file, to look up line numbers.
+type configDocument struct {
+	file string
+	root *yaml.Node
+}
+
+// locate returns the file and line of the setting at path of the merged
+// configuration of documents, and its path in that file. Registry entries
+// are numbered across the files in order.
+func locate(documents []configDocument, path []string) (string, int, []string) {
+	if len(path) >= 2 && path[0] == "registries" {
+		if index, err := strconv.Atoi(path[1]); err == nil {
+			for _, document := range documents {
+				entries := 0
+				if node := lookupNode(document.root, "registries"); node != nil && node.Kind == yaml.SequenceNode {
+					entries = len(node.Content)
+				}
+				if index < entries {
+					path = append([]string{"registries", strconv.Itoa(index)}, path[2:]...)
+					return document.file, nodeLine(document.root, path...), path
+				}
+				index -= entries
+			}
+		}
+	}
+	for _, document := range documents[1:] {
+		if len(path) > 0 && lookupNode(document.root, path[0]) != nil {
+			return document.file, nodeLine(document.root, path...), path
+		}
+	}
+	return documents[0].file, nodeLine(documents[0].root, path...), path
+}
+
+// validateConfig runs the checks a schema can't express.
+func validateConfig(configFile, configDir, secretsFile string, documents []configDocument) []configProblem {
+	problems := []configProblem{}
+	problem := func(message string, path ...string) {
+		file, line, path := locate(documents, path)
+		problems = append(problems, configProblem{
+			file:    file,
+			line:    line,
+			path:    strings.Join(path, "."),
+			message: message,
+		})
+	}
+
+	cfg, err := loadConfig(configFile, configDir)
+	if err != nil && configDir != "" {
+		return append(problems, configProblem{file: configDir, message: err.Error()})
+	}
+	if err != nil {
+		problem(err.Error())
+		return problems
+	}
+	secrets, err := config.LoadSecrets(secretsFile)
+	if err != nil {
+		return append(problems, configProblem{file: secretsFile, message: err.Error()})
+	}
+
+	if _, err := regsync.ParseBandwidth(cfg.MaxBandwidth); err != nil {
+		problem(err.Error(), "max_bandwidth")
+	}
+	if _, err := regsync.LoadSignaturePolicy(cfg); err != nil {
+		problem(err.Error(), "signature_policy")
+	}
+	if cfg.Sign != nil {
+		if err := cfg.Sign.Validate(); err != nil {
+			problem(err.Error(), "sign")
+		}
+	}
+	if cfg.VerifySignatures != nil {
+		if err := cfg.VerifySignatures.Validate(); err != nil {
+			problem(err.Error(), "verify_signatures")
+		}
+	}
+	if cfg.PolicyHook != nil {
+		if err := cfg.PolicyHook.Validate(); err != nil {
+			problem(err.Error(), "policy_hook")
+		}
+	}
+	if cfg.Scan != nil {
+		if err := cfg.Scan.Validate(); err != nil {
+			problem(err.Error(), "scan")
+		}
+	}
+	if cfg.Hooks != nil {
+		if err := cfg.Hooks.Validate(); err != nil {
+			problem(err.Error(), "hooks")
+		}
+	}
+	if cfg.Notify != nil {
+		if err := cfg.Notify.Validate(); err != nil {
+			problem(err.Error(), "notify")
+		} else if cfg.Notify.Email != nil {
+			if _, _, err := regsync.ParseEmailTemplates(cfg.Notify.Email); err != nil {
+				problem(err.Error(), "notify", "email")
+			}
+		}
+	}
+	if cfg.Pushgateway != nil {
+		if err := cfg.Pushgateway.Validate(); err != nil {
+			problem(err.Error(), "pushgateway")
+		}
+	}
+	if cfg.Quarantine != nil {
+		if err := cfg.Quarantine.Validate(); err != nil {
+			problem(err.Error(), "quarantine")
+		}
+	}
+	if cfg.RegistryPolicy != nil {
+		if err := cfg.RegistryPolicy.Validate(); err != nil {
+			problem(err.Error(), "registry_policy")
+		} else {
+			for i, registry := range cfg.Registries {
+				if err := cfg.RegistryPolicy.Check(registry); err != nil {
+					problem(err.Error(), "registries", strconv.Itoa(i))
+				}
+			}
+		}
+	}
+	for i, blocked := range cfg.BlockedDigests {
+		if _, err := digest.Parse(blocked); err != nil {
+			problem(err.Error(), "blocked_digests", strconv.Itoa(i))
+		}
+	}
+	for host, price := range cfg.EgressCostPerGB {
+		if price < 0 {
+			problem("egress cost must not be negative", "egress_cost_per_gb", host)
+		}
+	}
+	if err := regsync.ValidateEgressCosts(cfg); err != nil {
+		problem(err.Error(), "egress_cost_per_gb")
+	}
+	if err := regsync.ValidateRegistryHeaders(cfg); err != nil {
+		problem(err.Error(), "registry_headers")
+	}
+	if err := cfg.Publish.Validate(); err != nil {
+		problem(err.Error(), "publish")
+	}
+	if cfg.CircuitBreaker.Cooldown != "" {
+		if _, err := time.ParseDuration(cfg.CircuitBreaker.Cooldown); err != nil {
+			problem(err.Error(), "circuit_breaker", "cooldown")
+		}
+	}
+	if cfg.DockerHub.Pause != "" {
+		if _, err := time.ParseDuration(cfg.DockerHub.Pause); err != nil {
+			problem(err.Error(), "docker_hub", "pause")
+		}
+	}
+
+	for i, registry := range cfg.Registries {
+		index := strconv.Itoa(i)
+
+		for j, pattern := range registry.ExcludePatterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				problem(err.Error(), "registries", index, "exclude_patterns", strconv.Itoa(j))
+			}
+		}
+		for j, pattern := range registry.IncludePatterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				problem(err.Error(), "registries", index, "include_patterns", strconv.Itoa(j))
+			}
+		}
+		for j, patternLimit := range registry.PatternLimits {
+			if _, err := regexp.Compile(patternLimit.Pattern); err != nil {
+				problem(err.Error(), "registries", index, "pattern_limits", strconv.Itoa(j), "pattern")
+			}
+		}
+		if _, err := regsync.ParseSize(registry.MaxImageSize); err != nil {
+			problem(err.Error(), "registries", index, "max_image_size")
+		}
+		if _, err := regsync.ParseAge(registry.MaxAge); err != nil {
+			problem(err.Error(), "registries", index, "max_age")
+		}
+		if _, err := regsync.ParseAge(registry.MaxTagAge); err != nil {
+			problem(err.Error(), "registries", index, "max_tag_age")
+		}
+		if _, err := regsync.ParseBandwidth(registry.MaxBandwidth); err != nil {
+			problem(err.Error(), "registries", index, "max_bandwidth")
+		}
+		for j, pinned := range registry.Digests {
+			if _, err := digest.Parse(pinned.Digest); err != nil {
+				problem(err.Error(), "registries", index, "digests", strconv.Itoa(j), "digest")
+			}
+		}
+		for j, blocked := range registry.BlockedDigests {
+			if _, err := digest.Parse(blocked); err != nil {
+				problem(err.Error(), "registries", index, "blocked_digests", strconv.Itoa(j))
+			}
+		}
+		if _, err := regsync.ParseCompression(registry.Compression); err != nil {
+			problem(err.Error(), "registries", index, "compression")
+		} else if registry.Compression != "" && registry.Referrers {
+			problem("referrers can't be copied with compression set, recompressed images have a new digest", "registries", index, "referrers")
+		}
+		if (registry.ProvenanceAnnotations || len(registry.Annotations) > 0) && registry.Referrers {
+			problem("referrers can't be copied with annotations set, annotated images have a new digest", "registries", index, "referrers")
+		}
+		if registry.CopyTimeout != "" {
+			if _, err := time.ParseDuration(registry.CopyTimeout); err != nil {
+				problem(err.Error(), "registries", index, "copy_timeout")
+			}
+		}
+		if registry.Sign != nil {
+			if err := registry.Sign.Validate(); err != nil {
+				problem(err.Error(), "registries", index, "sign")
+			}
+		}
+		if registry.VerifySignatures != nil {
+			if err := registry.VerifySignatures.Validate(); err != nil {
+				problem(err.Error(), "registries", index, "verify_signatures")
+			}
+		}
+		if registry.Scan != nil {
+			if err := registry.Scan.Validate(); err != nil {
+				problem(err.Error(), "registries", index, "scan")
+			}
+		}
+		if registry.Hooks != nil {
+			if err := registry.Hooks.Validate(); err != nil {
+				problem(err.Error(), "registries", index, "hooks")
+			}
+		}
+		if registry.TagFilter != nil {
+			if err := registry.TagFilter.Validate(); err != nil {
+				problem(err.Error(), "registries", index, "tag_filter")
+			}
+		}
+		if _, err := regsync.ParseSize(registry.Harbor.StorageLimit); err != nil {
+			problem(err.Error(), "registries", index, "harbor", "storage_limit")
+		}
+		if registry.ECR.LifecyclePolicy != nil {
+			if err := regsync.ValidateECRLifecyclePolicy(registry.ECR.LifecyclePolicy); err != nil {
+				problem(err.Error(), "registries", index, "ecr", "lifecycle_policy")
+			}
+		}
+		if registry.TagRewrite != nil {
+			for j, rule := range registry.TagRewrite.Rules {
+				if _, err := regexp.Compile(rule.Match); err != nil {
+					problem(err.Error(), "registries", index, "tag_rewrite", "rules", strconv.Itoa(j), "match")
+				}
+			}
+		}
+
+		for j, fallback := range registry.SourceFallbacks {
+			if fallback == "" {
+				problem("empty source fallback", "registries", index, "source_fallbacks", strconv.Itoa(j))
+			}
+		}
+
+		destinations := registry.AllDestinations()
+		if len(destinations) == 0 {
+			problem("no destination configured", "registries", index)
+		}
+		for _, dest := range destinations {
+			if dest.DestRepository == "" {
+				problem(fmt.Sprintf("no repository for destination %s, set dest_repository or dest_repository_template", dest.DestRegistry), "registries", index)
+			}
+			if err := regsync.ValidateTransport(registry, dest); err != nil {
+				problem(err.Error(), "registries", index)
+			}
+			if dest.Local() {
+				continue
+			}
+			secret := auth.SecretFor(dest.DestRegistry, secrets.Secrets)
+			if secret.DestRegistry == "" {
+				problem(fmt.Sprintf("no secret for destination registry %s in %s", dest.DestRegistry, secretsFile), "registries", index)
+				continue
+			}
+			if secret.ServiceAccountKey != "" {
+				if _, err := os.Stat(secret.ServiceAccountKey); err != nil {
+					problems = append(problems, configProblem{file: secretsFile, message: fmt.Sprintf("service account key for %s: %v", dest.DestRegistry, err)})
+				}
+			}
+			if secret.ClientCert != "" || secret.ClientKey != "" {
+				if _, err := tls.LoadX509KeyPair(secret.ClientCert, secret.ClientKey); err != nil {
+					problems = append(problems, configProblem{file: secretsFile, message: fmt.Sprintf("client certificate for %s: %v", dest.DestRegistry, err)})
+				}
+			}
+			if secret.GitHubApp != nil {
+				if _, err := os.Stat(secret.GitHubApp.PrivateKey); err != nil {
+					problems = append(problems, configProblem{file: secretsFile, message: fmt.Sprintf("GitHub App private key for %s: %v", dest.DestRegistry, err)})
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// lookupNode returns the value of key in the top-level mapping of a document,
+// or nil when it isn't set.
+func lookupNode(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.DocumentNode || len(node.Content) == 0 || node.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	mapping := node.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// nodeLine returns the line of the node at path, where mapping keys and
+// sequence indexes are given as strings. It falls back to the line of the
+// closest existing parent.
+func nodeLine(node *yaml.Node, path ...string) int {
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, element := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == element {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if index, err := strconv.Atoi(element); err == nil && index >= 0 && index < len(node.Content) {
+				next = node.Content[index]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
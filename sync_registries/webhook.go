@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"registries-sync/pkg/config"
+	regsync "registries-sync/pkg/sync"
+)
+
+// pushEvent is a single tag push reported by a registry webhook.
+type pushEvent struct {
+	Registry   string
+	Repository string
+	Tag        string
+}
+
+type webhookParser func(body []byte) ([]pushEvent, error)
+
+// handleWebhook authenticates the request, parses the payload with parse and
+// enqueues a targeted sync for every registry entry whose source matches.
+func (d *daemon) handleWebhook(parse webhookParser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !d.authorizedWebhook(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !d.leader.Load() {
+			http.Error(w, "standby replica, not the leader", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		events, err := parse(body)
+		if err != nil {
+			log.Printf("Rejected webhook on %s: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		jobs := []syncJob{}
+		for _, event := range events {
+			jobs = append(jobs, d.jobsForEvent(event)...)
+		}
+		queued, ok := d.enqueueJobs(jobs)
+		if !ok {
+			http.Error(w, "sync queue is full", http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Printf("Webhook on %s queued %d of %d sync jobs", r.URL.Path, queued, len(jobs))
+		writeQueued(w, queued, len(jobs))
+	}
+}
+
+// enqueueJobs queues jobs if the queue has room for all of them, and reports
+// false otherwise, so the sender's retry doesn't run a part of them twice.
+// If concurrent requests fill the queue meanwhile, the jobs that still fit
+// are queued and counted.
+func (d *daemon) enqueueJobs(jobs []syncJob) (int, bool) {
+	if cap(d.jobs)-len(d.jobs) < len(jobs) {
+		return 0, false
+	}
+	for i, job := range jobs {
+		select {
+		case d.jobs <- job:
+		default:
+			return i, true
+		}
+	}
+	return len(jobs), true
+}
+
+// writeQueued answers 202 with the number of jobs queued, and of those that
+// didn't fit in the queue.
+func writeQueued(w http.ResponseWriter, queued, jobs int) {
+	response := map[string]int{"queued": queued}
+	if queued < jobs {
+		response["dropped"] = jobs - queued
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// authorizedWebhook checks the token of a webhook or /sync request. Without
+// a token configured only -insecure-webhooks lets requests through.
+func (d *daemon) authorizedWebhook(r *http.Request) bool {
+	if d.webhookToken == "" {
+		return d.insecureWebhooks
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(d.webhookToken)) == 1
+}
+
+// jobsForEvent returns a single-tag sync job for every registry entry that
+// mirrors the pushed repository, honouring the entry's tag filters.
+func (d *daemon) jobsForEvent(event pushEvent) []syncJob {
+	jobs := []syncJob{}
+	for _, registry := range d.currentConfig().Registries {
+		if config.ImagePath(registry.SourceRegistry, registry.SourceRepository) != config.ImagePath(event.Registry, event.Repository) {
+			continue
+		}
+		if !regsync.TagSelected(event.Tag, registry) {
+			log.Printf("Ignoring push of %s/%s:%s, tag is excluded", event.Registry, event.Repository, event.Tag)
+			continue
+		}
+		jobs = append(jobs, syncJob{Registry: registry, Tags: []string{event.Tag}, Reason: "webhook"})
+	}
+	return jobs
+}
+
+// parseHarborWebhook handles Harbor's PUSH_ARTIFACT (and legacy pushImage)
+// event payloads.
+func parseHarborWebhook(body []byte) ([]pushEvent, error) {
+	var payload struct {
+		Type      string `json:"type"`
+		EventData struct {
+			Resources []struct {
+				Tag         string `json:"tag"`
+				ResourceURL string `json:"resource_url"`
+			} `json:"resources"`
+			Repository struct {
+				RepoFullName string `json:"repo_full_name"`
+			} `json:"repository"`
+		} `json:"event_data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid Harbor payload: %w", err)
+	}
+	if payload.Type != "PUSH_ARTIFACT" && payload.Type != "pushImage" {
+		return nil, nil
+	}
+
+	events := []pushEvent{}
+	for _, resource := range payload.EventData.Resources {
+		if resource.Tag == "" {
+			continue
+		}
+		host := strings.SplitN(resource.ResourceURL, "/", 2)[0]
+		events = append(events, pushEvent{Registry: host, Repository: payload.EventData.Repository.RepoFullName, Tag: resource.Tag})
+	}
+	return events, nil
+}
+
+// parseQuayWebhook handles Quay's repository push notification payload.
+func parseQuayWebhook(body []byte) ([]pushEvent, error) {
+	var payload struct {
+		Repository  string   `json:"repository"`
+		DockerURL   string   `json:"docker_url"`
+		UpdatedTags []string `json:"updated_tags"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid Quay payload: %w", err)
+	}
+	if payload.DockerURL == "" || payload.Repository == "" {
+		return nil, fmt.Errorf("invalid Quay payload: missing repository")
+	}
+
+	host := strings.SplitN(payload.DockerURL, "/", 2)[0]
+	events := []pushEvent{}
+	for _, tag := range payload.UpdatedTags {
+		events = append(events, pushEvent{Registry: host, Repository: payload.Repository, Tag: tag})
+	}
+	return events, nil
+}
+
+// parseDockerHubWebhook handles Docker Hub's repository webhook payload.
+func parseDockerHubWebhook(body []byte) ([]pushEvent, error) {
+	var payload struct {
+		PushData struct {
+			Tag string `json:"tag"`
+		} `json:"push_data"`
+		Repository struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid Docker Hub payload: %w", err)
+	}
+	if payload.Repository.RepoName == "" || payload.PushData.Tag == "" {
+		return nil, fmt.Errorf("invalid Docker Hub payload: missing repository or tag")
+	}
+
+	return []pushEvent{{Registry: "docker.io", Repository: payload.Repository.RepoName, Tag: payload.PushData.Tag}}, nil
+}